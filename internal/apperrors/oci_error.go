@@ -19,6 +19,16 @@ func (e OCIError) CreateResponse(detail string) OCIErrorResponse {
 	}
 }
 
+// メッセージを lang の言語にしたコピーを返す。訳がなければ英語のまま
+func (e OCIError) Localize(lang string) OCIError {
+	if lang == "ja" {
+		if msg, ok := japaneseMessages[e.ErrorCode]; ok {
+			e.ErrorMessage = msg
+		}
+	}
+	return e
+}
+
 var BLOB_UNKNOWN = &OCIError{ErrorCode: "BLOB_UNKNOWN", ErrorMessage: "blob unknown to registry"}
 var BLOB_UPLOAD_INVALID = &OCIError{ErrorCode: "BLOB_UPLOAD_INVALID", ErrorMessage: "blob upload invalid"}
 var BLOB_UPLOAD_UNKNOWN = &OCIError{ErrorCode: "BLOB_UPLOAD_UNKNOWN", ErrorMessage: "blob upload unknown to registry"}
@@ -34,3 +44,35 @@ var TAG_INVALID = &OCIError{ErrorCode: "TAG_INVALID", ErrorMessage: "manifest ta
 var UNAUTHORIZED = &OCIError{ErrorCode: "UNAUTHORIZED", ErrorMessage: "authentication required"}
 var DENIED = &OCIError{ErrorCode: "DENIED", ErrorMessage: "requested access to the resource is denied"}
 var UNSUPPORTED = &OCIError{ErrorCode: "UNSUPPORTED", ErrorMessage: "The operation is unsupported"}
+
+// OCI の仕様にはないが、内部エラーでもレスポンスの形式を揃えるために使う
+var UNKNOWN = &OCIError{ErrorCode: "UNKNOWN", ErrorMessage: "unknown error"}
+var UNAVAILABLE = &OCIError{ErrorCode: "UNAVAILABLE", ErrorMessage: "service unavailable"}
+
+// 管理 API のリソースが見つからない
+var NOT_FOUND = &OCIError{ErrorCode: "NOT_FOUND", ErrorMessage: "resource not found"}
+
+// 管理 API で作ろうとしたリソースがすでにある
+var ALREADY_EXISTS = &OCIError{ErrorCode: "ALREADY_EXISTS", ErrorMessage: "resource already exists"}
+
+var japaneseMessages = map[string]string{
+	"BLOB_UNKNOWN":          "blob がレジストリにありません",
+	"BLOB_UPLOAD_INVALID":   "blob のアップロードが不正です",
+	"BLOB_UPLOAD_UNKNOWN":   "blob のアップロードがレジストリにありません",
+	"DIGEST_INVALID":        "digest がアップロードされた内容と一致しません",
+	"MANIFEST_BLOB_UNKNOWN": "マニフェストが参照する blob がレジストリにありません",
+	"MANIFEST_INVALID":      "マニフェストが不正です",
+	"MANIFEST_UNKNOWN":      "マニフェストがありません",
+	"MANIFEST_UNVERIFIED":   "マニフェストの署名を検証できませんでした",
+	"NAME_INVALID":          "リポジトリ名が不正です",
+	"NAME_UNKNOWN":          "リポジトリがレジストリにありません",
+	"SIZE_INVALID":          "指定された長さが内容の長さと一致しません",
+	"TAG_INVALID":           "タグが URI と一致しません",
+	"UNAUTHORIZED":          "認証が必要です",
+	"DENIED":                "リソースへのアクセスが拒否されました",
+	"UNSUPPORTED":           "サポートされていない操作です",
+	"UNKNOWN":               "不明なエラーが発生しました",
+	"UNAVAILABLE":           "サービスを利用できません",
+	"NOT_FOUND":             "リソースがありません",
+	"ALREADY_EXISTS":        "リソースがすでにあります",
+}
@@ -1,14 +1,13 @@
 package apperrors
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
-
-	"github.com/gin-gonic/gin"
 )
 
-// TODO: 実はOCIで定義されている。作り直し。
+// 下位の層が返すエラー。usecase で TCRError に変換されなかった場合も Classify が対応する TCRError に読み替える
 var ErrInvalidName = errors.New("name is invalid")
 var ErrInvalidManifest = errors.New("manifest is invalid")
 var ErrInvalidReference = errors.New("reference is invalid")
@@ -17,70 +16,144 @@ var ErrBlobNotFound = errors.New("blob not found")
 var ErrInvalidContentRange = errors.New("Content-Range format is invalid")
 var ErrChunkIsNotInSequence = errors.New("chunk is not in sequence")
 var ErrAllChunksAreAlreadyUploaded = errors.New("all chunks are already uploaded")
+var ErrRepositoryNotFound = errors.New("repository not found")
+var ErrPresignUnavailable = errors.New("blob storage cannot presign the blob URL")
+var ErrBlobUploadConflict = errors.New("blob upload progress was updated by another request")
+var ErrGrantNotFound = errors.New("grant not found")
+var ErrAccountNotFound = errors.New("account not found")
+var ErrAccountAlreadyExists = errors.New("account already exists")
+var ErrTeamNotFound = errors.New("team not found")
+var ErrTeamAlreadyExists = errors.New("team already exists")
+var ErrPullLinkNotFound = errors.New("pull link not found")
 
-// TODO: 直す
-func ErrorHanlder(c *gin.Context, err error) {
-	switch err {
-	case ErrInvalidName:
-		c.JSON(http.StatusBadRequest, err)
-	case ErrInvalidReference:
-		c.JSON(http.StatusBadRequest, err)
-	case ErrManifestNotFound:
-		c.JSON(http.StatusNotFound, err)
-	case ErrBlobNotFound:
-		c.JSON(http.StatusNotFound, err)
-	default:
-		c.JSON(http.StatusInternalServerError, err)
-	}
-}
-
-// TODO: persister をうまくリファクタできたらもうすこし具体的にする
-var TCRERR_PERSISTER_ERROR = &TCRError{Message: "永続化層でエラーが発生しました"}
+// 以下はエラーの種類を表す値で、変更してはいけない。
+// 返すときは Wrap や WithDetail でリクエストごとのインスタンスを作り、判定は errors.Is で行う
+var TCRERR_PERSISTER_ERROR = &TCRError{Kind: "PERSISTER_ERROR", Message: "persistence layer failed", Status: http.StatusInternalServerError, OCI: UNKNOWN}
+var TCRERR_LOGIC_ERROR = &TCRError{Kind: "LOGIC_ERROR", Message: "internal error", Status: http.StatusInternalServerError, OCI: UNKNOWN}
+var TCRERR_TAG_INVALID = &TCRError{Kind: "TAG_INVALID", Message: "tag is invalid", Status: http.StatusBadRequest, OCI: TAG_INVALID}
+var TCRERR_NAME_INVALID = &TCRError{Kind: "NAME_INVALID", Message: "name is invalid", Status: http.StatusBadRequest, OCI: NAME_INVALID}
+var TCRERR_MANIFEST_INVALID = &TCRError{Kind: "MANIFEST_INVALID", Message: "manifest is invalid", Status: http.StatusBadRequest, OCI: MANIFEST_INVALID}
+var TCRERR_MANIFEST_NOT_FOUND = &TCRError{Kind: "MANIFEST_NOT_FOUND", Message: "manifest not found", Status: http.StatusNotFound, OCI: MANIFEST_UNKNOWN}
+var TCRERR_NAME_NOT_FOUND = &TCRError{Kind: "NAME_NOT_FOUND", Message: "repository not found", Status: http.StatusNotFound, OCI: NAME_UNKNOWN}
+var TCRERR_DIGEST_INVALID = &TCRError{Kind: "DIGEST_INVALID", Message: "digest is invalid", Status: http.StatusBadRequest, OCI: DIGEST_INVALID}
+var TCRERR_BLOB_NOT_FOUND = &TCRError{Kind: "BLOB_NOT_FOUND", Message: "blob not found", Status: http.StatusNotFound, OCI: BLOB_UNKNOWN}
+var TCRERR_BLOB_UPLOAD_INVALID = &TCRError{Kind: "BLOB_UPLOAD_INVALID", Message: "blob upload is invalid", Status: http.StatusBadRequest, OCI: BLOB_UPLOAD_INVALID}
+var TCRERR_BLOB_UPLOAD_NOT_FOUND = &TCRError{Kind: "BLOB_UPLOAD_NOT_FOUND", Message: "blob upload not found", Status: http.StatusNotFound, OCI: BLOB_UPLOAD_UNKNOWN}
+var TCRERR_BLOB_UPLOAD_CONFLICT = &TCRError{Kind: "BLOB_UPLOAD_CONFLICT", Message: "blob upload was updated by another request", Status: http.StatusConflict, OCI: BLOB_UPLOAD_INVALID}
+var TCRERR_RANGE_INVALID = &TCRError{Kind: "RANGE_INVALID", Message: "chunk range is invalid", Status: http.StatusRequestedRangeNotSatisfiable, OCI: BLOB_UPLOAD_INVALID}
+var TCRERR_SIZE_INVALID = &TCRError{Kind: "SIZE_INVALID", Message: "content length does not match", Status: http.StatusBadRequest, OCI: SIZE_INVALID}
+var TCRERR_REQUEST_INVALID = &TCRError{Kind: "REQUEST_INVALID", Message: "request is invalid", Status: http.StatusBadRequest, OCI: UNSUPPORTED}
+var TCRERR_BATCH_TOO_LARGE = &TCRError{Kind: "BATCH_TOO_LARGE", Message: "too many items in a batch request", Status: http.StatusBadRequest, OCI: UNSUPPORTED}
+var TCRERR_ROUTE_NOT_FOUND = &TCRError{Kind: "ROUTE_NOT_FOUND", Message: "no such endpoint", Status: http.StatusNotFound, OCI: UNSUPPORTED}
+var TCRERR_METHOD_NOT_ALLOWED = &TCRError{Kind: "METHOD_NOT_ALLOWED", Message: "method not allowed", Status: http.StatusMethodNotAllowed, OCI: UNSUPPORTED}
+var TCRERR_UNAUTHORIZED = &TCRError{Kind: "UNAUTHORIZED", Message: "authentication required", Status: http.StatusUnauthorized, OCI: UNAUTHORIZED}
+var TCRERR_DENIED = &TCRError{Kind: "DENIED", Message: "access denied", Status: http.StatusForbidden, OCI: DENIED}
+var TCRERR_GRANT_INVALID = &TCRError{Kind: "GRANT_INVALID", Message: "grant is invalid", Status: http.StatusBadRequest, OCI: UNSUPPORTED}
+var TCRERR_GRANT_NOT_FOUND = &TCRError{Kind: "GRANT_NOT_FOUND", Message: "grant not found", Status: http.StatusNotFound, OCI: NOT_FOUND}
+var TCRERR_ACCOUNT_INVALID = &TCRError{Kind: "ACCOUNT_INVALID", Message: "account is invalid", Status: http.StatusBadRequest, OCI: UNSUPPORTED}
+var TCRERR_ACCOUNT_NOT_FOUND = &TCRError{Kind: "ACCOUNT_NOT_FOUND", Message: "account not found", Status: http.StatusNotFound, OCI: NOT_FOUND}
+var TCRERR_ACCOUNT_ALREADY_EXISTS = &TCRError{Kind: "ACCOUNT_ALREADY_EXISTS", Message: "account already exists", Status: http.StatusConflict, OCI: ALREADY_EXISTS}
+var TCRERR_TEAM_INVALID = &TCRError{Kind: "TEAM_INVALID", Message: "team is invalid", Status: http.StatusBadRequest, OCI: UNSUPPORTED}
+var TCRERR_TEAM_NOT_FOUND = &TCRError{Kind: "TEAM_NOT_FOUND", Message: "team not found", Status: http.StatusNotFound, OCI: NOT_FOUND}
+var TCRERR_TEAM_ALREADY_EXISTS = &TCRError{Kind: "TEAM_ALREADY_EXISTS", Message: "team already exists", Status: http.StatusConflict, OCI: ALREADY_EXISTS}
+var TCRERR_PULL_LINK_INVALID = &TCRError{Kind: "PULL_LINK_INVALID", Message: "pull link is invalid", Status: http.StatusBadRequest, OCI: UNSUPPORTED}
+var TCRERR_PULL_LINK_NOT_FOUND = &TCRError{Kind: "PULL_LINK_NOT_FOUND", Message: "pull link not found", Status: http.StatusNotFound, OCI: NOT_FOUND}
+var TCRERR_TIMEOUT = &TCRError{Kind: "TIMEOUT", Message: "request timed out", Status: http.StatusServiceUnavailable, OCI: UNAVAILABLE}
 
-// TODO: これももうちょっと細かくした方が良いかも
-var TCRERR_LOGIC_ERROR = &TCRError{Message: "内部でエラーが発生しました"}
+// クライアントが切断したため、レスポンスは届かない。nginx にならって 499 とする
+var TCRERR_CANCELED = &TCRError{Kind: "CANCELED", Message: "request was canceled by the client", Status: 499, OCI: UNKNOWN}
+var TCRERR_UNKNOWN = &TCRError{Kind: "UNKNOWN", Message: "unknown error", Status: http.StatusInternalServerError, OCI: UNKNOWN}
 
-var TCRERR_TAG_INVALID = &TCRError{Message: "tag の形式が不正です"}
-var TCRERR_NAME_INVALID = &TCRError{Message: "name の形式が不正です"}
-var TCRERR_MANIFEST_INVALID = &TCRError{Message: "manifest の形式が不正です"}
-var TCRERR_MANIFEST_NOT_FOUND = &TCRError{Message: "対象の manifest がありません"}
-var TCRERR_NAME_NOT_FOUND = &TCRError{Message: "対象の name を持つリポジトリがありません"}
-var TCRERR_DIGEST_INVALID = &TCRError{Message: "digest の形式が不正です"}
-var TCRERR_BLOB_NOT_FOUND = &TCRError{Message: "対象の blob がありません"}
-var TCRERR_UNKNOWN = &TCRError{Message: "不明なエラー。このエラーが出た場合は適切な TCRError オブジェクトが利用されるようにエラー処理を修正してください"}
-
-// OCI Error Code はすべてのエラーレスポンスに対して必須というわけではないので、TCR のエラーを作る
+// TCR のエラー。Kind ごとに HTTP ステータスと OCI のエラーコードが決まっている
 type TCRError struct {
+	Kind    string
 	Message string
-	Err     error
+	Status  int
+	OCI     *OCIError
+	// クライアントに返す補足。内部の情報を含めないこと
+	Detail string
+	Err    error
 }
 
-func (e TCRError) Error() string {
+func (e *TCRError) Error() string {
+	msg := e.Message
+	if e.Detail != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, e.Detail)
+	}
 	if e.Err != nil {
-		return fmt.Sprintf("%s: %s", e.Message, e.Err.Error())
+		return fmt.Sprintf("%s: %s", msg, e.Err.Error())
 	}
-	return e.Message
+	return msg
 }
 
 func (e *TCRError) Unwrap() error {
 	return e.Err
 }
 
-func (e *TCRError) Wrap(err error) error {
-	e.Err = err
-	return e
+// Kind が同じなら同じエラーとみなす
+func (e *TCRError) Is(target error) bool {
+	t, ok := target.(*TCRError)
+	return ok && t.Kind == e.Kind
+}
+
+// 原因となったエラーを持つ新しいインスタンスを返す。e 自体は変更しない
+func (e *TCRError) Wrap(err error) *TCRError {
+	copied := *e
+	copied.Err = err
+	return &copied
 }
 
-// TODO: これ作ってるけど、API によってはエラーコードとステータスコードが変わるので、結局使わなくなって API ごとに似たような処理を書くかも
-func CreateErrorResponse(err error) (uint, OCIErrorResponse) {
-	var tcrErr TCRError
-	if !errors.As(err, &tcrErr) {
-		err = TCRERR_UNKNOWN.Wrap(err)
+// クライアントに返す補足を持つ新しいインスタンスを返す。e 自体は変更しない
+func (e *TCRError) WithDetail(detail string) *TCRError {
+	copied := *e
+	copied.Detail = detail
+	return &copied
+}
+
+// 下位の層のエラーをどの TCRError として扱うか
+var sentinelKinds = []struct {
+	err  error
+	kind *TCRError
+}{
+	{ErrInvalidName, TCRERR_NAME_INVALID},
+	{ErrInvalidManifest, TCRERR_MANIFEST_INVALID},
+	{ErrInvalidReference, TCRERR_DIGEST_INVALID},
+	{ErrManifestNotFound, TCRERR_MANIFEST_NOT_FOUND},
+	{ErrBlobNotFound, TCRERR_BLOB_NOT_FOUND},
+	{ErrInvalidContentRange, TCRERR_RANGE_INVALID},
+	{ErrChunkIsNotInSequence, TCRERR_RANGE_INVALID},
+	{ErrRepositoryNotFound, TCRERR_NAME_NOT_FOUND},
+	{ErrBlobUploadConflict, TCRERR_BLOB_UPLOAD_CONFLICT},
+	{ErrGrantNotFound, TCRERR_GRANT_NOT_FOUND},
+	{ErrAccountNotFound, TCRERR_ACCOUNT_NOT_FOUND},
+	{ErrAccountAlreadyExists, TCRERR_ACCOUNT_ALREADY_EXISTS},
+	{ErrTeamNotFound, TCRERR_TEAM_NOT_FOUND},
+	{ErrTeamAlreadyExists, TCRERR_TEAM_ALREADY_EXISTS},
+	{ErrPullLinkNotFound, TCRERR_PULL_LINK_NOT_FOUND},
+}
+
+// err を TCRError として返す。TCRError でも既知のエラーでもなければ TCRERR_UNKNOWN として扱う。
+// context のタイムアウトやキャンセルが原因なら、どの層で包まれていてもそれを優先する
+func Classify(err error) *TCRError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return TCRERR_TIMEOUT.Wrap(err)
 	}
-	switch err {
-	case TCRERR_NAME_INVALID:
-		return 400, NAME_INVALID.CreateResponse("")
-	default:
-		return 500, OCIErrorResponse{Errors: []OCIError{{Detail: "不明なエラー"}}}
+	if errors.Is(err, context.Canceled) {
+		return TCRERR_CANCELED.Wrap(err)
 	}
+	var tcrErr *TCRError
+	if errors.As(err, &tcrErr) {
+		return tcrErr
+	}
+	for _, s := range sentinelKinds {
+		if errors.Is(err, s.err) {
+			return s.kind.Wrap(err)
+		}
+	}
+	return TCRERR_UNKNOWN.Wrap(err)
+}
+
+// クライアントに返す OCI のエラーレスポンス。lang が ja なら日本語のメッセージにする
+func (e *TCRError) Response(lang string) OCIErrorResponse {
+	return e.OCI.Localize(lang).CreateResponse(e.Detail)
 }
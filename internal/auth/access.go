@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// リソースに対する操作。Docker のトークン認証のスコープと同じ形
+type Access struct {
+	// repository か registry
+	Type string `json:"type"`
+	// repository ならリポジトリ名、registry なら catalog
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+const (
+	ActionPull   = "pull"
+	ActionPush   = "push"
+	ActionDelete = "delete"
+	// そのリソースのすべての操作
+	ActionAll = "*"
+)
+
+const (
+	TypeRepository = "repository"
+	TypeRegistry   = "registry"
+)
+
+// registry:catalog:* のスコープ。_catalog に必要
+var CatalogAccess = Access{Type: TypeRegistry, Name: "catalog", Actions: []string{ActionAll}}
+
+func RepositoryAccess(name string, actions ...string) Access {
+	return Access{Type: TypeRepository, Name: name, Actions: actions}
+}
+
+// repository:org/repo:pull,push の形式
+func (a Access) String() string {
+	return fmt.Sprintf("%s:%s:%s", a.Type, a.Name, strings.Join(a.Actions, ","))
+}
+
+// スコープの文字列を解析する。空白区切りで複数のスコープを書ける。
+// リポジトリ名はホスト名とポートを含むことがあるので、最初と最後の : で区切る
+func ParseScope(scope string) ([]Access, error) {
+	var accesses []Access
+	for _, s := range strings.Fields(scope) {
+		first, last := strings.Index(s, ":"), strings.LastIndex(s, ":")
+		if first < 0 || first == last {
+			return nil, fmt.Errorf("scope is invalid: %s", s)
+		}
+		a := Access{Type: s[:first], Name: s[first+1 : last]}
+		for _, action := range strings.Split(s[last+1:], ",") {
+			if action != "" && !slices.Contains(a.Actions, action) {
+				a.Actions = append(a.Actions, action)
+			}
+		}
+		if a.Type == "" || a.Name == "" || len(a.Actions) == 0 {
+			return nil, fmt.Errorf("scope is invalid: %s", s)
+		}
+		accesses = append(accesses, a)
+	}
+	return accesses, nil
+}
+
+// granted に required のすべての操作が含まれているか
+func Allows(granted []Access, required Access) bool {
+	for _, action := range required.Actions {
+		if !allowsAction(granted, required.Type, required.Name, action) {
+			return false
+		}
+	}
+	return true
+}
+
+func allowsAction(granted []Access, typ, name, action string) bool {
+	for _, g := range granted {
+		if g.Type != typ || g.Name != name {
+			continue
+		}
+		if slices.Contains(g.Actions, action) || slices.Contains(g.Actions, ActionAll) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		testName string
+		scope    string
+		want     []Access
+		wantErr  bool
+	}{
+		{
+			testName: "リポジトリ",
+			scope:    "repository:org/repo:pull,push",
+			want:     []Access{{Type: "repository", Name: "org/repo", Actions: []string{"pull", "push"}}},
+		},
+		{
+			testName: "ポートを含むリポジトリ名",
+			scope:    "repository:localhost:5000/repo:pull",
+			want:     []Access{{Type: "repository", Name: "localhost:5000/repo", Actions: []string{"pull"}}},
+		},
+		{
+			testName: "空白区切りの複数のスコープ",
+			scope:    "repository:a:pull registry:catalog:*",
+			want: []Access{
+				{Type: "repository", Name: "a", Actions: []string{"pull"}},
+				{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+			},
+		},
+		{
+			testName: "重複した操作",
+			scope:    "repository:a:pull,,pull",
+			want:     []Access{{Type: "repository", Name: "a", Actions: []string{"pull"}}},
+		},
+		{testName: "操作がない", scope: "repository:a:", wantErr: true},
+		{testName: "区切りが足りない", scope: "repository:a", wantErr: true},
+		{testName: "名前がない", scope: "repository::pull", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got, err := ParseScope(tt.scope)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("err is nil, but want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got is %+v, but want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllows(t *testing.T) {
+	granted := []Access{
+		RepositoryAccess("org/a", ActionPull),
+		RepositoryAccess("org/a", ActionPush),
+		RepositoryAccess("org/b", ActionAll),
+	}
+	tests := []struct {
+		testName string
+		required Access
+		want     bool
+	}{
+		{testName: "別々に許可された操作", required: RepositoryAccess("org/a", ActionPull, ActionPush), want: true},
+		{testName: "許可されていない操作", required: RepositoryAccess("org/a", ActionDelete), want: false},
+		{testName: "すべての操作", required: RepositoryAccess("org/b", ActionDelete), want: true},
+		{testName: "別のリポジトリ", required: RepositoryAccess("org/c", ActionPull), want: false},
+		{testName: "別の種類", required: Access{Type: TypeRegistry, Name: "org/a", Actions: []string{ActionPull}}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got := Allows(granted, tt.required)
+			if got != tt.want {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidCredentials = errors.New("username or password is incorrect")
+
+// ユーザー名とパスワードを検証する。認証できなければ ErrInvalidCredentials を返す
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (Principal, error)
+}
+
+// 設定ファイルに書かれたアカウントで認証する。パスワードは bcrypt のハッシュで持つ
+type StaticAuthenticator struct {
+	hashes map[string][]byte
+}
+
+// accounts はユーザー名から bcrypt のハッシュへの map
+func NewStaticAuthenticator(accounts map[string]string) *StaticAuthenticator {
+	hashes := make(map[string][]byte, len(accounts))
+	for name, hash := range accounts {
+		hashes[name] = []byte(hash)
+	}
+	return &StaticAuthenticator{hashes: hashes}
+}
+
+func (a *StaticAuthenticator) Authenticate(ctx context.Context, username, password string) (Principal, error) {
+	if !VerifyPassword(a.hashes[username], password) {
+		return Principal{}, ErrInvalidCredentials
+	}
+	return Principal{Subject: username}, nil
+}
+
+// 存在しないユーザーの比較に使う、コスト 10 の bcrypt のハッシュ
+var dummyHash = []byte("$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy")
+
+// password が bcrypt のハッシュ hash と一致するか。
+// ユーザーが存在するかどうかを応答時間から推測されないように、hash が空でも dummyHash と比較する
+func VerifyPassword(hash []byte, password string) bool {
+	if len(hash) == 0 {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// 32 バイトの乱数のシークレット。bcrypt が扱える 72 バイトに収まる
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// 先頭から順に認証を試す。どれでも認証できなければ ErrInvalidCredentials を返す
+type Authenticators []Authenticator
+
+func (as Authenticators) Authenticate(ctx context.Context, username, password string) (Principal, error) {
+	for _, a := range as {
+		p, err := a.Authenticate(ctx, username, password)
+		if errors.Is(err, ErrInvalidCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return Principal{}, ErrInvalidCredentials
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// クライアント証明書のどの値を送り主の名前にするか
+const (
+	CertIdentityCommonName = "commonName"
+	CertIdentityDNSName    = "dnsName"
+	CertIdentityEmail      = "email"
+	CertIdentityURI        = "uri"
+)
+
+// 証明書の送り主のアカウントが使えるかを確かめる。
+// 無効にされたか期限切れなら ErrInvalidCredentials を返す
+type AccountChecker interface {
+	CheckAccount(ctx context.Context, p Principal) error
+}
+
+// TLS で検証済みのクライアント証明書を送り主にする。名前が robot$ から始まればロボットアカウントとして扱う。
+// 証明書の失効は発行した CA の運用で行い、ここでは確かめない
+type CertificateAuthenticator struct {
+	identity string
+	// nil ならアカウントを確かめず、ロボットアカウントの証明書は受け付けない
+	accounts AccountChecker
+}
+
+func NewCertificateAuthenticator(identity string, accounts AccountChecker) (*CertificateAuthenticator, error) {
+	switch identity {
+	case CertIdentityCommonName, CertIdentityDNSName, CertIdentityEmail, CertIdentityURI:
+	default:
+		return nil, fmt.Errorf("unknown certificate identity: %s", identity)
+	}
+	return &CertificateAuthenticator{identity: identity, accounts: accounts}, nil
+}
+
+// cert は TLS のハンドシェイクで検証されたものを渡すこと。
+// 名前が取れないか、アカウントが使えなければ ErrInvalidCredentials を返す
+func (a *CertificateAuthenticator) AuthenticateCertificate(ctx context.Context, cert *x509.Certificate) (Principal, error) {
+	var name string
+	switch a.identity {
+	case CertIdentityCommonName:
+		name = cert.Subject.CommonName
+	case CertIdentityDNSName:
+		name = first(cert.DNSNames)
+	case CertIdentityEmail:
+		name = first(cert.EmailAddresses)
+	case CertIdentityURI:
+		if len(cert.URIs) > 0 {
+			name = cert.URIs[0].String()
+		}
+	}
+	if name == "" {
+		return Principal{}, ErrInvalidCredentials
+	}
+	p := Principal{Subject: name, Kind: KindUser}
+	if robot, ok := strings.CutPrefix(name, RobotPrefix); ok {
+		p = Principal{Subject: robot, Kind: KindRobot}
+	}
+	if a.accounts == nil {
+		if p.Kind == KindRobot {
+			return Principal{}, ErrInvalidCredentials
+		}
+		return p, nil
+	}
+	err := a.accounts.CheckAccount(ctx, p)
+	if err != nil {
+		return Principal{}, err
+	}
+	return p, nil
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// サーバー証明書と、クライアント証明書を検証する CA を持つ。
+// Watch を動かしておくと、証明書の更新をサーバーを止めずに反映する
+type TLSReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	state        atomic.Pointer[tlsState]
+}
+
+type tlsState struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// 最後に読んだときのファイルの更新時刻
+	modTimes []time.Time
+}
+
+// clientCAFile が空ならクライアント証明書を検証しない
+func NewTLSReloader(certFile, keyFile, clientCAFile string) (*TLSReloader, error) {
+	r := &TLSReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	_, err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// http.Server に設定する TLS の設定。ハンドシェイクのたびにその時点の証明書と CA を使う
+func (r *TLSReloader) Config(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s := r.state.Load()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if s.clientCAs != nil {
+				cfg.ClientAuth = clientAuth
+				cfg.ClientCAs = s.clientCAs
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ctx が終わるまで interval ごとにファイルを確認する。
+// 読み直しに失敗した場合は、直前に読めた証明書を使い続ける
+func (r *TLSReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := r.reload()
+		if err != nil {
+			slog.Error("failed to reload TLS certificate. keeping the previous one", "certFile", r.certFile, "error", err.Error())
+			continue
+		}
+		if reloaded {
+			slog.Info("reloaded TLS certificate", "certFile", r.certFile, "notAfter", r.state.Load().cert.Leaf.NotAfter)
+		}
+	}
+}
+
+// どのファイルも前回から変わっていなければ読まない。
+// 証明書と鍵は別々に書き換えられるので、組にならなければ次の確認まで待つ
+func (r *TLSReloader) reload() (bool, error) {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	modTimes := make([]time.Time, len(files))
+	for i, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if s := r.state.Load(); s != nil && equalTimes(s.modTimes, modTimes) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	s := &tlsState{cert: &cert, modTimes: modTimes}
+	if r.clientCAFile != "" {
+		data, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return false, err
+		}
+		s.clientCAs = x509.NewCertPool()
+		if !s.clientCAs.AppendCertsFromPEM(data) {
+			return false, errors.New(r.clientCAFile + ": no certificates found")
+		}
+	}
+	r.state.Store(s)
+	return true, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
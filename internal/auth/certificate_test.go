@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 名前が含まれていれば使えないアカウントとして扱う
+type fakeAccountChecker map[string]bool
+
+func (f fakeAccountChecker) CheckAccount(ctx context.Context, p Principal) error {
+	if f[p.Kind+"/"+p.Subject] {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func TestCertificateAuthenticator(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/ci")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "robot$ci"},
+		DNSNames:       []string{"builder.example.org"},
+		EmailAddresses: []string{"alice@example.org"},
+		URIs:           []*url.URL{spiffe},
+	}
+	checker := fakeAccountChecker{}
+	tests := []struct {
+		testName string
+		identity string
+		accounts AccountChecker
+		cert     *x509.Certificate
+		want     Principal
+		wantErr  error
+	}{
+		{testName: "CN のロボットアカウント", identity: CertIdentityCommonName, accounts: checker, cert: cert, want: Principal{Subject: "ci", Kind: KindRobot}},
+		{testName: "DNS 名", identity: CertIdentityDNSName, accounts: checker, cert: cert, want: Principal{Subject: "builder.example.org", Kind: KindUser}},
+		{testName: "メールアドレス", identity: CertIdentityEmail, accounts: checker, cert: cert, want: Principal{Subject: "alice@example.org", Kind: KindUser}},
+		{testName: "URI", identity: CertIdentityURI, accounts: checker, cert: cert, want: Principal{Subject: "spiffe://example.org/ci", Kind: KindUser}},
+		{testName: "名前がない", identity: CertIdentityEmail, accounts: checker, cert: &x509.Certificate{}, wantErr: ErrInvalidCredentials},
+		{testName: "使えないアカウント", identity: CertIdentityCommonName, accounts: fakeAccountChecker{"robot/ci": true}, cert: cert, wantErr: ErrInvalidCredentials},
+		{testName: "アカウントを確かめなければロボットアカウントは受け付けない", identity: CertIdentityCommonName, cert: cert, wantErr: ErrInvalidCredentials},
+		{testName: "アカウントを確かめなくてもユーザーは受け付ける", identity: CertIdentityEmail, cert: cert, want: Principal{Subject: "alice@example.org", Kind: KindUser}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			a, err := NewCertificateAuthenticator(tt.identity, tt.accounts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := a.AuthenticateCertificate(context.Background(), tt.cert)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Subject != tt.want.Subject || got.Kind != tt.want.Kind {
+				t.Fatalf("got is %+v, but want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile, "old.example.org", time.Now().Add(-time.Hour))
+
+	r, err := NewTLSReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serverName(t, r); got != "old.example.org" {
+		t.Fatalf("certificate is for %s, but want old.example.org", got)
+	}
+
+	// 更新時刻が変わらなければ読み直さない
+	reloaded, err := r.reload()
+	if err != nil || reloaded {
+		t.Fatalf("reloaded is %v and err is %v", reloaded, err)
+	}
+
+	writeKeyPair(t, certFile, keyFile, "new.example.org", time.Now())
+	reloaded, err = r.reload()
+	if err != nil || !reloaded {
+		t.Fatalf("reloaded is %v and err is %v", reloaded, err)
+	}
+	if got := serverName(t, r); got != "new.example.org" {
+		t.Fatalf("certificate is for %s, but want new.example.org", got)
+	}
+
+	// 壊れたファイルに書き換えられても直前の証明書を使い続ける
+	err = os.WriteFile(keyFile, []byte("broken"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(keyFile, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.reload()
+	if err == nil {
+		t.Fatalf("broken key must fail to reload")
+	}
+	if got := serverName(t, r); got != "new.example.org" {
+		t.Fatalf("certificate is for %s, but want new.example.org", got)
+	}
+}
+
+func serverName(t *testing.T, r *TLSReloader) string {
+	t.Helper()
+	cfg, err := r.Config(tls.VerifyClientCertIfGiven).GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Certificates[0].Leaf.Subject.CommonName
+}
+
+// 自己署名の証明書を書き、ファイルの更新時刻を modTime にする
+func writeKeyPair(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		err = os.Chtimes(f, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
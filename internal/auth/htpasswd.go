@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// htpasswd ファイルのアカウントで認証する。対応するのは bcrypt のエントリーだけ。
+// Watch を動かしておくと、ファイルが変わったときに読み直す
+type HtpasswdAuthenticator struct {
+	path     string
+	accounts atomic.Pointer[StaticAuthenticator]
+	// 最後に読んだときのファイルの状態
+	modTime time.Time
+	size    int64
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator{path: path}
+	_, err := a.reload()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(ctx context.Context, username, password string) (Principal, error) {
+	return a.accounts.Load().Authenticate(ctx, username, password)
+}
+
+// ctx が終わるまで interval ごとにファイルを確認する。
+// 読み直しに失敗した場合は、直前に読めたアカウントを使い続ける
+func (a *HtpasswdAuthenticator) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := a.reload()
+		if err != nil {
+			slog.Error("failed to reload htpasswd file. keeping the previous accounts", "path", a.path, "error", err.Error())
+			continue
+		}
+		if reloaded {
+			slog.Info("reloaded htpasswd file", "path", a.path)
+		}
+	}
+}
+
+// ファイルが前回から変わっていなければ読まない
+func (a *HtpasswdAuthenticator) reload() (bool, error) {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return false, err
+	}
+	if a.accounts.Load() != nil && info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return false, nil
+	}
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return false, err
+	}
+	accounts, err := ParseHtpasswd(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.accounts.Store(NewStaticAuthenticator(accounts))
+	a.modTime, a.size = info.ModTime(), info.Size()
+	return true, nil
+}
+
+// htpasswd の内容をユーザー名から bcrypt のハッシュへの map にする。空行と # から始まる行は無視する
+func ParseHtpasswd(data []byte) (map[string]string, error) {
+	accounts := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d is not in the form of name:hash", n)
+		}
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+			return nil, fmt.Errorf("line %d: only bcrypt entries are supported. create them with htpasswd -B", n)
+		}
+		if _, ok := accounts[name]; ok {
+			return nil, fmt.Errorf("line %d: %s is duplicated", n, name)
+		}
+		accounts[name] = hash
+	}
+	return accounts, scanner.Err()
+}
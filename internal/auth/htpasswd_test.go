@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	tests := []struct {
+		testName string
+		data     string
+		want     int
+		wantErr  bool
+	}{
+		{testName: "コメントと空行", data: "# users\n\nalice:$2y$05$abc\nbob:$2a$05$def\n", want: 2},
+		{testName: "bcrypt ではないエントリー", data: "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", wantErr: true},
+		{testName: "区切りがない", data: "alice\n", wantErr: true},
+		{testName: "重複したユーザー", data: "alice:$2y$05$abc\nalice:$2y$05$def\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got, err := ParseHtpasswd([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("err is nil, but want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != tt.want {
+				t.Fatalf("got %d accounts, but want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestHtpasswdAuthenticatorReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	write := func(data string, modTime time.Time) {
+		err := os.WriteFile(path, []byte(data), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 同じ秒に書き換えても変更を検知できるように時刻をずらす
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("alice:"+bcryptHash(t, "old")+"\n", now)
+
+	a, err := NewHtpasswdAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Authenticate(ctx, "alice", "old")
+	if err != nil || p.Subject != "alice" {
+		t.Fatalf("alice must be authenticated: %+v, %v", p, err)
+	}
+
+	write("alice:"+bcryptHash(t, "new")+"\n", now.Add(time.Second))
+	reloaded, err := a.reload()
+	if err != nil || !reloaded {
+		t.Fatalf("file must be reloaded: %v, %v", reloaded, err)
+	}
+	_, err = a.Authenticate(ctx, "alice", "old")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("old password must be rejected: %v", err)
+	}
+	_, err = a.Authenticate(ctx, "alice", "new")
+	if err != nil {
+		t.Fatalf("new password must be accepted: %v", err)
+	}
+
+	// 壊れたファイルを読んでも直前のアカウントを使い続ける
+	write("alice:plain\n", now.Add(2*time.Second))
+	_, err = a.reload()
+	if err == nil {
+		t.Fatalf("broken file must not be loaded")
+	}
+	_, err = a.Authenticate(ctx, "alice", "new")
+	if err != nil {
+		t.Fatalf("previous accounts must be kept: %v", err)
+	}
+}
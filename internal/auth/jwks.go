@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 鍵の一覧を取り直す間隔。知らない kid のトークンが来ても、前回から minKeyRefresh の間は取り直さない
+const (
+	maxKeyAge     = time.Hour
+	minKeyRefresh = time.Minute
+)
+
+// JWKS (RFC 7517) の鍵の一覧。トークンの kid から公開鍵を探す
+type KeySet struct {
+	fetch func(ctx context.Context) ([]byte, error)
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// JWKS を書いたファイルから読む。ネットワークにつながらない環境での確認に使う
+func NewFileKeySet(path string) *KeySet {
+	return &KeySet{fetch: func(ctx context.Context) ([]byte, error) {
+		return os.ReadFile(path)
+	}}
+}
+
+// url から JWKS を取得する
+func NewRemoteKeySet(client *http.Client, url string) *KeySet {
+	return &KeySet{fetch: func(ctx context.Context) ([]byte, error) {
+		return getJSON(ctx, client, url)
+	}}
+}
+
+// issuer の OpenID Connect discovery で jwks_uri を調べてから JWKS を取得する
+func NewDiscoveryKeySet(client *http.Client, issuer string) *KeySet {
+	return &KeySet{fetch: func(ctx context.Context) ([]byte, error) {
+		body, err := getJSON(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration")
+		if err != nil {
+			return nil, err
+		}
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		err = json.Unmarshal(body, &discovery)
+		if err != nil {
+			return nil, fmt.Errorf("parse openid configuration: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("openid configuration has no jwks_uri")
+		}
+		return getJSON(ctx, client, discovery.JWKSURI)
+	}}
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// kid の公開鍵。鍵のローテーションに追従するため、見つからなければ一覧を取り直す
+func (s *KeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	age := time.Since(s.fetchedAt)
+	key, ok := s.keys[kid]
+	if ok && age < maxKeyAge {
+		return key, nil
+	}
+	if s.keys == nil || age >= minKeyRefresh {
+		data, err := s.fetch(ctx)
+		if err != nil && ok {
+			// 取り直せなくても、期限を過ぎただけの鍵はそのまま使う
+			return key, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fetch jwks: %w", err)
+		}
+		keys, err := ParseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		s.keys, s.fetchedAt = keys, time.Now()
+		key, ok = keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown kid %q", ErrInvalidToken, kid)
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// 署名に使う RSA と EC の鍵を kid ごとに返す。暗号化用の鍵や知らない種類の鍵は無視する
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaPublicKey(k)
+		case "EC":
+			key, err = ecPublicKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse jwks key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func rsaPublicKey(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64BigInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64BigInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("RSA exponent is invalid")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func ecPublicKey(k jsonWebKey) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+	}
+	x, err := base64BigInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64BigInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("EC point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func base64BigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
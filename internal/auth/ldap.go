@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP サーバーへの接続とユーザーの探し方
+type LDAPOptions struct {
+	// ldap://host:389 か ldaps://host:636
+	URL string
+	// ldap:// の接続を StartTLS で暗号化する
+	StartTLS bool
+	// ユーザーとグループを検索するためのアカウント。空なら匿名で検索する
+	BindDN       string
+	BindPassword string
+	UserBaseDN   string
+	// %s がユーザー名に置き換わる (例: (uid=%s))
+	UserFilter  string
+	GroupBaseDN string
+	// %s がユーザーの DN に置き換わる (例: (member=%s))
+	GroupFilter string
+	// グループ名が入っている属性 (例: cn)
+	GroupAttribute string
+	GroupMappings  []LDAPGroupMapping
+	// 認証に成功した結果を覚えておく時間。0 なら覚えない
+	CacheTTL time.Duration
+	Timeout  time.Duration
+}
+
+// LDAP のグループ Group のメンバーを、TCR のチーム Team に入れるか、Pattern に一致するリポジトリの Role を与える
+type LDAPGroupMapping struct {
+	Group   string
+	Team    string
+	Pattern string
+	Role    string
+}
+
+// LDAP の接続のうち、認証に使う操作
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAP のユーザーとして bind できれば認証する。docker login はリクエストのたびに資格情報を送るので、
+// 成功した結果を CacheTTL の間は覚えておき、LDAP サーバーに問い合わせない
+type LDAPAuthenticator struct {
+	opts LDAPOptions
+	dial func() (ldapConn, error)
+	// キャッシュにはパスワードそのものではなく、起動ごとの鍵での HMAC を持つ
+	cacheKey []byte
+
+	mu    sync.Mutex
+	cache map[string]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	mac       []byte
+	principal Principal
+	expiresAt time.Time
+}
+
+func NewLDAPAuthenticator(opts LDAPOptions) (*LDAPAuthenticator, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	a := &LDAPAuthenticator{
+		opts:     opts,
+		cacheKey: make([]byte, 32),
+		cache:    map[string]ldapCacheEntry{},
+	}
+	_, err = rand.Read(a.cacheKey)
+	if err != nil {
+		return nil, err
+	}
+	a.dial = func() (ldapConn, error) {
+		conn, err := ldap.DialURL(opts.URL, ldap.DialWithDialer(&net.Dialer{Timeout: opts.Timeout}))
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(opts.Timeout)
+		if opts.StartTLS {
+			err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+	return a, nil
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, username, password string) (Principal, error) {
+	// 空のパスワードでの bind は匿名の bind として成功してしまう
+	if username == "" || password == "" {
+		return Principal{}, ErrInvalidCredentials
+	}
+	mac := a.mac(username, password)
+	if p, ok := a.cached(username, mac); ok {
+		return p, nil
+	}
+
+	p, err := a.lookup(username, password)
+	if err != nil {
+		return Principal{}, err
+	}
+	if a.opts.CacheTTL > 0 {
+		a.store(username, ldapCacheEntry{mac: mac, principal: p, expiresAt: time.Now().Add(a.opts.CacheTTL)})
+	}
+	return p, nil
+}
+
+func (a *LDAPAuthenticator) lookup(username, password string) (Principal, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return Principal{}, fmt.Errorf("connect to ldap: %w", err)
+	}
+	defer conn.Close()
+
+	err = a.bindService(conn)
+	if err != nil {
+		return Principal{}, err
+	}
+	users, err := conn.Search(ldap.NewSearchRequest(
+		a.opts.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.opts.UserFilter, ldap.EscapeFilter(username)), []string{"dn"}, nil,
+	))
+	if err != nil {
+		return Principal{}, fmt.Errorf("search ldap user: %w", err)
+	}
+	if len(users.Entries) != 1 {
+		// 存在しないか、一意に決まらない
+		return Principal{}, ErrInvalidCredentials
+	}
+	userDN := users.Entries[0].DN
+
+	err = conn.Bind(userDN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return Principal{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Principal{}, fmt.Errorf("bind as ldap user: %w", err)
+	}
+
+	// グループはユーザーの権限では読めないことがあるので、検索用のアカウントに戻す
+	err = a.bindService(conn)
+	if err != nil {
+		return Principal{}, err
+	}
+	groups, err := conn.Search(ldap.NewSearchRequest(
+		a.opts.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(a.opts.GroupFilter, ldap.EscapeFilter(userDN)), []string{a.opts.GroupAttribute}, nil,
+	))
+	if err != nil {
+		return Principal{}, fmt.Errorf("search ldap groups: %w", err)
+	}
+	var names []string
+	for _, e := range groups.Entries {
+		names = append(names, e.GetAttributeValues(a.opts.GroupAttribute)...)
+	}
+	return a.principal(username, names), nil
+}
+
+func (a *LDAPAuthenticator) bindService(conn ldapConn) error {
+	var err error
+	if a.opts.BindDN == "" {
+		err = conn.Bind("", "")
+	} else {
+		err = conn.Bind(a.opts.BindDN, a.opts.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("bind ldap service account: %w", err)
+	}
+	return nil
+}
+
+// 対応づけのない LDAP のグループは使わない
+func (a *LDAPAuthenticator) principal(username string, ldapGroups []string) Principal {
+	p := Principal{Subject: username, Kind: KindUser}
+	for _, m := range a.opts.GroupMappings {
+		if !slices.ContainsFunc(ldapGroups, func(g string) bool { return strings.EqualFold(g, m.Group) }) {
+			continue
+		}
+		if m.Team != "" && !slices.Contains(p.Groups, m.Team) {
+			p.Groups = append(p.Groups, m.Team)
+		}
+		if m.Role != "" {
+			p.Permissions = append(p.Permissions, Permission{Pattern: m.Pattern, Role: m.Role})
+		}
+	}
+	return p
+}
+
+func (a *LDAPAuthenticator) mac(username, password string) []byte {
+	h := hmac.New(sha256.New, a.cacheKey)
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+func (a *LDAPAuthenticator) cached(username string, mac []byte) (Principal, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.cache[username]
+	if !ok || time.Now().After(e.expiresAt) || !hmac.Equal(e.mac, mac) {
+		return Principal{}, false
+	}
+	return e.principal, true
+}
+
+func (a *LDAPAuthenticator) store(username string, entry ldapCacheEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for name, e := range a.cache {
+		if now.After(e.expiresAt) {
+			delete(a.cache, name)
+		}
+	}
+	a.cache[username] = entry
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldap-local の users.ldif と同じ構成の LDAP サーバー
+type fakeLDAP struct {
+	// uid から DN
+	users     map[string]string
+	passwords map[string]string
+	// DN をメンバーに持つグループ
+	groups map[string][]string
+	dials  int
+	bound  string
+}
+
+func (f *fakeLDAP) dial() (ldapConn, error) {
+	f.dials++
+	return f, nil
+}
+
+func (f *fakeLDAP) Bind(username, password string) error {
+	if username == "" && password == "" {
+		f.bound = ""
+		return nil
+	}
+	if pw, ok := f.passwords[username]; !ok || pw != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	f.bound = username
+	return nil
+}
+
+func (f *fakeLDAP) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if f.bound != "cn=admin,dc=example,dc=org" {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("not the service account"))
+	}
+	result := &ldap.SearchResult{}
+	switch req.BaseDN {
+	case "ou=people,dc=example,dc=org":
+		for uid, dn := range f.users {
+			if req.Filter == "(uid="+uid+")" {
+				result.Entries = append(result.Entries, ldap.NewEntry(dn, nil))
+			}
+		}
+	case "ou=groups,dc=example,dc=org":
+		member := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "(member="), ")")
+		for _, g := range f.groups[member] {
+			result.Entries = append(result.Entries, ldap.NewEntry("cn="+g+",ou=groups,dc=example,dc=org", map[string][]string{"cn": {g}}))
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeLDAP) Close() error {
+	return nil
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	tests := []struct {
+		testName string
+		username string
+		password string
+		want     Principal
+		wantErr  error
+	}{
+		{
+			testName: "グループをチームと役割に対応づける",
+			username: "alice",
+			password: "password",
+			want: Principal{
+				Subject:     "alice",
+				Kind:        KindUser,
+				Groups:      []string{"dev"},
+				Permissions: []Permission{{Pattern: "*", Role: RoleAdmin}},
+			},
+		},
+		{
+			testName: "対応づけのないグループは使わない",
+			username: "bob",
+			password: "password",
+			want:     Principal{Subject: "bob", Kind: KindUser, Groups: []string{"dev"}},
+		},
+		{testName: "パスワードが違う", username: "alice", password: "wrong", wantErr: ErrInvalidCredentials},
+		{testName: "ユーザーがいない", username: "carol", password: "password", wantErr: ErrInvalidCredentials},
+		{testName: "空のパスワード", username: "alice", password: "", wantErr: ErrInvalidCredentials},
+		{testName: "フィルターの特殊文字はエスケープする", username: "*", password: "password", wantErr: ErrInvalidCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			server := newFakeLDAP()
+			a := newTestLDAPAuthenticator(t, server)
+
+			got, err := a.Authenticate(context.Background(), tt.username, tt.password)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got is %+v, but want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticatorCache(t *testing.T) {
+	server := newFakeLDAP()
+	a := newTestLDAPAuthenticator(t, server)
+	ctx := context.Background()
+
+	_, err := a.Authenticate(ctx, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Authenticate(ctx, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.dials != 1 {
+		t.Fatalf("the second login must use the cache, but dialed %d times", server.dials)
+	}
+
+	// 覚えているのと違うパスワードは LDAP サーバーに問い合わせる
+	_, err = a.Authenticate(ctx, "alice", "wrong")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("err is %v, but want %v", err, ErrInvalidCredentials)
+	}
+	if server.dials != 2 {
+		t.Fatalf("a different password must not use the cache, but dialed %d times", server.dials)
+	}
+}
+
+func newFakeLDAP() *fakeLDAP {
+	return &fakeLDAP{
+		users: map[string]string{
+			"alice": "uid=alice,ou=people,dc=example,dc=org",
+			"bob":   "uid=bob,ou=people,dc=example,dc=org",
+		},
+		passwords: map[string]string{
+			"cn=admin,dc=example,dc=org":            "adminpassword",
+			"uid=alice,ou=people,dc=example,dc=org": "password",
+			"uid=bob,ou=people,dc=example,dc=org":   "password",
+		},
+		groups: map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=org": {"developers", "registry-admins"},
+			"uid=bob,ou=people,dc=example,dc=org":   {"developers", "designers"},
+		},
+	}
+}
+
+func newTestLDAPAuthenticator(t *testing.T, server *fakeLDAP) *LDAPAuthenticator {
+	t.Helper()
+	a, err := NewLDAPAuthenticator(LDAPOptions{
+		URL:            "ldap://localhost:1389",
+		BindDN:         "cn=admin,dc=example,dc=org",
+		BindPassword:   "adminpassword",
+		UserBaseDN:     "ou=people,dc=example,dc=org",
+		UserFilter:     "(uid=%s)",
+		GroupBaseDN:    "ou=groups,dc=example,dc=org",
+		GroupFilter:    "(member=%s)",
+		GroupAttribute: "cn",
+		GroupMappings: []LDAPGroupMapping{
+			{Group: "developers", Team: "dev"},
+			{Group: "Registry-Admins", Pattern: "*", Role: RoleAdmin},
+		},
+		CacheTTL: time.Minute,
+		Timeout:  time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.dial = server.dial
+	return a
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OIDC のトークンで認証するときのユーザー名。パスワードにトークンを渡す (docker login -u oidc -p <token>)
+const OIDCUsername = "oidc"
+
+// CI などが発行する OIDC のトークンを受け付ける ID プロバイダー
+type OIDCProvider struct {
+	// 送り主の名前の接頭辞になる (例: github)
+	Name     string
+	Issuer   string
+	Audience string
+	Keys     *KeySet
+	Rules    []ClaimRule
+}
+
+// Claims のすべてに一致するトークンに、Pattern に一致するリポジトリの Role を与える
+type ClaimRule struct {
+	// claim の名前から値のパターンへの map。* は / を含む任意の文字列に一致する
+	Claims map[string]string
+	// ${repository} のように claim の値を埋め込める
+	Pattern string
+	Role    string
+}
+
+// OIDC のトークンを検証し、規則から行える操作を決める。長く使えるシークレットを CI に置かなくて済む
+type OIDCAuthenticator struct {
+	providers []OIDCProvider
+}
+
+func NewOIDCAuthenticator(providers []OIDCProvider) *OIDCAuthenticator {
+	return &OIDCAuthenticator{providers: providers}
+}
+
+// 送り主は <プロバイダー名>:<sub> になる。一致する規則がなければ認証しない
+func (a *OIDCAuthenticator) Authenticate(ctx context.Context, username, password string) (Principal, error) {
+	if username != OIDCUsername {
+		return Principal{}, ErrInvalidCredentials
+	}
+	// 署名を検証する前に iss だけを見て、どのプロバイダーの鍵で検証するかを決める
+	var unverified jwt.RegisteredClaims
+	_, _, err := jwt.NewParser().ParseUnverified(password, &unverified)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %w", ErrInvalidCredentials, err)
+	}
+	for _, provider := range a.providers {
+		if provider.Issuer == unverified.Issuer {
+			return provider.authenticate(ctx, password)
+		}
+	}
+	return Principal{}, fmt.Errorf("%w: unknown issuer %q", ErrInvalidCredentials, unverified.Issuer)
+}
+
+func (p OIDCProvider) authenticate(ctx context.Context, token string) (Principal, error) {
+	claims := jwt.MapClaims{}
+	var keyErr error
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := p.Keys.Key(ctx, kid)
+		if err != nil && !errors.Is(err, ErrInvalidToken) {
+			keyErr = err
+		}
+		return key, err
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if keyErr != nil {
+		// 鍵を取得できないのはトークンの誤りではない
+		return Principal{}, keyErr
+	}
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %w", ErrInvalidCredentials, err)
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return Principal{}, fmt.Errorf("%w: sub is required", ErrInvalidCredentials)
+	}
+
+	var permissions []Permission
+	for _, rule := range p.Rules {
+		if permission, ok := rule.apply(claims); ok {
+			permissions = append(permissions, permission)
+		}
+	}
+	if len(permissions) == 0 {
+		return Principal{}, fmt.Errorf("%w: no rule matches %s", ErrInvalidCredentials, sub)
+	}
+	return Principal{Subject: p.Name + ":" + sub, Kind: KindFederated, Permissions: permissions}, nil
+}
+
+func (r ClaimRule) apply(claims jwt.MapClaims) (Permission, bool) {
+	for name, pattern := range r.Claims {
+		value, ok := claimString(claims, name)
+		if !ok || !MatchPattern(pattern, value) {
+			return Permission{}, false
+		}
+	}
+	ok := true
+	pattern := os.Expand(r.Pattern, func(name string) string {
+		value, found := claimString(claims, name)
+		// 埋め込んだ値の * がパターンとして働くと、意図より多くのリポジトリに一致してしまう
+		if !found || value == "" || strings.Contains(value, "*") {
+			ok = false
+		}
+		return value
+	})
+	return Permission{Pattern: pattern, Role: r.Role}, ok
+}
+
+// 文字列、数値と真偽値の claim を文字列として返す
+func claimString(claims jwt.MapClaims, name string) (string, bool) {
+	switch v := claims[name].(type) {
+	case string:
+		return v, true
+	case float64, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testOIDCIssuer = "https://token.actions.githubusercontent.com"
+
+// key の公開鍵を kid で書いた JWKS ファイル
+func writeJWKS(t *testing.T, key *ecdsa.PrivateKey, kid string) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	jwks := map[string]any{"keys": []map[string]string{{
+		"kty": "EC",
+		"kid": kid,
+		"use": "sig",
+		"crv": "P-256",
+		"x":   enc.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   enc.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}}
+	b, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(path, b, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signOIDCToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	key := generateKey(t).(*ecdsa.PrivateKey)
+	a := NewOIDCAuthenticator([]OIDCProvider{{
+		Name:     "github",
+		Issuer:   testOIDCIssuer,
+		Audience: "tcr",
+		Keys:     NewFileKeySet(writeJWKS(t, key, "k1")),
+		Rules: []ClaimRule{
+			{Claims: map[string]string{"repository": "my-org/*", "ref": "refs/heads/main"}, Pattern: "${repository}", Role: RoleWriter},
+			{Claims: map[string]string{"repository_owner": "my-org"}, Pattern: "shared/*", Role: RoleReader},
+		},
+	}})
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":              testOIDCIssuer,
+			"aud":              "tcr",
+			"sub":              "repo:my-org/app:ref:refs/heads/main",
+			"exp":              time.Now().Add(time.Minute).Unix(),
+			"repository":       "my-org/app",
+			"repository_owner": "my-org",
+			"ref":              "refs/heads/main",
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		testName string
+		username string
+		token    string
+		want     []Permission
+		wantErr  error
+	}{
+		{
+			testName: "すべての規則に一致する",
+			username: OIDCUsername,
+			token:    signOIDCToken(t, key, "k1", claims(nil)),
+			want:     []Permission{{Pattern: "my-org/app", Role: RoleWriter}, {Pattern: "shared/*", Role: RoleReader}},
+		},
+		{
+			testName: "main 以外のブランチ",
+			username: OIDCUsername,
+			token:    signOIDCToken(t, key, "k1", claims(jwt.MapClaims{"ref": "refs/heads/feature"})),
+			want:     []Permission{{Pattern: "shared/*", Role: RoleReader}},
+		},
+		{
+			testName: "埋め込む値に * を含む",
+			username: OIDCUsername,
+			token:    signOIDCToken(t, key, "k1", claims(jwt.MapClaims{"repository": "my-org/*"})),
+			want:     []Permission{{Pattern: "shared/*", Role: RoleReader}},
+		},
+		{
+			testName: "一致する規則がない",
+			username: OIDCUsername,
+			token:    signOIDCToken(t, key, "k1", claims(jwt.MapClaims{"repository": "other/app", "repository_owner": "other"})),
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			testName: "ユーザー名が oidc ではない",
+			username: "alice",
+			token:    signOIDCToken(t, key, "k1", claims(nil)),
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			testName: "audience が違う",
+			username: OIDCUsername,
+			token:    signOIDCToken(t, key, "k1", claims(jwt.MapClaims{"aud": "other"})),
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			testName: "期限切れ",
+			username: OIDCUsername,
+			token:    signOIDCToken(t, key, "k1", claims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})),
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			testName: "知らない issuer",
+			username: OIDCUsername,
+			token:    signOIDCToken(t, key, "k1", claims(jwt.MapClaims{"iss": "https://gitlab.example.com"})),
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			testName: "別の鍵で署名された",
+			username: OIDCUsername,
+			token:    signOIDCToken(t, generateKey(t).(*ecdsa.PrivateKey), "k1", claims(nil)),
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			testName: "JWT ではない",
+			username: OIDCUsername,
+			token:    "password",
+			wantErr:  ErrInvalidCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got, err := a.Authenticate(context.Background(), tt.username, tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Subject != "github:repo:my-org/app:ref:refs/heads/main" || got.Kind != KindFederated {
+				t.Fatalf("unexpected principal: %+v", got)
+			}
+			if !reflect.DeepEqual(got.Permissions, tt.want) {
+				t.Fatalf("permissions are %+v, but want %+v", got.Permissions, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	data := []byte(`{"keys":[
+		{"kty":"RSA","kid":"rsa","n":"sXchDaQebHnPiGvyDOAT4saGEUetSyo9MKLOoWFsueri23bOdgWp4Dy1WlUzewbgBHod5pcM9H95GQRV3JDXboIRROSBigeC5yjU1hGzHHyXss8UDprecbAYxknTcQkhslANGRUZmdTOQ5qTRsLAt6BTYuyvVRdhS8exSZEy_c4gs_7svlJJQ4H9_NxsiIoLwAEk7-Q3UXERGYw_75IDrGA84-lA_-Ct4eTlXHBIY2EaV7t7LjJaynVJCpkv4LKjTTAumiGUIuQhrNhZLuF_RJLqHpM2kgWFLU7-VTdL1VbC2tejvcI2BlMkEpk1BzBZI0KQB0GaDWFLN-aEAw3vRw","e":"AQAB"},
+		{"kty":"EC","kid":"enc","use":"enc","crv":"P-256","x":"","y":""},
+		{"kty":"oct","kid":"hmac","k":"c2VjcmV0"}
+	]}`)
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys["rsa"] == nil {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	_, err = ParseJWKS([]byte(`{"keys":[{"kty":"EC","kid":"bad","crv":"P-256","x":"AQ","y":"AQ"}]}`))
+	if err == nil {
+		t.Fatalf("a point not on the curve must be rejected")
+	}
+}
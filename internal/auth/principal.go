@@ -0,0 +1,64 @@
+package auth
+
+import "context"
+
+// 送り主の種類
+const (
+	KindUser  = "user"
+	KindRobot = "robot"
+	// 外部の ID プロバイダーのトークンで認証した送り主。権限の付与ではなく Permissions で判定する
+	KindFederated = "federated"
+	// pull link のトークンで認証した送り主。Permissions と Digest の範囲だけを pull できる
+	KindPullLink = "pull-link"
+)
+
+// ロボットアカウントで認証するときのユーザー名の接頭辞。robot$ci のように書く
+const RobotPrefix = "robot$"
+
+// /token で pull link のトークンをパスワードとして使うときのユーザー名
+const PullLinkUsername = "pull-link"
+
+// 認証されたリクエストの送り主
+type Principal struct {
+	// ユーザー名かロボットアカウント名。匿名なら空
+	Subject string
+	// 空ならユーザーとして扱う
+	Kind   string
+	Groups []string
+	// トークンで認証した場合は、トークンで許可された操作だけを行える
+	FromToken bool
+	Access    []Access
+	// KindFederated と KindPullLink の場合に行える操作
+	Permissions []Permission
+	// KindPullLink の場合に pull できるマニフェスト。空ならリポジトリのすべてを pull できる
+	Digest string
+}
+
+type principalKey struct{}
+
+// 認証を記録するためのクライアントの情報
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+type clientKey struct{}
+
+func WithClient(ctx context.Context, c Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+func ClientFrom(ctx context.Context) Client {
+	c, _ := ctx.Value(clientKey{}).(Client)
+	return c
+}
+
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// 認証が無効な場合は ok が false になる
+func PrincipalFrom(ctx context.Context) (p Principal, ok bool) {
+	p, ok = ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
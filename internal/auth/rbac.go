@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+// リポジトリに対する役割。後ろのものほど多くの操作を行える
+const (
+	RoleReader     = "reader"
+	RoleWriter     = "writer"
+	RoleMaintainer = "maintainer"
+	RoleAdmin      = "admin"
+)
+
+// 権限を与える相手の種類
+const (
+	SubjectUser  = "user"
+	SubjectGroup = "group"
+	SubjectRobot = "robot"
+)
+
+// リポジトリの公開範囲。未設定のリポジトリは private として扱う
+const (
+	// 匿名でも pull できる
+	VisibilityPublic = "public"
+	// 認証されていれば pull できる
+	VisibilityInternal = "internal"
+	// 権限の付与がなければ pull できない
+	VisibilityPrivate = "private"
+)
+
+// 管理 API を使うためのスコープ。* のすべてのリポジトリに admin を与えられた送り主にだけ許可する
+var AdminAccess = Access{Type: TypeRegistry, Name: "admin", Actions: []string{ActionAll}}
+
+var roleActions = map[string][]string{
+	RoleReader:     {ActionPull},
+	RoleWriter:     {ActionPull, ActionPush},
+	RoleMaintainer: {ActionPull, ActionPush, ActionDelete},
+	RoleAdmin:      {ActionPull, ActionPush, ActionDelete},
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleActions[role]
+	return ok
+}
+
+func ValidVisibility(visibility string) bool {
+	return visibility == VisibilityPublic || visibility == VisibilityInternal || visibility == VisibilityPrivate
+}
+
+// 公開範囲だけで p がリポジトリを pull できるか。push と delete は公開範囲では許可しない。
+// pull link はリンクのリポジトリだけに使えるので、internal のリポジトリは pull できない
+func VisibilityAllowsPull(visibility string, p Principal) bool {
+	switch visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilityInternal:
+		return p.Subject != "" && p.Kind != KindPullLink
+	}
+	return false
+}
+
+func ValidSubjectType(subjectType string) bool {
+	return subjectType == SubjectUser || subjectType == SubjectGroup || subjectType == SubjectRobot
+}
+
+// * は / を含む任意の文字列に一致する。それ以外の文字はそのまま比べる
+func MatchPattern(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return strings.HasSuffix(name, parts[len(parts)-1])
+}
+
+// grant が p に与えられたものか
+func grantedTo(grant model.Grant, p Principal) bool {
+	switch grant.SubjectType {
+	case SubjectUser:
+		return p.Kind != KindRobot && grant.Subject == p.Subject
+	case SubjectRobot:
+		return p.Kind == KindRobot && grant.Subject == p.Subject
+	case SubjectGroup:
+		return slices.Contains(p.Groups, grant.Subject)
+	}
+	return false
+}
+
+// grants と認証の方法が与えた役割によって p がリポジトリ name に行える操作
+func GrantedActions(grants []model.Grant, p Principal, name string) []string {
+	permissions := slices.Clone(p.Permissions)
+	for _, g := range grants {
+		if grantedTo(g, p) {
+			permissions = append(permissions, Permission{Pattern: g.Pattern, Role: g.Role})
+		}
+	}
+	return PermittedActions(permissions, name)
+}
+
+// Pattern に一致するリポジトリに対する役割。権限の付与を経由せず、認証の方法が直接与える
+type Permission struct {
+	Pattern string `json:"pattern"`
+	Role    string `json:"role"`
+}
+
+// permissions によってリポジトリ name に行える操作
+func PermittedActions(permissions []Permission, name string) []string {
+	var actions []string
+	for _, p := range permissions {
+		if !MatchPattern(p.Pattern, name) {
+			continue
+		}
+		for _, action := range roleActions[p.Role] {
+			if !slices.Contains(actions, action) {
+				actions = append(actions, action)
+			}
+		}
+	}
+	return actions
+}
+
+// grants と認証の方法が与えた役割によって p がすべてのリポジトリの admin か
+func IsAdmin(grants []model.Grant, p Principal) bool {
+	for _, perm := range p.Permissions {
+		if perm.Role == RoleAdmin && perm.Pattern == "*" {
+			return true
+		}
+	}
+	for _, g := range grants {
+		if g.Role == RoleAdmin && g.Pattern == "*" && grantedTo(g, p) {
+			return true
+		}
+	}
+	return false
+}
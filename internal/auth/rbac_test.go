@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "org/repo", name: "org/repo", want: true},
+		{pattern: "org/repo", name: "org/repo2", want: false},
+		{pattern: "*", name: "a/b/c", want: true},
+		{pattern: "org/*", name: "org/team/repo", want: true},
+		{pattern: "org/*", name: "org", want: false},
+		{pattern: "org/*", name: "other/repo", want: false},
+		{pattern: "*/cache", name: "org/team/cache", want: true},
+		{pattern: "org/*/base-*", name: "org/team/base-image", want: true},
+		{pattern: "org/*/base-*", name: "org/team/image", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			got := MatchPattern(tt.pattern, tt.name)
+			if got != tt.want {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrantedActions(t *testing.T) {
+	grants := []model.Grant{
+		{SubjectType: SubjectUser, Subject: "alice", Pattern: "org/*", Role: RoleReader},
+		{SubjectType: SubjectUser, Subject: "alice", Pattern: "org/app", Role: RoleWriter},
+		{SubjectType: SubjectGroup, Subject: "ops", Pattern: "*", Role: RoleMaintainer},
+		{SubjectType: SubjectRobot, Subject: "ci", Pattern: "org/app", Role: RoleWriter},
+	}
+	tests := []struct {
+		testName  string
+		principal Principal
+		name      string
+		want      []string
+	}{
+		{testName: "パターンに一致する役割", principal: Principal{Subject: "alice"}, name: "org/lib", want: []string{"pull"}},
+		{testName: "複数の役割を合わせる", principal: Principal{Subject: "alice"}, name: "org/app", want: []string{"pull", "push"}},
+		{testName: "付与がない", principal: Principal{Subject: "alice"}, name: "other/app", want: nil},
+		{testName: "グループへの付与", principal: Principal{Subject: "bob", Groups: []string{"ops"}}, name: "other/app", want: []string{"pull", "push", "delete"}},
+		{testName: "ロボットへの付与", principal: Principal{Subject: "ci", Kind: KindRobot}, name: "org/app", want: []string{"pull", "push"}},
+		{testName: "同じ名前のユーザーにはロボットへの付与を使わない", principal: Principal{Subject: "ci"}, name: "org/app", want: nil},
+		{testName: "認証で与えられた役割と合わせる", principal: Principal{Subject: "alice", Permissions: []Permission{{Pattern: "org/app", Role: RoleMaintainer}}}, name: "org/app", want: []string{"pull", "push", "delete"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got := GrantedActions(grants, tt.principal, tt.name)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	grants := []model.Grant{
+		{SubjectType: SubjectUser, Subject: "alice", Pattern: "*", Role: RoleAdmin},
+		{SubjectType: SubjectUser, Subject: "bob", Pattern: "org/*", Role: RoleAdmin},
+	}
+	if !IsAdmin(grants, Principal{Subject: "alice"}) {
+		t.Fatalf("alice must be an admin")
+	}
+	if IsAdmin(grants, Principal{Subject: "bob"}) {
+		t.Fatalf("admin of some repositories must not be a registry admin")
+	}
+	if !IsAdmin(nil, Principal{Subject: "carol", Permissions: []Permission{{Pattern: "*", Role: RoleAdmin}}}) {
+		t.Fatalf("carol must be an admin by permissions")
+	}
+}
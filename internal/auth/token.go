@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var ErrInvalidToken = errors.New("token is invalid")
+
+// Docker のトークン認証で使う JWT の claims
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Access []Access `json:"access"`
+	// _catalog でスコープのないリポジトリを見せるかどうかの判定に使う
+	Kind        string       `json:"kind,omitempty"`
+	Groups      []string     `json:"groups,omitempty"`
+	Permissions []Permission `json:"permissions,omitempty"`
+	Digest      string       `json:"digest,omitempty"`
+}
+
+// pull link のトークンの audience の接尾辞。レジストリのトークンと取り違えないように audience を変える
+const pullLinkAudienceSuffix = "#pull-link"
+
+// pull link のトークンに書かれている内容。取り消されていないかは呼び出し側で確かめる
+type PullLinkClaims struct {
+	ID         string
+	Repository string
+	Digest     string
+}
+
+// レジストリのトークンを発行し、検証する。発行と検証に同じ鍵を使うので、
+// 複数のインスタンスで動かす場合はすべてのインスタンスに同じ鍵を渡す
+type TokenIssuer struct {
+	key        crypto.Signer
+	method     jwt.SigningMethod
+	issuer     string
+	service    string
+	expiration time.Duration
+}
+
+func NewTokenIssuer(key crypto.Signer, issuer, service string, expiration time.Duration) (*TokenIssuer, error) {
+	var method jwt.SigningMethod
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 is supported for ECDSA signing keys")
+		}
+		method = jwt.SigningMethodES256
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("unsupported signing key type: %T", key)
+	}
+	return &TokenIssuer{
+		key:        key,
+		method:     method,
+		issuer:     issuer,
+		service:    service,
+		expiration: expiration,
+	}, nil
+}
+
+// p に access を許可するトークンを発行する
+func (t *TokenIssuer) Issue(p Principal, access []Access, now time.Time) (token string, expiresAt time.Time, err error) {
+	expiresAt = now.Add(t.expiration)
+	claims := tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    t.issuer,
+			Subject:   p.Subject,
+			Audience:  jwt.ClaimStrings{t.service},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        uuid.NewString(),
+		},
+		Access:      access,
+		Kind:        p.Kind,
+		Groups:      p.Groups,
+		Permissions: p.Permissions,
+		Digest:      p.Digest,
+	}
+	if claims.Access == nil {
+		claims.Access = []Access{}
+	}
+	token, err = jwt.NewWithClaims(t.method, claims).SignedString(t.key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// トークンを検証し、送り主と許可されている操作を返す
+func (t *TokenIssuer) Verify(token string) (Principal, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return t.key.Public(), nil
+	},
+		jwt.WithValidMethods([]string{t.method.Alg()}),
+		jwt.WithIssuer(t.issuer),
+		jwt.WithAudience(t.service),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	return Principal{
+		Subject:     claims.Subject,
+		Kind:        claims.Kind,
+		Groups:      claims.Groups,
+		FromToken:   true,
+		Access:      claims.Access,
+		Permissions: claims.Permissions,
+		Digest:      claims.Digest,
+	}, nil
+}
+
+// repository (と digest) の pull だけを expiresAt まで許可する pull link のトークンを発行する
+func (t *TokenIssuer) IssuePullLink(c PullLinkClaims, now, expiresAt time.Time) (string, error) {
+	claims := tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    t.issuer,
+			Subject:   c.ID,
+			Audience:  jwt.ClaimStrings{t.service + pullLinkAudienceSuffix},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        c.ID,
+		},
+		Access: []Access{RepositoryAccess(c.Repository, ActionPull)},
+		Kind:   KindPullLink,
+		Digest: c.Digest,
+	}
+	return jwt.NewWithClaims(t.method, claims).SignedString(t.key)
+}
+
+func (t *TokenIssuer) VerifyPullLink(token string) (PullLinkClaims, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return t.key.Public(), nil
+	},
+		jwt.WithValidMethods([]string{t.method.Alg()}),
+		jwt.WithIssuer(t.issuer),
+		jwt.WithAudience(t.service+pullLinkAudienceSuffix),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return PullLinkClaims{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if claims.Kind != KindPullLink || len(claims.Access) != 1 || claims.Access[0].Type != TypeRepository {
+		return PullLinkClaims{}, fmt.Errorf("%w: not a pull link", ErrInvalidToken)
+	}
+	return PullLinkClaims{ID: claims.ID, Repository: claims.Access[0].Name, Digest: claims.Digest}, nil
+}
+
+// PEM 形式の ECDSA (P-256) か RSA の秘密鍵を読む
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported signing key type: %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block: %s", block.Type)
+}
+
+// 起動ごとに作る鍵。再起動すると発行済みのトークンは使えなくなるので、ローカルでだけ使う
+func GenerateSigningKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
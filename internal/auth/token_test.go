@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestIssuer(t *testing.T, key crypto.Signer, service string) *TokenIssuer {
+	t.Helper()
+	ti, err := NewTokenIssuer(key, "tcr", service, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ti
+}
+
+func generateKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestTokenIssuer(t *testing.T) {
+	ti := newTestIssuer(t, generateKey(t), "tcr")
+	access := []Access{RepositoryAccess("org/repo", ActionPull)}
+
+	p := Principal{Subject: "alice", Kind: KindUser, Groups: []string{"dev"}, Permissions: []Permission{{Pattern: "org/*", Role: RoleReader}}}
+	token, expiresAt, err := ti.Issue(p, access, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expiresAt) <= 4*time.Minute {
+		t.Fatalf("expiresAt is %v", expiresAt)
+	}
+	got, err := ti.Verify(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Principal{Subject: "alice", Kind: KindUser, Groups: []string{"dev"}, FromToken: true, Access: access, Permissions: p.Permissions}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got is %+v, but want %+v", got, want)
+	}
+}
+
+func TestTokenIssuerRejects(t *testing.T) {
+	key := generateKey(t)
+	ti := newTestIssuer(t, key, "tcr")
+	valid, _, err := ti.Issue(Principal{Subject: "alice"}, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := ti.Issue(Principal{Subject: "alice"}, nil, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := newTestIssuer(t, generateKey(t), "tcr").Issue(Principal{Subject: "alice"}, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherService, _, err := newTestIssuer(t, key, "other").Issue(Principal{Subject: "alice"}, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		testName string
+		token    string
+	}{
+		{testName: "期限切れ", token: expired},
+		{testName: "別の鍵で署名", token: otherKey},
+		{testName: "別のサービス向け", token: otherService},
+		{testName: "署名の改ざん", token: valid[:len(valid)-4] + "AAAA"},
+		{testName: "JWT ではない", token: "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			_, err := ti.Verify(tt.token)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("err is %v, but want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestTokenIssuerPullLink(t *testing.T) {
+	key := generateKey(t)
+	ti := newTestIssuer(t, key, "tcr")
+	now := time.Now()
+	claims := PullLinkClaims{ID: "link-1", Repository: "org/app", Digest: "sha256:" + strings.Repeat("a", 64)}
+	token, err := ti.IssuePullLink(claims, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ti.VerifyPullLink(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != claims {
+		t.Fatalf("got is %+v, but want %+v", got, claims)
+	}
+
+	// レジストリのトークンとは audience が違うので、取り違えない
+	_, err = ti.Verify(token)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("pull link must not be accepted as a registry token: %v", err)
+	}
+	registry, _, err := ti.Issue(Principal{Subject: "alice"}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ti.VerifyPullLink(registry)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("registry token must not be accepted as a pull link: %v", err)
+	}
+	expired, err := ti.IssuePullLink(claims, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ti.VerifyPullLink(expired)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expired pull link must be rejected: %v", err)
+	}
+}
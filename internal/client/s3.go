@@ -2,23 +2,25 @@ package client
 
 import (
 	"context"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-func NewS3Client(isLocal bool) (*s3.Client, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("ap-northeast-1"))
+// endpoint が空なら AWS のエンドポイントを使う。
+// minio などの S3 互換のサービスでは usePathStyle を有効にする必要がある
+func NewS3Client(ctx context.Context, region, endpoint string, usePathStyle bool) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
 	if err != nil {
 		return nil, err
 	}
-	if isLocal {
-		return s3.NewFromConfig(cfg, func(o *s3.Options) {
-			o.BaseEndpoint = aws.String("http://localhost:9000")
-			o.UsePathStyle = true // local のときだけ minio を使うために必要
-			o.EndpointOptions.DisableHTTPS = true
-		}), nil
-	}
-	return s3.NewFromConfig(cfg), nil
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.EndpointOptions.DisableHTTPS = strings.HasPrefix(endpoint, "http://")
+		}
+		o.UsePathStyle = usePathStyle
+	}), nil
 }
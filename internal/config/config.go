@@ -0,0 +1,497 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TCR の設定。YAML ファイルを読んだあとに環境変数で上書きし、Validate で検証してから使う
+type Config struct {
+	// ローカルの DynamoDB と minio を使う。エンドポイントやスキーマの自動作成の既定値が変わる
+	Local   bool          `yaml:"local"`
+	Server  ServerConfig  `yaml:"server"`
+	Storage StorageConfig `yaml:"storage"`
+	Schema  SchemaConfig  `yaml:"schema"`
+	Limits  LimitsConfig  `yaml:"limits"`
+	Cache   CacheConfig   `yaml:"cache"`
+	// blob のダウンロードを blob ストレージの署名付き URL にリダイレクトする
+	BlobRedirect BlobRedirectConfig `yaml:"blobRedirect"`
+	Auth         AuthConfig         `yaml:"auth"`
+}
+
+type ServerConfig struct {
+	Listen string `yaml:"listen"`
+	// SIGTERM を受け取ってから処理中のリクエストを待つ時間。
+	// ECS は stopTimeout (既定 30 秒) を過ぎると SIGKILL するので、それより短くする
+	ShutdownGracePeriod time.Duration `yaml:"shutdownGracePeriod"`
+	TLS                 TLSConfig     `yaml:"tls"`
+	// /debug/vars でキャッシュのヒット数などを公開する。認証が有効なら管理者だけが見られる
+	DebugVars bool `yaml:"debugVars"`
+}
+
+// ALB を置かずに TLS を終端する。certFile と keyFile が空なら HTTP で待ち受ける
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// 証明書と鍵のファイルの変更を確認する間隔
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+	// クライアント証明書を発行した CA の PEM。空ならクライアント証明書を求めない
+	ClientCAFile string `yaml:"clientCAFile"`
+	// optional なら証明書のないクライアントも受け付ける。require なら証明書を必須にする
+	ClientAuth string `yaml:"clientAuth"`
+	// 証明書のどの値を TCR のユーザー名にするか。commonName、dnsName、email か uri
+	ClientIdentity string `yaml:"clientIdentity"`
+}
+
+const (
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+type StorageConfig struct {
+	Blob     BlobStorageConfig     `yaml:"blob"`
+	Metadata MetadataStorageConfig `yaml:"metadata"`
+}
+
+type BlobStorageConfig struct {
+	Bucket string `yaml:"bucket"`
+	Region string `yaml:"region"`
+	// 空なら AWS のエンドポイントを使う
+	Endpoint string `yaml:"endpoint"`
+	// minio などの S3 互換のサービスではパス形式でないとアクセスできない
+	UsePathStyle bool `yaml:"usePathStyle"`
+}
+
+type MetadataStorageConfig struct {
+	// メタデータはすべてこのテーブルに保存する
+	Table  string `yaml:"table"`
+	Region string `yaml:"region"`
+	// 空なら AWS のエンドポイントを使う
+	Endpoint string `yaml:"endpoint"`
+	// 単一テーブルに移行する前のテーブル名。指定されていないテーブルは移行しない
+	LegacyTables LegacyTablesConfig `yaml:"legacyTables"`
+}
+
+type LegacyTablesConfig struct {
+	Manifest           string `yaml:"manifest"`
+	Tag                string `yaml:"tag"`
+	Repository         string `yaml:"repository"`
+	BlobMetadata       string `yaml:"blobMetadata"`
+	BlobUploadProgress string `yaml:"blobUploadProgress"`
+}
+
+type SchemaConfig struct {
+	// 未指定ならローカルのときだけ有効にする
+	AutoCreate  *bool `yaml:"autoCreate"`
+	AutoMigrate *bool `yaml:"autoMigrate"`
+}
+
+type LimitsConfig struct {
+	// blob の転送以外のリクエストの処理時間の上限。0 なら上限を設けない
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+	// blob のダウンロードとアップロードの処理時間の上限。0 なら上限を設けない
+	TransferTimeout time.Duration `yaml:"transferTimeout"`
+	// DynamoDB の項目に直接入れるマニフェストの最大バイト数。0 ならすべて blob ストレージに保存する
+	ManifestInlineLimit int `yaml:"manifestInlineLimit"`
+}
+
+type CacheConfig struct {
+	Blob     BlobCacheConfig     `yaml:"blob"`
+	Manifest ManifestCacheConfig `yaml:"manifest"`
+}
+
+type BlobCacheConfig struct {
+	// 空ならディスクキャッシュを使わない
+	Dir      string `yaml:"dir"`
+	MaxBytes int64  `yaml:"maxBytes"`
+	// マニフェストが push されたときにレイヤーをキャッシュに読み込んでおく
+	Prefetch bool `yaml:"prefetch"`
+}
+
+type ManifestCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// タグが指す digest をキャッシュする時間。他のインスタンスでの付け替えはこの時間だけ遅れて反映される
+	TagTTL time.Duration `yaml:"tagTTL"`
+}
+
+type BlobRedirectConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// 発行する URL の有効期間
+	Expires time.Duration `yaml:"expires"`
+	// リダイレクトせずに中継するリポジトリ名のパターン (path.Match の形式)
+	ExcludeRepositories []string `yaml:"excludeRepositories"`
+	// リダイレクトをたどれないクライアントの User-Agent の前方一致
+	ExcludeUserAgents []string `yaml:"excludeUserAgents"`
+}
+
+const (
+	AuthModeNone  = "none"
+	AuthModeToken = "token"
+	AuthModeBasic = "basic"
+)
+
+type AuthConfig struct {
+	// none なら認証しない。token なら Docker のトークン認証、basic なら Basic 認証を使う
+	Mode  string          `yaml:"mode"`
+	Token TokenAuthConfig `yaml:"token"`
+	// token と basic で認証するアカウント。htpasswd ファイルのアカウントと合わせて使う
+	Accounts []AccountConfig `yaml:"accounts"`
+	Htpasswd HtpasswdConfig  `yaml:"htpasswd"`
+	// 権限の付与がなくてもすべての操作と権限の管理を行えるユーザー
+	Admins []string `yaml:"admins"`
+	// 権限の付与をメモリに持っておく時間。他のインスタンスでの変更はこの時間だけ遅れて反映される
+	GrantCacheTTL time.Duration `yaml:"grantCacheTTL"`
+	// ロボットアカウントのシークレットの既定の有効期間
+	RobotSecretTTL time.Duration  `yaml:"robotSecretTTL"`
+	OIDC           OIDCConfig     `yaml:"oidc"`
+	LDAP           LDAPConfig     `yaml:"ldap"`
+	PullLink       PullLinkConfig `yaml:"pullLink"`
+}
+
+// 期限付きで pull だけを許可するリンク。token でだけ使える
+type PullLinkConfig struct {
+	// 有効期間を指定しなかったときの有効期間
+	DefaultTTL time.Duration `yaml:"defaultTTL"`
+	// 指定できる最長の有効期間
+	MaxTTL time.Duration `yaml:"maxTTL"`
+}
+
+type HtpasswdConfig struct {
+	// bcrypt のエントリーだけを書いた htpasswd ファイル。空なら使わない
+	File string `yaml:"file"`
+	// ファイルの変更を確認する間隔
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+type TokenAuthConfig struct {
+	// クライアントがトークンを取得する URL。TCR の /token を指す
+	Realm   string `yaml:"realm"`
+	Service string `yaml:"service"`
+	Issuer  string `yaml:"issuer"`
+	// トークンに署名する PEM 形式の ECDSA (P-256) か RSA の秘密鍵。
+	// 空ならローカルでだけ起動ごとに鍵を作る
+	SigningKeyFile string        `yaml:"signingKeyFile"`
+	Expiration     time.Duration `yaml:"expiration"`
+}
+
+type AccountConfig struct {
+	Name string `yaml:"name"`
+	// bcrypt のハッシュ。htpasswd -nbB で作れる
+	PasswordHash string `yaml:"passwordHash"`
+}
+
+// CI などが発行する OIDC のトークンでの認証。token と basic で使える
+type OIDCConfig struct {
+	Providers []OIDCProviderConfig `yaml:"providers"`
+}
+
+type OIDCProviderConfig struct {
+	// 送り主の名前の接頭辞 (例: github)
+	Name     string `yaml:"name"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// JWKS を書いたファイル。指定するとネットワークから取得しない
+	JWKSFile string `yaml:"jwksFile"`
+	// JWKS の URL。JWKSFile も JWKSURL も空なら issuer の discovery で調べる
+	JWKSURL string           `yaml:"jwksURL"`
+	Rules   []OIDCRuleConfig `yaml:"rules"`
+}
+
+// claims のすべてに一致するトークンに、pattern に一致するリポジトリの role を与える
+type OIDCRuleConfig struct {
+	// claim の名前から値のパターンへの map。* は / を含む任意の文字列に一致する
+	Claims map[string]string `yaml:"claims"`
+	// ${repository} のように claim の値を埋め込める
+	Pattern string `yaml:"pattern"`
+	// reader、writer か maintainer
+	Role string `yaml:"role"`
+}
+
+// LDAP のユーザーとして bind できれば認証する。url が空なら使わない
+type LDAPConfig struct {
+	// ldap://host:389 か ldaps://host:636
+	URL      string `yaml:"url"`
+	StartTLS bool   `yaml:"startTLS"`
+	// ユーザーとグループを検索するためのアカウント。空なら匿名で検索する
+	BindDN       string `yaml:"bindDN"`
+	BindPassword string `yaml:"bindPassword"`
+	UserBaseDN   string `yaml:"userBaseDN"`
+	// %s がユーザー名に置き換わる
+	UserFilter  string `yaml:"userFilter"`
+	GroupBaseDN string `yaml:"groupBaseDN"`
+	// %s がユーザーの DN に置き換わる
+	GroupFilter    string                   `yaml:"groupFilter"`
+	GroupAttribute string                   `yaml:"groupAttribute"`
+	GroupMappings  []LDAPGroupMappingConfig `yaml:"groupMappings"`
+	// 認証に成功した結果を覚えておく時間
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// LDAP のグループのメンバーを team に入れるか、pattern に一致するリポジトリの role を与える
+type LDAPGroupMappingConfig struct {
+	Group   string `yaml:"group"`
+	Team    string `yaml:"team"`
+	Pattern string `yaml:"pattern"`
+	Role    string `yaml:"role"`
+}
+
+// 設定ファイルで指定されなかった項目の値
+func Default() Config {
+	return Config{
+		Local: true,
+		Server: ServerConfig{
+			Listen:              ":8080",
+			ShutdownGracePeriod: 25 * time.Second,
+			TLS: TLSConfig{
+				ReloadInterval: time.Minute,
+				ClientAuth:     ClientAuthOptional,
+				ClientIdentity: "commonName",
+			},
+		},
+		Storage: StorageConfig{
+			Blob: BlobStorageConfig{
+				Bucket: "tcr-blob-local",
+				Region: "ap-northeast-1",
+			},
+			Metadata: MetadataStorageConfig{
+				Table:  "tcr-metadata-local",
+				Region: "ap-northeast-1",
+			},
+		},
+		Limits: LimitsConfig{
+			RequestTimeout:      30 * time.Second,
+			TransferTimeout:     30 * time.Minute,
+			ManifestInlineLimit: 64 * 1024,
+		},
+		Cache: CacheConfig{
+			Blob: BlobCacheConfig{
+				MaxBytes: 10 * 1024 * 1024 * 1024,
+			},
+			Manifest: ManifestCacheConfig{
+				TagTTL: 10 * time.Second,
+			},
+		},
+		BlobRedirect: BlobRedirectConfig{
+			Expires: 5 * time.Minute,
+		},
+		Auth: AuthConfig{
+			Mode: AuthModeNone,
+			Token: TokenAuthConfig{
+				Realm:      "http://localhost:8080/token",
+				Service:    "tcr",
+				Issuer:     "tcr",
+				Expiration: 5 * time.Minute,
+			},
+			Htpasswd: HtpasswdConfig{
+				ReloadInterval: 5 * time.Second,
+			},
+			GrantCacheTTL:  10 * time.Second,
+			RobotSecretTTL: 90 * 24 * time.Hour,
+			LDAP: LDAPConfig{
+				UserFilter:     "(uid=%s)",
+				GroupFilter:    "(member=%s)",
+				GroupAttribute: "cn",
+				CacheTTL:       time.Minute,
+				Timeout:        5 * time.Second,
+			},
+			PullLink: PullLinkConfig{
+				DefaultTTL: 24 * time.Hour,
+				MaxTTL:     7 * 24 * time.Hour,
+			},
+		},
+	}
+}
+
+// path の設定ファイルを読み、環境変数で上書きして検証する。path が空なら既定値と環境変数だけを使う
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("read config file: %w", err)
+		}
+		err = decode(data, &cfg)
+		if err != nil {
+			return Config{}, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	}
+	err := applyEnv(&cfg, os.LookupEnv)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.applyLocalDefaults()
+	err = cfg.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// 知らない項目は書き間違いなのでエラーにする
+func decode(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(cfg)
+	// 空のファイルは既定値のまま
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// ローカルではエンドポイントを docker-compose.yml のサービスに向ける
+func (c *Config) applyLocalDefaults() {
+	if !c.Local {
+		return
+	}
+	if c.Storage.Metadata.Endpoint == "" {
+		c.Storage.Metadata.Endpoint = "http://localhost:8000"
+	}
+	if c.Storage.Blob.Endpoint == "" {
+		c.Storage.Blob.Endpoint = "http://localhost:9000"
+		c.Storage.Blob.UsePathStyle = true
+	}
+}
+
+func (c Config) SchemaAutoCreate() bool {
+	if c.Schema.AutoCreate == nil {
+		return c.Local
+	}
+	return *c.Schema.AutoCreate
+}
+
+func (c Config) SchemaAutoMigrate() bool {
+	if c.Schema.AutoMigrate == nil {
+		return c.Local
+	}
+	return *c.Schema.AutoMigrate
+}
+
+// 表示するときに秘密の値の代わりに書く文字列
+const redacted = "REDACTED"
+
+// config check で表示するために、パスワードやそのハッシュを伏せた複製を返す
+func (c Config) Redacted() Config {
+	if c.Auth.LDAP.BindPassword != "" {
+		c.Auth.LDAP.BindPassword = redacted
+	}
+	accounts := make([]AccountConfig, len(c.Auth.Accounts))
+	for i, a := range c.Auth.Accounts {
+		if a.PasswordHash != "" {
+			a.PasswordHash = redacted
+		}
+		accounts[i] = a
+	}
+	c.Auth.Accounts = accounts
+	return c
+}
+
+// すべての誤りをまとめて返す
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Listen != "", "server.listen is required")
+	check(c.Server.ShutdownGracePeriod > 0, "server.shutdownGracePeriod must be positive")
+	if t := c.Server.TLS; t.CertFile != "" || t.KeyFile != "" || t.ClientCAFile != "" {
+		check(t.CertFile != "" && t.KeyFile != "", "server.tls.certFile and server.tls.keyFile are required for TLS")
+		check(t.ReloadInterval > 0, "server.tls.reloadInterval must be positive")
+		check(t.ClientAuth == ClientAuthOptional || t.ClientAuth == ClientAuthRequire, "server.tls.clientAuth must be optional or require: %s", t.ClientAuth)
+		check(t.ClientIdentity == "commonName" || t.ClientIdentity == "dnsName" || t.ClientIdentity == "email" || t.ClientIdentity == "uri", "server.tls.clientIdentity must be commonName, dnsName, email or uri: %s", t.ClientIdentity)
+	}
+
+	check(c.Storage.Blob.Bucket != "", "storage.blob.bucket is required")
+	check(c.Storage.Blob.Region != "", "storage.blob.region is required")
+	check(validEndpoint(c.Storage.Blob.Endpoint), "storage.blob.endpoint must be an http or https URL: %s", c.Storage.Blob.Endpoint)
+	check(c.Storage.Metadata.Table != "", "storage.metadata.table is required")
+	check(c.Storage.Metadata.Region != "", "storage.metadata.region is required")
+	check(validEndpoint(c.Storage.Metadata.Endpoint), "storage.metadata.endpoint must be an http or https URL: %s", c.Storage.Metadata.Endpoint)
+
+	check(c.Limits.RequestTimeout >= 0, "limits.requestTimeout must not be negative")
+	check(c.Limits.TransferTimeout >= 0, "limits.transferTimeout must not be negative")
+	check(c.Limits.ManifestInlineLimit >= 0, "limits.manifestInlineLimit must not be negative")
+
+	check(c.Cache.Blob.MaxBytes > 0, "cache.blob.maxBytes must be positive")
+	check(!c.Cache.Blob.Prefetch || c.Cache.Blob.Dir != "", "cache.blob.prefetch requires cache.blob.dir")
+	check(c.Cache.Manifest.TagTTL >= 0, "cache.manifest.tagTTL must not be negative")
+
+	check(c.BlobRedirect.Expires > 0, "blobRedirect.expires must be positive")
+
+	check(c.Auth.Mode == AuthModeNone || c.Auth.Mode == AuthModeToken || c.Auth.Mode == AuthModeBasic, "auth.mode must be none, token or basic: %s", c.Auth.Mode)
+	if c.Auth.Mode == AuthModeBasic {
+		check(c.Auth.Htpasswd.File != "" || len(c.Auth.Accounts) > 0 || c.Auth.LDAP.URL != "", "auth.htpasswd.file, auth.accounts or auth.ldap.url is required for basic auth")
+	}
+	check(c.Auth.Htpasswd.ReloadInterval > 0, "auth.htpasswd.reloadInterval must be positive")
+	check(c.Auth.GrantCacheTTL >= 0, "auth.grantCacheTTL must not be negative")
+	check(c.Auth.RobotSecretTTL > 0, "auth.robotSecretTTL must be positive")
+	check(c.Auth.PullLink.DefaultTTL > 0, "auth.pullLink.defaultTTL must be positive")
+	check(c.Auth.PullLink.DefaultTTL <= c.Auth.PullLink.MaxTTL, "auth.pullLink.defaultTTL must not exceed auth.pullLink.maxTTL")
+	if c.Auth.Mode == AuthModeToken {
+		check(validEndpoint(c.Auth.Token.Realm) && c.Auth.Token.Realm != "", "auth.token.realm must be an http or https URL: %s", c.Auth.Token.Realm)
+		check(c.Auth.Token.Service != "", "auth.token.service is required")
+		check(c.Auth.Token.Issuer != "", "auth.token.issuer is required")
+		check(c.Auth.Token.SigningKeyFile != "" || c.Local, "auth.token.signingKeyFile is required unless local")
+		check(c.Auth.Token.Expiration > 0, "auth.token.expiration must be positive")
+	}
+	names := map[string]bool{}
+	for i, a := range c.Auth.Accounts {
+		check(a.Name != "", "auth.accounts[%d].name is required", i)
+		check(!names[a.Name], "auth.accounts[%d].name is duplicated: %s", i, a.Name)
+		check(strings.HasPrefix(a.PasswordHash, "$2"), "auth.accounts[%d].passwordHash must be a bcrypt hash", i)
+		names[a.Name] = true
+	}
+	providers := map[string]bool{}
+	for i, p := range c.Auth.OIDC.Providers {
+		check(p.Name != "" && !strings.Contains(p.Name, ":"), "auth.oidc.providers[%d].name is required and must not contain ':'", i)
+		check(!providers[p.Name], "auth.oidc.providers[%d].name is duplicated: %s", i, p.Name)
+		check(p.Issuer != "" && validEndpoint(p.Issuer), "auth.oidc.providers[%d].issuer must be an http or https URL: %s", i, p.Issuer)
+		check(p.Audience != "", "auth.oidc.providers[%d].audience is required", i)
+		check(validEndpoint(p.JWKSURL), "auth.oidc.providers[%d].jwksURL must be an http or https URL: %s", i, p.JWKSURL)
+		check(len(p.Rules) > 0, "auth.oidc.providers[%d].rules are required", i)
+		for j, r := range p.Rules {
+			check(len(r.Claims) > 0, "auth.oidc.providers[%d].rules[%d].claims are required", i, j)
+			check(r.Pattern != "", "auth.oidc.providers[%d].rules[%d].pattern is required", i, j)
+			check(r.Role == "reader" || r.Role == "writer" || r.Role == "maintainer", "auth.oidc.providers[%d].rules[%d].role must be reader, writer or maintainer: %s", i, j, r.Role)
+		}
+		providers[p.Name] = true
+	}
+	if l := c.Auth.LDAP; l.URL != "" {
+		check(strings.HasPrefix(l.URL, "ldap://") || strings.HasPrefix(l.URL, "ldaps://"), "auth.ldap.url must be an ldap or ldaps URL: %s", l.URL)
+		check(!l.StartTLS || strings.HasPrefix(l.URL, "ldap://"), "auth.ldap.startTLS requires an ldap URL")
+		check(l.UserBaseDN != "", "auth.ldap.userBaseDN is required")
+		check(strings.Count(l.UserFilter, "%s") == 1, "auth.ldap.userFilter must contain one %%s: %s", l.UserFilter)
+		check(l.GroupBaseDN != "" || len(l.GroupMappings) == 0, "auth.ldap.groupBaseDN is required for groupMappings")
+		check(strings.Count(l.GroupFilter, "%s") == 1, "auth.ldap.groupFilter must contain one %%s: %s", l.GroupFilter)
+		check(l.CacheTTL >= 0, "auth.ldap.cacheTTL must not be negative")
+		check(l.Timeout > 0, "auth.ldap.timeout must be positive")
+		for i, m := range l.GroupMappings {
+			check(m.Group != "", "auth.ldap.groupMappings[%d].group is required", i)
+			check(m.Team != "" || m.Role != "", "auth.ldap.groupMappings[%d] requires team or role", i)
+			check(m.Role == "" || m.Pattern != "", "auth.ldap.groupMappings[%d].pattern is required for role", i)
+			check(m.Role == "" || m.Role == "reader" || m.Role == "writer" || m.Role == "maintainer" || m.Role == "admin", "auth.ldap.groupMappings[%d].role must be reader, writer, maintainer or admin: %s", i, m.Role)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 空はエンドポイントを指定しないことを表す
+func validEndpoint(endpoint string) bool {
+	if endpoint == "" {
+		return true
+	}
+	u, err := url.Parse(endpoint)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		testName string
+		yaml     string
+		env      map[string]string
+		check    func(t *testing.T, c Config)
+		wantErr  string
+	}{
+		{
+			testName: "ファイルがなければ既定値とローカルのエンドポイント",
+			check: func(t *testing.T, c Config) {
+				if c.Server.Listen != ":8080" || c.Storage.Metadata.Endpoint != "http://localhost:8000" || !c.Storage.Blob.UsePathStyle {
+					t.Fatalf("unexpected config: %+v", c)
+				}
+				if !c.SchemaAutoCreate() || !c.SchemaAutoMigrate() {
+					t.Fatalf("schema should be managed automatically in local")
+				}
+				if c.Server.DebugVars {
+					t.Fatalf("debug vars must be disabled by default")
+				}
+			},
+		},
+		{
+			testName: "ファイルの値で上書きする",
+			yaml: `
+local: false
+storage:
+  blob:
+    bucket: prod-blob
+    region: us-east-1
+  metadata:
+    table: prod-metadata
+limits:
+  requestTimeout: 1m
+`,
+			check: func(t *testing.T, c Config) {
+				if c.Storage.Blob.Bucket != "prod-blob" || c.Storage.Blob.Region != "us-east-1" || c.Storage.Metadata.Table != "prod-metadata" {
+					t.Fatalf("unexpected storage: %+v", c.Storage)
+				}
+				if c.Storage.Blob.Endpoint != "" || c.Storage.Blob.UsePathStyle {
+					t.Fatalf("endpoint must be AWS when not local: %+v", c.Storage.Blob)
+				}
+				if c.Limits.RequestTimeout != time.Minute || c.Limits.TransferTimeout != 30*time.Minute {
+					t.Fatalf("unexpected limits: %+v", c.Limits)
+				}
+				if c.SchemaAutoCreate() || c.SchemaAutoMigrate() {
+					t.Fatalf("schema must not be managed automatically outside local")
+				}
+			},
+		},
+		{
+			testName: "環境変数はファイルより優先する",
+			yaml:     "storage:\n  metadata:\n    table: from-file\n",
+			env: map[string]string{
+				"IS_LOCAL":                           "false",
+				"METADATA_TABLE_NAME":                "from-env",
+				"SCHEMA_AUTO_MIGRATE":                "true",
+				"BLOB_REDIRECT_EXCLUDE_USER_AGENTS":  "containerd/, skopeo/",
+				"BLOB_REDIRECT_EXCLUDE_REPOSITORIES": "",
+			},
+			check: func(t *testing.T, c Config) {
+				if c.Local || c.Storage.Metadata.Table != "from-env" || !c.SchemaAutoMigrate() || c.SchemaAutoCreate() {
+					t.Fatalf("unexpected config: %+v", c)
+				}
+				got := c.BlobRedirect.ExcludeUserAgents
+				if len(got) != 2 || got[0] != "containerd/" || got[1] != "skopeo/" {
+					t.Fatalf("unexpected user agents: %v", got)
+				}
+			},
+		},
+		{
+			testName: "知らない項目",
+			yaml:     "server:\n  listn: :9090\n",
+			wantErr:  "field listn not found",
+		},
+		{
+			testName: "不正な環境変数",
+			env:      map[string]string{"REQUEST_TIMEOUT": "soon"},
+			wantErr:  "REQUEST_TIMEOUT is invalid: soon",
+		},
+		{
+			testName: "検証の誤りはまとめて返す",
+			yaml: `
+storage:
+  blob:
+    endpoint: localhost:9000
+cache:
+  blob:
+    maxBytes: 0
+    prefetch: true
+`,
+			wantErr: "storage.blob.endpoint must be an http or https URL: localhost:9000\ncache.blob.maxBytes must be positive\ncache.blob.prefetch requires cache.blob.dir",
+		},
+		{
+			testName: "トークン認証には署名の鍵が必要",
+			yaml: `
+local: false
+auth:
+  mode: token
+  accounts:
+    - name: ci
+      passwordHash: plain
+    - name: ci
+      passwordHash: $2y$05$abc
+`,
+			wantErr: "auth.token.signingKeyFile is required unless local\nauth.accounts[0].passwordHash must be a bcrypt hash\nauth.accounts[1].name is duplicated: ci",
+		},
+		{
+			testName: "TLS には証明書と鍵が必要",
+			yaml: `
+server:
+  tls:
+    clientCAFile: ca.pem
+    clientIdentity: serialNumber
+`,
+			wantErr: "server.tls.certFile and server.tls.keyFile are required for TLS\nserver.tls.clientIdentity must be commonName, dnsName, email or uri: serialNumber",
+		},
+		{
+			testName: "OIDC のプロバイダー",
+			yaml: `
+auth:
+  oidc:
+    providers:
+      - name: github
+        issuer: https://token.actions.githubusercontent.com
+        rules:
+          - claims:
+              repository: org/*
+            pattern: ${repository}
+            role: admin
+`,
+			wantErr: "auth.oidc.providers[0].audience is required\nauth.oidc.providers[0].rules[0].role must be reader, writer or maintainer: admin",
+		},
+		{
+			testName: "LDAP のグループの対応づけ",
+			yaml: `
+auth:
+  ldap:
+    url: ldap://localhost:1389
+    userBaseDN: ou=people,dc=example,dc=org
+    userFilter: (uid=*)
+    groupBaseDN: ou=groups,dc=example,dc=org
+    groupMappings:
+      - group: developers
+      - group: registry-admins
+        role: admin
+`,
+			wantErr: "auth.ldap.userFilter must contain one %s: (uid=*)\nauth.ldap.groupMappings[0] requires team or role\nauth.ldap.groupMappings[1].pattern is required for role",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			for _, o := range envOverrides(&Config{}) {
+				t.Setenv(o.key, "")
+				os.Unsetenv(o.key)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if tt.yaml != "" {
+				path = filepath.Join(t.TempDir(), "config.yaml")
+				err := os.WriteFile(path, []byte(tt.yaml), 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err is %v, but want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func TestValidateDefault(t *testing.T) {
+	c := Default()
+	c.Local = false
+	err := c.Validate()
+	if err != nil {
+		t.Fatalf("default config must be valid: %v", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := Default()
+	c.Auth.LDAP.BindPassword = "secret"
+	c.Auth.Accounts = []AccountConfig{{Name: "alice", PasswordHash: "$2y$10$hash"}}
+
+	got := c.Redacted()
+	if got.Auth.LDAP.BindPassword != redacted || got.Auth.Accounts[0].PasswordHash != redacted || got.Auth.Accounts[0].Name != "alice" {
+		t.Fatalf("secrets are not redacted: %+v", got.Auth)
+	}
+	// 元の設定は変えない
+	if c.Auth.LDAP.BindPassword != "secret" || c.Auth.Accounts[0].PasswordHash != "$2y$10$hash" {
+		t.Fatalf("original config is modified: %+v", c.Auth)
+	}
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 設定ファイルの項目を上書きする環境変数。ECS のタスク定義ではこちらで指定する
+func envOverrides(c *Config) []struct {
+	key   string
+	apply func(v string) error
+} {
+	return []struct {
+		key   string
+		apply func(v string) error
+	}{
+		{"IS_LOCAL", boolValue(&c.Local)},
+		{"LISTEN_ADDRESS", stringValue(&c.Server.Listen)},
+		{"SHUTDOWN_GRACE_PERIOD", durationValue(&c.Server.ShutdownGracePeriod)},
+		{"DEBUG_VARS_ENABLED", boolValue(&c.Server.DebugVars)},
+		{"BLOB_STORAGE_NAME", stringValue(&c.Storage.Blob.Bucket)},
+		{"BLOB_STORAGE_REGION", stringValue(&c.Storage.Blob.Region)},
+		{"BLOB_STORAGE_ENDPOINT", stringValue(&c.Storage.Blob.Endpoint)},
+		{"BLOB_STORAGE_USE_PATH_STYLE", boolValue(&c.Storage.Blob.UsePathStyle)},
+		{"METADATA_TABLE_NAME", stringValue(&c.Storage.Metadata.Table)},
+		{"METADATA_TABLE_REGION", stringValue(&c.Storage.Metadata.Region)},
+		{"METADATA_TABLE_ENDPOINT", stringValue(&c.Storage.Metadata.Endpoint)},
+		{"MANIFEST_TABLE_NAME", stringValue(&c.Storage.Metadata.LegacyTables.Manifest)},
+		{"TAG_TABLE_NAME", stringValue(&c.Storage.Metadata.LegacyTables.Tag)},
+		{"REPOSITORY_TABLE_NAME", stringValue(&c.Storage.Metadata.LegacyTables.Repository)},
+		{"BLOB_METADATA_TABLE_NAME", stringValue(&c.Storage.Metadata.LegacyTables.BlobMetadata)},
+		{"BLOB_UPLOAD_PROGRESS_TABLE_NAME", stringValue(&c.Storage.Metadata.LegacyTables.BlobUploadProgress)},
+		{"SCHEMA_AUTO_CREATE", boolPointerValue(&c.Schema.AutoCreate)},
+		{"SCHEMA_AUTO_MIGRATE", boolPointerValue(&c.Schema.AutoMigrate)},
+		{"REQUEST_TIMEOUT", durationValue(&c.Limits.RequestTimeout)},
+		{"TRANSFER_TIMEOUT", durationValue(&c.Limits.TransferTimeout)},
+		{"MANIFEST_INLINE_LIMIT", intValue(&c.Limits.ManifestInlineLimit)},
+		{"BLOB_CACHE_DIR", stringValue(&c.Cache.Blob.Dir)},
+		{"BLOB_CACHE_MAX_BYTES", int64Value(&c.Cache.Blob.MaxBytes)},
+		{"BLOB_CACHE_PREFETCH", boolValue(&c.Cache.Blob.Prefetch)},
+		{"MANIFEST_CACHE_ENABLED", boolValue(&c.Cache.Manifest.Enabled)},
+		{"MANIFEST_CACHE_TAG_TTL", durationValue(&c.Cache.Manifest.TagTTL)},
+		{"BLOB_REDIRECT_ENABLED", boolValue(&c.BlobRedirect.Enabled)},
+		{"BLOB_REDIRECT_EXPIRES", durationValue(&c.BlobRedirect.Expires)},
+		{"BLOB_REDIRECT_EXCLUDE_REPOSITORIES", listValue(&c.BlobRedirect.ExcludeRepositories)},
+		{"BLOB_REDIRECT_EXCLUDE_USER_AGENTS", listValue(&c.BlobRedirect.ExcludeUserAgents)},
+		{"AUTH_MODE", stringValue(&c.Auth.Mode)},
+		{"AUTH_TOKEN_REALM", stringValue(&c.Auth.Token.Realm)},
+		{"AUTH_TOKEN_SERVICE", stringValue(&c.Auth.Token.Service)},
+		{"AUTH_TOKEN_ISSUER", stringValue(&c.Auth.Token.Issuer)},
+		{"AUTH_TOKEN_SIGNING_KEY_FILE", stringValue(&c.Auth.Token.SigningKeyFile)},
+		{"AUTH_TOKEN_EXPIRATION", durationValue(&c.Auth.Token.Expiration)},
+		{"AUTH_HTPASSWD_FILE", stringValue(&c.Auth.Htpasswd.File)},
+		{"AUTH_HTPASSWD_RELOAD_INTERVAL", durationValue(&c.Auth.Htpasswd.ReloadInterval)},
+		{"AUTH_ADMINS", listValue(&c.Auth.Admins)},
+		{"AUTH_GRANT_CACHE_TTL", durationValue(&c.Auth.GrantCacheTTL)},
+		{"AUTH_ROBOT_SECRET_TTL", durationValue(&c.Auth.RobotSecretTTL)},
+		{"AUTH_PULL_LINK_DEFAULT_TTL", durationValue(&c.Auth.PullLink.DefaultTTL)},
+		{"AUTH_PULL_LINK_MAX_TTL", durationValue(&c.Auth.PullLink.MaxTTL)},
+		{"TLS_CERT_FILE", stringValue(&c.Server.TLS.CertFile)},
+		{"TLS_KEY_FILE", stringValue(&c.Server.TLS.KeyFile)},
+		{"TLS_CLIENT_CA_FILE", stringValue(&c.Server.TLS.ClientCAFile)},
+		{"AUTH_LDAP_URL", stringValue(&c.Auth.LDAP.URL)},
+		{"AUTH_LDAP_BIND_DN", stringValue(&c.Auth.LDAP.BindDN)},
+		{"AUTH_LDAP_BIND_PASSWORD", stringValue(&c.Auth.LDAP.BindPassword)},
+	}
+}
+
+// 空でない環境変数で c を上書きする。lookup は os.LookupEnv
+func applyEnv(c *Config, lookup func(key string) (string, bool)) error {
+	var errs []error
+	for _, o := range envOverrides(c) {
+		v, ok := lookup(o.key)
+		if !ok || v == "" {
+			continue
+		}
+		err := o.apply(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s is invalid: %s", o.key, v))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func stringValue(p *string) func(string) error {
+	return func(v string) error {
+		*p = v
+		return nil
+	}
+}
+
+func boolValue(p *bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		*p = b
+		return err
+	}
+}
+
+func boolPointerValue(p **bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		*p = &b
+		return err
+	}
+}
+
+func intValue(p *int) func(string) error {
+	return func(v string) error {
+		i, err := strconv.Atoi(v)
+		*p = i
+		return err
+	}
+}
+
+func int64Value(p *int64) func(string) error {
+	return func(v string) error {
+		i, err := strconv.ParseInt(v, 10, 64)
+		*p = i
+		return err
+	}
+}
+
+func durationValue(p *time.Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		*p = d
+		return err
+	}
+}
+
+// カンマ区切りの値を分割する
+func listValue(p *[]string) func(string) error {
+	return func(v string) error {
+		var values []string
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+		*p = values
+		return nil
+	}
+}
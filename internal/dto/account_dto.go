@@ -0,0 +1,64 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+// POST /admin/users のリクエスト。パスワードを省略するとサーバーで作る
+type CreateUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// POST /admin/robots のリクエスト
+type CreateRobotRequest struct {
+	Name string `json:"name"`
+	// ロボットアカウントに与える役割。ロボットへの権限の付与として保存する
+	Grants []RobotGrant `json:"grants"`
+	// シークレットの有効期間 (例: 720h)。省略すると設定の既定値
+	ExpiresIn string `json:"expiresIn"`
+}
+
+type RobotGrant struct {
+	Pattern string `json:"pattern"`
+	Role    string `json:"role"`
+}
+
+// POST /admin/robots/:name/rotate のリクエスト
+type RotateSecretRequest struct {
+	ExpiresIn string `json:"expiresIn"`
+}
+
+// POST /admin/teams のリクエスト
+type CreateTeamRequest struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// PUT /admin/teams/:name/members のリクエスト
+type UpdateTeamMembersRequest struct {
+	Members []string `json:"members"`
+}
+
+type FindAccountInput struct {
+	Kind string
+	Name string
+}
+
+type TouchAccountInput struct {
+	Kind   string
+	Name   string
+	UsedAt time.Time
+}
+
+type DeleteTeamInput struct {
+	Name string
+}
+
+// 作成やローテーションで作ったシークレット。このときにしか返さない
+type AccountSecretOutput struct {
+	Account model.Account
+	Secret  string
+}
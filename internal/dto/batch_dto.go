@@ -0,0 +1,57 @@
+package dto
+
+// POST /v2/_tcr/batch のリクエスト
+type BatchRequest struct {
+	Blobs      []BatchBlobsRequest `json:"blobs"`
+	References []string            `json:"references"`
+}
+
+type BatchBlobsRequest struct {
+	Name    string   `json:"name"`
+	Digests []string `json:"digests"`
+}
+
+// POST /v2/_tcr/batch のレスポンス。リクエストと同じ順番で返す
+type BatchResponse struct {
+	Blobs      []BatchBlobResult      `json:"blobs"`
+	References []BatchReferenceResult `json:"references"`
+}
+
+type BatchBlobResult struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+	Exists bool   `json:"exists"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+type BatchReferenceResult struct {
+	Reference string `json:"reference"`
+	Exists    bool   `json:"exists"`
+	Digest    string `json:"digest,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+}
+
+type BatchFindBlobMetadataInput struct {
+	Keys []FindBlobMetadataInput
+}
+
+// 見つからなかったものは含まれない
+type BatchFindBlobMetadataOutput struct {
+	Items []FindBlobMetadataOutput
+}
+
+type ResolveReferencesInput struct {
+	References []FindManifestInput
+}
+
+// 見つからなかったものは含まれない
+type ResolveReferencesOutput struct {
+	Items []ResolvedReference
+}
+
+type ResolvedReference struct {
+	Name      string
+	Reference string
+	Digest    string
+	Size      int64
+}
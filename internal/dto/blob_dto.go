@@ -1,12 +1,15 @@
 package dto
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 type ExistsBlobInput struct {
-	Name   string
 	Digest string
 }
 
+// blob の実体は digest だけで特定できる。Name は移行前の blob を探すときにだけ使われる
 type FindBlobInput struct {
 	Name   string
 	Digest string
@@ -23,11 +26,17 @@ type FindBlobOutput struct {
 }
 
 type SaveBlobInput struct {
-	Name   string
 	Digest string
 	Blob   io.Reader
 }
 
+type DeleteChunkedBlobsInput struct {
+	Name string
+	Uuid string
+	// 削除するチャンクの数。0 から ChunkNums-1 までのチャンクを削除する
+	ChunkNums int
+}
+
 type SaveChunkedBlobInput struct {
 	Name       string
 	Uuid       string
@@ -40,12 +49,30 @@ type DeleteBlobInput struct {
 	Digest string
 }
 
+type PresignBlobURLInput struct {
+	Digest  string
+	Expires time.Duration
+}
+
+type PrefetchBlobsInput struct {
+	Name    string
+	Digests []string
+}
+
+type MountBlobInput struct {
+	Name     string
+	Digest   string
+	From     string
+	Uploader string
+}
+
 type UploadMonolithicBlobInput struct {
 	Name          string
 	Uuid          string
 	Digest        string
 	ContentLength int64
 	ContentType   string
+	Uploader      string
 	Blob          io.ReadCloser
 }
 
@@ -58,13 +85,16 @@ type UploadChunkedBlobInput struct {
 	Key           string
 	Digest        string
 	IsLast        bool
+	Uploader      string
 	Blob          io.ReadCloser
 }
 
 type BlobUploadProgress struct {
 	Uuid         string `json:"Uuid"`
+	Name         string `json:"Name"`
 	ByteUploaded int64  `json:"ByteUploaded"`
 	NextChunkNo  int    `json:"NextChunkNo"`
 	Done         bool   `json:"Done"`
 	Digest       string `json:"Digest"`
+	Version      int64  `json:"Version"`
 }
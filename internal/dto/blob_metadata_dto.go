@@ -0,0 +1,41 @@
+package dto
+
+type FindBlobMetadataInput struct {
+	Name   string
+	Digest string
+}
+
+// リポジトリからリンクされていない場合は Digest が空になる
+type FindBlobMetadataOutput struct {
+	Name      string
+	Digest    string
+	Size      int64
+	MediaType string
+	PushedAt  string
+	Uploader  string
+}
+
+type FindBlobContentMetadataInput struct {
+	Digest string
+}
+
+type SaveBlobMetadataInput struct {
+	Name      string
+	Digest    string
+	Size      int64
+	MediaType string
+	Uploader  string
+}
+
+type ListBlobLinksInput struct {
+	Digest string
+}
+
+type ListBlobLinksOutput struct {
+	Names []string
+}
+
+type DeleteBlobLinkInput struct {
+	Name   string
+	Digest string
+}
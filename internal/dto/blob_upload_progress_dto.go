@@ -4,18 +4,26 @@ type FindBlobUploadProgressInput struct {
 	Uuid string
 }
 
+// Name はアップロードを開始したリポジトリ
 type FindBlobUploadProgressOutput struct {
 	Uuid         string
+	Name         string
 	ByteUploaded int64
 	NextChunkNo  int
 	Digest       string
+	Version      int64
 }
 
+// Version には読み出したときの Version を指定する。
+// 永続化層はその Version から更新されていない場合に限り Version+1 として保存する。
+// 新規作成時は 0 を指定する
 type SaveBlobUploadProgressInput struct {
 	Uuid         string
+	Name         string
 	ByteUploaded int64
 	NextChunkNo  int
 	Digest       string
+	Version      int64
 }
 
 type DeleteBlobUploadProgressInput struct {
@@ -0,0 +1,13 @@
+package dto
+
+// POST /admin/grants のリクエスト
+type CreateGrantRequest struct {
+	SubjectType string `json:"subjectType"`
+	Subject     string `json:"subject"`
+	Pattern     string `json:"pattern"`
+	Role        string `json:"role"`
+}
+
+type DeleteGrantInput struct {
+	ID string
+}
@@ -7,11 +7,34 @@ type GetTagsResponse struct {
 	Tags []string `json:"tags"`
 }
 
+// Raw は push されたままのマニフェスト。レスポンスにはこちらを返す
 type GetManifestResponse struct {
 	Manifest model.Manifest
+	Raw      []byte
 	Digest   string
 }
 
+// Subject はマニフェストが subject を持つ場合だけ入る
+type PutManifestResponse struct {
+	Digest  string
+	Subject string
+}
+
+// GET /v2/<name>/referrers/<digest> のレスポンス。OCI の image index の形をしている
+type GetReferrersResponse struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Manifests     []ReferrerDescriptor `json:"manifests"`
+}
+
+type ReferrerDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
 type ExistsManifestInput struct {
 	Name      string
 	Reference string
@@ -30,14 +53,31 @@ type FindManifestOutput struct {
 	Manifest []byte
 }
 
+// MediaType 以降は referrers API で返すために、マニフェストの中身から取り出しておく。
+// Subject はマニフェストが subject を持たない場合は空
 type SaveManifestInput struct {
-	Name     string
-	Tag      string
-	Digest   string
-	Manifest []byte
+	Name         string
+	Tag          string
+	Digest       string
+	Manifest     []byte
+	MediaType    string
+	ArtifactType string
+	Subject      string
+	Annotations  map[string]string
 }
 
 type DeleteManifestInput struct {
 	Name      string
 	Reference string
 }
+
+// ArtifactType が空でなければ、その artifactType を持つものだけを返す
+type ListReferrersInput struct {
+	Name         string
+	Digest       string
+	ArtifactType string
+}
+
+type ListReferrersOutput struct {
+	Descriptors []model.Descriptor
+}
@@ -0,0 +1,32 @@
+package dto
+
+import "github.com/a-takamin/tcr/internal/model"
+
+// POST /admin/pull-links のリクエスト
+type CreatePullLinkRequest struct {
+	Repository string `json:"repository"`
+	// 省略するとリポジトリのすべてのマニフェストを pull できる
+	Digest string `json:"digest"`
+	// 有効期間 (例: 24h)。省略すると設定の既定値
+	ExpiresIn   string `json:"expiresIn"`
+	Description string `json:"description"`
+}
+
+// トークンは作成したときにだけ返す
+type PullLinkTokenOutput struct {
+	Link  model.PullLink
+	Token string
+}
+
+type FindPullLinkInput struct {
+	ID string
+}
+
+type RevokePullLinkInput struct {
+	ID        string
+	RevokedBy string
+}
+
+type ListPullLinkUsesInput struct {
+	ID string
+}
@@ -1,5 +1,7 @@
 package dto
 
+import "github.com/a-takamin/tcr/internal/model"
+
 type ExistsRepositoryInput struct {
 	Name string
 }
@@ -12,6 +14,28 @@ type SaveRepositoryInput struct {
 	Name string
 }
 
+type SetRepositoryVisibilityInput struct {
+	Name       string
+	Visibility string
+}
+
+type SetRepositoryVisibilityRequest struct {
+	Visibility string `json:"visibility"`
+}
+
 type DeleteRepositoryInput struct {
 	Name string
 }
+
+// Last より後ろのリポジトリを名前順に最大 N 件取得する
+type ListRepositoriesInput struct {
+	N    int
+	Last string
+}
+
+// 続きがない場合は Next が空になる。Repositories は Names と同じ順で公開範囲を持つ
+type ListRepositoriesOutput struct {
+	Names        []string
+	Repositories []model.Repository
+	Next         string
+}
@@ -0,0 +1,24 @@
+package dto
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+type IssueTokenInput struct {
+	// 資格情報がなければ匿名のトークンを発行する
+	HasCredentials bool
+	Username       string
+	Password       string
+	// TLS で検証済みのクライアント証明書。資格情報がない場合に使う
+	Certificate *x509.Certificate
+	Service     string
+	// クエリの scope をそのまま渡す。1 つの値に空白区切りで複数のスコープを書ける
+	Scopes []string
+}
+
+type IssueTokenOutput struct {
+	Token     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/a-takamin/tcr/internal/service/usecase"
+	"github.com/gin-gonic/gin"
+)
+
+// 権限とアカウントを管理する API。/v2 の外の /admin に置く
+type AdminHandler struct {
+	usecase        *usecase.AccessUseCase
+	accountUsecase *usecase.AccountUseCase
+	// nil なら pull link の API を置かない
+	pullLinkUsecase *usecase.PullLinkUseCase
+}
+
+func NewAdminHandler(u *usecase.AccessUseCase, au *usecase.AccountUseCase, plu *usecase.PullLinkUseCase) *AdminHandler {
+	return &AdminHandler{
+		usecase:         u,
+		accountUsecase:  au,
+		pullLinkUsecase: plu,
+	}
+}
+
+// g は AdminMiddleware を通したグループ
+func (h *AdminHandler) RegisterRoutes(g *gin.RouterGroup) {
+	g.GET("/grants", h.ListGrantsHandler)
+	g.POST("/grants", h.CreateGrantHandler)
+	g.DELETE("/grants/:id", h.DeleteGrantHandler)
+
+	g.GET("/users", func(c *gin.Context) { h.ListAccountsHandler(c, auth.KindUser) })
+	g.POST("/users", h.CreateUserHandler)
+	g.POST("/users/:name/rotate", func(c *gin.Context) { h.RotateSecretHandler(c, auth.KindUser) })
+	g.POST("/users/:name/disable", func(c *gin.Context) { h.SetDisabledHandler(c, auth.KindUser, true) })
+	g.POST("/users/:name/enable", func(c *gin.Context) { h.SetDisabledHandler(c, auth.KindUser, false) })
+
+	g.GET("/robots", func(c *gin.Context) { h.ListAccountsHandler(c, auth.KindRobot) })
+	g.POST("/robots", h.CreateRobotHandler)
+	g.POST("/robots/:name/rotate", func(c *gin.Context) { h.RotateSecretHandler(c, auth.KindRobot) })
+	g.POST("/robots/:name/disable", func(c *gin.Context) { h.SetDisabledHandler(c, auth.KindRobot, true) })
+	g.POST("/robots/:name/enable", func(c *gin.Context) { h.SetDisabledHandler(c, auth.KindRobot, false) })
+
+	g.GET("/teams", h.ListTeamsHandler)
+	g.POST("/teams", h.CreateTeamHandler)
+	g.PUT("/teams/:name/members", h.UpdateTeamMembersHandler)
+	g.DELETE("/teams/:name", h.DeleteTeamHandler)
+
+	// リポジトリ名は / を含むので、残りのパスをすべて名前として扱う
+	g.GET("/repositories/*name", h.GetVisibilityHandler)
+	g.PUT("/repositories/*name", h.SetVisibilityHandler)
+
+	if h.pullLinkUsecase != nil {
+		g.GET("/pull-links", h.ListPullLinksHandler)
+		g.POST("/pull-links", h.CreatePullLinkHandler)
+		g.POST("/pull-links/:id/revoke", h.RevokePullLinkHandler)
+		g.GET("/pull-links/:id/uses", h.ListPullLinkUsesHandler)
+	}
+}
+
+// /admin 以下のリクエストの送り主を確かめる。管理者かどうかはユースケースでも判定する
+func AdminMiddleware(authorizer RequestAuthorizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizer.Authorize(c, []auth.Access{auth.AdminAccess}) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+type grantsResponse struct {
+	Grants []model.Grant `json:"grants"`
+}
+
+// GET /admin/grants
+func (h *AdminHandler) ListGrantsHandler(c *gin.Context) {
+	grants, err := h.usecase.ListGrants(c.Request.Context())
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if grants == nil {
+		grants = []model.Grant{}
+	}
+	c.JSON(http.StatusOK, grantsResponse{Grants: grants})
+}
+
+// POST /admin/grants
+func (h *AdminHandler) CreateGrantHandler(c *gin.Context) {
+	var req dto.CreateGrantRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		writeError(c, apperrors.TCRERR_GRANT_INVALID.Wrap(err))
+		return
+	}
+	grant, err := h.usecase.CreateGrant(c.Request.Context(), req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, grant)
+}
+
+// DELETE /admin/grants/:id
+func (h *AdminHandler) DeleteGrantHandler(c *gin.Context) {
+	err := h.usecase.DeleteGrant(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GET /admin/repositories/<name>
+func (h *AdminHandler) GetVisibilityHandler(c *gin.Context) {
+	repo, err := h.usecase.GetVisibility(c.Request.Context(), strings.TrimPrefix(c.Param("name"), "/"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, repo)
+}
+
+// PUT /admin/repositories/<name>
+func (h *AdminHandler) SetVisibilityHandler(c *gin.Context) {
+	var req dto.SetRepositoryVisibilityRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		writeError(c, apperrors.TCRERR_REQUEST_INVALID.Wrap(err))
+		return
+	}
+	repo, err := h.usecase.SetVisibility(c.Request.Context(), strings.TrimPrefix(c.Param("name"), "/"), req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, repo)
+}
+
+type accountsResponse struct {
+	Accounts []model.Account `json:"accounts"`
+}
+
+// シークレットは作成とローテーションのときにだけ返す
+type accountSecretResponse struct {
+	Account model.Account `json:"account"`
+	// 認証に使うユーザー名。ロボットアカウントは robot$<name>
+	Username string `json:"username"`
+	Secret   string `json:"secret,omitempty"`
+}
+
+func newAccountSecretResponse(out dto.AccountSecretOutput) accountSecretResponse {
+	username := out.Account.Name
+	if out.Account.Kind == auth.KindRobot {
+		username = auth.RobotPrefix + username
+	}
+	return accountSecretResponse{Account: out.Account, Username: username, Secret: out.Secret}
+}
+
+// GET /admin/users, GET /admin/robots
+func (h *AdminHandler) ListAccountsHandler(c *gin.Context, kind string) {
+	accounts, err := h.accountUsecase.ListAccounts(c.Request.Context(), kind)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if accounts == nil {
+		accounts = []model.Account{}
+	}
+	c.JSON(http.StatusOK, accountsResponse{Accounts: accounts})
+}
+
+// POST /admin/users
+func (h *AdminHandler) CreateUserHandler(c *gin.Context) {
+	var req dto.CreateUserRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		writeError(c, apperrors.TCRERR_ACCOUNT_INVALID.Wrap(err))
+		return
+	}
+	out, err := h.accountUsecase.CreateUser(c.Request.Context(), req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, newAccountSecretResponse(out))
+}
+
+// POST /admin/robots
+func (h *AdminHandler) CreateRobotHandler(c *gin.Context) {
+	var req dto.CreateRobotRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		writeError(c, apperrors.TCRERR_ACCOUNT_INVALID.Wrap(err))
+		return
+	}
+	out, err := h.accountUsecase.CreateRobot(c.Request.Context(), req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, newAccountSecretResponse(out))
+}
+
+// POST /admin/users/:name/rotate, POST /admin/robots/:name/rotate
+//
+// 本文は省略できる
+func (h *AdminHandler) RotateSecretHandler(c *gin.Context, kind string) {
+	var req dto.RotateSecretRequest
+	if c.Request.ContentLength != 0 {
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			writeError(c, apperrors.TCRERR_ACCOUNT_INVALID.Wrap(err))
+			return
+		}
+	}
+	out, err := h.accountUsecase.RotateSecret(c.Request.Context(), kind, c.Param("name"), req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newAccountSecretResponse(out))
+}
+
+// POST /admin/users/:name/disable など
+func (h *AdminHandler) SetDisabledHandler(c *gin.Context, kind string, disabled bool) {
+	account, err := h.accountUsecase.SetDisabled(c.Request.Context(), kind, c.Param("name"), disabled)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, account)
+}
+
+type teamsResponse struct {
+	Teams []model.Team `json:"teams"`
+}
+
+// GET /admin/teams
+func (h *AdminHandler) ListTeamsHandler(c *gin.Context) {
+	teams, err := h.accountUsecase.ListTeams(c.Request.Context())
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if teams == nil {
+		teams = []model.Team{}
+	}
+	c.JSON(http.StatusOK, teamsResponse{Teams: teams})
+}
+
+// POST /admin/teams
+func (h *AdminHandler) CreateTeamHandler(c *gin.Context) {
+	var req dto.CreateTeamRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		writeError(c, apperrors.TCRERR_TEAM_INVALID.Wrap(err))
+		return
+	}
+	team, err := h.accountUsecase.CreateTeam(c.Request.Context(), req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, team)
+}
+
+// PUT /admin/teams/:name/members
+func (h *AdminHandler) UpdateTeamMembersHandler(c *gin.Context) {
+	var req dto.UpdateTeamMembersRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		writeError(c, apperrors.TCRERR_TEAM_INVALID.Wrap(err))
+		return
+	}
+	team, err := h.accountUsecase.UpdateTeamMembers(c.Request.Context(), c.Param("name"), req.Members)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, team)
+}
+
+// DELETE /admin/teams/:name
+func (h *AdminHandler) DeleteTeamHandler(c *gin.Context) {
+	err := h.accountUsecase.DeleteTeam(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type pullLinksResponse struct {
+	PullLinks []model.PullLink `json:"pullLinks"`
+}
+
+// トークンは作成したときにだけ返す
+type pullLinkTokenResponse struct {
+	PullLink model.PullLink `json:"pullLink"`
+	Token    string         `json:"token"`
+}
+
+type pullLinkUsesResponse struct {
+	Uses []model.PullLinkUse `json:"uses"`
+}
+
+// GET /admin/pull-links
+func (h *AdminHandler) ListPullLinksHandler(c *gin.Context) {
+	links, err := h.pullLinkUsecase.ListPullLinks(c.Request.Context())
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if links == nil {
+		links = []model.PullLink{}
+	}
+	c.JSON(http.StatusOK, pullLinksResponse{PullLinks: links})
+}
+
+// POST /admin/pull-links
+func (h *AdminHandler) CreatePullLinkHandler(c *gin.Context) {
+	var req dto.CreatePullLinkRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		writeError(c, apperrors.TCRERR_PULL_LINK_INVALID.Wrap(err))
+		return
+	}
+	out, err := h.pullLinkUsecase.CreatePullLink(c.Request.Context(), req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, pullLinkTokenResponse{PullLink: out.Link, Token: out.Token})
+}
+
+// POST /admin/pull-links/:id/revoke
+func (h *AdminHandler) RevokePullLinkHandler(c *gin.Context) {
+	link, err := h.pullLinkUsecase.RevokePullLink(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, link)
+}
+
+// GET /admin/pull-links/:id/uses
+func (h *AdminHandler) ListPullLinkUsesHandler(c *gin.Context) {
+	uses, err := h.pullLinkUsecase.ListPullLinkUses(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if uses == nil {
+		uses = []model.PullLinkUse{}
+	}
+	c.JSON(http.StatusOK, pullLinkUsesResponse{Uses: uses})
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// Router がハンドラーを呼ぶ前にリクエストの送り主を確かめる。
+// 認証できれば送り主をリクエストの context に入れて true を返し、できなければレスポンスを書いて false を返す
+type RequestAuthorizer interface {
+	Authorize(c *gin.Context, required []auth.Access) bool
+}
+
+// Docker のトークン認証。トークンがないか、必要な操作が許可されていなければ
+// トークンを取得する場所を WWW-Authenticate で伝える
+type TokenAuthorizer struct {
+	verifier TokenVerifier
+	// nil なら pull link のトークンを受け付けない
+	links PullLinkVerifier
+	// トークンを発行する URL
+	realm   string
+	service string
+}
+
+type TokenVerifier interface {
+	Verify(token string) (auth.Principal, error)
+}
+
+// pull link のトークンを Bearer でそのまま使えるようにする。
+// 取り消されていなければ送り主を返し、使えないトークンなら auth.ErrInvalidToken を返す
+type PullLinkVerifier interface {
+	VerifyPullLink(ctx context.Context, token string) (auth.Principal, error)
+}
+
+func NewTokenAuthorizer(verifier TokenVerifier, links PullLinkVerifier, realm, service string) *TokenAuthorizer {
+	return &TokenAuthorizer{
+		verifier: verifier,
+		links:    links,
+		realm:    realm,
+		service:  service,
+	}
+}
+
+func (a *TokenAuthorizer) Authorize(c *gin.Context, required []auth.Access) bool {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		a.challenge(c, required, "")
+		writeError(c, apperrors.TCRERR_UNAUTHORIZED)
+		return false
+	}
+	principal, err := a.verifier.Verify(token)
+	if err != nil && a.links != nil {
+		ctx := auth.WithClient(c.Request.Context(), requestClient(c))
+		principal, err = a.links.VerifyPullLink(ctx, token)
+		if err != nil && !errors.Is(err, auth.ErrInvalidToken) {
+			writeError(c, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err))
+			return false
+		}
+	}
+	if err != nil {
+		a.challenge(c, required, "invalid_token")
+		writeError(c, apperrors.TCRERR_UNAUTHORIZED.Wrap(err))
+		return false
+	}
+	for _, r := range required {
+		if !auth.Allows(principal.Access, r) {
+			a.challenge(c, required, "insufficient_scope")
+			writeError(c, apperrors.TCRERR_UNAUTHORIZED.WithDetail("insufficient scope: "+r.String()))
+			return false
+		}
+	}
+	c.Request = c.Request.WithContext(auth.WithPrincipal(c.Request.Context(), principal))
+	return true
+}
+
+func (a *TokenAuthorizer) challenge(c *gin.Context, required []auth.Access, errorCode string) {
+	params := fmt.Sprintf(`Bearer realm=%q,service=%q`, a.realm, a.service)
+	if len(required) > 0 {
+		scopes := make([]string, 0, len(required))
+		for _, r := range required {
+			scopes = append(scopes, r.String())
+		}
+		params += fmt.Sprintf(`,scope=%q`, strings.Join(scopes, " "))
+	}
+	if errorCode != "" {
+		params += fmt.Sprintf(`,error=%q`, errorCode)
+	}
+	c.Header("WWW-Authenticate", params)
+}
+
+// HTTP の Basic 認証。docker login は WWW-Authenticate の Basic を見て資格情報を送る。
+// certs が nil でなければ、資格情報のないリクエストはクライアント証明書で認証する
+type BasicAuthorizer struct {
+	authenticator auth.Authenticator
+	certs         *auth.CertificateAuthenticator
+	realm         string
+}
+
+func NewBasicAuthorizer(authenticator auth.Authenticator, certs *auth.CertificateAuthenticator, realm string) *BasicAuthorizer {
+	return &BasicAuthorizer{
+		authenticator: authenticator,
+		certs:         certs,
+		realm:         realm,
+	}
+}
+
+// 認証だけを行う。リポジトリごとの操作はユースケースで役割に基づいて判定する
+func (a *BasicAuthorizer) Authorize(c *gin.Context, required []auth.Access) bool {
+	username, password, ok := c.Request.BasicAuth()
+	if cert := clientCertificate(c); !ok && cert != nil && a.certs != nil {
+		principal, err := a.certs.AuthenticateCertificate(c.Request.Context(), cert)
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			writeError(c, apperrors.TCRERR_UNAUTHORIZED.Wrap(err))
+			return false
+		}
+		if err != nil {
+			writeError(c, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err))
+			return false
+		}
+		c.Request = c.Request.WithContext(auth.WithPrincipal(c.Request.Context(), principal))
+		return true
+	}
+	if !ok {
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, a.realm))
+		writeError(c, apperrors.TCRERR_UNAUTHORIZED)
+		return false
+	}
+	principal, err := a.authenticator.Authenticate(c.Request.Context(), username, password)
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, a.realm))
+		writeError(c, apperrors.TCRERR_UNAUTHORIZED.Wrap(err))
+		return false
+	}
+	if err != nil {
+		writeError(c, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err))
+		return false
+	}
+	c.Request = c.Request.WithContext(auth.WithPrincipal(c.Request.Context(), principal))
+	return true
+}
+
+// TLS のハンドシェイクで検証されたクライアント証明書。なければ nil
+func clientCertificate(c *gin.Context) *x509.Certificate {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 || len(c.Request.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return c.Request.TLS.VerifiedChains[0][0]
+}
+
+// pull link が使われたときに記録する
+func requestClient(c *gin.Context) auth.Client {
+	return auth.Client{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+}
+
+// route への method のリクエストに必要な操作。
+// 空なら認証されていればよく、リポジトリごとの判定はユースケースで行う
+func requiredAccess(route Route, c *gin.Context) []auth.Access {
+	switch route.Kind {
+	case RouteBase, RouteExtension:
+		return nil
+	case RouteCatalog:
+		return []auth.Access{auth.CatalogAccess}
+	case RouteBlobUploads, RouteBlobUpload:
+		// マウントの元のリポジトリを pull できなければ、ユースケースが通常のアップロードに切り替える
+		return []auth.Access{auth.RepositoryAccess(route.Name, auth.ActionPush)}
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		return []auth.Access{auth.RepositoryAccess(route.Name, auth.ActionPull)}
+	case http.MethodDelete:
+		return []auth.Access{auth.RepositoryAccess(route.Name, auth.ActionDelete)}
+	}
+	return []auth.Access{auth.RepositoryAccess(route.Name, auth.ActionPush)}
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func TestTokenAuthorizer(t *testing.T) {
+	key, err := auth.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := auth.NewTokenIssuer(key, "tcr", "tcr", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(access ...auth.Access) string {
+		token, _, err := issuer.Issue(auth.Principal{Subject: "alice"}, access, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + token
+	}
+	a := NewTokenAuthorizer(issuer, nil, "https://registry.example.com/token", "tcr")
+
+	tests := []struct {
+		testName      string
+		method        string
+		path          string
+		authorization string
+		want          bool
+		wantChallenge string
+	}{
+		{
+			testName:      "トークンがないベース",
+			method:        "GET",
+			path:          "/",
+			want:          false,
+			wantChallenge: `Bearer realm="https://registry.example.com/token",service="tcr"`,
+		},
+		{
+			testName:      "トークンがない pull",
+			method:        "GET",
+			path:          "/org/repo/manifests/latest",
+			want:          false,
+			wantChallenge: `Bearer realm="https://registry.example.com/token",service="tcr",scope="repository:org/repo:pull"`,
+		},
+		{
+			testName:      "不正なトークン",
+			method:        "GET",
+			path:          "/",
+			authorization: "Bearer abc",
+			want:          false,
+			wantChallenge: `Bearer realm="https://registry.example.com/token",service="tcr",error="invalid_token"`,
+		},
+		{
+			testName:      "pull だけのトークンで push",
+			method:        "PUT",
+			path:          "/org/repo/manifests/latest",
+			authorization: issue(auth.RepositoryAccess("org/repo", auth.ActionPull)),
+			want:          false,
+			wantChallenge: `Bearer realm="https://registry.example.com/token",service="tcr",scope="repository:org/repo:push",error="insufficient_scope"`,
+		},
+		{
+			testName:      "マウントは元のリポジトリの pull がなくても通す",
+			method:        "POST",
+			path:          "/org/repo/blobs/uploads/?mount=" + testDigest + "&from=org/base",
+			authorization: issue(auth.RepositoryAccess("org/repo", auth.ActionPull, auth.ActionPush)),
+			want:          true,
+		},
+		{
+			testName:      "許可された pull",
+			method:        "HEAD",
+			path:          "/org/repo/blobs/" + testDigest,
+			authorization: issue(auth.RepositoryAccess("org/repo", auth.ActionPull)),
+			want:          true,
+		},
+		{
+			testName:      "カタログ",
+			method:        "GET",
+			path:          "/_catalog",
+			authorization: issue(auth.CatalogAccess),
+			want:          true,
+		},
+		{
+			testName:      "アップロードの中止は push",
+			method:        "DELETE",
+			path:          "/org/repo/blobs/uploads/" + testUuid,
+			authorization: issue(auth.RepositoryAccess("org/repo", auth.ActionPush)),
+			want:          true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(tt.method, "/v2"+tt.path, nil)
+			if tt.authorization != "" {
+				c.Request.Header.Set("Authorization", tt.authorization)
+			}
+			route, err := ParseRoute(c.Request.URL.Path[len("/v2"):])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := a.Authorize(c, requiredAccess(route, c))
+
+			if got != tt.want {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+			if got {
+				p, ok := auth.PrincipalFrom(c.Request.Context())
+				if !ok || p.Subject != "alice" {
+					t.Fatalf("principal is not set: %+v", p)
+				}
+				return
+			}
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("status is %d, but want %d", w.Code, http.StatusUnauthorized)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); challenge != tt.wantChallenge {
+				t.Fatalf("challenge is %s, but want %s", challenge, tt.wantChallenge)
+			}
+		})
+	}
+}
+
+type fakeAuthenticator map[string]string
+
+func (f fakeAuthenticator) Authenticate(ctx context.Context, username, password string) (auth.Principal, error) {
+	if p, ok := f[username]; ok && p == password {
+		return auth.Principal{Subject: username}, nil
+	}
+	return auth.Principal{}, auth.ErrInvalidCredentials
+}
+
+func TestBasicAuthorizer(t *testing.T) {
+	certs, err := auth.NewCertificateAuthenticator(auth.CertIdentityCommonName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewBasicAuthorizer(fakeAuthenticator{"alice": "secret"}, certs, "tcr")
+	tests := []struct {
+		testName string
+		username string
+		password string
+		// TLS で検証済みのクライアント証明書の CN
+		commonName string
+		want       bool
+	}{
+		{testName: "資格情報がない", want: false},
+		{testName: "パスワードが違う", username: "alice", password: "wrong", want: false},
+		{testName: "正しい資格情報", username: "alice", password: "secret", want: true},
+		{testName: "クライアント証明書", commonName: "alice", want: true},
+		{testName: "資格情報があればクライアント証明書より優先する", username: "alice", password: "wrong", commonName: "alice", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/v2/", nil)
+			if tt.username != "" {
+				c.Request.SetBasicAuth(tt.username, tt.password)
+			}
+			if tt.commonName != "" {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: tt.commonName}}
+				c.Request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			}
+
+			got := a.Authorize(c, nil)
+
+			if got != tt.want {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+			if got {
+				p, ok := auth.PrincipalFrom(c.Request.Context())
+				if !ok || p.Subject != "alice" {
+					t.Fatalf("principal is not set: %+v", p)
+				}
+				return
+			}
+			if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Basic realm="tcr"` {
+				t.Fatalf("status is %d and challenge is %q", w.Code, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
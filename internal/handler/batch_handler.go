@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/service/usecase"
+	"github.com/gin-gonic/gin"
+)
+
+// OCI の仕様にはない TCR 独自の API。
+// blob の存在確認や参照の解決を 1 件ずつ HEAD するかわりにまとめて行う
+type BatchHandler struct {
+	blobUsecase     *usecase.BlobUseCase
+	manifestUsecase *usecase.ManifestUseCase
+}
+
+func NewBatchHandler(bu *usecase.BlobUseCase, mu *usecase.ManifestUseCase) *BatchHandler {
+	return &BatchHandler{
+		blobUsecase:     bu,
+		manifestUsecase: mu,
+	}
+}
+
+func (h *BatchHandler) BatchHandler(c *gin.Context) {
+	var req dto.BatchRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		writeError(c, apperrors.TCRERR_REQUEST_INVALID.WithDetail("request body is not a valid batch request").Wrap(err))
+		return
+	}
+
+	resp := dto.BatchResponse{
+		Blobs:      []dto.BatchBlobResult{},
+		References: []dto.BatchReferenceResult{},
+	}
+	if len(req.Blobs) > 0 {
+		resp.Blobs, err = h.blobUsecase.BatchExistsBlobs(c.Request.Context(), req.Blobs)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+	}
+	if len(req.References) > 0 {
+		resp.References, err = h.manifestUsecase.ResolveReferences(c.Request.Context(), req.References)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
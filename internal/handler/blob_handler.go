@@ -5,21 +5,44 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
 	"github.com/a-takamin/tcr/internal/dto"
 	"github.com/a-takamin/tcr/internal/service/usecase"
 	"github.com/gin-gonic/gin"
 )
 
 type BlobHandler struct {
-	usecase *usecase.BlobUseCase
+	usecase  *usecase.BlobUseCase
+	redirect BlobRedirectOption
+	// nil なら認証が無効
+	public PublicChecker
 }
 
-func NewBlobHandler(s *usecase.BlobUseCase) *BlobHandler {
+// blob の GET をストレージの期限付き URL へのリダイレクトで返すための設定
+type BlobRedirectOption struct {
+	Enabled bool
+	// 発行する URL の有効期間
+	Expires time.Duration
+	// リダイレクトせずに中継するリポジトリ名のパターン (path.Match の形式)
+	ExcludeRepositories []string
+	// リダイレクトをたどれないクライアントの User-Agent の前方一致
+	ExcludeUserAgents []string
+}
+
+// クライアントがリクエストごとにリダイレクトを拒否するためのヘッダー
+const noRedirectHeader = "X-TCR-Blob-Redirect"
+
+func NewBlobHandler(s *usecase.BlobUseCase, redirect BlobRedirectOption, public PublicChecker) *BlobHandler {
 	return &BlobHandler{
-		usecase: s,
+		usecase:  s,
+		redirect: redirect,
+		public:   public,
 	}
 }
 func (h *BlobHandler) ExistsBlobHandler(c *gin.Context, name string, digest string) {
@@ -28,26 +51,18 @@ func (h *BlobHandler) ExistsBlobHandler(c *gin.Context, name string, digest stri
 		Digest: digest,
 	}
 
-	_, err := h.usecase.ExistsBlob(metadata)
+	blob, err := h.usecase.ExistsBlob(c.Request.Context(), metadata)
 	if err != nil {
-		slog.Error(err.Error())
-		switch {
-		case errors.Is(err, apperrors.TCRERR_NAME_INVALID), errors.Is(err, apperrors.TCRERR_DIGEST_INVALID):
-			c.JSON(http.StatusBadRequest, apperrors.NAME_INVALID.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_NAME_NOT_FOUND), errors.Is(err, apperrors.TCRERR_BLOB_NOT_FOUND):
-			c.JSON(http.StatusNotFound, apperrors.NAME_UNKNOWN.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_PERSISTER_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		case errors.Is(err, apperrors.TCRERR_LOGIC_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		default:
-			c.JSON(http.StatusInternalServerError, "")
-		}
+		writeError(c, err)
 		return
 	}
 
-	c.Header("Docker-Content-Digest", digest)
-	c.JSON(http.StatusOK, "")
+	h.setBlobCacheHeaders(c, name, digest)
+	if notModified(c, digest) {
+		return
+	}
+	c.Header("Content-Length", strconv.FormatInt(blob.Size, 10))
+	c.Status(http.StatusOK)
 }
 
 func (h *BlobHandler) GetBlobHandler(c *gin.Context, name string, digest string) {
@@ -56,32 +71,92 @@ func (h *BlobHandler) GetBlobHandler(c *gin.Context, name string, digest string)
 		Digest: digest,
 	}
 
-	blob, err := h.usecase.GetBlob(metadata)
-	if err != nil {
-		slog.Error(err.Error())
-		switch {
-		case errors.Is(err, apperrors.TCRERR_NAME_INVALID), errors.Is(err, apperrors.TCRERR_DIGEST_INVALID):
-			c.JSON(http.StatusBadRequest, apperrors.NAME_INVALID.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_NAME_NOT_FOUND), errors.Is(err, apperrors.TCRERR_BLOB_NOT_FOUND):
-			c.JSON(http.StatusNotFound, apperrors.NAME_UNKNOWN.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_PERSISTER_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		case errors.Is(err, apperrors.TCRERR_LOGIC_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		default:
-			c.JSON(http.StatusInternalServerError, "")
+	// キャッシュが持っている blob なら中身を取得せずに存在だけ確認して返す
+	if c.GetHeader("If-None-Match") != "" {
+		_, err := h.usecase.ExistsBlob(c.Request.Context(), metadata)
+		if err == nil {
+			h.setBlobCacheHeaders(c, name, digest)
+			if notModified(c, digest) {
+				return
+			}
+		}
+	}
+
+	if h.shouldRedirect(c, name) {
+		url, err := h.usecase.GetBlobURL(c.Request.Context(), metadata, h.redirect.Expires)
+		if err == nil {
+			c.Header("Docker-Content-Digest", digest)
+			c.Redirect(http.StatusTemporaryRedirect, url)
+			return
 		}
+		// URL を発行できなければ中継する。blob がないなどのエラーは GetBlob でも同じように返る
+		if errors.Is(err, apperrors.TCRERR_PERSISTER_ERROR) {
+			slog.Warn("failed to presign blob url. falling back to proxy", "error", err.Error())
+		}
+	}
+
+	blob, err := h.usecase.GetBlob(c.Request.Context(), metadata)
+	if err != nil {
+		writeError(c, err)
 		return
 	}
 
+	h.setBlobCacheHeaders(c, name, digest)
+	c.Data(http.StatusOK, "application/octet-stream", blob.Blob)
+}
+
+// blob は digest で指定されるので中身が変わることはない
+func (h *BlobHandler) setBlobCacheHeaders(c *gin.Context, name string, digest string) {
 	c.Header("Docker-Content-Digest", digest)
-	c.JSON(http.StatusOK, blob)
+	c.Header("ETag", etagOf(digest))
+	c.Header("Cache-Control", immutableCacheControl(c, h.public, name))
+}
+
+func (h *BlobHandler) shouldRedirect(c *gin.Context, name string) bool {
+	if !h.redirect.Enabled {
+		return false
+	}
+	if strings.EqualFold(c.GetHeader(noRedirectHeader), "false") {
+		return false
+	}
+	for _, pattern := range h.redirect.ExcludeRepositories {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	userAgent := c.GetHeader("User-Agent")
+	for _, prefix := range h.redirect.ExcludeUserAgents {
+		if strings.HasPrefix(userAgent, prefix) {
+			return false
+		}
+	}
+	return true
 }
 
 func (h *BlobHandler) StartUploadBlobHandler(c *gin.Context, name string) {
-	redirectUrl, err := h.usecase.StartBlobUpload(name)
+	// クロスリポジトリマウント。マウントできなければ通常のアップロードを始める
+	if mount, from := c.Query("mount"), c.Query("from"); mount != "" && from != "" {
+		mounted, err := h.usecase.MountBlob(c.Request.Context(), dto.MountBlobInput{
+			Name:     name,
+			Digest:   mount,
+			From:     from,
+			Uploader: requester(c),
+		})
+		if err != nil {
+			// マウントできなくても通常のアップロードは始められる
+			slog.Warn("failed to mount blob. starting a new upload", "error", err.Error())
+		}
+		if mounted {
+			c.Header("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, mount))
+			c.Header("Docker-Content-Digest", mount)
+			c.JSON(http.StatusCreated, "")
+			return
+		}
+	}
+
+	redirectUrl, err := h.usecase.StartBlobUpload(c.Request.Context(), name)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, err)
+		writeError(c, err)
 		return
 	}
 
@@ -97,9 +172,9 @@ func (h *BlobHandler) UploadBlobHandler(c *gin.Context, name string, uuid string
 	ContentType := c.ContentType()
 	bodyStream := c.Request.Body
 
-	isChunkedUpload, err := h.usecase.IsChunkedUpload(name, uuid)
+	isChunkedUpload, err := h.usecase.IsChunkedUpload(c.Request.Context(), name, uuid)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, "")
+		writeError(c, err)
 		return
 	}
 	if !isChunkedUpload {
@@ -110,16 +185,14 @@ func (h *BlobHandler) UploadBlobHandler(c *gin.Context, name string, uuid string
 			Digest:        digest,
 			ContentLength: ContentLength,
 			ContentType:   ContentType,
+			Uploader:      requester(c),
 			Blob:          bodyStream,
 		}
-		err := h.usecase.UploadMonolithicBlob(input)
+		err := h.usecase.UploadMonolithicBlob(c.Request.Context(), input)
 		if err != nil {
-			// TODO: http status code
-			slog.Error(err.Error())
-			c.JSON(http.StatusInternalServerError, "")
+			writeError(c, err)
 			return
 		}
-		// TODO: http status code
 		c.Header("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
 		c.JSON(http.StatusCreated, "")
 		return
@@ -135,17 +208,16 @@ func (h *BlobHandler) UploadBlobHandler(c *gin.Context, name string, uuid string
 		ContentType:   ContentType,
 		Blob:          bodyStream,
 		IsLast:        true,
+		Uploader:      requester(c),
 	}
 
-	offset, err := h.usecase.UploadLastChunkedBlob(input)
-
+	offset, err := h.usecase.UploadLastChunkedBlob(c.Request.Context(), input)
 	if err != nil {
-		slog.Error(err.Error())
+		// クライアントが続きから送り直せるように、アップロードの状態を返す
 		c.Header("Location", c.Request.URL.Path)
-		c.Header("Content-Length", "0")
 		c.Header("Docker-Upload-UUID", uuid)
 		c.Header("Range", fmt.Sprintf("0-%d", offset))
-		c.JSON(http.StatusRequestedRangeNotSatisfiable, "")
+		writeError(c, err)
 		return
 	}
 
@@ -164,7 +236,7 @@ func (h *BlobHandler) UploadChunkedBlobHandler(c *gin.Context, name string, uuid
 		var err error
 		ContentLength, err = strconv.ParseInt(ContentLengthHeaderVal, 10, 64)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, err)
+			writeError(c, apperrors.TCRERR_SIZE_INVALID.WithDetail("Content-Length is not a number").Wrap(err))
 			return
 		}
 	}
@@ -184,20 +256,18 @@ func (h *BlobHandler) UploadChunkedBlobHandler(c *gin.Context, name string, uuid
 		Blob:          bodyStream,
 	}
 
-	offset, err := h.usecase.UploadChunkedBlob(input)
+	offset, err := h.usecase.UploadChunkedBlob(c.Request.Context(), input)
 
 	c.Header("Location", c.Request.URL.Path)
-	c.Header("Content-Length", "0")
 	c.Header("Docker-Upload-UUID", uuid)
-
+	c.Header("Range", fmt.Sprintf("0-%d", offset))
 	if err != nil {
-		slog.Error(err.Error())
-		c.Header("Range", fmt.Sprintf("0-%d", offset))
-		c.JSON(http.StatusRequestedRangeNotSatisfiable, "")
+		// 同じアップロードに対する別のリクエストが先に進捗を更新した場合は 409 になる
+		writeError(c, err)
 		return
 	}
 
-	c.Header("Range", fmt.Sprintf("0-%d", offset))
+	c.Header("Content-Length", "0")
 	c.JSON(http.StatusAccepted, "")
 }
 
@@ -207,10 +277,9 @@ func (h *BlobHandler) DeleteBlobHandler(c *gin.Context, name string, digest stri
 		Digest: digest,
 	}
 
-	err := h.usecase.DeleteBlob(input)
+	err := h.usecase.DeleteBlob(c.Request.Context(), input)
 	if err != nil {
-		slog.Error(err.Error())
-		apperrors.ErrorHanlder(c, err)
+		writeError(c, err)
 		return
 	}
 
@@ -218,11 +287,9 @@ func (h *BlobHandler) DeleteBlobHandler(c *gin.Context, name string, digest stri
 }
 
 func (h *BlobHandler) GetUploadStatusHandler(c *gin.Context, name string, uuid string) {
-	offset, err := h.usecase.GetBlobUploadOffset(name, uuid)
+	offset, err := h.usecase.GetBlobUploadOffset(c.Request.Context(), name, uuid)
 	if err != nil {
-		slog.Error(err.Error())
-		// TODO: http status
-		c.JSON(http.StatusNotFound, "")
+		writeError(c, err)
 		return
 	}
 	c.Header("Range", fmt.Sprintf("0-%d", offset))
@@ -231,3 +298,20 @@ func (h *BlobHandler) GetUploadStatusHandler(c *gin.Context, name string, uuid s
 	c.Header("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, uuid))
 	c.JSON(http.StatusNoContent, "")
 }
+
+func (h *BlobHandler) CancelUploadHandler(c *gin.Context, name string, uuid string) {
+	err := h.usecase.CancelBlobUpload(c.Request.Context(), name, uuid)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// blob のメタデータに記録するアップロードした人。認証が無効なら IP アドレスにする
+func requester(c *gin.Context) string {
+	if p, ok := auth.PrincipalFrom(c.Request.Context()); ok && p.Subject != "" {
+		return p.Subject
+	}
+	return c.ClientIP()
+}
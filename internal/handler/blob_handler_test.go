@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func TestShouldRedirect(t *testing.T) {
+	option := BlobRedirectOption{
+		Enabled:             true,
+		ExcludeRepositories: []string{"team-a/*"},
+		ExcludeUserAgents:   []string{"old-client/"},
+	}
+	tests := []struct {
+		testName string
+		option   BlobRedirectOption
+		name     string
+		headers  map[string]string
+		want     bool
+	}{
+		{
+			testName: "リダイレクトが無効",
+			option:   BlobRedirectOption{},
+			name:     "org/repo",
+			want:     false,
+		},
+		{
+			testName: "除外されていないリポジトリ",
+			option:   option,
+			name:     "org/repo",
+			want:     true,
+		},
+		{
+			testName: "除外パターンに一致するリポジトリ",
+			option:   option,
+			name:     "team-a/repo",
+			want:     false,
+		},
+		{
+			testName: "除外された User-Agent",
+			option:   option,
+			name:     "org/repo",
+			headers:  map[string]string{"User-Agent": "old-client/1.0"},
+			want:     false,
+		},
+		{
+			testName: "クライアントがヘッダーでリダイレクトを拒否",
+			option:   option,
+			name:     "org/repo",
+			headers:  map[string]string{noRedirectHeader: "false"},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/v2/"+tt.name+"/blobs/sha256:0", nil)
+			for k, v := range tt.headers {
+				c.Request.Header.Set(k, v)
+			}
+			h := NewBlobHandler(nil, tt.option, nil)
+			got := h.shouldRedirect(c, tt.name)
+			if got != tt.want {
+				t.Fatalf("got is %t, but want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequester(t *testing.T) {
+	tests := []struct {
+		testName  string
+		principal *auth.Principal
+		want      string
+	}{
+		{testName: "認証されたユーザー", principal: &auth.Principal{Subject: "alice"}, want: "alice"},
+		{testName: "認証が無効なら IP アドレス", want: "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("PUT", "/v2/org/repo/blobs/uploads/"+testUuid, nil)
+			c.Request.RemoteAddr = "192.0.2.1:1234"
+			if tt.principal != nil {
+				c.Request = c.Request.WithContext(auth.WithPrincipal(context.Background(), *tt.principal))
+			}
+			if got := requester(c); got != tt.want {
+				t.Fatalf("got is %s, but want %s", got, tt.want)
+			}
+		})
+	}
+}
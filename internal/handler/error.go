@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/gin-gonic/gin"
+)
+
+// err を OCI のエラーレスポンスとして返す。HTTP ステータスとエラーコードは apperrors.Classify で決める
+func writeError(c *gin.Context, err error) {
+	e := apperrors.Classify(err)
+	if e.Status >= http.StatusInternalServerError {
+		slog.Error(err.Error(), "method", c.Request.Method, "path", c.Request.URL.Path)
+	} else {
+		slog.Warn(err.Error(), "method", c.Request.Method, "path", c.Request.URL.Path)
+	}
+	c.JSON(e.Status, e.Response(preferredLanguage(c.GetHeader("Accept-Language"))))
+}
+
+// Accept-Language から返すメッセージの言語を選ぶ。対応しているのは en と ja で、既定は en
+func preferredLanguage(header string) string {
+	lang, best := "en", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if (primary == "en" || primary == "ja") && q > best {
+			lang, best = primary, q
+		}
+	}
+	return lang
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/gin-gonic/gin"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		testName       string
+		err            error
+		acceptLanguage string
+		wantStatus     int
+		wantCode       string
+		wantMessage    string
+		wantDetail     string
+	}{
+		{
+			testName:    "TCRError はその種類のステータスとコードになる",
+			err:         apperrors.TCRERR_NAME_NOT_FOUND,
+			wantStatus:  http.StatusNotFound,
+			wantCode:    "NAME_UNKNOWN",
+			wantMessage: "repository name not known to registry",
+		},
+		{
+			testName:    "リポジトリにないマニフェスト",
+			err:         apperrors.TCRERR_MANIFEST_NOT_FOUND,
+			wantStatus:  http.StatusNotFound,
+			wantCode:    "MANIFEST_UNKNOWN",
+			wantMessage: "manifest unknown",
+		},
+		{
+			testName:    "ラップされた TCRError",
+			err:         fmt.Errorf("put manifest: %w", apperrors.TCRERR_DIGEST_INVALID.WithDetail("digest does not match")),
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    "DIGEST_INVALID",
+			wantMessage: "provided digest did not match uploaded content",
+			wantDetail:  "digest does not match",
+		},
+		{
+			testName:    "下位の層のエラー",
+			err:         apperrors.ErrBlobUploadConflict,
+			wantStatus:  http.StatusConflict,
+			wantCode:    "BLOB_UPLOAD_INVALID",
+			wantMessage: "blob upload invalid",
+		},
+		{
+			testName:    "チャンクの順番が違う",
+			err:         apperrors.TCRERR_RANGE_INVALID.Wrap(apperrors.ErrChunkIsNotInSequence),
+			wantStatus:  http.StatusRequestedRangeNotSatisfiable,
+			wantCode:    "BLOB_UPLOAD_INVALID",
+			wantMessage: "blob upload invalid",
+		},
+		{
+			testName:    "内部のエラーは詳細を返さない",
+			err:         apperrors.TCRERR_PERSISTER_ERROR.Wrap(errors.New("dynamodb is down")),
+			wantStatus:  http.StatusInternalServerError,
+			wantCode:    "UNKNOWN",
+			wantMessage: "unknown error",
+		},
+		{
+			testName:    "未知のエラー",
+			err:         errors.New("something happened"),
+			wantStatus:  http.StatusInternalServerError,
+			wantCode:    "UNKNOWN",
+			wantMessage: "unknown error",
+		},
+		{
+			testName:    "タイムアウト",
+			err:         apperrors.TCRERR_PERSISTER_ERROR.Wrap(fmt.Errorf("get item: %w", context.DeadlineExceeded)),
+			wantStatus:  http.StatusServiceUnavailable,
+			wantCode:    "UNAVAILABLE",
+			wantMessage: "service unavailable",
+		},
+		{
+			testName:       "日本語を優先するクライアント",
+			err:            apperrors.TCRERR_BLOB_NOT_FOUND,
+			acceptLanguage: "ja,en-US;q=0.8",
+			wantStatus:     http.StatusNotFound,
+			wantCode:       "BLOB_UNKNOWN",
+			wantMessage:    "blob がレジストリにありません",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/v2/org/repo/blobs/sha256:0", nil)
+			if tt.acceptLanguage != "" {
+				c.Request.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+
+			writeError(c, tt.err)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status is %d, but want %d", w.Code, tt.wantStatus)
+			}
+			var got apperrors.OCIErrorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &got)
+			if err != nil {
+				t.Fatalf("response is not an OCI error: %s", w.Body.String())
+			}
+			want := apperrors.OCIError{ErrorCode: tt.wantCode, ErrorMessage: tt.wantMessage, Detail: tt.wantDetail}
+			if len(got.Errors) != 1 || got.Errors[0] != want {
+				t.Fatalf("errors are %+v, but want [%+v]", got.Errors, want)
+			}
+		})
+	}
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: "en"},
+		{header: "ja", want: "ja"},
+		{header: "ja-JP", want: "ja"},
+		{header: "en-US,ja;q=0.9", want: "en"},
+		{header: "fr,ja;q=0.5,en;q=0.3", want: "ja"},
+		{header: "fr", want: "en"},
+		{header: "ja;q=abc", want: "en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got := preferredLanguage(tt.header)
+			if got != tt.want {
+				t.Fatalf("got is %s, but want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// 種類を表す値は共有されているので、インスタンスを作っても変わってはいけない
+func TestTCRErrorWrapDoesNotMutate(t *testing.T) {
+	wrapped := apperrors.TCRERR_PERSISTER_ERROR.Wrap(errors.New("cause"))
+	detailed := apperrors.TCRERR_PERSISTER_ERROR.WithDetail("detail")
+
+	if apperrors.TCRERR_PERSISTER_ERROR.Err != nil || apperrors.TCRERR_PERSISTER_ERROR.Detail != "" {
+		t.Fatalf("shared error was mutated: %+v", apperrors.TCRERR_PERSISTER_ERROR)
+	}
+	if !errors.Is(wrapped, apperrors.TCRERR_PERSISTER_ERROR) || !errors.Is(detailed, apperrors.TCRERR_PERSISTER_ERROR) {
+		t.Fatalf("instances must match their kind")
+	}
+	if errors.Is(wrapped, apperrors.TCRERR_LOGIC_ERROR) {
+		t.Fatalf("instances must not match other kinds")
+	}
+}
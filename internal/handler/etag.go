@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// digest で指定されたものは中身が変わらないので、キャッシュに無期限で保持させてよい。
+// 認証が必要なものは、共有キャッシュが他の人に返さないように private にする
+const (
+	publicImmutableCacheControl  = "public, max-age=31536000, immutable"
+	privateImmutableCacheControl = "private, max-age=31536000, immutable"
+)
+
+// タグで指定されたマニフェストは付け替えられることがあるので、使う前に毎回再検証させる
+const revalidateCacheControl = "no-cache"
+
+// 誰でも pull できるリポジトリかどうか。usecase.AccessUseCase が実装する
+type PublicChecker interface {
+	IsPublic(ctx context.Context, name string) (bool, error)
+}
+
+// public が nil なら認証が無効なので、どのリポジトリも共有キャッシュに保存させてよい
+func immutableCacheControl(c *gin.Context, public PublicChecker, name string) string {
+	if public == nil {
+		return publicImmutableCacheControl
+	}
+	ok, err := public.IsPublic(c.Request.Context(), name)
+	if err != nil || !ok {
+		return privateImmutableCacheControl
+	}
+	return publicImmutableCacheControl
+}
+
+func etagOf(digest string) string {
+	return `"` + digest + `"`
+}
+
+// If-None-Match がこの digest に一致すれば 304 を返して true を返す。
+// 呼び出し側は true の場合にそれ以上レスポンスを書かないこと
+func notModified(c *gin.Context, digest string) bool {
+	if !matchesETag(c.GetHeader("If-None-Match"), etagOf(digest)) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// If-None-Match は弱い比較をするので W/ は無視する
+func matchesETag(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
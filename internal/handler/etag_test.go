@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMatchesETag(t *testing.T) {
+	etag := `"sha256:abc"`
+	tests := []struct {
+		testName    string
+		ifNoneMatch string
+		want        bool
+	}{
+		{testName: "ヘッダーがない", ifNoneMatch: "", want: false},
+		{testName: "一致する", ifNoneMatch: `"sha256:abc"`, want: true},
+		{testName: "一致しない", ifNoneMatch: `"sha256:def"`, want: false},
+		{testName: "弱い ETag", ifNoneMatch: `W/"sha256:abc"`, want: true},
+		{testName: "複数のうちの 1 つが一致する", ifNoneMatch: `"sha256:def", "sha256:abc"`, want: true},
+		{testName: "ワイルドカード", ifNoneMatch: "*", want: true},
+		{testName: "引用符がない", ifNoneMatch: "sha256:abc", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got := matchesETag(tt.ifNoneMatch, etag)
+			if got != tt.want {
+				t.Fatalf("got is %t, but want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakePublicChecker map[string]bool
+
+func (f fakePublicChecker) IsPublic(ctx context.Context, name string) (bool, error) {
+	if name == "org/broken" {
+		return false, errors.New("unavailable")
+	}
+	return f[name], nil
+}
+
+func TestImmutableCacheControl(t *testing.T) {
+	tests := []struct {
+		testName string
+		public   PublicChecker
+		name     string
+		want     string
+	}{
+		{testName: "認証が無効", public: nil, name: "org/app", want: publicImmutableCacheControl},
+		{testName: "公開されたリポジトリ", public: fakePublicChecker{"org/app": true}, name: "org/app", want: publicImmutableCacheControl},
+		{testName: "非公開のリポジトリ", public: fakePublicChecker{}, name: "org/app", want: privateImmutableCacheControl},
+		{testName: "公開範囲が分からない", public: fakePublicChecker{}, name: "org/broken", want: privateImmutableCacheControl},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/v2/"+tt.name+"/blobs/"+testDigest, nil)
+			got := immutableCacheControl(c, tt.public, tt.name)
+			if got != tt.want {
+				t.Fatalf("got is %s, but want %s", got, tt.want)
+			}
+		})
+	}
+}
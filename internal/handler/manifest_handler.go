@@ -1,25 +1,28 @@
 package handler
 
 import (
-	"errors"
-	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
+	"strconv"
 
 	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
 	"github.com/a-takamin/tcr/internal/model"
+	"github.com/a-takamin/tcr/internal/service/domain"
 	"github.com/a-takamin/tcr/internal/service/usecase"
 	"github.com/gin-gonic/gin"
 )
 
 type ManifestHandler struct {
 	usecase *usecase.ManifestUseCase
+	// nil なら認証が無効
+	public PublicChecker
 }
 
-func NewManifestHandler(u *usecase.ManifestUseCase) *ManifestHandler {
+func NewManifestHandler(u *usecase.ManifestUseCase, public PublicChecker) *ManifestHandler {
 	return &ManifestHandler{
 		usecase: u,
+		public:  public,
 	}
 }
 
@@ -29,26 +32,19 @@ func (h *ManifestHandler) ExistsManifestHandler(c *gin.Context, name string, ref
 		Reference: reference,
 	}
 
-	resp, err := h.usecase.ExistsManifest(metadata)
+	resp, err := h.usecase.ExistsManifest(c.Request.Context(), metadata)
 	if err != nil {
-		slog.Error(err.Error())
-		switch {
-		case errors.Is(err, apperrors.TCRERR_NAME_INVALID):
-			c.JSON(http.StatusBadRequest, apperrors.NAME_INVALID.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_NAME_NOT_FOUND):
-			c.JSON(http.StatusNotFound, apperrors.NAME_UNKNOWN.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_PERSISTER_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		case errors.Is(err, apperrors.TCRERR_LOGIC_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		default:
-			c.JSON(http.StatusInternalServerError, "")
-		}
+		writeError(c, err)
 		return
 	}
 
-	c.Header("Docker-Content-Digest", resp.Digest)
-	c.JSON(http.StatusOK, "")
+	h.setManifestCacheHeaders(c, name, reference, resp.Digest)
+	if notModified(c, resp.Digest) {
+		return
+	}
+	c.Header("Content-Type", manifestContentType(resp))
+	c.Header("Content-Length", strconv.Itoa(len(resp.Raw)))
+	c.Status(http.StatusOK)
 }
 
 func (h *ManifestHandler) GetManifestHandler(c *gin.Context, name string, reference string) {
@@ -57,45 +53,60 @@ func (h *ManifestHandler) GetManifestHandler(c *gin.Context, name string, refere
 		Reference: reference,
 	}
 
-	resp, err := h.usecase.GetManifest(metadata)
+	resp, err := h.usecase.GetManifest(c.Request.Context(), metadata)
 	if err != nil {
-		slog.Error(err.Error())
-		switch {
-		case errors.Is(err, apperrors.TCRERR_NAME_INVALID):
-			c.JSON(http.StatusBadRequest, apperrors.NAME_INVALID.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_NAME_NOT_FOUND):
-			c.JSON(http.StatusNotFound, apperrors.NAME_UNKNOWN.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_PERSISTER_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		case errors.Is(err, apperrors.TCRERR_LOGIC_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		default:
-			c.JSON(http.StatusInternalServerError, "")
-		}
+		writeError(c, err)
 		return
 	}
 
-	c.Header("Docker-Content-Digest", resp.Digest)
-	c.JSON(http.StatusOK, resp.Manifest)
+	h.setManifestCacheHeaders(c, name, reference, resp.Digest)
+	if notModified(c, resp.Digest) {
+		return
+	}
+	c.Data(http.StatusOK, manifestContentType(resp), resp.Raw)
+}
+
+func (h *ManifestHandler) setManifestCacheHeaders(c *gin.Context, name string, reference string, digest string) {
+	c.Header("Docker-Content-Digest", digest)
+	c.Header("ETag", etagOf(digest))
+	if domain.IsDigest(reference) {
+		c.Header("Cache-Control", immutableCacheControl(c, h.public, name))
+	} else {
+		c.Header("Cache-Control", revalidateCacheControl)
+	}
+}
+
+// mediaType を持たない古い形式のマニフェストは OCI のイメージマニフェストとして扱う
+func manifestContentType(resp dto.GetManifestResponse) string {
+	if resp.Manifest.MediaType != "" {
+		return resp.Manifest.MediaType
+	}
+	return "application/vnd.oci.image.manifest.v1+json"
 }
 
 func (h *ManifestHandler) GetTagsHandler(c *gin.Context, name string) {
-	tags, err := h.usecase.GetTags(name)
+	tags, err := h.usecase.GetTags(c.Request.Context(), name)
 	if err != nil {
-		slog.Error(err.Error())
-		switch {
-		case errors.Is(err, apperrors.TCRERR_PERSISTER_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		case errors.Is(err, apperrors.TCRERR_NAME_NOT_FOUND):
-			c.JSON(http.StatusNotFound, apperrors.NAME_UNKNOWN.CreateResponse(""))
-		default:
-			c.JSON(http.StatusInternalServerError, "")
-		}
+		writeError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, tags)
 }
 
+func (h *ManifestHandler) GetReferrersHandler(c *gin.Context, name string, digest string) {
+	artifactType := c.Query("artifactType")
+	resp, err := h.usecase.GetReferrers(c.Request.Context(), name, digest, artifactType)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if artifactType != "" {
+		c.Header("OCI-Filters-Applied", "artifactType")
+	}
+	c.Header("Content-Type", resp.MediaType)
+	c.JSON(http.StatusOK, resp)
+}
+
 func (h *ManifestHandler) PutManifestHandler(c *gin.Context, name string, reference string) {
 	metadata := model.ManifestMetadata{
 		Name:        name,
@@ -105,32 +116,20 @@ func (h *ManifestHandler) PutManifestHandler(c *gin.Context, name string, refere
 
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		err := fmt.Errorf("could not read manifest body: %w", err)
-		slog.Error(err.Error())
-		c.JSON(http.StatusInternalServerError, "could not read manifest body")
+		writeError(c, apperrors.TCRERR_REQUEST_INVALID.WithDetail("could not read manifest body").Wrap(err))
 		return
 	}
 
-	digest, err := h.usecase.PutManifest(metadata, body)
+	resp, err := h.usecase.PutManifest(c.Request.Context(), metadata, body)
 	if err != nil {
-		slog.Error(err.Error())
-		switch {
-		case errors.Is(err, apperrors.TCRERR_NAME_INVALID):
-			c.JSON(http.StatusBadRequest, apperrors.NAME_INVALID.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_MANIFEST_INVALID):
-			c.JSON(http.StatusBadRequest, apperrors.MANIFEST_INVALID.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_NAME_NOT_FOUND):
-			c.JSON(http.StatusNotFound, apperrors.NAME_UNKNOWN.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_PERSISTER_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		case errors.Is(err, apperrors.TCRERR_LOGIC_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		default:
-			c.JSON(http.StatusInternalServerError, "")
-		}
+		writeError(c, err)
 		return
 	}
-	c.Header("Docker-Content-Digest", digest)
+	c.Header("Docker-Content-Digest", resp.Digest)
+	// referrers API に対応していることをクライアントに伝える
+	if resp.Subject != "" {
+		c.Header("OCI-Subject", resp.Subject)
+	}
 	c.Redirect(http.StatusCreated, c.Request.Host+c.Request.URL.Path)
 }
 
@@ -140,21 +139,9 @@ func (h *ManifestHandler) DeleteManifestHandler(c *gin.Context, name string, ref
 		Reference: reference,
 	}
 
-	err := h.usecase.DeleteManifest(metadata)
+	err := h.usecase.DeleteManifest(c.Request.Context(), metadata)
 	if err != nil {
-		slog.Error(err.Error())
-		switch {
-		case errors.Is(err, apperrors.TCRERR_NAME_INVALID):
-			c.JSON(http.StatusBadRequest, apperrors.NAME_INVALID.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_NAME_NOT_FOUND):
-			c.JSON(http.StatusNotFound, apperrors.NAME_UNKNOWN.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_MANIFEST_NOT_FOUND):
-			c.JSON(http.StatusNotFound, apperrors.MANIFEST_UNKNOWN.CreateResponse(""))
-		case errors.Is(err, apperrors.TCRERR_PERSISTER_ERROR):
-			c.JSON(http.StatusInternalServerError, "")
-		default:
-			c.JSON(http.StatusInternalServerError, "")
-		}
+		writeError(c, err)
 		return
 	}
 	c.JSON(http.StatusAccepted, "")
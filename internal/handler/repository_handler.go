@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/service/usecase"
+	"github.com/gin-gonic/gin"
+)
+
+type RepositoryHandler struct {
+	usecase *usecase.RepositoryUseCase
+}
+
+func NewRepositoryHandler(u *usecase.RepositoryUseCase) *RepositoryHandler {
+	return &RepositoryHandler{
+		usecase: u,
+	}
+}
+
+type catalogResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+// 続きがある場合は Link ヘッダーで次のページの URL を返す
+func (h *RepositoryHandler) CatalogHandler(c *gin.Context) {
+	n := 0
+	if v := c.Query("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(c, apperrors.TCRERR_REQUEST_INVALID.WithDetail("n must be a non-negative integer"))
+			return
+		}
+	}
+
+	resp, err := h.usecase.ListRepositories(c.Request.Context(), n, c.Query("last"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if resp.Next != "" {
+		next := url.Values{}
+		if n > 0 {
+			next.Set("n", strconv.Itoa(n))
+		}
+		next.Set("last", resp.Next)
+		c.Header("Link", fmt.Sprintf(`</v2/_catalog?%s>; rel="next"`, next.Encode()))
+	}
+	c.JSON(http.StatusOK, catalogResponse{Repositories: resp.Names})
+}
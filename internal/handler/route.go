@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/service/domain"
+	"github.com/google/uuid"
+)
+
+// /v2 以下のエンドポイントの種類
+type RouteKind int
+
+const (
+	// /v2/
+	RouteBase RouteKind = iota + 1
+	// /v2/_catalog
+	RouteCatalog
+	// /v2/<name>/manifests/<reference>
+	RouteManifest
+	// /v2/<name>/blobs/<digest>
+	RouteBlob
+	// /v2/<name>/blobs/uploads/
+	RouteBlobUploads
+	// /v2/<name>/blobs/uploads/<uuid>
+	RouteBlobUpload
+	// /v2/<name>/tags/list
+	RouteTags
+	// /v2/<name>/referrers/<digest>
+	RouteReferrers
+	// /v2/_<extension>/... と /v2/<name>/_<extension>/...
+	RouteExtension
+)
+
+// パスを解析した結果。Kind によって使うフィールドが決まる
+type Route struct {
+	Kind RouteKind
+	// リポジトリ名。レジストリ全体に対するエンドポイントでは空
+	Name string
+	// manifests ではタグか digest、blobs と referrers では digest
+	Reference string
+	// アップロードのセッション ID
+	Uuid string
+	// _ から始まる拡張の名前 (例: _tcr) と、その後ろのパス (例: batch)
+	Extension     string
+	ExtensionPath string
+}
+
+// /v2 より後ろのパスを Route に解析する。
+//
+// name はスラッシュを含められるので、パスの末尾の形からエンドポイントを決めて残りを name とする。
+// name の各部分は _ から始められないので、name に _ から始まる部分があれば拡張として扱う。
+// タグとアップロードの ID は _ から始められるので、末尾の形に当てはまった部分は見ない
+func ParseRoute(path string) (Route, error) {
+	path = strings.TrimPrefix(path, "/")
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		return Route{Kind: RouteBase}, nil
+	}
+	parts := strings.Split(path, "/")
+
+	route, nameParts, ok := matchEndpoint(parts)
+	if !ok {
+		nameParts = len(parts)
+	}
+	for i, part := range parts[:nameParts] {
+		if strings.HasPrefix(part, "_") {
+			return parseExtension(parts, i)
+		}
+	}
+	if !ok {
+		return Route{}, apperrors.TCRERR_ROUTE_NOT_FOUND
+	}
+	route.Name = strings.Join(parts[:nameParts], "/")
+
+	err := validateName(route.Name)
+	if err != nil {
+		return Route{}, err
+	}
+	switch route.Kind {
+	case RouteManifest:
+		err = validateManifestReference(route.Reference)
+	case RouteBlob, RouteReferrers:
+		err = validateDigest(route.Reference)
+	case RouteBlobUpload:
+		// TCR が発行する ID は UUID なので、それ以外は存在しない
+		if uuid.Validate(route.Uuid) != nil {
+			err = apperrors.TCRERR_BLOB_UPLOAD_NOT_FOUND
+		}
+	}
+	if err != nil {
+		return Route{}, err
+	}
+	return route, nil
+}
+
+// パスの末尾の形からエンドポイントを決める。name は埋めずに、name にあたる部分の数を返す
+func matchEndpoint(parts []string) (Route, int, bool) {
+	n := len(parts)
+	if n < 3 {
+		return Route{}, 0, false
+	}
+	route := Route{}
+	nameParts := n - 2
+	switch {
+	case parts[n-2] == "tags" && parts[n-1] == "list":
+		route.Kind = RouteTags
+	case parts[n-2] == "manifests":
+		route.Kind = RouteManifest
+		route.Reference = parts[n-1]
+	case parts[n-2] == "referrers":
+		route.Kind = RouteReferrers
+		route.Reference = parts[n-1]
+	case parts[n-2] == "blobs" && parts[n-1] == "uploads":
+		route.Kind = RouteBlobUploads
+	case parts[n-2] == "blobs":
+		route.Kind = RouteBlob
+		route.Reference = parts[n-1]
+	case n >= 4 && parts[n-3] == "blobs" && parts[n-2] == "uploads":
+		route.Kind = RouteBlobUpload
+		route.Uuid = parts[n-1]
+		nameParts = n - 3
+	default:
+		return Route{}, 0, false
+	}
+	return route, nameParts, true
+}
+
+// parts[i] を拡張の名前、その前を name、後ろを拡張の中のパスとする
+func parseExtension(parts []string, i int) (Route, error) {
+	if i == 0 && len(parts) == 1 && parts[0] == "_catalog" {
+		return Route{Kind: RouteCatalog}, nil
+	}
+	route := Route{
+		Kind:          RouteExtension,
+		Extension:     parts[i],
+		ExtensionPath: strings.Join(parts[i+1:], "/"),
+	}
+	if i > 0 {
+		route.Name = strings.Join(parts[:i], "/")
+		return route, validateName(route.Name)
+	}
+	return route, nil
+}
+
+func validateName(name string) error {
+	if domain.ValidateName(name) != nil {
+		return apperrors.TCRERR_NAME_INVALID.WithDetail(name)
+	}
+	return nil
+}
+
+func validateDigest(digest string) error {
+	if domain.ValidateDigest(digest) != nil {
+		return apperrors.TCRERR_DIGEST_INVALID.WithDetail(digest)
+	}
+	return nil
+}
+
+// タグには : を使えないので、: を含んでいれば digest として検証する
+func validateManifestReference(reference string) error {
+	if strings.Contains(reference, ":") {
+		return validateDigest(reference)
+	}
+	if domain.ValidateTag(reference) != nil {
+		return apperrors.TCRERR_TAG_INVALID.WithDetail(reference)
+	}
+	return nil
+}
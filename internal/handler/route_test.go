@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	testDigest = "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	testUuid   = "6f1c2b8e-3a4d-4e5f-9a6b-7c8d9e0f1a2b"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		testName string
+		path     string
+		want     Route
+		wantErr  error
+	}{
+		{testName: "ベース", path: "/", want: Route{Kind: RouteBase}},
+		{testName: "ベースのスラッシュなし", path: "", want: Route{Kind: RouteBase}},
+		{testName: "カタログ", path: "/_catalog", want: Route{Kind: RouteCatalog}},
+		{
+			testName: "タグのマニフェスト",
+			path:     "/org/repo/manifests/latest",
+			want:     Route{Kind: RouteManifest, Name: "org/repo", Reference: "latest"},
+		},
+		{
+			testName: "digest のマニフェスト",
+			path:     "/repo/manifests/" + testDigest,
+			want:     Route{Kind: RouteManifest, Name: "repo", Reference: testDigest},
+		},
+		{
+			testName: "blob",
+			path:     "/a/b/c/blobs/" + testDigest,
+			want:     Route{Kind: RouteBlob, Name: "a/b/c", Reference: testDigest},
+		},
+		{
+			testName: "アップロードの開始",
+			path:     "/org/repo/blobs/uploads/",
+			want:     Route{Kind: RouteBlobUploads, Name: "org/repo"},
+		},
+		{
+			testName: "末尾のスラッシュがないアップロードの開始",
+			path:     "/org/repo/blobs/uploads",
+			want:     Route{Kind: RouteBlobUploads, Name: "org/repo"},
+		},
+		{
+			testName: "アップロードのセッション",
+			path:     "/org/repo/blobs/uploads/" + testUuid,
+			want:     Route{Kind: RouteBlobUpload, Name: "org/repo", Uuid: testUuid},
+		},
+		{
+			testName: "タグ一覧",
+			path:     "/org/repo/tags/list",
+			want:     Route{Kind: RouteTags, Name: "org/repo"},
+		},
+		{
+			testName: "referrers",
+			path:     "/org/repo/referrers/" + testDigest,
+			want:     Route{Kind: RouteReferrers, Name: "org/repo", Reference: testDigest},
+		},
+		{
+			testName: "名前に blobs を含むリポジトリの blob",
+			path:     "/org/blobs/blobs/" + testDigest,
+			want:     Route{Kind: RouteBlob, Name: "org/blobs", Reference: testDigest},
+		},
+		{
+			testName: "名前に blobs/uploads を含むリポジトリのアップロード",
+			path:     "/blobs/uploads/blobs/uploads/" + testUuid,
+			want:     Route{Kind: RouteBlobUpload, Name: "blobs/uploads", Uuid: testUuid},
+		},
+		{
+			testName: "名前に manifests を含むリポジトリのタグ一覧",
+			path:     "/org/manifests/tags/list",
+			want:     Route{Kind: RouteTags, Name: "org/manifests"},
+		},
+		{
+			testName: "名前に tags を含むリポジトリのマニフェスト",
+			path:     "/tags/list/manifests/v1",
+			want:     Route{Kind: RouteManifest, Name: "tags/list", Reference: "v1"},
+		},
+		{
+			testName: "レジストリの拡張",
+			path:     "/_tcr/batch",
+			want:     Route{Kind: RouteExtension, Extension: "_tcr", ExtensionPath: "batch"},
+		},
+		{
+			testName: "リポジトリの拡張",
+			path:     "/org/repo/_oci/ext/discover",
+			want:     Route{Kind: RouteExtension, Name: "org/repo", Extension: "_oci", ExtensionPath: "ext/discover"},
+		},
+		{
+			testName: "_ から始まるタグ",
+			path:     "/foo/manifests/_latest",
+			want:     Route{Kind: RouteManifest, Name: "foo", Reference: "_latest"},
+		},
+		{
+			testName: "_ から始まるタグと階層のある name",
+			path:     "/org/repo/manifests/_foo",
+			want:     Route{Kind: RouteManifest, Name: "org/repo", Reference: "_foo"},
+		},
+		{
+			testName: "末尾がエンドポイントの形の拡張",
+			path:     "/org/_tcr/manifests/latest",
+			want:     Route{Kind: RouteExtension, Name: "org", Extension: "_tcr", ExtensionPath: "manifests/latest"},
+		},
+		{testName: "name がない", path: "/manifests/latest", wantErr: apperrors.TCRERR_ROUTE_NOT_FOUND},
+		{testName: "知らないエンドポイント", path: "/org/repo/unknown/x", wantErr: apperrors.TCRERR_ROUTE_NOT_FOUND},
+		{testName: "タグ一覧ではない tags", path: "/org/repo/tags/all", wantErr: apperrors.TCRERR_ROUTE_NOT_FOUND},
+		{testName: "大文字の name", path: "/Org/repo/manifests/latest", wantErr: apperrors.TCRERR_NAME_INVALID},
+		{testName: "空の name の部分", path: "/org//repo/manifests/latest", wantErr: apperrors.TCRERR_NAME_INVALID},
+		{testName: "リポジトリの拡張の name が不正", path: "/Org/_oci/ext", wantErr: apperrors.TCRERR_NAME_INVALID},
+		{testName: "不正なタグ", path: "/org/repo/manifests/-latest", wantErr: apperrors.TCRERR_TAG_INVALID},
+		{testName: "不正な digest のマニフェスト", path: "/org/repo/manifests/sha256:xyz", wantErr: apperrors.TCRERR_DIGEST_INVALID},
+		{testName: "digest ではない blob", path: "/org/repo/blobs/latest", wantErr: apperrors.TCRERR_DIGEST_INVALID},
+		{testName: "digest ではない referrers", path: "/org/repo/referrers/latest", wantErr: apperrors.TCRERR_DIGEST_INVALID},
+		{testName: "UUID ではないアップロード", path: "/org/repo/blobs/uploads/abc", wantErr: apperrors.TCRERR_BLOB_UPLOAD_NOT_FOUND},
+		{testName: "_ から始まるアップロードの ID", path: "/org/repo/blobs/uploads/_abc", wantErr: apperrors.TCRERR_BLOB_UPLOAD_NOT_FOUND},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got, err := ParseRoute(tt.path)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got is %+v, but want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterMethods(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: "/", want: []string{"GET", "HEAD"}},
+		{path: "/_catalog", want: []string{"GET"}},
+		{path: "/org/repo/manifests/latest", want: []string{"DELETE", "GET", "HEAD", "PUT"}},
+		{path: "/org/repo/blobs/" + testDigest, want: []string{"DELETE", "GET", "HEAD"}},
+		{path: "/org/repo/blobs/uploads/", want: []string{"POST"}},
+		{path: "/org/repo/blobs/uploads/" + testUuid, want: []string{"DELETE", "GET", "PATCH", "PUT"}},
+		{path: "/org/repo/tags/list", want: []string{"GET"}},
+		{path: "/org/repo/referrers/" + testDigest, want: []string{"GET"}},
+		{path: "/_tcr/batch", want: []string{"POST"}},
+		{path: "/_tcr/unknown", want: []string{}},
+		{path: "/org/repo/_tcr/batch", want: []string{}},
+	}
+
+	r := NewRouter(nil, nil, nil, nil, RequestTimeoutOption{}, nil)
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			route, err := ParseRoute(tt.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := allowedMethods(r.handlers(route))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got is %v, but want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// ハンドラーに届く前に返すレスポンス
+func TestRouterHandleRejects(t *testing.T) {
+	tests := []struct {
+		testName   string
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+		wantAllow  string
+	}{
+		{
+			testName:   "受け付けないメソッド",
+			method:     "POST",
+			path:       "/org/repo/manifests/latest",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCode:   "UNSUPPORTED",
+			wantAllow:  "DELETE, GET, HEAD, PUT",
+		},
+		{
+			testName:   "タグ一覧への PUT",
+			method:     "PUT",
+			path:       "/org/repo/tags/list",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCode:   "UNSUPPORTED",
+			wantAllow:  "GET",
+		},
+		{
+			testName:   "存在しないエンドポイント",
+			method:     "GET",
+			path:       "/org/repo/unknown/x",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "UNSUPPORTED",
+		},
+		{
+			testName:   "知らない拡張",
+			method:     "POST",
+			path:       "/_tcr/unknown",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "UNSUPPORTED",
+		},
+		{
+			testName:   "不正な name",
+			method:     "GET",
+			path:       "/Org/repo/manifests/latest",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "NAME_INVALID",
+		},
+		{
+			testName:   "不正な digest",
+			method:     "GET",
+			path:       "/org/repo/blobs/sha256:xyz",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "DIGEST_INVALID",
+		},
+	}
+
+	r := NewRouter(nil, nil, nil, nil, RequestTimeoutOption{}, nil)
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(tt.method, "/v2"+tt.path, nil)
+			c.Params = gin.Params{{Key: "remain", Value: tt.path}}
+
+			r.Handle(c)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status is %d, but want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Fatalf("Allow is %q, but want %q", got, tt.wantAllow)
+			}
+			var body apperrors.OCIErrorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatalf("response is not an OCI error: %s", w.Body.String())
+			}
+			if len(body.Errors) != 1 || body.Errors[0].ErrorCode != tt.wantCode {
+				t.Fatalf("errors are %+v, but want code %s", body.Errors, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutOption(t *testing.T) {
+	o := RequestTimeoutOption{Default: time.Second, Transfer: time.Hour}
+	tests := []struct {
+		method string
+		path   string
+		want   time.Duration
+	}{
+		{method: "GET", path: "/org/repo/manifests/latest", want: time.Second},
+		{method: "GET", path: "/org/repo/blobs/" + testDigest, want: time.Hour},
+		{method: "HEAD", path: "/org/repo/blobs/" + testDigest, want: time.Second},
+		{method: "POST", path: "/org/repo/blobs/uploads/", want: time.Second},
+		{method: "PATCH", path: "/org/repo/blobs/uploads/" + testUuid, want: time.Hour},
+		{method: "PUT", path: "/org/repo/blobs/uploads/" + testUuid, want: time.Hour},
+		{method: "GET", path: "/org/repo/blobs/uploads/" + testUuid, want: time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			route, err := ParseRoute(tt.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := o.of(route, tt.method)
+			if got != tt.want {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+		})
+	}
+}
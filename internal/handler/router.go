@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/gin-gonic/gin"
+)
+
+// /v2 以下のすべてのリクエストを受け取り、パスを Route に解析して各ハンドラーに振り分ける。
+// Gin ではパスの変数にスラッシュを使えないため、ルーティングは自前で行う
+type Router struct {
+	blobHandler     *BlobHandler
+	manifestHandler *ManifestHandler
+	batchHandler    *BatchHandler
+	repoHandler     *RepositoryHandler
+	timeout         RequestTimeoutOption
+	// nil なら認証しない
+	authorizer RequestAuthorizer
+}
+
+// リクエストごとの処理時間の上限。0 なら上限を設けない
+type RequestTimeoutOption struct {
+	// blob の転送以外のリクエスト
+	Default time.Duration
+	// blob のダウンロードとアップロード。大きな blob でも終わるように長くする
+	Transfer time.Duration
+}
+
+func NewRouter(mh *ManifestHandler, bh *BlobHandler, bth *BatchHandler, rh *RepositoryHandler, timeout RequestTimeoutOption, authorizer RequestAuthorizer) *Router {
+	return &Router{
+		blobHandler:     bh,
+		manifestHandler: mh,
+		batchHandler:    bth,
+		repoHandler:     rh,
+		timeout:         timeout,
+		authorizer:      authorizer,
+	}
+}
+
+// "/v2/*remain" に登録する
+func (r *Router) Handle(c *gin.Context) {
+	route, err := ParseRoute(c.Param("remain"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	handlers := r.handlers(route)
+	if len(handlers) == 0 {
+		writeError(c, apperrors.TCRERR_ROUTE_NOT_FOUND)
+		return
+	}
+	handle, ok := handlers[c.Request.Method]
+	if !ok {
+		c.Header("Allow", strings.Join(allowedMethods(handlers), ", "))
+		writeError(c, apperrors.TCRERR_METHOD_NOT_ALLOWED.WithDetail(c.Request.Method))
+		return
+	}
+	if r.authorizer != nil && !r.authorizer.Authorize(c, requiredAccess(route, c)) {
+		return
+	}
+	if d := r.timeout.of(route, c.Request.Method); d > 0 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+	}
+	handle(c)
+}
+
+func (o RequestTimeoutOption) of(route Route, method string) time.Duration {
+	switch {
+	case route.Kind == RouteBlob && method == http.MethodGet,
+		route.Kind == RouteBlobUpload && (method == http.MethodPatch || method == http.MethodPut):
+		return o.Transfer
+	}
+	return o.Default
+}
+
+// route が受け付けるメソッドとそのハンドラー
+func (r *Router) handlers(route Route) map[string]gin.HandlerFunc {
+	switch route.Kind {
+	case RouteBase:
+		ok := func(c *gin.Context) { c.JSON(http.StatusOK, "") }
+		return map[string]gin.HandlerFunc{
+			http.MethodGet:  ok,
+			http.MethodHead: ok,
+		}
+	case RouteCatalog:
+		return map[string]gin.HandlerFunc{
+			http.MethodGet: r.repoHandler.CatalogHandler,
+		}
+	case RouteManifest:
+		return map[string]gin.HandlerFunc{
+			http.MethodGet:    func(c *gin.Context) { r.manifestHandler.GetManifestHandler(c, route.Name, route.Reference) },
+			http.MethodHead:   func(c *gin.Context) { r.manifestHandler.ExistsManifestHandler(c, route.Name, route.Reference) },
+			http.MethodPut:    func(c *gin.Context) { r.manifestHandler.PutManifestHandler(c, route.Name, route.Reference) },
+			http.MethodDelete: func(c *gin.Context) { r.manifestHandler.DeleteManifestHandler(c, route.Name, route.Reference) },
+		}
+	case RouteBlob:
+		return map[string]gin.HandlerFunc{
+			http.MethodGet:    func(c *gin.Context) { r.blobHandler.GetBlobHandler(c, route.Name, route.Reference) },
+			http.MethodHead:   func(c *gin.Context) { r.blobHandler.ExistsBlobHandler(c, route.Name, route.Reference) },
+			http.MethodDelete: func(c *gin.Context) { r.blobHandler.DeleteBlobHandler(c, route.Name, route.Reference) },
+		}
+	case RouteBlobUploads:
+		return map[string]gin.HandlerFunc{
+			http.MethodPost: func(c *gin.Context) { r.blobHandler.StartUploadBlobHandler(c, route.Name) },
+		}
+	case RouteBlobUpload:
+		return map[string]gin.HandlerFunc{
+			http.MethodGet:    func(c *gin.Context) { r.blobHandler.GetUploadStatusHandler(c, route.Name, route.Uuid) },
+			http.MethodPatch:  func(c *gin.Context) { r.blobHandler.UploadChunkedBlobHandler(c, route.Name, route.Uuid) },
+			http.MethodPut:    func(c *gin.Context) { r.blobHandler.UploadBlobHandler(c, route.Name, route.Uuid) },
+			http.MethodDelete: func(c *gin.Context) { r.blobHandler.CancelUploadHandler(c, route.Name, route.Uuid) },
+		}
+	case RouteTags:
+		return map[string]gin.HandlerFunc{
+			http.MethodGet: func(c *gin.Context) { r.manifestHandler.GetTagsHandler(c, route.Name) },
+		}
+	case RouteReferrers:
+		return map[string]gin.HandlerFunc{
+			http.MethodGet: func(c *gin.Context) { r.manifestHandler.GetReferrersHandler(c, route.Name, route.Reference) },
+		}
+	case RouteExtension:
+		return r.extensionHandlers(route)
+	}
+	return nil
+}
+
+// TCR 独自の拡張。知らない拡張は存在しないエンドポイントとして扱う
+func (r *Router) extensionHandlers(route Route) map[string]gin.HandlerFunc {
+	if route.Name == "" && route.Extension == "_tcr" && route.ExtensionPath == "batch" {
+		return map[string]gin.HandlerFunc{
+			http.MethodPost: r.batchHandler.BatchHandler,
+		}
+	}
+	return nil
+}
+
+func allowedMethods(handlers map[string]gin.HandlerFunc) []string {
+	methods := make([]string, 0, len(handlers))
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
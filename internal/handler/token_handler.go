@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/service/usecase"
+	"github.com/gin-gonic/gin"
+)
+
+// Docker のトークン認証のトークンを発行する。/v2 の外に置く
+type TokenHandler struct {
+	usecase *usecase.TokenUseCase
+}
+
+func NewTokenHandler(u *usecase.TokenUseCase) *TokenHandler {
+	return &TokenHandler{
+		usecase: u,
+	}
+}
+
+type tokenResponse struct {
+	Token string `json:"token"`
+	// OAuth 2.0 と互換にするために同じ値を返す
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// GET /token?service=...&scope=...
+//
+// 資格情報は Basic 認証で受け取る。資格情報がなければクライアント証明書で認証し、それもなければ匿名のトークンを返す
+func (h *TokenHandler) GetTokenHandler(c *gin.Context) {
+	username, password, ok := c.Request.BasicAuth()
+	ctx := auth.WithClient(c.Request.Context(), requestClient(c))
+	out, err := h.usecase.IssueToken(ctx, dto.IssueTokenInput{
+		HasCredentials: ok,
+		Username:       username,
+		Password:       password,
+		Certificate:    clientCertificate(c),
+		Service:        c.Query("service"),
+		Scopes:         c.QueryArray("scope"),
+	})
+	if err != nil {
+		if errors.Is(err, apperrors.TCRERR_UNAUTHORIZED) {
+			c.Header("WWW-Authenticate", `Basic realm="tcr"`)
+		}
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, tokenResponse{
+		Token:       out.Token,
+		AccessToken: out.Token,
+		ExpiresIn:   int(out.ExpiresAt.Sub(out.IssuedAt).Seconds()),
+		IssuedAt:    out.IssuedAt.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,21 @@
+package persister
+
+import (
+	"context"
+
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+// ユーザーとロボットアカウント
+type AccountPersister interface {
+	// 存在しない場合は apperrors.ErrAccountNotFound を返す
+	FindAccount(ctx context.Context, input dto.FindAccountInput) (model.Account, error)
+	ListAccounts(ctx context.Context, kind string) ([]model.Account, error)
+	// すでに存在する場合は apperrors.ErrAccountAlreadyExists を返す
+	CreateAccount(ctx context.Context, account model.Account) error
+	// シークレット、無効かどうか、有効期限を更新する。存在しない場合は apperrors.ErrAccountNotFound を返す
+	UpdateAccount(ctx context.Context, account model.Account) error
+	// 最後に認証に使われた日時を記録する
+	TouchAccount(ctx context.Context, input dto.TouchAccountInput) error
+}
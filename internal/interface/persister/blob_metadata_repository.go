@@ -0,0 +1,22 @@
+package persister
+
+import (
+	"context"
+
+	"github.com/a-takamin/tcr/internal/dto"
+)
+
+// blob の実体とは別に、サイズや push された日時、どのリポジトリからリンクされているかを管理する。
+// blob の存在確認やストレージ使用量の集計はこちらを正とする
+type BlobMetadataPersister interface {
+	// リポジトリからのリンクを取得する
+	FindBlobMetadata(ctx context.Context, input dto.FindBlobMetadataInput) (dto.FindBlobMetadataOutput, error)
+	// 複数のリンクをまとめて取得する
+	BatchFindBlobMetadata(ctx context.Context, input dto.BatchFindBlobMetadataInput) (dto.BatchFindBlobMetadataOutput, error)
+	// どのリポジトリからのリンクかに関係なく、blob 自体のメタデータを取得する。Name は空になる
+	FindBlobContentMetadata(ctx context.Context, input dto.FindBlobContentMetadataInput) (dto.FindBlobMetadataOutput, error)
+	// blob 自体のメタデータとリポジトリからのリンクをアトミックに保存する
+	SaveBlobMetadata(ctx context.Context, input dto.SaveBlobMetadataInput) error
+	ListBlobLinks(ctx context.Context, input dto.ListBlobLinksInput) (dto.ListBlobLinksOutput, error)
+	DeleteBlobLink(ctx context.Context, input dto.DeleteBlobLinkInput) error
+}
@@ -1,14 +1,31 @@
 package persister
 
 import (
+	"context"
+
 	"github.com/a-takamin/tcr/internal/dto"
 )
 
+// blob を直接ダウンロードできる期限付きの URL を発行できるストレージが実装する。
+// 発行できない blob の場合は apperrors.ErrPresignUnavailable を返す
+type BlobURLPresigner interface {
+	PresignBlobURL(ctx context.Context, input dto.PresignBlobURLInput) (string, error)
+}
+
+// pull されそうな blob を先に読み込んでおける BlobPersister が実装する。
+// 先読みはバックグラウンドで行い、呼び出し側を待たせない。ctx がキャンセルされても先読みは続ける
+type BlobPrefetcher interface {
+	PrefetchBlobs(ctx context.Context, input dto.PrefetchBlobsInput)
+}
+
+// blob の実体は digest をキーにしてリポジトリをまたいで 1 つだけ保存する
 type BlobPersister interface {
-	ExistsBlob(input dto.ExistsBlobInput) (bool, error)
-	FindBlob(input dto.FindBlobInput) (dto.FindBlobOutput, error)
-	FindChunkedBlob(input dto.FindChunkedBlobInput) (dto.FindBlobOutput, error)
-	SaveBlob(input dto.SaveBlobInput) error
-	SaveChunkedBlob(input dto.SaveChunkedBlobInput) error
-	DeleteBlob(input dto.DeleteBlobInput) error
+	ExistsBlob(ctx context.Context, input dto.ExistsBlobInput) (bool, error)
+	FindBlob(ctx context.Context, input dto.FindBlobInput) (dto.FindBlobOutput, error)
+	FindChunkedBlob(ctx context.Context, input dto.FindChunkedBlobInput) (dto.FindBlobOutput, error)
+	SaveBlob(ctx context.Context, input dto.SaveBlobInput) error
+	SaveChunkedBlob(ctx context.Context, input dto.SaveChunkedBlobInput) error
+	// アップロード途中のチャンクを削除する。存在しないチャンクは無視する
+	DeleteChunkedBlobs(ctx context.Context, input dto.DeleteChunkedBlobsInput) error
+	DeleteBlob(ctx context.Context, input dto.DeleteBlobInput) error
 }
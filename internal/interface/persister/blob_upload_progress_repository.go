@@ -1,8 +1,14 @@
 package persister
 
-import "github.com/a-takamin/tcr/internal/dto"
+import (
+	"context"
+
+	"github.com/a-takamin/tcr/internal/dto"
+)
 
 type BlobUploadProgressPersister interface {
-	FindBlobUploadProgress(input dto.FindBlobUploadProgressInput) (dto.FindBlobUploadProgressOutput, error)
-	SaveBlobUploadProgress(input dto.SaveBlobUploadProgressInput) error
+	FindBlobUploadProgress(ctx context.Context, input dto.FindBlobUploadProgressInput) (dto.FindBlobUploadProgressOutput, error)
+	// input.Version が保存されている Version と一致しない場合は apperrors.ErrBlobUploadConflict を返す
+	SaveBlobUploadProgress(ctx context.Context, input dto.SaveBlobUploadProgressInput) error
+	DeleteBlobUploadProgress(ctx context.Context, input dto.DeleteBlobUploadProgressInput) error
 }
@@ -0,0 +1,16 @@
+package persister
+
+import (
+	"context"
+
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+// リポジトリに対する権限の付与
+type GrantPersister interface {
+	ListGrants(ctx context.Context) ([]model.Grant, error)
+	SaveGrant(ctx context.Context, grant model.Grant) error
+	// 存在しない場合は apperrors.ErrGrantNotFound を返す
+	DeleteGrant(ctx context.Context, input dto.DeleteGrantInput) error
+}
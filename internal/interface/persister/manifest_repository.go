@@ -1,6 +1,8 @@
 package persister
 
 import (
+	"context"
+
 	"github.com/a-takamin/tcr/internal/dto"
 )
 
@@ -8,10 +10,18 @@ type ManifestPersister interface {
 	// リファクタ
 	// 次の段階: なるべきエンティティ（ドメインオブジェクト）を引数や戻り値で扱うようにする
 	// つまり、ユースケースにドメインオブジェクトをそのまま永続化しているように感じさせる
-	ExistsManifest(input dto.ExistsManifestInput) (bool, error)
-	FindManifest(input dto.FindManifestInput) (dto.FindManifestOutput, error)
-	SaveManifest(input dto.SaveManifestInput) error
-	DeleteManifest(input dto.DeleteManifestInput) error
+	ExistsManifest(ctx context.Context, input dto.ExistsManifestInput) (bool, error)
+	FindManifest(ctx context.Context, input dto.FindManifestInput) (dto.FindManifestOutput, error)
+	// 複数の digest やタグをまとめて解決する。マニフェストの中身は取得しない
+	ResolveReferences(ctx context.Context, input dto.ResolveReferencesInput) (dto.ResolveReferencesOutput, error)
+	// マニフェストの登録とタグの付け替えはアトミックに行われなければならない。
+	// リポジトリが存在しない場合は apperrors.ErrRepositoryNotFound を返す
+	SaveManifest(ctx context.Context, input dto.SaveManifestInput) error
+	// Reference が digest の場合はマニフェストとそれを指すタグを、タグの場合はタグだけを削除する。
+	// 削除するものがなければ apperrors.ErrManifestNotFound を返す
+	DeleteManifest(ctx context.Context, input dto.DeleteManifestInput) error
+	// Digest のマニフェストを subject に持つマニフェストを取得する
+	ListReferrers(ctx context.Context, input dto.ListReferrersInput) (dto.ListReferrersOutput, error)
 	// tag
-	GetTags(name string) (dto.GetTagsResponse, error)
+	GetTags(ctx context.Context, name string) (dto.GetTagsResponse, error)
 }
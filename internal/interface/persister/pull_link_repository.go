@@ -0,0 +1,21 @@
+package persister
+
+import (
+	"context"
+
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+type PullLinkPersister interface {
+	ListPullLinks(ctx context.Context) ([]model.PullLink, error)
+	// 存在しない場合は apperrors.ErrPullLinkNotFound を返す
+	FindPullLink(ctx context.Context, input dto.FindPullLinkInput) (model.PullLink, error)
+	CreatePullLink(ctx context.Context, link model.PullLink) error
+	// 存在しない場合は apperrors.ErrPullLinkNotFound を返す
+	RevokePullLink(ctx context.Context, input dto.RevokePullLinkInput) error
+	// 使われた記録を残し、リンクの最終利用日時と回数を更新する
+	RecordPullLinkUse(ctx context.Context, use model.PullLinkUse) error
+	// 新しいものから順に返す
+	ListPullLinkUses(ctx context.Context, input dto.ListPullLinkUsesInput) ([]model.PullLinkUse, error)
+}
@@ -1,9 +1,21 @@
 package persister
 
-import "github.com/a-takamin/tcr/internal/dto"
+import (
+	"context"
+
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+)
 
 type RepositoryPersister interface {
-	ExistsRepository(input dto.ExistsRepositoryInput) (bool, error)
-	SaveRepository(input dto.SaveRepositoryInput) error
-	DeleteRepository(input dto.DeleteRepositoryInput) error
+	ExistsRepository(ctx context.Context, input dto.ExistsRepositoryInput) (bool, error)
+	// なければ ErrRepositoryNotFound を返す
+	FindRepository(ctx context.Context, input dto.FindRepositoryInput) (model.Repository, error)
+	// リポジトリの一覧を名前順に取得する
+	ListRepositories(ctx context.Context, input dto.ListRepositoriesInput) (dto.ListRepositoriesOutput, error)
+	// すでにある場合は何もしない
+	SaveRepository(ctx context.Context, input dto.SaveRepositoryInput) error
+	// なければ ErrRepositoryNotFound を返す
+	SetRepositoryVisibility(ctx context.Context, input dto.SetRepositoryVisibilityInput) error
+	DeleteRepository(ctx context.Context, input dto.DeleteRepositoryInput) error
 }
@@ -0,0 +1,14 @@
+package persister
+
+import "context"
+
+// メタデータの保存先ごとに、テーブルなどのスキーマとそのバージョンを管理する
+type SchemaMigrator interface {
+	// テーブルやインデックスがなければ作成する。すでにあるものは変更しない
+	EnsureSchema(ctx context.Context) error
+	// 適用済みのスキーマバージョンと、このバイナリが知っている最新のバージョンを返す
+	SchemaVersion(ctx context.Context) (current int, latest int, err error)
+	// 未適用のマイグレーションを順に適用する。
+	// 途中で中断した場合は、次に呼ばれたときに中断したところから再開する
+	Migrate(ctx context.Context) error
+}
@@ -0,0 +1,18 @@
+package persister
+
+import (
+	"context"
+
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+type TeamPersister interface {
+	ListTeams(ctx context.Context) ([]model.Team, error)
+	// すでに存在する場合は apperrors.ErrTeamAlreadyExists を返す
+	CreateTeam(ctx context.Context, team model.Team) error
+	// メンバーを置き換える。存在しない場合は apperrors.ErrTeamNotFound を返す
+	UpdateTeam(ctx context.Context, team model.Team) error
+	// 存在しない場合は apperrors.ErrTeamNotFound を返す
+	DeleteTeam(ctx context.Context, input dto.DeleteTeamInput) error
+}
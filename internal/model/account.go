@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+// メタデータに保存するユーザーかロボットアカウント
+type Account struct {
+	// user か robot
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// パスワードかシークレットの bcrypt のハッシュ。API では返さない
+	SecretHash string `json:"-"`
+	Disabled   bool   `json:"disabled"`
+	// シークレットの有効期限。ユーザーは期限を持たない
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	CreatedBy  string     `json:"createdBy"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// ユーザーのまとまり。権限の付与ではグループとして扱う
+type Team struct {
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy"`
+}
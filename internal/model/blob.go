@@ -1,7 +1,9 @@
 package model
 
 type Blob struct {
-	Blob   []byte
-	Digest string
-	Name   string
+	Blob      []byte
+	Digest    string
+	Name      string
+	Size      int64
+	MediaType string
 }
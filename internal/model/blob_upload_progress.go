@@ -7,4 +7,5 @@ type BlobUploadProgress struct {
 	NextChunkNo  int    `json:"NextChunkNo"`
 	Done         bool   `json:"Done"`
 	Digest       string `json:"Digest"`
+	Version      int64  `json:"Version"`
 }
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// Pattern に一致するリポジトリに対して、Subject に Role を与える
+type Grant struct {
+	ID string `json:"id"`
+	// user、group か robot
+	SubjectType string `json:"subjectType"`
+	Subject     string `json:"subject"`
+	// リポジトリ名のパターン。* は / を含む任意の文字列に一致する (例: team-a/*)
+	Pattern   string    `json:"pattern"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy"`
+}
@@ -7,13 +7,15 @@ type ManifestMetadata struct {
 }
 
 type Manifest struct {
-	SchemaVersion int               `json:"schemaVersion"`
-	MediaType     string            `json:"mediaType"`
-	ArtifactType  string            `json:"artifactType"`
-	Config        Descriptor        `json:"config"`
-	Layers        []Descriptor      `json:"layers"`
-	Subject       Descriptor        `json:"subject"`
-	Annotations   map[string]string `json:"annotations"`
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	ArtifactType  string       `json:"artifactType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+	// インデックスの場合に含まれるマニフェスト
+	Manifests   []Descriptor      `json:"manifests"`
+	Subject     Descriptor        `json:"subject"`
+	Annotations map[string]string `json:"annotations"`
 }
 
 type Descriptor struct {
@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+// アカウントを作らずに、1 つのリポジトリ (と digest) の pull だけを期限付きで許可するリンク
+type PullLink struct {
+	ID         string `json:"id"`
+	Repository string `json:"repository"`
+	// 空ならリポジトリのすべてのマニフェストを pull できる
+	Digest      string     `json:"digest,omitempty"`
+	Description string     `json:"description,omitempty"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CreatedBy   string     `json:"createdBy"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+	RevokedBy   string     `json:"revokedBy,omitempty"`
+	// 使われた記録は同じクライアントから 1 分に 1 回までなので、Uses はリクエストの数ではない
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	Uses       int        `json:"uses"`
+}
+
+// pull link のトークンで認証したことの記録
+type PullLinkUse struct {
+	LinkID    string    `json:"linkId"`
+	UsedAt    time.Time `json:"usedAt"`
+	ClientIP  string    `json:"clientIp"`
+	UserAgent string    `json:"userAgent"`
+}
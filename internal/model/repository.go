@@ -1,5 +1,7 @@
 package model
 
 type Repository struct {
-	Name string
+	Name string `json:"name"`
+	// public、internal か private。空なら private として扱う
+	Visibility string `json:"visibility"`
 }
@@ -0,0 +1,273 @@
+package repository
+
+import (
+	"context"
+
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/a-takamin/tcr/internal/service/domain"
+	"golang.org/x/sync/singleflight"
+)
+
+// 先読みで同時に取得する blob の数
+const prefetchConcurrency = 4
+
+var errBlobDigestMismatch = errors.New("blob content does not match its digest")
+
+// BlobPersister をラップして、取得した blob をローカルディスクにキャッシュする。
+//
+// キャッシュの合計サイズが maxBytes を超えると、最後に使われたのが古いものから削除する。
+// 同じ digest への取得が同時に来た場合、ストレージへの読み込みは 1 回にまとめられる
+type CachedBlobRepository struct {
+	persister.BlobPersister
+	dir      string
+	maxBytes int64
+
+	group singleflight.Group
+
+	mu      sync.Mutex
+	lru     *list.List // 先頭ほど最近使われた cacheEntry
+	entries map[string]*list.Element
+	size    int64
+}
+
+type cacheEntry struct {
+	digest string
+	size   int64
+}
+
+// dir にすでにあるキャッシュは更新日時の新しい順に引き継ぐ
+func NewCachedBlobRepository(inner persister.BlobPersister, dir string, maxBytes int64) (*CachedBlobRepository, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	r := &CachedBlobRepository{
+		BlobPersister: inner,
+		dir:           dir,
+		maxBytes:      maxBytes,
+		lru:           list.New(),
+		entries:       map[string]*list.Element{},
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type existing struct {
+		entry   cacheEntry
+		modTime int64
+	}
+	var found []existing
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		// 書き込み途中で終了したファイル
+		if strings.HasPrefix(f.Name(), ".tmp-") {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		found = append(found, existing{
+			entry:   cacheEntry{digest: strings.Replace(f.Name(), "-", ":", 1), size: info.Size()},
+			modTime: info.ModTime().UnixNano(),
+		})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime > found[j].modTime })
+	for _, f := range found {
+		r.entries[f.entry.digest] = r.lru.PushBack(f.entry)
+		r.size += f.entry.size
+	}
+	r.mu.Lock()
+	r.evict()
+	r.mu.Unlock()
+
+	return r, nil
+}
+
+func (r *CachedBlobRepository) path(digest string) string {
+	return filepath.Join(r.dir, strings.Replace(digest, ":", "-", 1))
+}
+
+// blobs/<digest> に保存されているかを返す。キャッシュは移行前のキーから読んだ blob も持つので見ない
+func (r *CachedBlobRepository) ExistsBlob(ctx context.Context, input dto.ExistsBlobInput) (bool, error) {
+	return r.BlobPersister.ExistsBlob(ctx, input)
+}
+
+func (r *CachedBlobRepository) FindBlob(ctx context.Context, input dto.FindBlobInput) (dto.FindBlobOutput, error) {
+	// digest の形式でないものはファイル名にできないのでキャッシュしない
+	if domain.ValidateDigest(input.Digest) != nil {
+		return r.BlobPersister.FindBlob(ctx, input)
+	}
+
+	if blob, ok := r.load(input.Digest); ok {
+		return dto.FindBlobOutput{Blob: blob}, nil
+	}
+
+	v, err, _ := r.group.Do(input.Digest, func() (interface{}, error) {
+		// 待っている間に他のリクエストがキャッシュしているかもしれない
+		if blob, ok := r.load(input.Digest); ok {
+			return blob, nil
+		}
+		// 同じ blob を待っている他のリクエストもいるので、最初のリクエストが切断されても取得は続ける
+		resp, err := r.BlobPersister.FindBlob(context.WithoutCancel(ctx), input)
+		if err != nil {
+			return nil, err
+		}
+		if fmt.Sprintf("sha256:%x", sha256.Sum256(resp.Blob)) != input.Digest {
+			return nil, fmt.Errorf("%w: %s", errBlobDigestMismatch, input.Digest)
+		}
+		err = r.store(input.Digest, resp.Blob)
+		if err != nil {
+			// キャッシュできなくても取得自体は成功している
+			slog.Warn("failed to cache blob", "digest", input.Digest, "error", err.Error())
+		}
+		return resp.Blob, nil
+	})
+	if err != nil {
+		return dto.FindBlobOutput{}, err
+	}
+	return dto.FindBlobOutput{Blob: v.([]byte)}, nil
+}
+
+func (r *CachedBlobRepository) DeleteBlob(ctx context.Context, input dto.DeleteBlobInput) error {
+	r.mu.Lock()
+	if e, ok := r.entries[input.Digest]; ok {
+		r.remove(e)
+	}
+	r.mu.Unlock()
+	return r.BlobPersister.DeleteBlob(ctx, input)
+}
+
+// キャッシュ越しでもストレージが URL を発行できるならリダイレクトできるようにする
+func (r *CachedBlobRepository) PresignBlobURL(ctx context.Context, input dto.PresignBlobURLInput) (string, error) {
+	presigner, ok := r.BlobPersister.(persister.BlobURLPresigner)
+	if !ok {
+		return "", apperrors.ErrPresignUnavailable
+	}
+	return presigner.PresignBlobURL(ctx, input)
+}
+
+// マニフェストが pull されたときに、続いて pull されるはずのレイヤーを先にキャッシュしておく
+func (r *CachedBlobRepository) PrefetchBlobs(ctx context.Context, input dto.PrefetchBlobsInput) {
+	// マニフェストのレスポンスを返した後も読み込みを続ける
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		sem := make(chan struct{}, prefetchConcurrency)
+		var wg sync.WaitGroup
+		for _, digest := range input.Digests {
+			r.mu.Lock()
+			_, ok := r.entries[digest]
+			r.mu.Unlock()
+			if ok {
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(digest string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				_, err := r.FindBlob(ctx, dto.FindBlobInput{Name: input.Name, Digest: digest})
+				if err != nil {
+					slog.Warn("failed to prefetch blob", "digest", digest, "error", err.Error())
+				}
+			}(digest)
+		}
+		wg.Wait()
+	}()
+}
+
+func (r *CachedBlobRepository) load(digest string) ([]byte, bool) {
+	r.mu.Lock()
+	e, ok := r.entries[digest]
+	if ok {
+		r.lru.MoveToFront(e)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	blob, err := os.ReadFile(r.path(digest))
+	if err != nil {
+		// 削除された直後など。キャッシュにないものとして扱う
+		r.mu.Lock()
+		if e, ok := r.entries[digest]; ok {
+			r.remove(e)
+		}
+		r.mu.Unlock()
+		return nil, false
+	}
+	return blob, true
+}
+
+func (r *CachedBlobRepository) store(digest string, blob []byte) error {
+	size := int64(len(blob))
+	if size > r.maxBytes {
+		return nil
+	}
+
+	// 書き込み途中のファイルを読まれないよう、一時ファイルに書いてから置き換える
+	tmp, err := os.CreateTemp(r.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(blob)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.path(digest))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.entries[digest]; ok {
+		r.size -= e.Value.(cacheEntry).size
+		r.lru.Remove(e)
+	}
+	r.entries[digest] = r.lru.PushFront(cacheEntry{digest: digest, size: size})
+	r.size += size
+	r.evict()
+	return nil
+}
+
+// r.mu を取得した状態で呼ぶこと
+func (r *CachedBlobRepository) evict() {
+	for r.size > r.maxBytes {
+		e := r.lru.Back()
+		if e == nil {
+			return
+		}
+		r.remove(e)
+	}
+}
+
+// r.mu を取得した状態で呼ぶこと
+func (r *CachedBlobRepository) remove(e *list.Element) {
+	entry := e.Value.(cacheEntry)
+	r.lru.Remove(e)
+	delete(r.entries, entry.digest)
+	r.size -= entry.size
+	err := os.Remove(r.path(entry.digest))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to remove cached blob", "digest", entry.digest, "error", err.Error())
+	}
+}
@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/dto"
+	s3Type "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type fakeBlobStore struct {
+	blobs map[string][]byte
+	// 移行前のリポジトリごとのキーにある blob
+	legacy map[string][]byte
+	reads  atomic.Int32
+	delay  time.Duration
+}
+
+func (s *fakeBlobStore) ExistsBlob(ctx context.Context, input dto.ExistsBlobInput) (bool, error) {
+	_, ok := s.blobs[input.Digest]
+	return ok, nil
+}
+func (s *fakeBlobStore) FindBlob(ctx context.Context, input dto.FindBlobInput) (dto.FindBlobOutput, error) {
+	s.reads.Add(1)
+	time.Sleep(s.delay)
+	b, ok := s.blobs[input.Digest]
+	if !ok && input.Name != "" {
+		b, ok = s.legacy[legacyBlobKey(input.Name, input.Digest)]
+	}
+	if !ok {
+		return dto.FindBlobOutput{}, &s3Type.NoSuchKey{}
+	}
+	return dto.FindBlobOutput{Blob: b}, nil
+}
+func (s *fakeBlobStore) FindChunkedBlob(ctx context.Context, input dto.FindChunkedBlobInput) (dto.FindBlobOutput, error) {
+	return dto.FindBlobOutput{}, nil
+}
+func (s *fakeBlobStore) SaveBlob(ctx context.Context, input dto.SaveBlobInput) error {
+	b, err := io.ReadAll(input.Blob)
+	if err != nil {
+		return err
+	}
+	s.blobs[input.Digest] = b
+	return nil
+}
+func (s *fakeBlobStore) SaveChunkedBlob(ctx context.Context, input dto.SaveChunkedBlobInput) error {
+	return nil
+}
+func (s *fakeBlobStore) DeleteBlob(ctx context.Context, input dto.DeleteBlobInput) error { return nil }
+func (s *fakeBlobStore) DeleteChunkedBlobs(ctx context.Context, input dto.DeleteChunkedBlobsInput) error {
+	return nil
+}
+
+func digestOf(b []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+func TestCachedBlobRepositoryCoalescesMisses(t *testing.T) {
+	blob := []byte("layer")
+	store := &fakeBlobStore{blobs: map[string][]byte{digestOf(blob): blob}, delay: 50 * time.Millisecond}
+	cache, err := NewCachedBlobRepository(store, t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("err is %s, but want nil", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := cache.FindBlob(context.Background(), dto.FindBlobInput{Digest: digestOf(blob)})
+			if err != nil || string(resp.Blob) != "layer" {
+				t.Errorf("got is %s, %v, but want layer", resp.Blob, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 2 回目以降はディスクから返る
+	_, err = cache.FindBlob(context.Background(), dto.FindBlobInput{Digest: digestOf(blob)})
+	if err != nil {
+		t.Fatalf("err is %s, but want nil", err.Error())
+	}
+	if got := store.reads.Load(); got != 1 {
+		t.Fatalf("backend reads are %d, but want 1", got)
+	}
+}
+
+func TestCachedBlobRepositoryRejectsDigestMismatch(t *testing.T) {
+	digest := digestOf([]byte("expected"))
+	store := &fakeBlobStore{blobs: map[string][]byte{digest: []byte("corrupted")}}
+	cache, err := NewCachedBlobRepository(store, t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("err is %s, but want nil", err.Error())
+	}
+
+	_, err = cache.FindBlob(context.Background(), dto.FindBlobInput{Digest: digest})
+	if !errors.Is(err, errBlobDigestMismatch) {
+		t.Fatalf("err is %v, but want %v", err, errBlobDigestMismatch)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, ok := cache.entries[digest]; ok {
+		t.Fatalf("corrupted blob is cached")
+	}
+}
+
+func TestCachedBlobRepositoryEvictsLeastRecentlyUsed(t *testing.T) {
+	a, b, c := []byte("aaaa"), []byte("bbbb"), []byte("cccc")
+	store := &fakeBlobStore{blobs: map[string][]byte{digestOf(a): a, digestOf(b): b, digestOf(c): c}}
+	cache, err := NewCachedBlobRepository(store, t.TempDir(), 8)
+	if err != nil {
+		t.Fatalf("err is %s, but want nil", err.Error())
+	}
+
+	for _, blob := range [][]byte{a, b, a, c} {
+		_, err := cache.FindBlob(context.Background(), dto.FindBlobInput{Digest: digestOf(blob)})
+		if err != nil {
+			t.Fatalf("err is %s, but want nil", err.Error())
+		}
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, ok := cache.entries[digestOf(b)]; ok {
+		t.Fatalf("least recently used blob is not evicted")
+	}
+	if _, ok := cache.entries[digestOf(a)]; !ok {
+		t.Fatalf("recently used blob is evicted")
+	}
+	if cache.size != 8 {
+		t.Fatalf("size is %d, but want 8", cache.size)
+	}
+}
+
+func TestCachedBlobRepositoryExistsBlob(t *testing.T) {
+	stored, legacy := []byte("stored"), []byte("legacy")
+	store := &fakeBlobStore{
+		blobs:  map[string][]byte{digestOf(stored): stored},
+		legacy: map[string][]byte{legacyBlobKey("org/repo", digestOf(legacy)): legacy},
+	}
+	cache, err := NewCachedBlobRepository(store, t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("err is %s, but want nil", err.Error())
+	}
+	tests := []struct {
+		testName string
+		blob     []byte
+		want     bool
+	}{
+		{testName: "digest のキーにある", blob: stored, want: true},
+		{testName: "移行前のキーから読んでキャッシュしただけ", blob: legacy, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			_, err := cache.FindBlob(context.Background(), dto.FindBlobInput{Name: "org/repo", Digest: digestOf(tt.blob)})
+			if err != nil {
+				t.Fatalf("err is %s, but want nil", err.Error())
+			}
+			got, err := cache.ExistsBlob(context.Background(), dto.ExistsBlobInput{Digest: digestOf(tt.blob)})
+			if err != nil {
+				t.Fatalf("err is %s, but want nil", err.Error())
+			}
+			if got != tt.want {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+		})
+	}
+}
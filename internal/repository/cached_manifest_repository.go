@@ -0,0 +1,181 @@
+package repository
+
+import (
+	"context"
+
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/a-takamin/tcr/internal/service/domain"
+)
+
+// /debug/vars で確認できるキャッシュのヒット数とミス数
+var manifestCacheStats = expvar.NewMap("manifest_cache")
+
+// ManifestPersister をラップして、マニフェストとタグの解決結果をメモリにキャッシュする。
+//
+// digest で指定されたマニフェストは中身が変わらないので、件数の上限に達するまで保持し続ける。
+// タグが指す digest は他のインスタンスで付け替えられることがあるので tagTTL の間だけ保持する。
+// このインスタンスで PUT や DELETE が行われた場合はすぐに破棄する
+type CachedManifestRepository struct {
+	persister.ManifestPersister
+	tagTTL     time.Duration
+	maxEntries int
+
+	mu        sync.Mutex
+	manifests map[manifestKey]*list.Element
+	lru       *list.List // 先頭ほど最近使われた dto.FindManifestOutput
+	tags      map[manifestKey]cachedTag
+}
+
+// Reference は digest かタグ
+type manifestKey struct {
+	Name      string
+	Reference string
+}
+
+type cachedTag struct {
+	digest    string
+	expiresAt time.Time
+}
+
+func NewCachedManifestRepository(inner persister.ManifestPersister, tagTTL time.Duration, maxEntries int) *CachedManifestRepository {
+	return &CachedManifestRepository{
+		ManifestPersister: inner,
+		tagTTL:            tagTTL,
+		maxEntries:        maxEntries,
+		manifests:         map[manifestKey]*list.Element{},
+		lru:               list.New(),
+		tags:              map[manifestKey]cachedTag{},
+	}
+}
+
+func (r *CachedManifestRepository) ExistsManifest(ctx context.Context, input dto.ExistsManifestInput) (bool, error) {
+	manifest, err := r.FindManifest(ctx, dto.FindManifestInput{
+		Name:      input.Name,
+		Reference: input.Reference,
+	})
+	if err != nil {
+		return false, err
+	}
+	return manifest.Name != "", nil
+}
+
+func (r *CachedManifestRepository) FindManifest(ctx context.Context, input dto.FindManifestInput) (dto.FindManifestOutput, error) {
+	digest := input.Reference
+	if !domain.IsDigest(input.Reference) {
+		var ok bool
+		digest, ok = r.lookupTag(manifestKey{Name: input.Name, Reference: input.Reference})
+		if !ok {
+			manifestCacheStats.Add("tag_misses", 1)
+			return r.findAndCache(ctx, input)
+		}
+		manifestCacheStats.Add("tag_hits", 1)
+	}
+
+	if manifest, ok := r.lookupManifest(manifestKey{Name: input.Name, Reference: digest}); ok {
+		manifestCacheStats.Add("digest_hits", 1)
+		if !domain.IsDigest(input.Reference) {
+			manifest.Tag = input.Reference
+		}
+		return manifest, nil
+	}
+	manifestCacheStats.Add("digest_misses", 1)
+	return r.findAndCache(ctx, input)
+}
+
+func (r *CachedManifestRepository) SaveManifest(ctx context.Context, input dto.SaveManifestInput) error {
+	err := r.ManifestPersister.SaveManifest(ctx, input)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if input.Tag != "" {
+		delete(r.tags, manifestKey{Name: input.Name, Reference: input.Tag})
+	}
+	return err
+}
+
+func (r *CachedManifestRepository) DeleteManifest(ctx context.Context, input dto.DeleteManifestInput) error {
+	err := r.ManifestPersister.DeleteManifest(ctx, input)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !domain.IsDigest(input.Reference) {
+		delete(r.tags, manifestKey{Name: input.Name, Reference: input.Reference})
+		return err
+	}
+	if e, ok := r.manifests[manifestKey{Name: input.Name, Reference: input.Reference}]; ok {
+		r.removeManifest(e)
+	}
+	for key, tag := range r.tags {
+		if key.Name == input.Name && tag.digest == input.Reference {
+			delete(r.tags, key)
+		}
+	}
+	return err
+}
+
+func (r *CachedManifestRepository) findAndCache(ctx context.Context, input dto.FindManifestInput) (dto.FindManifestOutput, error) {
+	manifest, err := r.ManifestPersister.FindManifest(ctx, input)
+	if err != nil || manifest.Name == "" {
+		return manifest, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !domain.IsDigest(input.Reference) {
+		r.tags[manifestKey{Name: input.Name, Reference: input.Reference}] = cachedTag{
+			digest:    manifest.Digest,
+			expiresAt: time.Now().Add(r.tagTTL),
+		}
+	}
+	key := manifestKey{Name: manifest.Name, Reference: manifest.Digest}
+	if e, ok := r.manifests[key]; ok {
+		r.lru.MoveToFront(e)
+		return manifest, nil
+	}
+	// タグ経由で取得した場合でも、digest のキャッシュにはタグを含めない
+	cached := manifest
+	cached.Tag = ""
+	r.manifests[key] = r.lru.PushFront(cached)
+	for r.lru.Len() > r.maxEntries {
+		r.removeManifest(r.lru.Back())
+	}
+	return manifest, nil
+}
+
+func (r *CachedManifestRepository) lookupTag(key manifestKey) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tag, ok := r.tags[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(tag.expiresAt) {
+		delete(r.tags, key)
+		return "", false
+	}
+	return tag.digest, true
+}
+
+func (r *CachedManifestRepository) lookupManifest(key manifestKey) (dto.FindManifestOutput, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.manifests[key]
+	if !ok {
+		return dto.FindManifestOutput{}, false
+	}
+	r.lru.MoveToFront(e)
+	return e.Value.(dto.FindManifestOutput), true
+}
+
+// r.mu を取得した状態で呼ぶこと
+func (r *CachedManifestRepository) removeManifest(e *list.Element) {
+	manifest := e.Value.(dto.FindManifestOutput)
+	r.lru.Remove(e)
+	delete(r.manifests, manifestKey{Name: manifest.Name, Reference: manifest.Digest})
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/dto"
+)
+
+type fakeManifestStore struct {
+	tags  map[string]string
+	finds int
+}
+
+func (s *fakeManifestStore) ExistsManifest(ctx context.Context, input dto.ExistsManifestInput) (bool, error) {
+	return false, nil
+}
+func (s *fakeManifestStore) FindManifest(ctx context.Context, input dto.FindManifestInput) (dto.FindManifestOutput, error) {
+	s.finds++
+	digest := input.Reference
+	if d, ok := s.tags[input.Reference]; ok {
+		digest = d
+	}
+	return dto.FindManifestOutput{Name: input.Name, Digest: digest, Manifest: []byte(digest)}, nil
+}
+func (s *fakeManifestStore) SaveManifest(ctx context.Context, input dto.SaveManifestInput) error {
+	s.tags[input.Tag] = input.Digest
+	return nil
+}
+func (s *fakeManifestStore) DeleteManifest(ctx context.Context, input dto.DeleteManifestInput) error {
+	delete(s.tags, input.Reference)
+	return nil
+}
+func (s *fakeManifestStore) ResolveReferences(ctx context.Context, input dto.ResolveReferencesInput) (dto.ResolveReferencesOutput, error) {
+	return dto.ResolveReferencesOutput{}, nil
+}
+func (s *fakeManifestStore) ListReferrers(ctx context.Context, input dto.ListReferrersInput) (dto.ListReferrersOutput, error) {
+	return dto.ListReferrersOutput{}, nil
+}
+func (s *fakeManifestStore) GetTags(ctx context.Context, name string) (dto.GetTagsResponse, error) {
+	return dto.GetTagsResponse{}, nil
+}
+
+const (
+	digestA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	digestB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func TestCachedManifestRepository(t *testing.T) {
+	store := &fakeManifestStore{tags: map[string]string{"latest": digestA}}
+	cache := NewCachedManifestRepository(store, time.Minute, 10)
+	find := func(reference string) string {
+		t.Helper()
+		resp, err := cache.FindManifest(context.Background(), dto.FindManifestInput{Name: "org/repo", Reference: reference})
+		if err != nil {
+			t.Fatalf("err is %s, but want nil", err.Error())
+		}
+		return resp.Digest
+	}
+
+	// タグの解決もマニフェストの取得もキャッシュされる
+	find("latest")
+	find("latest")
+	find(digestA)
+	if store.finds != 1 {
+		t.Fatalf("finds are %d, but want 1", store.finds)
+	}
+
+	// このインスタンスでタグを付け替えたらすぐに反映される
+	err := cache.SaveManifest(context.Background(), dto.SaveManifestInput{Name: "org/repo", Tag: "latest", Digest: digestB})
+	if err != nil {
+		t.Fatalf("err is %s, but want nil", err.Error())
+	}
+	if got := find("latest"); got != digestB {
+		t.Fatalf("got is %s, but want %s", got, digestB)
+	}
+
+	// digest で削除したらそれを指すタグのキャッシュも消える
+	err = cache.DeleteManifest(context.Background(), dto.DeleteManifestInput{Name: "org/repo", Reference: digestB})
+	if err != nil {
+		t.Fatalf("err is %s, but want nil", err.Error())
+	}
+	finds := store.finds
+	find("latest")
+	if store.finds == finds {
+		t.Fatalf("deleted manifest is still cached")
+	}
+}
+
+func TestCachedManifestRepositoryTagExpires(t *testing.T) {
+	store := &fakeManifestStore{tags: map[string]string{"latest": digestA}}
+	cache := NewCachedManifestRepository(store, 0, 10)
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.FindManifest(context.Background(), dto.FindManifestInput{Name: "org/repo", Reference: "latest"})
+		if err != nil {
+			t.Fatalf("err is %s, but want nil", err.Error())
+		}
+	}
+	if store.finds != 2 {
+		t.Fatalf("finds are %d, but want 2", store.finds)
+	}
+}
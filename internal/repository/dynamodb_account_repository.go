@@ -0,0 +1,204 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// アカウントの数は多くないので、一覧できるように 1 つのパーティションにまとめる
+type Account struct {
+	itemKeys
+	Kind       string `dynamodbav:"Kind"`
+	Name       string `dynamodbav:"Name"`
+	SecretHash string `dynamodbav:"SecretHash"`
+	Disabled   bool   `dynamodbav:"Disabled"`
+	ExpiresAt  string `dynamodbav:"ExpiresAt,omitempty"`
+	CreatedAt  string `dynamodbav:"CreatedAt"`
+	CreatedBy  string `dynamodbav:"CreatedBy"`
+	LastUsedAt string `dynamodbav:"LastUsedAt,omitempty"`
+}
+
+type AccountRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewAccountRepository(client *dynamodb.Client, TableName string) *AccountRepository {
+	return &AccountRepository{
+		client:    client,
+		tableName: TableName,
+	}
+}
+
+func (r AccountRepository) FindAccount(ctx context.Context, input dto.FindAccountInput) (model.Account, error) {
+	resp, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       tableKey(accountsPK, accountSK(input.Kind, input.Name)),
+	})
+	if err != nil {
+		return model.Account{}, err
+	}
+	if resp.Item == nil {
+		return model.Account{}, apperrors.ErrAccountNotFound
+	}
+	var item Account
+	err = attributevalue.UnmarshalMap(resp.Item, &item)
+	if err != nil {
+		return model.Account{}, err
+	}
+	return item.toModel(), nil
+}
+
+func (r AccountRepository) ListAccounts(ctx context.Context, kind string) ([]model.Account, error) {
+	keyEx := expression.Key("PK").Equal(expression.Value(accountsPK)).
+		And(expression.Key("SK").BeginsWith(accountSK(kind, "")))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []model.Account
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var items []Account
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			accounts = append(accounts, item.toModel())
+		}
+	}
+	return accounts, nil
+}
+
+func (r AccountRepository) CreateAccount(ctx context.Context, account model.Account) error {
+	item, err := attributevalue.MarshalMap(Account{
+		itemKeys: itemKeys{
+			PK:   accountsPK,
+			SK:   accountSK(account.Kind, account.Name),
+			Type: itemTypeAccount,
+		},
+		Kind:       account.Kind,
+		Name:       account.Name,
+		SecretHash: account.SecretHash,
+		Disabled:   account.Disabled,
+		ExpiresAt:  formatOptionalTime(account.ExpiresAt),
+		CreatedAt:  account.CreatedAt.UTC().Format(time.RFC3339Nano),
+		CreatedBy:  account.CreatedBy,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrAccountAlreadyExists
+	}
+	return err
+}
+
+// 最後に使われた日時は認証のたびに別に更新されるので、項目全体は置き換えない
+func (r AccountRepository) UpdateAccount(ctx context.Context, account model.Account) error {
+	update := expression.Set(expression.Name("SecretHash"), expression.Value(account.SecretHash)).
+		Set(expression.Name("Disabled"), expression.Value(account.Disabled))
+	if account.ExpiresAt != nil {
+		update = update.Set(expression.Name("ExpiresAt"), expression.Value(formatOptionalTime(account.ExpiresAt)))
+	} else {
+		update = update.Remove(expression.Name("ExpiresAt"))
+	}
+	cond := expression.AttributeExists(expression.Name("PK"))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       tableKey(accountsPK, accountSK(account.Kind, account.Name)),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrAccountNotFound
+	}
+	return err
+}
+
+func (r AccountRepository) TouchAccount(ctx context.Context, input dto.TouchAccountInput) error {
+	update := expression.Set(expression.Name("LastUsedAt"), expression.Value(input.UsedAt.UTC().Format(time.RFC3339Nano)))
+	// 認証の後に削除されたアカウントを作り直さない
+	cond := expression.AttributeExists(expression.Name("PK"))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       tableKey(accountsPK, accountSK(input.Kind, input.Name)),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrAccountNotFound
+	}
+	return err
+}
+
+func (item Account) toModel() model.Account {
+	createdAt, _ := time.Parse(time.RFC3339Nano, item.CreatedAt)
+	return model.Account{
+		Kind:       item.Kind,
+		Name:       item.Name,
+		SecretHash: item.SecretHash,
+		Disabled:   item.Disabled,
+		ExpiresAt:  parseOptionalTime(item.ExpiresAt),
+		CreatedAt:  createdAt,
+		CreatedBy:  item.CreatedBy,
+		LastUsedAt: parseOptionalTime(item.LastUsedAt),
+	}
+}
+
+// nil は空の文字列にして、属性を保存しない
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseOptionalTime(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// BatchGetItem で一度に取得できる項目の数
+const batchGetItemLimit = 100
+
+// UnprocessedKeys や UnprocessedItems をやり直す回数
+const maxBatchRetries = 5
+
+// keys の項目をまとめて取得する。存在しない項目は結果に含まれず、順番も保証されない
+//
+// projection が空でなければ、その属性だけを取得する
+func batchGetItems(ctx context.Context, client *dynamodb.Client, tableName string, keys []map[string]types.AttributeValue, projection string, names map[string]string) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	for start := 0; start < len(keys); start += batchGetItemLimit {
+		end := min(start+batchGetItemLimit, len(keys))
+		request := types.KeysAndAttributes{
+			Keys: keys[start:end],
+		}
+		if projection != "" {
+			request.ProjectionExpression = aws.String(projection)
+			request.ExpressionAttributeNames = names
+		}
+		pending := map[string]types.KeysAndAttributes{tableName: request}
+
+		for i := 0; len(pending) > 0; i++ {
+			if i >= maxBatchRetries {
+				return nil, errBatchGetUnprocessed
+			}
+			if i > 0 {
+				// スロットリングされているので少し待つ
+				err := sleepContext(ctx, time.Duration(i)*50*time.Millisecond)
+				if err != nil {
+					return nil, err
+				}
+			}
+			resp, err := client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, resp.Responses[tableName]...)
+			pending = resp.UnprocessedKeys
+		}
+	}
+	return items, nil
+}
+
+var errBatchGetUnprocessed = errors.New("some items were not processed by BatchGetItem")
+
+// BatchWriteItem で一度に書き込める項目の数
+const batchWriteItemLimit = 25
+
+var errBatchWriteUnprocessed = errors.New("some items were not processed by BatchWriteItem")
+
+// items をまとめて書き込む。同じキーの項目がすでにあれば上書きする。
+// BatchWriteItem は同じキーが含まれているとエラーになるので、items の中で重複したキーは後ろのものを使う
+func batchPutItems(ctx context.Context, client *dynamodb.Client, tableName string, items []map[string]types.AttributeValue) error {
+	type key struct{ pk, sk string }
+	index := map[key]int{}
+	var unique []map[string]types.AttributeValue
+	for _, item := range items {
+		pk, _ := item["PK"].(*types.AttributeValueMemberS)
+		sk, _ := item["SK"].(*types.AttributeValueMemberS)
+		if pk == nil || sk == nil {
+			continue
+		}
+		k := key{pk: pk.Value, sk: sk.Value}
+		if i, ok := index[k]; ok {
+			unique[i] = item
+			continue
+		}
+		index[k] = len(unique)
+		unique = append(unique, item)
+	}
+	items = unique
+
+	for start := 0; start < len(items); start += batchWriteItemLimit {
+		end := min(start+batchWriteItemLimit, len(items))
+		var requests []types.WriteRequest
+		for _, item := range items[start:end] {
+			requests = append(requests, types.WriteRequest{
+				PutRequest: &types.PutRequest{Item: item},
+			})
+		}
+		pending := map[string][]types.WriteRequest{tableName: requests}
+
+		for i := 0; len(pending) > 0; i++ {
+			if i >= maxBatchRetries {
+				return errBatchWriteUnprocessed
+			}
+			if i > 0 {
+				err := sleepContext(ctx, time.Duration(i)*50*time.Millisecond)
+				if err != nil {
+					return err
+				}
+			}
+			resp, err := client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return err
+			}
+			pending = resp.UnprocessedItems
+		}
+	}
+	return nil
+}
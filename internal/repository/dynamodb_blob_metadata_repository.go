@@ -0,0 +1,200 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// blob 自体の項目 (PK が BLOB#<digest>) と、リポジトリからのリンクの項目 (PK が REPO#<name>) がある。
+// リンクは GSI1 の BLOB#<digest> パーティションに載せて、blob をリンクしているリポジトリを逆引きできるようにする。
+// blob 自体の項目では Name が空になる
+type BlobMetadata struct {
+	itemKeys
+	Digest    string `dynamodbav:"Digest"`
+	Name      string `dynamodbav:"Name,omitempty"`
+	Size      int64  `dynamodbav:"Size"`
+	MediaType string `dynamodbav:"MediaType"`
+	PushedAt  string `dynamodbav:"PushedAt"`
+	Uploader  string `dynamodbav:"Uploader"`
+}
+
+type BlobMetadataRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewBlobMetadataRepository(client *dynamodb.Client, tableName string) *BlobMetadataRepository {
+	return &BlobMetadataRepository{
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+func (r BlobMetadataRepository) FindBlobMetadata(ctx context.Context, input dto.FindBlobMetadataInput) (dto.FindBlobMetadataOutput, error) {
+	return r.findItem(ctx, repositoryPK(input.Name), blobLinkSK(input.Digest))
+}
+
+func (r BlobMetadataRepository) FindBlobContentMetadata(ctx context.Context, input dto.FindBlobContentMetadataInput) (dto.FindBlobMetadataOutput, error) {
+	return r.findItem(ctx, blobPK(input.Digest), blobSK)
+}
+
+func (r BlobMetadataRepository) findItem(ctx context.Context, pk string, sk string) (dto.FindBlobMetadataOutput, error) {
+	resp, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       tableKey(pk, sk),
+	})
+	if err != nil {
+		return dto.FindBlobMetadataOutput{}, err
+	}
+
+	var metadata BlobMetadata
+	err = attributevalue.UnmarshalMap(resp.Item, &metadata)
+	if err != nil {
+		return dto.FindBlobMetadataOutput{}, err
+	}
+
+	return dto.FindBlobMetadataOutput{
+		Name:      metadata.Name,
+		Digest:    metadata.Digest,
+		Size:      metadata.Size,
+		MediaType: metadata.MediaType,
+		PushedAt:  metadata.PushedAt,
+		Uploader:  metadata.Uploader,
+	}, nil
+}
+
+func (r BlobMetadataRepository) BatchFindBlobMetadata(ctx context.Context, input dto.BatchFindBlobMetadataInput) (dto.BatchFindBlobMetadataOutput, error) {
+	// BatchGetItem は同じキーが含まれているとエラーになる
+	seen := map[dto.FindBlobMetadataInput]bool{}
+	var keys []map[string]types.AttributeValue
+	for _, key := range input.Keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, tableKey(repositoryPK(key.Name), blobLinkSK(key.Digest)))
+	}
+
+	items, err := batchGetItems(ctx, r.client, r.tableName, keys, "", nil)
+	if err != nil {
+		return dto.BatchFindBlobMetadataOutput{}, err
+	}
+	var metadata []BlobMetadata
+	err = attributevalue.UnmarshalListOfMaps(items, &metadata)
+	if err != nil {
+		return dto.BatchFindBlobMetadataOutput{}, err
+	}
+
+	var output dto.BatchFindBlobMetadataOutput
+	for _, m := range metadata {
+		output.Items = append(output.Items, dto.FindBlobMetadataOutput{
+			Name:      m.Name,
+			Digest:    m.Digest,
+			Size:      m.Size,
+			MediaType: m.MediaType,
+			PushedAt:  m.PushedAt,
+			Uploader:  m.Uploader,
+		})
+	}
+	return output, nil
+}
+
+// blob 自体の項目は最初に push されたときの PushedAt と Uploader を保持し続ける
+func (r BlobMetadataRepository) SaveBlobMetadata(ctx context.Context, input dto.SaveBlobMetadataInput) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	blobUpdate := expression.Set(expression.Name("Type"), expression.Value(itemTypeBlob)).
+		Set(expression.Name("Digest"), expression.Value(input.Digest)).
+		Set(expression.Name("Size"), expression.Value(input.Size)).
+		Set(expression.Name("MediaType"), expression.Value(input.MediaType)).
+		Set(expression.Name("PushedAt"), expression.IfNotExists(expression.Name("PushedAt"), expression.Value(now))).
+		Set(expression.Name("Uploader"), expression.IfNotExists(expression.Name("Uploader"), expression.Value(input.Uploader)))
+	blobExpr, err := expression.NewBuilder().WithUpdate(blobUpdate).Build()
+	if err != nil {
+		return err
+	}
+
+	link, err := attributevalue.MarshalMap(BlobMetadata{
+		itemKeys: itemKeys{
+			PK:     repositoryPK(input.Name),
+			SK:     blobLinkSK(input.Digest),
+			Type:   itemTypeBlobLink,
+			GSI1PK: blobPK(input.Digest),
+			GSI1SK: input.Name,
+		},
+		Digest:    input.Digest,
+		Name:      input.Name,
+		Size:      input.Size,
+		MediaType: input.MediaType,
+		PushedAt:  now,
+		Uploader:  input.Uploader,
+	})
+	if err != nil {
+		return err
+	}
+
+	return transactWriteItems(ctx, r.client, []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName:                 aws.String(r.tableName),
+				Key:                       tableKey(blobPK(input.Digest), blobSK),
+				UpdateExpression:          blobExpr.Update(),
+				ExpressionAttributeNames:  blobExpr.Names(),
+				ExpressionAttributeValues: blobExpr.Values(),
+			},
+		},
+		{
+			Put: &types.Put{
+				TableName: aws.String(r.tableName),
+				Item:      link,
+			},
+		},
+	})
+}
+
+func (r BlobMetadataRepository) ListBlobLinks(ctx context.Context, input dto.ListBlobLinksInput) (dto.ListBlobLinksOutput, error) {
+	keyEx := expression.Key("GSI1PK").Equal(expression.Value(blobPK(input.Digest)))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return dto.ListBlobLinksOutput{}, err
+	}
+
+	var output dto.ListBlobLinksOutput
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		IndexName:                 aws.String(gsi1IndexName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return dto.ListBlobLinksOutput{}, err
+		}
+		var items []BlobMetadata
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &items)
+		if err != nil {
+			return dto.ListBlobLinksOutput{}, err
+		}
+		for _, item := range items {
+			output.Names = append(output.Names, item.Name)
+		}
+	}
+	return output, nil
+}
+
+func (r BlobMetadataRepository) DeleteBlobLink(ctx context.Context, input dto.DeleteBlobLinkInput) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       tableKey(repositoryPK(input.Name), blobLinkSK(input.Digest)),
+	})
+	return err
+}
@@ -2,20 +2,26 @@ package repository
 
 import (
 	"context"
+	"errors"
 
+	"github.com/a-takamin/tcr/internal/apperrors"
 	"github.com/a-takamin/tcr/internal/dto"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 type BlobUploadProgress struct {
+	itemKeys
 	Uuid         string `dynamodbav:"Uuid"`
+	Name         string `dynamodbav:"Name"`
 	ByteUploaded int64  `dynamodbav:"ByteUploaded"`
 	NextChunkNo  int    `dynamodbav:"NextChunkNo"`
 	Done         bool   `dynamodbav:"Done"`
 	Digest       string `dynamodbav:"Digest"`
+	Version      int64  `dynamodbav:"Version"`
 }
 
 type BlobUploadProgressRepository struct {
@@ -30,14 +36,12 @@ func NewBlobUploadProgressRepository(client *dynamodb.Client, TableName string)
 	}
 }
 
-func (r BlobUploadProgressRepository) FindBlobUploadProgress(input dto.FindBlobUploadProgressInput) (dto.FindBlobUploadProgressOutput, error) {
-	resp, err := r.client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+func (r BlobUploadProgressRepository) FindBlobUploadProgress(ctx context.Context, input dto.FindBlobUploadProgressInput) (dto.FindBlobUploadProgressOutput, error) {
+	resp, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"Uuid": &types.AttributeValueMemberS{
-				Value: input.Uuid,
-			},
-		},
+		Key:       tableKey(uploadPK(input.Uuid), uploadSK),
+		// 直前の条件付き書き込みの結果を確実に読むため
+		ConsistentRead: aws.Bool(true),
 	})
 	if err != nil {
 		return dto.FindBlobUploadProgressOutput{}, err
@@ -51,27 +55,65 @@ func (r BlobUploadProgressRepository) FindBlobUploadProgress(input dto.FindBlobU
 
 	return dto.FindBlobUploadProgressOutput{
 		Uuid:         progress.Uuid,
+		Name:         progress.Name,
 		ByteUploaded: progress.ByteUploaded,
 		NextChunkNo:  progress.NextChunkNo,
 		Digest:       progress.Digest,
+		Version:      progress.Version,
 	}, nil
 }
 
-func (r BlobUploadProgressRepository) SaveBlobUploadProgress(input dto.SaveBlobUploadProgressInput) error {
+func (r BlobUploadProgressRepository) DeleteBlobUploadProgress(ctx context.Context, input dto.DeleteBlobUploadProgressInput) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       tableKey(uploadPK(input.Uuid), uploadSK),
+	})
+	return err
+}
+
+// 楽観的排他制御を行う。
+// 読み出したときの Version から更新されていなければ Version+1 として保存し、
+// 他のリクエストに先を越されていた場合は apperrors.ErrBlobUploadConflict を返す
+func (r BlobUploadProgressRepository) SaveBlobUploadProgress(ctx context.Context, input dto.SaveBlobUploadProgressInput) error {
 	progress := BlobUploadProgress{
+		itemKeys: itemKeys{
+			PK:   uploadPK(input.Uuid),
+			SK:   uploadSK,
+			Type: itemTypeUpload,
+		},
 		Uuid:         input.Uuid,
+		Name:         input.Name,
 		ByteUploaded: input.ByteUploaded,
 		NextChunkNo:  input.NextChunkNo,
 		Digest:       input.Digest,
+		Version:      input.Version + 1,
 	}
 	item, err := attributevalue.MarshalMap(progress)
 	if err != nil {
 		return err
 	}
-	_, err = r.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(r.tableName),
-		Item:      item,
-	})
 
+	var cond expression.ConditionBuilder
+	if input.Version == 0 {
+		cond = expression.AttributeNotExists(expression.Name("Version"))
+	} else {
+		cond = expression.Name("Version").Equal(expression.Value(input.Version))
+	}
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(r.tableName),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrBlobUploadConflict
+	}
 	return err
 }
@@ -0,0 +1,149 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDB の API の代わりに応答する HTTP サーバー。
+// respond が操作の名前 (GetItem など) とリクエストの本文から、応答の本文かエラーの種類を決める
+type fakeDynamoDB struct {
+	respond func(op string, req map[string]any) (resp any, errType string)
+
+	mu       sync.Mutex
+	requests []fakeDynamoDBRequest
+}
+
+type fakeDynamoDBRequest struct {
+	Op   string
+	Body map[string]any
+}
+
+func newFakeDynamoDB(t *testing.T, respond func(op string, req map[string]any) (any, string)) (*dynamodb.Client, *fakeDynamoDB) {
+	t.Helper()
+	f := &fakeDynamoDB{respond: respond}
+	srv := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(srv.Close)
+	client := dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+	return client, f
+}
+
+func (f *fakeDynamoDB) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	_, op, _ := strings.Cut(r.Header.Get("X-Amz-Target"), ".")
+	var body map[string]any
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, fakeDynamoDBRequest{Op: op, Body: body})
+	f.mu.Unlock()
+
+	resp, errType := f.respond(op, body)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if errType != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"__type":  "com.amazonaws.dynamodb.v20120810#" + errType,
+			"message": errType,
+		})
+		return
+	}
+	if resp == nil {
+		resp = map[string]any{}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeDynamoDB) ops() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ops []string
+	for _, r := range f.requests {
+		ops = append(ops, r.Op)
+	}
+	return ops
+}
+
+func (f *fakeDynamoDB) requestsOf(op string) []map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var bodies []map[string]any
+	for _, r := range f.requests {
+		if r.Op == op {
+			bodies = append(bodies, r.Body)
+		}
+	}
+	return bodies
+}
+
+// 項目を DynamoDB の JSON の形にする
+func wireItem(t *testing.T, v any) map[string]any {
+	t.Helper()
+	item, err := attributevalue.MarshalMap(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wireMap(item)
+}
+
+func wireMap(item map[string]types.AttributeValue) map[string]any {
+	m := map[string]any{}
+	for k, v := range item {
+		m[k] = wireValue(v)
+	}
+	return m
+}
+
+func wireValue(v types.AttributeValue) map[string]any {
+	switch v := v.(type) {
+	case *types.AttributeValueMemberS:
+		return map[string]any{"S": v.Value}
+	case *types.AttributeValueMemberN:
+		return map[string]any{"N": v.Value}
+	case *types.AttributeValueMemberB:
+		return map[string]any{"B": base64.StdEncoding.EncodeToString(v.Value)}
+	case *types.AttributeValueMemberBOOL:
+		return map[string]any{"BOOL": v.Value}
+	case *types.AttributeValueMemberNULL:
+		return map[string]any{"NULL": true}
+	case *types.AttributeValueMemberSS:
+		return map[string]any{"SS": v.Value}
+	case *types.AttributeValueMemberM:
+		return map[string]any{"M": wireMap(v.Value)}
+	case *types.AttributeValueMemberL:
+		l := []any{}
+		for _, e := range v.Value {
+			l = append(l, wireValue(e))
+		}
+		return map[string]any{"L": l}
+	}
+	return nil
+}
+
+// リクエストの Key から SK を取り出す
+func requestSK(req map[string]any) string {
+	key, _ := req["Key"].(map[string]any)
+	sk, _ := key["SK"].(map[string]any)
+	s, _ := sk["S"].(string)
+	return s
+}
@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// 権限の付与はリクエストのたびに全件を使うので、1 つのパーティションにまとめる
+type Grant struct {
+	itemKeys
+	ID          string `dynamodbav:"ID"`
+	SubjectType string `dynamodbav:"SubjectType"`
+	Subject     string `dynamodbav:"Subject"`
+	Pattern     string `dynamodbav:"Pattern"`
+	Role        string `dynamodbav:"Role"`
+	CreatedAt   string `dynamodbav:"CreatedAt"`
+	CreatedBy   string `dynamodbav:"CreatedBy"`
+}
+
+type GrantRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewGrantRepository(client *dynamodb.Client, TableName string) *GrantRepository {
+	return &GrantRepository{
+		client:    client,
+		tableName: TableName,
+	}
+}
+
+func (r GrantRepository) ListGrants(ctx context.Context) ([]model.Grant, error) {
+	keyEx := expression.Key("PK").Equal(expression.Value(grantsPK))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []model.Grant
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var items []Grant
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			createdAt, _ := time.Parse(time.RFC3339Nano, item.CreatedAt)
+			grants = append(grants, model.Grant{
+				ID:          item.ID,
+				SubjectType: item.SubjectType,
+				Subject:     item.Subject,
+				Pattern:     item.Pattern,
+				Role:        item.Role,
+				CreatedAt:   createdAt,
+				CreatedBy:   item.CreatedBy,
+			})
+		}
+	}
+	return grants, nil
+}
+
+func (r GrantRepository) SaveGrant(ctx context.Context, grant model.Grant) error {
+	item, err := attributevalue.MarshalMap(Grant{
+		itemKeys: itemKeys{
+			PK:   grantsPK,
+			SK:   grantSK(grant.ID),
+			Type: itemTypeGrant,
+		},
+		ID:          grant.ID,
+		SubjectType: grant.SubjectType,
+		Subject:     grant.Subject,
+		Pattern:     grant.Pattern,
+		Role:        grant.Role,
+		CreatedAt:   grant.CreatedAt.UTC().Format(time.RFC3339Nano),
+		CreatedBy:   grant.CreatedBy,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
+	})
+	return err
+}
+
+func (r GrantRepository) DeleteGrant(ctx context.Context, input dto.DeleteGrantInput) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(r.tableName),
+		Key:                 tableKey(grantsPK, grantSK(input.ID)),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrGrantNotFound
+	}
+	return err
+}
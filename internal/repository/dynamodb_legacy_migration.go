@@ -0,0 +1,179 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/a-takamin/tcr/internal/service/domain"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// 単一テーブルに移行する前のテーブル名。空のテーブルは移行しない。
+// 移行はスキーマバージョン 2 のマイグレーションとして行う
+type LegacyTableNames struct {
+	Manifest           string
+	Tag                string
+	Repository         string
+	BlobMetadata       string
+	BlobUploadProgress string
+}
+
+// 旧テーブルの項目。単一テーブルの項目とは属性名が同じでもキーが違う
+type legacyManifest struct {
+	Name        string `dynamodbav:"Name"`
+	Digest      string `dynamodbav:"Digest"`
+	Tag         string `dynamodbav:"Tag"`
+	Manifest    string `dynamodbav:"Manifest"`
+	ManifestRef string `dynamodbav:"ManifestRef"`
+	Size        int    `dynamodbav:"Size"`
+}
+
+type legacyTag struct {
+	Name      string `dynamodbav:"Name"`
+	Tag       string `dynamodbav:"Tag"`
+	Digest    string `dynamodbav:"Digest"`
+	UpdatedAt string `dynamodbav:"UpdatedAt"`
+}
+
+type legacyRepository struct {
+	Name      string `dynamodbav:"Name"`
+	UpdatedAt string `dynamodbav:"UpdatedAt"`
+}
+
+// Name が #blob の項目は blob 自体のメタデータ
+type legacyBlobMetadata struct {
+	Digest    string `dynamodbav:"Digest"`
+	Name      string `dynamodbav:"Name"`
+	Size      int64  `dynamodbav:"Size"`
+	MediaType string `dynamodbav:"MediaType"`
+	PushedAt  string `dynamodbav:"PushedAt"`
+	Uploader  string `dynamodbav:"Uploader"`
+}
+
+const legacyBlobRecordName = "#blob"
+
+func convertLegacyRepository(item map[string]types.AttributeValue) ([]any, error) {
+	var repo legacyRepository
+	err := attributevalue.UnmarshalMap(item, &repo)
+	if err != nil {
+		return nil, err
+	}
+	return []any{Repository{
+		itemKeys: itemKeys{
+			PK:     repositoryPK(repo.Name),
+			SK:     repositorySK,
+			Type:   itemTypeRepository,
+			GSI1PK: catalogPK,
+			GSI1SK: repo.Name,
+		},
+		Name:      repo.Name,
+		CreatedAt: repo.UpdatedAt,
+		UpdatedAt: repo.UpdatedAt,
+	}}, nil
+}
+
+// referrers を引けるように、マニフェストの中身から subject などを取り出し直す
+func (r ManifestRepository) convertLegacyManifest(ctx context.Context, item map[string]types.AttributeValue) ([]any, error) {
+	var legacy legacyManifest
+	err := attributevalue.UnmarshalMap(item, &legacy)
+	if err != nil {
+		return nil, err
+	}
+	dbManifest := Manifest{
+		itemKeys: itemKeys{
+			PK:   repositoryPK(legacy.Name),
+			SK:   manifestSK(legacy.Digest),
+			Type: itemTypeManifest,
+		},
+		Name:        legacy.Name,
+		Digest:      legacy.Digest,
+		Manifest:    legacy.Manifest,
+		ManifestRef: legacy.ManifestRef,
+		Size:        legacy.Size,
+	}
+
+	raw, err := r.loadManifest(ctx, dbManifest)
+	if err != nil {
+		return nil, err
+	}
+	if dbManifest.Size == 0 {
+		dbManifest.Size = len(raw)
+	}
+	var m model.Manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		// 中身が読めなくても pull はできるので、referrers に載せないだけにする
+		slog.Warn("failed to parse legacy manifest", "name", legacy.Name, "digest", legacy.Digest, "error", err.Error())
+	} else {
+		dbManifest.MediaType = m.MediaType
+		dbManifest.ArtifactType = domain.ArtifactType(m)
+		dbManifest.Annotations = m.Annotations
+		if m.Subject.Digest != "" {
+			dbManifest.GSI2PK = referrersGSI2PK(legacy.Name, m.Subject.Digest)
+			dbManifest.GSI2SK = legacy.Digest
+		}
+	}
+
+	converted := []any{dbManifest}
+	if legacy.Tag != "" {
+		converted = append(converted, newTagItem(legacy.Name, legacy.Tag, legacy.Digest, ""))
+	}
+	return converted, nil
+}
+
+func convertLegacyTag(item map[string]types.AttributeValue) ([]any, error) {
+	var legacy legacyTag
+	err := attributevalue.UnmarshalMap(item, &legacy)
+	if err != nil {
+		return nil, err
+	}
+	return []any{newTagItem(legacy.Name, legacy.Tag, legacy.Digest, legacy.UpdatedAt)}, nil
+}
+
+func convertLegacyBlobMetadata(item map[string]types.AttributeValue) ([]any, error) {
+	var legacy legacyBlobMetadata
+	err := attributevalue.UnmarshalMap(item, &legacy)
+	if err != nil {
+		return nil, err
+	}
+	metadata := BlobMetadata{
+		Digest:    legacy.Digest,
+		Size:      legacy.Size,
+		MediaType: legacy.MediaType,
+		PushedAt:  legacy.PushedAt,
+		Uploader:  legacy.Uploader,
+	}
+	if legacy.Name == legacyBlobRecordName {
+		metadata.itemKeys = itemKeys{
+			PK:   blobPK(legacy.Digest),
+			SK:   blobSK,
+			Type: itemTypeBlob,
+		}
+		return []any{metadata}, nil
+	}
+	metadata.Name = legacy.Name
+	metadata.itemKeys = itemKeys{
+		PK:     repositoryPK(legacy.Name),
+		SK:     blobLinkSK(legacy.Digest),
+		Type:   itemTypeBlobLink,
+		GSI1PK: blobPK(legacy.Digest),
+		GSI1SK: legacy.Name,
+	}
+	return []any{metadata}, nil
+}
+
+func convertLegacyBlobUploadProgress(item map[string]types.AttributeValue) ([]any, error) {
+	var progress BlobUploadProgress
+	err := attributevalue.UnmarshalMap(item, &progress)
+	if err != nil {
+		return nil, err
+	}
+	progress.itemKeys = itemKeys{
+		PK:   uploadPK(progress.Uuid),
+		SK:   uploadSK,
+		Type: itemTypeUpload,
+	}
+	return []any{progress}, nil
+}
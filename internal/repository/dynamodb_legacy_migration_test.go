@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+func TestConvertLegacyBlobMetadata(t *testing.T) {
+	tests := []struct {
+		testName string
+		legacy   legacyBlobMetadata
+		want     itemKeys
+	}{
+		{
+			testName: "blob 自体の項目",
+			legacy:   legacyBlobMetadata{Digest: digestA, Name: legacyBlobRecordName, Size: 10},
+			want:     itemKeys{PK: "BLOB#" + digestA, SK: "#BLOB", Type: itemTypeBlob},
+		},
+		{
+			testName: "リポジトリからのリンク",
+			legacy:   legacyBlobMetadata{Digest: digestA, Name: "org/repo", Size: 10},
+			want: itemKeys{
+				PK:     "REPO#org/repo",
+				SK:     "BLOB#" + digestA,
+				Type:   itemTypeBlobLink,
+				GSI1PK: "BLOB#" + digestA,
+				GSI1SK: "org/repo",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			item, err := attributevalue.MarshalMap(tt.legacy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			converted, err := convertLegacyBlobMetadata(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := converted[0].(BlobMetadata)
+			if got.itemKeys != tt.want {
+				t.Errorf("keys = %+v, want %+v", got.itemKeys, tt.want)
+			}
+			if got.Size != tt.legacy.Size {
+				t.Errorf("Size = %d, want %d", got.Size, tt.legacy.Size)
+			}
+		})
+	}
+}
+
+func TestConvertLegacyManifestKeepsTag(t *testing.T) {
+	legacy, err := attributevalue.MarshalMap(legacyManifest{
+		Name:     "org/repo",
+		Digest:   digestB,
+		Tag:      "latest",
+		Manifest: "eyJtZWRpYVR5cGUiOiJhcHBsaWNhdGlvbi92bmQub2NpLmltYWdlLm1hbmlmZXN0LnYxK2pzb24iLCJzdWJqZWN0Ijp7ImRpZ2VzdCI6InNoYTI1NjphYWEifX0=",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	converted, err := ManifestRepository{}.convertLegacyManifest(context.Background(), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(converted) != 2 {
+		t.Fatalf("converted %d items, want manifest and tag", len(converted))
+	}
+	manifest := converted[0].(Manifest)
+	if manifest.GSI2PK != "REFERRERS#org/repo#sha256:aaa" || manifest.GSI2SK != digestB {
+		t.Errorf("referrers keys = %q %q", manifest.GSI2PK, manifest.GSI2SK)
+	}
+	tag := converted[1].(Tag)
+	if tag.SK != "TAG#latest" || tag.GSI1PK != "TAGGED#org/repo#"+digestB {
+		t.Errorf("tag keys = %+v", tag.itemKeys)
+	}
+}
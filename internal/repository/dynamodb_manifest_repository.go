@@ -1,10 +1,18 @@
 package repository
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
 
+	"github.com/a-takamin/tcr/internal/apperrors"
 	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/a-takamin/tcr/internal/model"
 	"github.com/a-takamin/tcr/internal/service/domain"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -14,98 +22,115 @@ import (
 )
 
 type ManifestRepository struct {
-	client            *dynamodb.Client
-	manifestTableName string
+	client    *dynamodb.Client
+	tableName string
+	// inlineLimit バイトを超えるマニフェストは DynamoDB の項目に入れず、blobRepo に保存する
+	blobRepo    persister.BlobPersister
+	inlineLimit int
 }
 
+// Manifest と ManifestRef のどちらか一方だけが入る。
+// ManifestRef にはマニフェストの中身の sha256 が入り、blob と同じように保存されている
+//
+// subject を持つマニフェストは GSI2 の REFERRERS#<name>#<subject> パーティションに載せる
 type Manifest struct {
-	Name     string `dynamodbav:Name`
-	Digest   string `dynamodbav:Digest`
-	Tag      string `dynamodbav:Tag`
-	Manifest string `dynamodbav:Manifest`
+	itemKeys
+	Name         string            `dynamodbav:"Name"`
+	Digest       string            `dynamodbav:"Digest"`
+	Manifest     string            `dynamodbav:"Manifest,omitempty"`
+	ManifestRef  string            `dynamodbav:"ManifestRef,omitempty"`
+	Size         int               `dynamodbav:"Size"`
+	MediaType    string            `dynamodbav:"MediaType,omitempty"`
+	ArtifactType string            `dynamodbav:"ArtifactType,omitempty"`
+	Annotations  map[string]string `dynamodbav:"Annotations,omitempty"`
+	PushedAt     string            `dynamodbav:"PushedAt,omitempty"`
 }
 
-func NewManifestRepository(client *dynamodb.Client, manifestTableName string) *ManifestRepository {
-	return &ManifestRepository{
-		client:            client,
-		manifestTableName: manifestTableName,
-	}
+// タグは 1 つの digest だけを指すように (Name, Tag) をキーにした項目で管理する。
+// GSI1 の TAGGED#<name>#<digest> パーティションに載せて、digest を指すタグを引けるようにする
+type Tag struct {
+	itemKeys
+	Name      string `dynamodbav:"Name"`
+	Tag       string `dynamodbav:"Tag"`
+	Digest    string `dynamodbav:"Digest"`
+	UpdatedAt string `dynamodbav:"UpdatedAt"`
 }
 
-func (r ManifestRepository) getItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
-	return r.client.GetItem(ctx, params, optFns...)
-}
-
-func (r ManifestRepository) QueryItem(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
-	return r.client.Query(ctx, params, optFns...)
+// inlineLimit が 0 の場合はすべてのマニフェストを blobRepo に保存する
+func NewManifestRepository(client *dynamodb.Client, tableName string, blobRepo persister.BlobPersister, inlineLimit int) *ManifestRepository {
+	return &ManifestRepository{
+		client:      client,
+		tableName:   tableName,
+		blobRepo:    blobRepo,
+		inlineLimit: inlineLimit,
+	}
 }
 
-func (r ManifestRepository) GetTags(name string) (dto.GetTagsResponse, error) {
-	input, err := r.createGetTagsInput(name)
-	if err != nil {
-		return dto.GetTagsResponse{}, err
-	}
-	resp, err := r.QueryItem(context.TODO(), input)
+func (r ManifestRepository) GetTags(ctx context.Context, name string) (dto.GetTagsResponse, error) {
+	keyEx := expression.Key("PK").Equal(expression.Value(repositoryPK(name))).
+		And(expression.Key("SK").BeginsWith(tagSK("")))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
 	if err != nil {
 		return dto.GetTagsResponse{}, err
 	}
-	var manifests []Manifest
-	err = attributevalue.UnmarshalListOfMaps(resp.Items, &manifests)
+	tags, err := r.queryTags(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
 	if err != nil {
 		return dto.GetTagsResponse{}, err
 	}
 
-	var tags dto.GetTagsResponse
-	for _, m := range manifests {
-		tags.Tags = append(tags.Tags, m.Tag)
+	resp := dto.GetTagsResponse{Name: name}
+	for _, t := range tags {
+		resp.Tags = append(resp.Tags, t.Tag)
 	}
 
-	return tags, nil
+	return resp, nil
 }
 
-func (r ManifestRepository) createGetTagsInput(name string) (*dynamodb.QueryInput, error) {
-	keyEx := expression.Key("Name").Equal(expression.Value(name))
-	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+// digest を指しているタグを取得する。GSI1 は結果整合で直前に書かれたタグを返さないことがあるので、
+// リポジトリのタグを強い整合性で読んで digest で絞り込む
+func (r ManifestRepository) findTagsByDigest(ctx context.Context, name string, digest string) ([]Tag, error) {
+	keyEx := expression.Key("PK").Equal(expression.Value(repositoryPK(name))).
+		And(expression.Key("SK").BeginsWith(tagSK("")))
+	filter := expression.Name("Digest").Equal(expression.Value(digest))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filter).Build()
 	if err != nil {
-		return &dynamodb.QueryInput{}, err
+		return nil, err
 	}
-	return &dynamodb.QueryInput{
-		TableName:                 aws.String(r.manifestTableName),
+	return r.queryTags(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		ConsistentRead:            aws.Bool(true),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		KeyConditionExpression:    expr.KeyCondition(),
-	}, nil
+		FilterExpression:          expr.Filter(),
+	})
 }
 
-// リファクタ
-// / Name があるかどうかを確認する関数
-// リファクタメモここまで
-
-func (r ManifestRepository) ExistsName(name string) (bool, error) {
-	keyEx := expression.Key("Name").Equal(expression.Value(name))
-	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
-	if err != nil {
-		return false, err
+func (r ManifestRepository) queryTags(ctx context.Context, input *dynamodb.QueryInput) ([]Tag, error) {
+	var tags []Tag
+	paginator := dynamodb.NewQueryPaginator(r.client, input)
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []Tag
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &page)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
 	}
-	input := &dynamodb.QueryInput{
-		TableName:                 aws.String(r.manifestTableName),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		KeyConditionExpression:    expr.KeyCondition(),
-	}
-	resp, err := r.QueryItem(context.TODO(), input)
-	if err != nil {
-		return false, err
-	}
-	if resp.Count == 0 {
-		return false, nil
-	}
-	return true, nil
+	return tags, nil
 }
 
-// リファクタ
-func (r ManifestRepository) ExistsManifest(input dto.ExistsManifestInput) (bool, error) {
-	manifest, err := r.FindManifest(dto.FindManifestInput{
+func (r ManifestRepository) ExistsManifest(ctx context.Context, input dto.ExistsManifestInput) (bool, error) {
+	manifest, err := r.FindManifest(ctx, dto.FindManifestInput{
 		Name:      input.Name,
 		Reference: input.Reference,
 	})
@@ -118,29 +143,19 @@ func (r ManifestRepository) ExistsManifest(input dto.ExistsManifestInput) (bool,
 	return true, nil
 }
 
-func (r ManifestRepository) FindManifest(input dto.FindManifestInput) (dto.FindManifestOutput, error) {
+func (r ManifestRepository) FindManifest(ctx context.Context, input dto.FindManifestInput) (dto.FindManifestOutput, error) {
 	if domain.IsDigest(input.Reference) {
-		return r.FindManifestByDigest(input)
+		return r.FindManifestByDigest(ctx, input)
 	} else {
-		return r.FindManifestByTag(input)
+		return r.FindManifestByTag(ctx, input)
 	}
 }
 
-func (r ManifestRepository) FindManifestByDigest(input dto.FindManifestInput) (dto.FindManifestOutput, error) {
-	itemInput := &dynamodb.GetItemInput{
-		TableName: aws.String(r.manifestTableName),
-		Key: map[string]types.AttributeValue{
-			"Name": &types.AttributeValueMemberS{
-				Value: input.Name,
-			},
-			"Digest": &types.AttributeValueMemberS{
-				Value: input.Reference,
-			},
-		},
-	}
-
-	resp, err := r.getItem(context.TODO(), itemInput)
-
+func (r ManifestRepository) FindManifestByDigest(ctx context.Context, input dto.FindManifestInput) (dto.FindManifestOutput, error) {
+	resp, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       tableKey(repositoryPK(input.Name), manifestSK(input.Reference)),
+	})
 	if err != nil {
 		return dto.FindManifestOutput{}, err
 	}
@@ -151,148 +166,382 @@ func (r ManifestRepository) FindManifestByDigest(input dto.FindManifestInput) (d
 		return dto.FindManifestOutput{}, err
 	}
 
-	decordedManifest, err := base64.StdEncoding.DecodeString(dbManifest.Manifest)
+	decordedManifest, err := r.loadManifest(ctx, dbManifest)
 	if err != nil {
 		return dto.FindManifestOutput{}, err
 	}
 
 	return dto.FindManifestOutput{
 		Name:     dbManifest.Name,
-		Tag:      dbManifest.Tag,
 		Digest:   dbManifest.Digest,
 		Manifest: decordedManifest,
 	}, nil
 }
 
-func (r ManifestRepository) FindManifestByTag(input dto.FindManifestInput) (dto.FindManifestOutput, error) {
-	keyEx := expression.KeyAnd(
-		expression.Key("Name").Equal(expression.Value(input.Name)),
-		expression.Key("Tag").Equal(expression.Value(input.Reference)),
-	)
-	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+func (r ManifestRepository) loadManifest(ctx context.Context, dbManifest Manifest) ([]byte, error) {
+	if dbManifest.ManifestRef == "" {
+		return base64.StdEncoding.DecodeString(dbManifest.Manifest)
+	}
+	resp, err := r.blobRepo.FindBlob(ctx, dto.FindBlobInput{
+		Digest: dbManifest.ManifestRef,
+	})
 	if err != nil {
-		return dto.FindManifestOutput{}, err
+		return nil, err
 	}
-	queryInput := &dynamodb.QueryInput{
-		TableName:                 aws.String(r.manifestTableName),
-		IndexName:                 aws.String("ManifestTagIndex"),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		KeyConditionExpression:    expr.KeyCondition(),
+	return resp.Blob, nil
+}
+
+// 大きなマニフェストは DynamoDB の項目サイズの上限 (400 KB) に引っかかるので、
+// 中身を blobRepo に保存して項目には参照だけを持たせる
+func (r ManifestRepository) toDBManifest(ctx context.Context, input dto.SaveManifestInput, now string) (Manifest, error) {
+	dbManifest := Manifest{
+		itemKeys: itemKeys{
+			PK:   repositoryPK(input.Name),
+			SK:   manifestSK(input.Digest),
+			Type: itemTypeManifest,
+		},
+		Name:         input.Name,
+		Digest:       input.Digest,
+		Size:         len(input.Manifest),
+		MediaType:    input.MediaType,
+		ArtifactType: input.ArtifactType,
+		Annotations:  input.Annotations,
+		PushedAt:     now,
+	}
+	if input.Subject != "" {
+		dbManifest.GSI2PK = referrersGSI2PK(input.Name, input.Subject)
+		dbManifest.GSI2SK = input.Digest
+	}
+	if len(input.Manifest) <= r.inlineLimit {
+		dbManifest.Manifest = base64.StdEncoding.EncodeToString(input.Manifest)
+		return dbManifest, nil
+	}
+
+	// マニフェストの digest は整形後の内容から計算しているので、保存する中身そのものの digest を別に求める
+	ref := fmt.Sprintf("sha256:%x", sha256.Sum256(input.Manifest))
+	err := r.blobRepo.SaveBlob(ctx, dto.SaveBlobInput{
+		Digest: ref,
+		Blob:   bytes.NewReader(input.Manifest),
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+	dbManifest.ManifestRef = ref
+	return dbManifest, nil
+}
+
+// タグをまとめて digest に解決してから、マニフェストの項目をまとめて取得する
+func (r ManifestRepository) ResolveReferences(ctx context.Context, input dto.ResolveReferencesInput) (dto.ResolveReferencesOutput, error) {
+	type key struct {
+		Name      string
+		Reference string
 	}
-	resp, err := r.QueryItem(context.TODO(), queryInput)
 
+	seenTags := map[key]bool{}
+	var tagKeys []map[string]types.AttributeValue
+	for _, ref := range input.References {
+		k := key{Name: ref.Name, Reference: ref.Reference}
+		if domain.IsDigest(ref.Reference) || seenTags[k] {
+			continue
+		}
+		seenTags[k] = true
+		tagKeys = append(tagKeys, tableKey(repositoryPK(ref.Name), tagSK(ref.Reference)))
+	}
+	tagItems, err := batchGetItems(ctx, r.client, r.tableName, tagKeys, "", nil)
 	if err != nil {
-		return dto.FindManifestOutput{}, err
+		return dto.ResolveReferencesOutput{}, err
+	}
+	var tags []Tag
+	err = attributevalue.UnmarshalListOfMaps(tagItems, &tags)
+	if err != nil {
+		return dto.ResolveReferencesOutput{}, err
+	}
+	tagDigests := map[key]string{}
+	for _, t := range tags {
+		tagDigests[key{Name: t.Name, Reference: t.Tag}] = t.Digest
+	}
+
+	// リクエストの参照を digest に置き換える
+	digests := make([]string, len(input.References))
+	seenManifests := map[key]bool{}
+	var manifestKeys []map[string]types.AttributeValue
+	for i, ref := range input.References {
+		digest := ref.Reference
+		if !domain.IsDigest(ref.Reference) {
+			digest = tagDigests[key{Name: ref.Name, Reference: ref.Reference}]
+		}
+		digests[i] = digest
+		k := key{Name: ref.Name, Reference: digest}
+		if digest == "" || seenManifests[k] {
+			continue
+		}
+		seenManifests[k] = true
+		manifestKeys = append(manifestKeys, tableKey(repositoryPK(ref.Name), manifestSK(digest)))
+	}
+	// マニフェストの中身は大きいことがあるので取得しない
+	manifestItems, err := batchGetItems(ctx, r.client, r.tableName, manifestKeys, "#n, #d, #s", map[string]string{
+		"#n": "Name",
+		"#d": "Digest",
+		"#s": "Size",
+	})
+	if err != nil {
+		return dto.ResolveReferencesOutput{}, err
 	}
 	var manifests []Manifest
-	err = attributevalue.UnmarshalListOfMaps(resp.Items, &manifests)
+	err = attributevalue.UnmarshalListOfMaps(manifestItems, &manifests)
 	if err != nil {
-		return dto.FindManifestOutput{}, err
+		return dto.ResolveReferencesOutput{}, err
 	}
+	sizes := map[key]int{}
+	for _, m := range manifests {
+		sizes[key{Name: m.Name, Reference: m.Digest}] = m.Size
+	}
+
+	var output dto.ResolveReferencesOutput
+	for i, ref := range input.References {
+		size, ok := sizes[key{Name: ref.Name, Reference: digests[i]}]
+		if !ok {
+			continue
+		}
+		output.Items = append(output.Items, dto.ResolvedReference{
+			Name:      ref.Name,
+			Reference: ref.Reference,
+			Digest:    digests[i],
+			Size:      int64(size),
+		})
+	}
+	return output, nil
+}
 
-	// 一見ロジックだが問題ない。
-	// Query はリストを取得してしまうという DynamoDB 固有の特性をインターフェースの制約にあうようにしているだけ
-	if len(manifests) < 1 {
-		return dto.FindManifestOutput{}, nil
+// GSI2 は referrers API で返す属性だけを射影しているので、マニフェストの中身は読まない
+func (r ManifestRepository) ListReferrers(ctx context.Context, input dto.ListReferrersInput) (dto.ListReferrersOutput, error) {
+	keyEx := expression.Key("GSI2PK").Equal(expression.Value(referrersGSI2PK(input.Name, input.Digest)))
+	builder := expression.NewBuilder().WithKeyCondition(keyEx)
+	if input.ArtifactType != "" {
+		builder = builder.WithFilter(expression.Name("ArtifactType").Equal(expression.Value(input.ArtifactType)))
 	}
-	manifest := manifests[0]
-	decordedManifest, err := base64.StdEncoding.DecodeString(manifest.Manifest)
+	expr, err := builder.Build()
 	if err != nil {
-		return dto.FindManifestOutput{}, err
+		return dto.ListReferrersOutput{}, err
 	}
 
-	return dto.FindManifestOutput{
-		Name:     manifest.Name,
-		Tag:      manifest.Tag,
-		Digest:   manifest.Digest,
-		Manifest: decordedManifest,
-	}, nil
+	output := dto.ListReferrersOutput{Descriptors: []model.Descriptor{}}
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		IndexName:                 aws.String(gsi2IndexName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return dto.ListReferrersOutput{}, err
+		}
+		var manifests []Manifest
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &manifests)
+		if err != nil {
+			return dto.ListReferrersOutput{}, err
+		}
+		for _, m := range manifests {
+			output.Descriptors = append(output.Descriptors, model.Descriptor{
+				MediaType:    m.MediaType,
+				Digest:       m.Digest,
+				Size:         int64(m.Size),
+				ArtifactType: m.ArtifactType,
+				Annotations:  m.Annotations,
+			})
+		}
+	}
+	return output, nil
 }
 
-func (r ManifestRepository) SaveManifest(input dto.SaveManifestInput) error {
-	base64Manifest := base64.StdEncoding.EncodeToString(input.Manifest)
+func (r ManifestRepository) findTag(ctx context.Context, name string, tag string) (Tag, error) {
+	resp, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       tableKey(repositoryPK(name), tagSK(tag)),
+	})
+	if err != nil {
+		return Tag{}, err
+	}
+	var t Tag
+	err = attributevalue.UnmarshalMap(resp.Item, &t)
+	if err != nil {
+		return Tag{}, err
+	}
+	return t, nil
+}
 
-	dbManifest := Manifest{
-		Name:     input.Name,
-		Digest:   input.Digest,
-		Tag:      input.Tag,
-		Manifest: base64Manifest,
+func newTagItem(name string, tag string, digest string, updatedAt string) Tag {
+	return Tag{
+		itemKeys: itemKeys{
+			PK:     repositoryPK(name),
+			SK:     tagSK(tag),
+			Type:   itemTypeTag,
+			GSI1PK: taggedGSI1PK(name, digest),
+			GSI1SK: tag,
+		},
+		Name:      name,
+		Tag:       tag,
+		Digest:    digest,
+		UpdatedAt: updatedAt,
 	}
+}
 
-	item, err := attributevalue.MarshalMap(dbManifest)
+func (r ManifestRepository) FindManifestByTag(ctx context.Context, input dto.FindManifestInput) (dto.FindManifestOutput, error) {
+	tag, err := r.findTag(ctx, input.Name, input.Reference)
 	if err != nil {
-		return err
+		return dto.FindManifestOutput{}, err
+	}
+	if tag.Digest == "" {
+		return dto.FindManifestOutput{}, nil
 	}
-	_, err = r.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(r.manifestTableName),
-		Item:      item,
+
+	manifest, err := r.FindManifestByDigest(ctx, dto.FindManifestInput{
+		Name:      input.Name,
+		Reference: tag.Digest,
 	})
-	return err
+	if err != nil {
+		return dto.FindManifestOutput{}, err
+	}
+	if manifest.Name == "" {
+		return dto.FindManifestOutput{}, nil
+	}
+	manifest.Tag = tag.Tag
+	return manifest, nil
 }
 
-func (r ManifestRepository) DeleteManifest(input dto.DeleteManifestInput) error {
-	if domain.IsDigest(input.Reference) {
-		return r.DeleteManifestByDigest(input)
-	} else {
-		return r.DeleteManifestByDigest(input)
+// マニフェストの登録、タグの付け替え、リポジトリの更新日時の記録を 1 つのトランザクションで行う。
+//
+// タグは (Name, Tag) をキーにした項目を上書きするので、同じタグへの push が同時に来ても
+// タグが指す digest は常に 1 つで、後にコミットされた方が勝つ
+//
+// リポジトリが存在しない場合は apperrors.ErrRepositoryNotFound を返す
+func (r ManifestRepository) SaveManifest(ctx context.Context, input dto.SaveManifestInput) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	dbManifest, err := r.toDBManifest(ctx, input, now)
+	if err != nil {
+		return err
 	}
-}
 
-func (r ManifestRepository) DeleteManifestByDigest(input dto.DeleteManifestInput) error {
-	itemInput := &dynamodb.DeleteItemInput{
-		TableName: aws.String(r.manifestTableName),
-		Key: map[string]types.AttributeValue{
-			"Name": &types.AttributeValueMemberS{
-				Value: input.Name,
+	manifestItem, err := attributevalue.MarshalMap(dbManifest)
+	if err != nil {
+		return err
+	}
+
+	repoUpdate := expression.Set(expression.Name("UpdatedAt"), expression.Value(now))
+	repoCond := expression.AttributeExists(expression.Name("PK"))
+	repoExpr, err := expression.NewBuilder().WithUpdate(repoUpdate).WithCondition(repoCond).Build()
+	if err != nil {
+		return err
+	}
+
+	items := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName:                 aws.String(r.tableName),
+				Key:                       tableKey(repositoryPK(input.Name), repositorySK),
+				UpdateExpression:          repoExpr.Update(),
+				ConditionExpression:       repoExpr.Condition(),
+				ExpressionAttributeNames:  repoExpr.Names(),
+				ExpressionAttributeValues: repoExpr.Values(),
 			},
-			"Digest": &types.AttributeValueMemberS{
-				Value: input.Reference,
+		},
+		{
+			Put: &types.Put{
+				TableName: aws.String(r.tableName),
+				Item:      manifestItem,
 			},
 		},
 	}
 
-	_, err := r.client.DeleteItem(context.TODO(), itemInput)
+	if input.Tag != "" {
+		tagItem, err := attributevalue.MarshalMap(newTagItem(input.Name, input.Tag, input.Digest, now))
+		if err != nil {
+			return err
+		}
+		items = append(items, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName: aws.String(r.tableName),
+				Item:      tagItem,
+			},
+		})
+	}
+
+	err = transactWriteItems(ctx, r.client, items)
+	// 0 番目はリポジトリの存在確認
+	if isConditionFailedAt(err, 0) {
+		return apperrors.ErrRepositoryNotFound
+	}
 	return err
+}
 
+func (r ManifestRepository) DeleteManifest(ctx context.Context, input dto.DeleteManifestInput) error {
+	if domain.IsDigest(input.Reference) {
+		return r.DeleteManifestByDigest(ctx, input)
+	} else {
+		return r.DeleteManifestByTag(ctx, input)
+	}
 }
 
-func (r ManifestRepository) DeleteManifestByTag(input dto.DeleteManifestInput) error {
-	keyEx := expression.KeyAnd(
-		expression.Key("Name").Equal(expression.Value(input.Name)),
-		expression.Key("Tag").Equal(expression.Value(input.Reference)),
-	)
-	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+// マニフェストを削除してから、それを指しているタグを 1 つずつ削除する。
+// タグの数は決まっていないので、トランザクションの項目数の上限 (100) に収まるとは限らない
+func (r ManifestRepository) DeleteManifestByDigest(ctx context.Context, input dto.DeleteManifestInput) error {
+	resp, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:    aws.String(r.tableName),
+		Key:          tableKey(repositoryPK(input.Name), manifestSK(input.Reference)),
+		ReturnValues: types.ReturnValueAllOld,
+	})
 	if err != nil {
 		return err
 	}
-	queryInput := &dynamodb.QueryInput{
-		TableName:                 aws.String(r.manifestTableName),
-		IndexName:                 aws.String("ManifestTagIndex"),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		KeyConditionExpression:    expr.KeyCondition(),
+	if resp.Attributes == nil {
+		return apperrors.ErrManifestNotFound
 	}
+
+	// マニフェストを削除する直前に書かれたタグも消すように、削除してから探す
+	tags, err := r.findTagsByDigest(ctx, input.Name, input.Reference)
 	if err != nil {
 		return err
 	}
-	resp, err := r.QueryItem(context.TODO(), queryInput)
+	// 探してから削除するまでの間に別の digest に付け替えられたタグは消さない
+	cond := expression.Name("Digest").Equal(expression.Value(input.Reference))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
 	if err != nil {
 		return err
 	}
-	var manifests []Manifest
-	err = attributevalue.UnmarshalListOfMaps(resp.Items, &manifests)
+	for _, t := range tags {
+		_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 aws.String(r.tableName),
+			Key:                       tableKey(repositoryPK(t.Name), tagSK(t.Tag)),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// タグだけを削除する。タグが指していたマニフェストは残る
+func (r ManifestRepository) DeleteManifestByTag(ctx context.Context, input dto.DeleteManifestInput) error {
+	resp, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:    aws.String(r.tableName),
+		Key:          tableKey(repositoryPK(input.Name), tagSK(input.Reference)),
+		ReturnValues: types.ReturnValueAllOld,
+	})
 	if err != nil {
 		return err
 	}
-
-	if len(manifests) < 1 {
-		// no such tag, but success
-		return nil
+	if resp.Attributes == nil {
+		return apperrors.ErrManifestNotFound
 	}
-	manifest := manifests[0]
-	return r.DeleteManifestByDigest(dto.DeleteManifestInput{
-		Name:      input.Name,
-		Reference: manifest.Digest,
-	})
+	return nil
 }
@@ -0,0 +1,196 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+func TestDeleteManifestByDigest(t *testing.T) {
+	tests := []struct {
+		testName string
+		// DeleteItem の SK ごとのエラーの種類
+		deleteErrs map[string]string
+		// マニフェストの項目がない
+		missing    bool
+		wantErr    bool
+		wantDelete []string
+	}{
+		{
+			testName:   "マニフェストとタグを削除する",
+			wantDelete: []string{manifestSK(digestA), tagSK("v1"), tagSK("latest")},
+		},
+		{
+			testName:   "別の digest に付け替えられたタグは残して続ける",
+			deleteErrs: map[string]string{tagSK("v1"): "ConditionalCheckFailedException"},
+			wantDelete: []string{manifestSK(digestA), tagSK("v1"), tagSK("latest")},
+		},
+		{
+			testName:   "マニフェストを削除できなければタグは消さない",
+			deleteErrs: map[string]string{manifestSK(digestA): "ResourceNotFoundException"},
+			wantErr:    true,
+			wantDelete: []string{manifestSK(digestA)},
+		},
+		{
+			testName:   "マニフェストがなければ見つからないエラー",
+			missing:    true,
+			wantErr:    true,
+			wantDelete: []string{manifestSK(digestA)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			client, fake := newFakeDynamoDB(t, func(op string, req map[string]any) (any, string) {
+				switch op {
+				case "Query":
+					return map[string]any{"Items": []any{
+						wireItem(t, newTagItem("org/repo", "v1", digestA, "")),
+						wireItem(t, newTagItem("org/repo", "latest", digestA, "")),
+					}}, ""
+				case "DeleteItem":
+					sk := requestSK(req)
+					if sk == manifestSK(digestA) && !tt.missing {
+						return map[string]any{"Attributes": wireItem(t, Manifest{Name: "org/repo", Digest: digestA})}, tt.deleteErrs[sk]
+					}
+					return nil, tt.deleteErrs[sk]
+				}
+				return nil, "UnknownOperationException"
+			})
+			repo := NewManifestRepository(client, "tcr", nil, 1024)
+
+			err := repo.DeleteManifest(context.Background(), dto.DeleteManifestInput{Name: "org/repo", Reference: digestA})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err is %v, but want error: %v", err, tt.wantErr)
+			}
+			if tt.missing && !errors.Is(err, apperrors.ErrManifestNotFound) {
+				t.Fatalf("err is %v, but want %v", err, apperrors.ErrManifestNotFound)
+			}
+			var got []string
+			for _, req := range fake.requestsOf("DeleteItem") {
+				got = append(got, requestSK(req))
+			}
+			if !reflect.DeepEqual(got, tt.wantDelete) {
+				t.Fatalf("got is %v, but want %v", got, tt.wantDelete)
+			}
+			// タグはマニフェストを削除してから、GSI ではなくベーステーブルを強い整合性で読んで探す
+			for _, req := range fake.requestsOf("Query") {
+				if _, ok := req["IndexName"]; ok || req["ConsistentRead"] != true {
+					t.Fatalf("tags must be queried with a consistent read on the base table: %v", req)
+				}
+			}
+			if ops := fake.ops(); len(ops) > 1 && ops[0] != "DeleteItem" {
+				t.Fatalf("got %v requests, but want the manifest deleted first", ops)
+			}
+		})
+	}
+}
+
+func TestSaveManifestTag(t *testing.T) {
+	tests := []struct {
+		testName string
+		tag      string
+		// トランザクションの項目のうち、Put する項目の SK
+		wantPuts []string
+	}{
+		{testName: "digest での push はタグを作らない", wantPuts: []string{manifestSK(digestA)}},
+		{testName: "タグでの push はタグも書く", tag: "latest", wantPuts: []string{manifestSK(digestA), tagSK("latest")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			client, fake := newFakeDynamoDB(t, func(op string, req map[string]any) (any, string) {
+				return nil, ""
+			})
+			repo := NewManifestRepository(client, "tcr", nil, 1024)
+
+			err := repo.SaveManifest(context.Background(), dto.SaveManifestInput{
+				Name:     "org/repo",
+				Tag:      tt.tag,
+				Digest:   digestA,
+				Manifest: []byte(`{"schemaVersion":2}`),
+			})
+			if err != nil {
+				t.Fatalf("err is %s, but want nil", err.Error())
+			}
+			transacts := fake.requestsOf("TransactWriteItems")
+			if len(transacts) != 1 {
+				t.Fatalf("got %v requests, but want one transaction", fake.ops())
+			}
+			var got []string
+			for _, item := range transacts[0]["TransactItems"].([]any) {
+				put, ok := item.(map[string]any)["Put"].(map[string]any)
+				if !ok {
+					continue
+				}
+				sk := put["Item"].(map[string]any)["SK"].(map[string]any)["S"].(string)
+				got = append(got, sk)
+			}
+			if !reflect.DeepEqual(got, tt.wantPuts) {
+				t.Fatalf("got is %v, but want %v", got, tt.wantPuts)
+			}
+		})
+	}
+}
+
+func TestManifestInlineLimit(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	tests := []struct {
+		testName    string
+		inlineLimit int
+		wantRef     bool
+	}{
+		{testName: "上限より小さければ項目に入れる", inlineLimit: 1024},
+		{testName: "上限と同じ大きさなら項目に入れる", inlineLimit: len(manifest)},
+		{testName: "上限を超えれば blob ストレージに保存する", inlineLimit: len(manifest) - 1, wantRef: true},
+		{testName: "上限が 0 ならすべて blob ストレージに保存する", inlineLimit: 0, wantRef: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			store := &fakeBlobStore{blobs: map[string][]byte{}}
+			repo := NewManifestRepository(nil, "tcr", store, tt.inlineLimit)
+
+			dbManifest, err := repo.toDBManifest(context.Background(), dto.SaveManifestInput{
+				Name:     "org/repo",
+				Digest:   digestA,
+				Manifest: manifest,
+			}, "2026-01-01T00:00:00Z")
+			if err != nil {
+				t.Fatalf("err is %s, but want nil", err.Error())
+			}
+			if got := dbManifest.ManifestRef != ""; got != tt.wantRef {
+				t.Fatalf("got is %v, but want ManifestRef: %v", dbManifest.ManifestRef, tt.wantRef)
+			}
+			if tt.wantRef && (dbManifest.Manifest != "" || string(store.blobs[dbManifest.ManifestRef]) != string(manifest)) {
+				t.Fatalf("manifest must be stored only in the blob store: %+v", dbManifest)
+			}
+			if !tt.wantRef && len(store.blobs) != 0 {
+				t.Fatalf("inline manifest must not be stored in the blob store: %v", store.blobs)
+			}
+
+			// DynamoDB の項目を経由しても同じ中身を読めること
+			item, err := attributevalue.MarshalMap(dbManifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var loaded Manifest
+			err = attributevalue.UnmarshalMap(item, &loaded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := repo.loadManifest(context.Background(), loaded)
+			if err != nil {
+				t.Fatalf("err is %s, but want nil", err.Error())
+			}
+			if string(got) != string(manifest) {
+				t.Fatalf("got is %s, but want %s", got, manifest)
+			}
+		})
+	}
+}
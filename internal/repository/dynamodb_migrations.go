@@ -0,0 +1,387 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/a-takamin/tcr/internal/service/domain"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	s3Type "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// checkpoint は前回中断したところまでの途中経過。空なら最初から実行する。
+// 処理が進むたびに save で途中経過を記録しておけば、中断しても続きから再開できる。
+// 何度実行しても同じ結果になるように書くこと
+type dynamodbMigration struct {
+	version     int
+	description string
+	run         func(ctx context.Context, s *DynamoDBSchema, checkpoint string, save func(checkpoint string) error) error
+}
+
+// 一度リリースしたマイグレーションは変更せず、末尾に追加する
+var dynamodbMigrations = []dynamodbMigration{
+	{
+		version:     1,
+		description: "single table layout",
+		// テーブルとインデックスは EnsureSchema が作成する
+		run: func(ctx context.Context, s *DynamoDBSchema, checkpoint string, save func(string) error) error {
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "import items from legacy tables",
+		run:         importLegacyTables,
+	},
+	{
+		version:     3,
+		description: "backfill referrers attributes on manifests",
+		run:         backfillManifestAttributes,
+	},
+	{
+		version:     4,
+		description: "backfill blob links from manifests",
+		run:         backfillBlobLinks,
+	},
+}
+
+func latestDynamoDBSchemaVersion() int {
+	return dynamodbMigrations[len(dynamodbMigrations)-1].version
+}
+
+// 複数のテーブルを順にスキャンするマイグレーションの途中経過
+type scanCheckpoint struct {
+	Step int            `json:"step"`
+	Key  map[string]any `json:"key,omitempty"`
+}
+
+func decodeScanCheckpoint(checkpoint string) (scanCheckpoint, map[string]types.AttributeValue, error) {
+	var c scanCheckpoint
+	if checkpoint == "" {
+		return c, nil, nil
+	}
+	err := json.Unmarshal([]byte(checkpoint), &c)
+	if err != nil {
+		return c, nil, err
+	}
+	if c.Key == nil {
+		return c, nil, nil
+	}
+	key, err := attributevalue.MarshalMap(c.Key)
+	return c, key, err
+}
+
+func encodeScanCheckpoint(step int, key map[string]types.AttributeValue) (string, error) {
+	c := scanCheckpoint{Step: step}
+	if key != nil {
+		err := attributevalue.UnmarshalMap(key, &c.Key)
+		if err != nil {
+			return "", err
+		}
+	}
+	b, err := json.Marshal(c)
+	return string(b), err
+}
+
+// input のスキャンを startKey から再開し、ページごとに handle を呼んでから次のページの開始位置を save する
+func scanWithCheckpoint(ctx context.Context, client *dynamodb.Client, input *dynamodb.ScanInput, startKey map[string]types.AttributeValue, handle func([]map[string]types.AttributeValue) error, save func(next map[string]types.AttributeValue) error) error {
+	input.ExclusiveStartKey = startKey
+	for {
+		resp, err := client.Scan(ctx, input)
+		if err != nil {
+			return err
+		}
+		err = handle(resp.Items)
+		if err != nil {
+			return err
+		}
+		if resp.LastEvaluatedKey == nil {
+			return nil
+		}
+		err = save(resp.LastEvaluatedKey)
+		if err != nil {
+			return err
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// 旧テーブルの項目を単一テーブルの形式に変換して書き込む。旧テーブルは読むだけで変更しない。
+// 旧テーブル名が指定されていない、またはテーブルがない場合は何もしない
+//
+// 移行中に旧テーブルへ書き込まれた内容は反映されないことがあるので、書き込みを止めてから実行する
+func importLegacyTables(ctx context.Context, s *DynamoDBSchema, checkpoint string, save func(string) error) error {
+	manifests := ManifestRepository{client: s.client, tableName: s.tableName, blobRepo: s.blobRepo}
+	steps := []struct {
+		table   string
+		convert func(map[string]types.AttributeValue) ([]any, error)
+	}{
+		{s.legacy.Repository, convertLegacyRepository},
+		// 旧形式のマニフェストの Tag は Tag テーブルの内容で上書きされるよう先に移行する
+		{s.legacy.Manifest, func(item map[string]types.AttributeValue) ([]any, error) {
+			return manifests.convertLegacyManifest(ctx, item)
+		}},
+		{s.legacy.Tag, convertLegacyTag},
+		{s.legacy.BlobMetadata, convertLegacyBlobMetadata},
+		{s.legacy.BlobUploadProgress, convertLegacyBlobUploadProgress},
+	}
+
+	progress, startKey, err := decodeScanCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+	for i := progress.Step; i < len(steps); i++ {
+		step := steps[i]
+		if i != progress.Step {
+			startKey = nil
+		}
+		if step.table == "" {
+			continue
+		}
+		count := 0
+		err := scanWithCheckpoint(ctx, s.client, &dynamodb.ScanInput{TableName: aws.String(step.table)}, startKey,
+			func(legacyItems []map[string]types.AttributeValue) error {
+				var items []map[string]types.AttributeValue
+				for _, legacyItem := range legacyItems {
+					converted, err := step.convert(legacyItem)
+					if err != nil {
+						return err
+					}
+					for _, c := range converted {
+						item, err := attributevalue.MarshalMap(c)
+						if err != nil {
+							return err
+						}
+						items = append(items, item)
+					}
+				}
+				count += len(items)
+				return batchPutItems(ctx, s.client, s.tableName, items)
+			},
+			func(next map[string]types.AttributeValue) error {
+				checkpoint, err := encodeScanCheckpoint(i, next)
+				if err != nil {
+					return err
+				}
+				return save(checkpoint)
+			})
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			slog.Info("legacy table does not exist. skipping", "table", step.table)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("imported legacy table", "table", step.table, "items", count)
+
+		checkpoint, err := encodeScanCheckpoint(i+1, nil)
+		if err != nil {
+			return err
+		}
+		err = save(checkpoint)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referrers API のために追加した属性を持たないマニフェストについて、中身を読み直して埋める
+func backfillManifestAttributes(ctx context.Context, s *DynamoDBSchema, checkpoint string, save func(string) error) error {
+	manifests := ManifestRepository{client: s.client, tableName: s.tableName, blobRepo: s.blobRepo}
+
+	_, startKey, err := decodeScanCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+	filter := expression.Name("Type").Equal(expression.Value(itemTypeManifest)).
+		And(expression.AttributeNotExists(expression.Name("MediaType")))
+	expr, err := expression.NewBuilder().WithFilter(filter).Build()
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(s.tableName),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	return scanWithCheckpoint(ctx, s.client, input, startKey,
+		func(items []map[string]types.AttributeValue) error {
+			for _, item := range items {
+				var dbManifest Manifest
+				err := attributevalue.UnmarshalMap(item, &dbManifest)
+				if err != nil {
+					return err
+				}
+				err = manifests.backfillAttributes(ctx, dbManifest)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(next map[string]types.AttributeValue) error {
+			checkpoint, err := encodeScanCheckpoint(0, next)
+			if err != nil {
+				return err
+			}
+			return save(checkpoint)
+		})
+}
+
+func (r ManifestRepository) backfillAttributes(ctx context.Context, dbManifest Manifest) error {
+	raw, err := r.loadManifest(ctx, dbManifest)
+	if err != nil {
+		return err
+	}
+	var m model.Manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		// 中身が読めなくても pull はできるので、referrers に載せないだけにする
+		slog.Warn("failed to parse manifest", "name", dbManifest.Name, "digest", dbManifest.Digest, "error", err.Error())
+		return nil
+	}
+
+	update := expression.Set(expression.Name("MediaType"), expression.Value(m.MediaType)).
+		Set(expression.Name("ArtifactType"), expression.Value(domain.ArtifactType(m)))
+	if len(m.Annotations) > 0 {
+		update = update.Set(expression.Name("Annotations"), expression.Value(m.Annotations))
+	}
+	if m.Subject.Digest != "" {
+		update = update.Set(expression.Name("GSI2PK"), expression.Value(referrersGSI2PK(dbManifest.Name, m.Subject.Digest))).
+			Set(expression.Name("GSI2SK"), expression.Value(dbManifest.Digest))
+	}
+	// スキャンの後に削除されたマニフェストを作り直さない
+	cond := expression.AttributeExists(expression.Name("PK"))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       tableKey(dbManifest.PK, dbManifest.SK),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil
+	}
+	return err
+}
+
+// blob のメタデータを記録するようになる前に push された blob には、リポジトリからのリンクがなく、
+// 実体もリポジトリごとのキーにしかない。マニフェストから参照されている blob について、
+// 実体を digest のキーにコピーしてからリンクを作る
+func backfillBlobLinks(ctx context.Context, s *DynamoDBSchema, checkpoint string, save func(string) error) error {
+	manifests := ManifestRepository{client: s.client, tableName: s.tableName, blobRepo: s.blobRepo}
+	metadata := BlobMetadataRepository{client: s.client, tableName: s.tableName}
+
+	_, startKey, err := decodeScanCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+	filter := expression.Name("Type").Equal(expression.Value(itemTypeManifest))
+	expr, err := expression.NewBuilder().WithFilter(filter).Build()
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(s.tableName),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	// 同じ blob を参照するマニフェストは多いので、実体を確認した digest は覚えておく
+	stored := map[string]bool{}
+	return scanWithCheckpoint(ctx, s.client, input, startKey,
+		func(items []map[string]types.AttributeValue) error {
+			for _, item := range items {
+				var dbManifest Manifest
+				err := attributevalue.UnmarshalMap(item, &dbManifest)
+				if err != nil {
+					return err
+				}
+				raw, err := manifests.loadManifest(ctx, dbManifest)
+				if err != nil {
+					return err
+				}
+				var m model.Manifest
+				if err := json.Unmarshal(raw, &m); err != nil {
+					slog.Warn("failed to parse manifest", "name", dbManifest.Name, "digest", dbManifest.Digest, "error", err.Error())
+					continue
+				}
+				for _, d := range append([]model.Descriptor{m.Config}, m.Layers...) {
+					if d.Digest == "" {
+						continue
+					}
+					err = backfillBlobLink(ctx, s.blobRepo, metadata, dbManifest.Name, d, stored)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		func(next map[string]types.AttributeValue) error {
+			checkpoint, err := encodeScanCheckpoint(0, next)
+			if err != nil {
+				return err
+			}
+			return save(checkpoint)
+		})
+}
+
+// リンクがすでにあっても、実体がリポジトリごとのキーにしかないことがあるので、実体は必ず確認する
+func backfillBlobLink(ctx context.Context, blobRepo persister.BlobPersister, metadata BlobMetadataRepository, name string, d model.Descriptor, stored map[string]bool) error {
+	if !stored[d.Digest] {
+		exists, err := blobRepo.ExistsBlob(ctx, dto.ExistsBlobInput{Digest: d.Digest})
+		if err != nil {
+			return err
+		}
+		if !exists {
+			resp, err := blobRepo.FindBlob(ctx, dto.FindBlobInput{Name: name, Digest: d.Digest})
+			var noSuchKey *s3Type.NoSuchKey
+			if errors.As(err, &noSuchKey) {
+				// 実体がなければ pull できないので、リンクも作らない
+				slog.Warn("blob referenced by manifest does not exist", "name", name, "digest", d.Digest)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = blobRepo.SaveBlob(ctx, dto.SaveBlobInput{Digest: d.Digest, Blob: bytes.NewReader(resp.Blob)})
+			if err != nil {
+				return err
+			}
+		}
+		stored[d.Digest] = true
+	}
+
+	link, err := metadata.FindBlobMetadata(ctx, dto.FindBlobMetadataInput{Name: name, Digest: d.Digest})
+	if err != nil {
+		return err
+	}
+	if link.Digest != "" {
+		return nil
+	}
+	return metadata.SaveBlobMetadata(ctx, dto.SaveBlobMetadataInput{
+		Name:      name,
+		Digest:    d.Digest,
+		Size:      d.Size,
+		MediaType: d.MediaType,
+	})
+}
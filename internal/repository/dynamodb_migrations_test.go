@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+)
+
+func TestBackfillBlobLinks(t *testing.T) {
+	config, linked, legacy, missing := []byte("config"), []byte("linked"), []byte("legacy"), []byte("missing")
+	manifest := []byte(`{"schemaVersion":2,"config":{"digest":"` + digestOf(config) + `","size":6},"layers":[` +
+		`{"digest":"` + digestOf(linked) + `","size":6},` +
+		`{"digest":"` + digestOf(legacy) + `","size":6,"mediaType":"application/vnd.oci.image.layer.v1.tar"},` +
+		`{"digest":"` + digestOf(missing) + `","size":7}]}`)
+	store := &fakeBlobStore{
+		blobs: map[string][]byte{digestOf(config): config},
+		legacy: map[string][]byte{
+			legacyBlobKey("org/repo", digestOf(linked)): linked,
+			legacyBlobKey("org/repo", digestOf(legacy)): legacy,
+		},
+	}
+	// config と linked はリンクがある。linked はリンクがあっても実体は移行前のキーにしかない
+	links := map[string]bool{blobLinkSK(digestOf(config)): true, blobLinkSK(digestOf(linked)): true}
+	client, fake := newFakeDynamoDB(t, func(op string, req map[string]any) (any, string) {
+		switch op {
+		case "Scan":
+			return map[string]any{"Items": []any{wireItem(t, Manifest{
+				itemKeys: itemKeys{PK: repositoryPK("org/repo"), SK: manifestSK(digestA), Type: itemTypeManifest},
+				Name:     "org/repo",
+				Digest:   digestA,
+				Manifest: base64.StdEncoding.EncodeToString(manifest),
+			})}}, ""
+		case "GetItem":
+			if !links[requestSK(req)] {
+				return nil, ""
+			}
+			return map[string]any{"Item": wireItem(t, BlobMetadata{Digest: digestA, Name: "org/repo"})}, ""
+		case "TransactWriteItems":
+			return nil, ""
+		}
+		return nil, "UnknownOperationException"
+	})
+	s := &DynamoDBSchema{client: client, tableName: "tcr", blobRepo: store}
+
+	err := backfillBlobLinks(context.Background(), s, "", func(string) error { return nil })
+	if err != nil {
+		t.Fatalf("err is %s, but want nil", err.Error())
+	}
+
+	for _, b := range [][]byte{linked, legacy} {
+		if string(store.blobs[digestOf(b)]) != string(b) {
+			t.Fatalf("blob %s is not copied to the content-addressed key", b)
+		}
+	}
+	if _, ok := store.blobs[digestOf(missing)]; ok {
+		t.Fatalf("missing blob must not be created")
+	}
+	transacts := fake.requestsOf("TransactWriteItems")
+	if len(transacts) != 1 {
+		t.Fatalf("got %v requests, but want one transaction", fake.ops())
+	}
+	put := transacts[0]["TransactItems"].([]any)[1].(map[string]any)["Put"].(map[string]any)["Item"].(map[string]any)
+	got := put["SK"].(map[string]any)["S"].(string) + " " + put["MediaType"].(map[string]any)["S"].(string)
+	want := blobLinkSK(digestOf(legacy)) + " application/vnd.oci.image.layer.v1.tar"
+	if got != want {
+		t.Fatalf("got is %s, but want %s", got, want)
+	}
+}
@@ -0,0 +1,262 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// pull link はたまにしか作らないので、一覧できるように 1 つのパーティションにまとめる
+type PullLink struct {
+	itemKeys
+	ID          string `dynamodbav:"ID"`
+	Repository  string `dynamodbav:"Repository"`
+	Digest      string `dynamodbav:"Digest,omitempty"`
+	Description string `dynamodbav:"Description,omitempty"`
+	ExpiresAt   string `dynamodbav:"ExpiresAt"`
+	CreatedAt   string `dynamodbav:"CreatedAt"`
+	CreatedBy   string `dynamodbav:"CreatedBy"`
+	RevokedAt   string `dynamodbav:"RevokedAt,omitempty"`
+	RevokedBy   string `dynamodbav:"RevokedBy,omitempty"`
+	LastUsedAt  string `dynamodbav:"LastUsedAt,omitempty"`
+	Uses        int    `dynamodbav:"Uses"`
+}
+
+// 使われた記録はリンクごとのパーティションに、日時の順に並べる
+type PullLinkUse struct {
+	itemKeys
+	LinkID    string `dynamodbav:"LinkID"`
+	UsedAt    string `dynamodbav:"UsedAt"`
+	ClientIP  string `dynamodbav:"ClientIP"`
+	UserAgent string `dynamodbav:"UserAgent"`
+}
+
+type PullLinkRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewPullLinkRepository(client *dynamodb.Client, TableName string) *PullLinkRepository {
+	return &PullLinkRepository{
+		client:    client,
+		tableName: TableName,
+	}
+}
+
+func (r PullLinkRepository) ListPullLinks(ctx context.Context) ([]model.PullLink, error) {
+	keyEx := expression.Key("PK").Equal(expression.Value(pullLinksPK))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var links []model.PullLink
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var items []PullLink
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			links = append(links, item.toModel())
+		}
+	}
+	return links, nil
+}
+
+func (r PullLinkRepository) FindPullLink(ctx context.Context, input dto.FindPullLinkInput) (model.PullLink, error) {
+	resp, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       tableKey(pullLinksPK, pullLinkSK(input.ID)),
+		// 取り消しの直後のトークンを受け付けないようにする
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return model.PullLink{}, err
+	}
+	if resp.Item == nil {
+		return model.PullLink{}, apperrors.ErrPullLinkNotFound
+	}
+	var item PullLink
+	err = attributevalue.UnmarshalMap(resp.Item, &item)
+	if err != nil {
+		return model.PullLink{}, err
+	}
+	return item.toModel(), nil
+}
+
+func (r PullLinkRepository) CreatePullLink(ctx context.Context, link model.PullLink) error {
+	item, err := attributevalue.MarshalMap(PullLink{
+		itemKeys: itemKeys{
+			PK:   pullLinksPK,
+			SK:   pullLinkSK(link.ID),
+			Type: itemTypePullLink,
+		},
+		ID:          link.ID,
+		Repository:  link.Repository,
+		Digest:      link.Digest,
+		Description: link.Description,
+		ExpiresAt:   link.ExpiresAt.UTC().Format(time.RFC3339Nano),
+		CreatedAt:   link.CreatedAt.UTC().Format(time.RFC3339Nano),
+		CreatedBy:   link.CreatedBy,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	return err
+}
+
+// 取り消した記録を残すので、項目は削除しない
+func (r PullLinkRepository) RevokePullLink(ctx context.Context, input dto.RevokePullLinkInput) error {
+	update := expression.Set(expression.Name("RevokedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339Nano))).
+		Set(expression.Name("RevokedBy"), expression.Value(input.RevokedBy))
+	cond := expression.AttributeExists(expression.Name("PK"))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       tableKey(pullLinksPK, pullLinkSK(input.ID)),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrPullLinkNotFound
+	}
+	return err
+}
+
+func (r PullLinkRepository) RecordPullLinkUse(ctx context.Context, use model.PullLinkUse) error {
+	usedAt := use.UsedAt.UTC().Format(time.RFC3339Nano)
+	useItem, err := attributevalue.MarshalMap(PullLinkUse{
+		itemKeys: itemKeys{
+			PK:   pullLinkPK(use.LinkID),
+			SK:   pullLinkUseSK(use.UsedAt, uuid.NewString()),
+			Type: itemTypePullLinkUse,
+		},
+		LinkID:    use.LinkID,
+		UsedAt:    usedAt,
+		ClientIP:  use.ClientIP,
+		UserAgent: use.UserAgent,
+	})
+	if err != nil {
+		return err
+	}
+	update := expression.Set(expression.Name("LastUsedAt"), expression.Value(usedAt)).
+		Add(expression.Name("Uses"), expression.Value(1))
+	cond := expression.AttributeExists(expression.Name("PK"))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	err = transactWriteItems(ctx, r.client, []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName:                 aws.String(r.tableName),
+				Key:                       tableKey(pullLinksPK, pullLinkSK(use.LinkID)),
+				UpdateExpression:          expr.Update(),
+				ConditionExpression:       expr.Condition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			},
+		},
+		{
+			Put: &types.Put{
+				TableName: aws.String(r.tableName),
+				Item:      useItem,
+			},
+		},
+	})
+	// 0 番目はリンクの存在確認
+	if isConditionFailedAt(err, 0) {
+		return apperrors.ErrPullLinkNotFound
+	}
+	return err
+}
+
+func (r PullLinkRepository) ListPullLinkUses(ctx context.Context, input dto.ListPullLinkUsesInput) ([]model.PullLinkUse, error) {
+	keyEx := expression.Key("PK").Equal(expression.Value(pullLinkPK(input.ID))).
+		And(expression.Key("SK").BeginsWith("USE#"))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var uses []model.PullLinkUse
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ScanIndexForward:          aws.Bool(false),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var items []PullLinkUse
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			usedAt, _ := time.Parse(time.RFC3339Nano, item.UsedAt)
+			uses = append(uses, model.PullLinkUse{
+				LinkID:    item.LinkID,
+				UsedAt:    usedAt,
+				ClientIP:  item.ClientIP,
+				UserAgent: item.UserAgent,
+			})
+		}
+	}
+	return uses, nil
+}
+
+func (item PullLink) toModel() model.PullLink {
+	expiresAt, _ := time.Parse(time.RFC3339Nano, item.ExpiresAt)
+	createdAt, _ := time.Parse(time.RFC3339Nano, item.CreatedAt)
+	return model.PullLink{
+		ID:          item.ID,
+		Repository:  item.Repository,
+		Digest:      item.Digest,
+		Description: item.Description,
+		ExpiresAt:   expiresAt,
+		CreatedAt:   createdAt,
+		CreatedBy:   item.CreatedBy,
+		RevokedAt:   parseOptionalTime(item.RevokedAt),
+		RevokedBy:   item.RevokedBy,
+		LastUsedAt:  parseOptionalTime(item.LastUsedAt),
+		Uses:        item.Uses,
+	}
+}
@@ -2,16 +2,27 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"github.com/a-takamin/tcr/internal/apperrors"
 	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+// GSI1 の CATALOG パーティションに載せて、リポジトリの一覧を名前順に取得できるようにする
 type Repository struct {
-	Name string `dynamodbav:Name`
+	itemKeys
+	Name      string `dynamodbav:"Name"`
+	CreatedAt string `dynamodbav:"CreatedAt"`
+	UpdatedAt string `dynamodbav:"UpdatedAt,omitempty"`
+	// 設定されるまでは入らない
+	Visibility string `dynamodbav:"Visibility,omitempty"`
 }
 
 type RepositoryRepository struct {
@@ -26,16 +37,12 @@ func NewRepositoryRepository(client *dynamodb.Client, TableName string) *Reposit
 	}
 }
 
-func (r RepositoryRepository) ExistsRepository(input dto.ExistsRepositoryInput) (bool, error) {
+func (r RepositoryRepository) ExistsRepository(ctx context.Context, input dto.ExistsRepositoryInput) (bool, error) {
 	itemInput := &dynamodb.GetItemInput{
 		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"Name": &types.AttributeValueMemberS{
-				Value: input.Name,
-			},
-		},
+		Key:       tableKey(repositoryPK(input.Name), repositorySK),
 	}
-	resp, err := r.client.GetItem(context.TODO(), itemInput)
+	resp, err := r.client.GetItem(ctx, itemInput)
 
 	if err != nil {
 		return false, err
@@ -54,31 +61,119 @@ func (r RepositoryRepository) ExistsRepository(input dto.ExistsRepositoryInput)
 	return true, nil
 }
 
-func (r RepositoryRepository) SaveRepository(input dto.SaveRepositoryInput) error {
-	repo := Repository{
-		Name: input.Name,
+func (r RepositoryRepository) FindRepository(ctx context.Context, input dto.FindRepositoryInput) (model.Repository, error) {
+	resp, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       tableKey(repositoryPK(input.Name), repositorySK),
+	})
+	if err != nil {
+		return model.Repository{}, err
+	}
+	if resp.Item == nil {
+		return model.Repository{}, apperrors.ErrRepositoryNotFound
 	}
-	item, err := attributevalue.MarshalMap(repo)
+	var repo Repository
+	err = attributevalue.UnmarshalMap(resp.Item, &repo)
+	if err != nil {
+		return model.Repository{}, err
+	}
+	return model.Repository{Name: repo.Name, Visibility: repo.Visibility}, nil
+}
+
+func (r RepositoryRepository) ListRepositories(ctx context.Context, input dto.ListRepositoriesInput) (dto.ListRepositoriesOutput, error) {
+	keyEx := expression.Key("GSI1PK").Equal(expression.Value(catalogPK))
+	if input.Last != "" {
+		keyEx = keyEx.And(expression.Key("GSI1SK").GreaterThan(expression.Value(input.Last)))
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return dto.ListRepositoriesOutput{}, err
+	}
+
+	var output dto.ListRepositoriesOutput
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		IndexName:                 aws.String(gsi1IndexName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		Limit:                     aws.Int32(int32(input.N)),
+	})
+	for paginator.HasMorePages() && len(output.Names) < input.N {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return dto.ListRepositoriesOutput{}, err
+		}
+		var repos []Repository
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &repos)
+		if err != nil {
+			return dto.ListRepositoriesOutput{}, err
+		}
+		for _, repo := range repos {
+			output.Names = append(output.Names, repo.Name)
+			output.Repositories = append(output.Repositories, model.Repository{Name: repo.Name, Visibility: repo.Visibility})
+		}
+	}
+	if len(output.Names) > input.N {
+		output.Names = output.Names[:input.N]
+		output.Repositories = output.Repositories[:input.N]
+	}
+	if len(output.Names) == input.N && paginator.HasMorePages() {
+		output.Next = output.Names[len(output.Names)-1]
+	}
+	return output, nil
+}
+
+// CreatedAt は最初に作られたときの日時を保持し続ける
+func (r RepositoryRepository) SaveRepository(ctx context.Context, input dto.SaveRepositoryInput) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	update := expression.Set(expression.Name("Type"), expression.Value(itemTypeRepository)).
+		Set(expression.Name("Name"), expression.Value(input.Name)).
+		Set(expression.Name("GSI1PK"), expression.Value(catalogPK)).
+		Set(expression.Name("GSI1SK"), expression.Value(input.Name)).
+		Set(expression.Name("CreatedAt"), expression.IfNotExists(expression.Name("CreatedAt"), expression.Value(now)))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
 	if err != nil {
 		return err
 	}
-	_, err = r.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(r.tableName),
-		Item:      item,
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       tableKey(repositoryPK(input.Name), repositorySK),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
+
+func (r RepositoryRepository) SetRepositoryVisibility(ctx context.Context, input dto.SetRepositoryVisibilityInput) error {
+	update := expression.Set(expression.Name("Visibility"), expression.Value(input.Visibility))
+	cond := expression.AttributeExists(expression.Name("PK"))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       tableKey(repositoryPK(input.Name), repositorySK),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
 	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrRepositoryNotFound
+	}
 	return err
 }
 
-func (r RepositoryRepository) DeleteRepository(input dto.DeleteRepositoryInput) error {
+func (r RepositoryRepository) DeleteRepository(ctx context.Context, input dto.DeleteRepositoryInput) error {
 	itemInput := &dynamodb.DeleteItemInput{
 		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"Name": &types.AttributeValueMemberS{
-				Value: input.Name,
-			},
-		},
+		Key:       tableKey(repositoryPK(input.Name), repositorySK),
 	}
 
-	_, err := r.client.DeleteItem(context.TODO(), itemInput)
+	_, err := r.client.DeleteItem(ctx, itemInput)
 	return err
 }
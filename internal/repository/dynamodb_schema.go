@@ -0,0 +1,336 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// スキーマバージョンとマイグレーションの進み具合を記録する項目のキー。
+// リポジトリ名は # から始められないので、他の項目と衝突しない
+const schemaPK = "#SCHEMA"
+
+const itemTypeSchema = "Schema"
+
+// マイグレーションを実行しているインスタンスが持つロックの期限。
+// 期限が切れたロックは、実行中のインスタンスが落ちたものとみなして他のインスタンスが奪える
+const schemaLockLease = 5 * time.Minute
+
+// テーブルやインデックスが使えるようになるまで待つ時間
+const schemaWaitTimeout = 10 * time.Minute
+
+var errSchemaLocked = errors.New("another instance is migrating the metadata schema")
+
+// Migrating が 0 でなければ、そのバージョンのマイグレーションを Checkpoint まで終えたところで中断している
+type schemaItem struct {
+	itemKeys
+	Version     int    `dynamodbav:"Version"`
+	Migrating   int    `dynamodbav:"Migrating,omitempty"`
+	Checkpoint  string `dynamodbav:"Checkpoint,omitempty"`
+	LockOwner   string `dynamodbav:"LockOwner,omitempty"`
+	LockedUntil int64  `dynamodbav:"LockedUntil,omitempty"`
+	UpdatedAt   string `dynamodbav:"UpdatedAt,omitempty"`
+}
+
+var _ persister.SchemaMigrator = (*DynamoDBSchema)(nil)
+
+// 単一テーブルとその GSI を作成し、dynamodbMigrations を順に適用する
+type DynamoDBSchema struct {
+	client    *dynamodb.Client
+	tableName string
+	// マニフェストを読み直すマイグレーションで、blob ストレージに保存された大きなマニフェストを読むために使う
+	blobRepo persister.BlobPersister
+	legacy   LegacyTableNames
+	owner    string
+}
+
+func NewDynamoDBSchema(client *dynamodb.Client, tableName string, blobRepo persister.BlobPersister, legacy LegacyTableNames) *DynamoDBSchema {
+	hostname, _ := os.Hostname()
+	return &DynamoDBSchema{
+		client:    client,
+		tableName: tableName,
+		blobRepo:  blobRepo,
+		legacy:    legacy,
+		owner:     fmt.Sprintf("%s/%d/%d", hostname, os.Getpid(), time.Now().UnixNano()),
+	}
+}
+
+func metadataAttributeDefinitions() []types.AttributeDefinition {
+	var definitions []types.AttributeDefinition
+	for _, name := range []string{"PK", "SK", "GSI1PK", "GSI1SK", "GSI2PK", "GSI2SK"} {
+		definitions = append(definitions, types.AttributeDefinition{
+			AttributeName: aws.String(name),
+			AttributeType: types.ScalarAttributeTypeS,
+		})
+	}
+	return definitions
+}
+
+// GSI には問い合わせで使う属性だけを射影する
+func metadataIndexes() []types.GlobalSecondaryIndex {
+	index := func(name string, attributes ...string) types.GlobalSecondaryIndex {
+		return types.GlobalSecondaryIndex{
+			IndexName: aws.String(name),
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String(name + "PK"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String(name + "SK"), KeyType: types.KeyTypeRange},
+			},
+			Projection: &types.Projection{
+				ProjectionType:   types.ProjectionTypeInclude,
+				NonKeyAttributes: attributes,
+			},
+		}
+	}
+	return []types.GlobalSecondaryIndex{
+		index(gsi1IndexName, "Name", "Tag", "Digest"),
+		index(gsi2IndexName, "Name", "Digest", "Size", "MediaType", "ArtifactType", "Annotations"),
+	}
+}
+
+func (s *DynamoDBSchema) EnsureSchema(ctx context.Context) error {
+	desc, err := s.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.tableName),
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return s.createTable(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	for _, index := range desc.Table.GlobalSecondaryIndexes {
+		existing[aws.ToString(index.IndexName)] = true
+	}
+	// UpdateTable では一度に 1 つの GSI しか作成できない
+	for _, index := range metadataIndexes() {
+		if existing[aws.ToString(index.IndexName)] {
+			continue
+		}
+		slog.Info("creating index", "table", s.tableName, "index", aws.ToString(index.IndexName))
+		_, err := s.client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:            aws.String(s.tableName),
+			AttributeDefinitions: metadataAttributeDefinitions(),
+			GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+				{Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:  index.IndexName,
+					KeySchema:  index.KeySchema,
+					Projection: index.Projection,
+				}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		err = s.waitForIndex(ctx, aws.ToString(index.IndexName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DynamoDBSchema) createTable(ctx context.Context) error {
+	slog.Info("creating table", "table", s.tableName)
+	_, err := s.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:            aws.String(s.tableName),
+		AttributeDefinitions: metadataAttributeDefinitions(),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("PK"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("SK"), KeyType: types.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: metadataIndexes(),
+		BillingMode:            types.BillingModePayPerRequest,
+	})
+	// 他のインスタンスが同時に作成した場合
+	var inUse *types.ResourceInUseException
+	if err != nil && !errors.As(err, &inUse) {
+		return err
+	}
+	return dynamodb.NewTableExistsWaiter(s.client).Wait(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.tableName),
+	}, schemaWaitTimeout)
+}
+
+func (s *DynamoDBSchema) waitForIndex(ctx context.Context, indexName string) error {
+	deadline := time.Now().Add(schemaWaitTimeout)
+	for time.Now().Before(deadline) {
+		desc, err := s.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(s.tableName),
+		})
+		if err != nil {
+			return err
+		}
+		for _, index := range desc.Table.GlobalSecondaryIndexes {
+			if aws.ToString(index.IndexName) == indexName && index.IndexStatus == types.IndexStatusActive {
+				return nil
+			}
+		}
+		err = sleepContext(ctx, 5*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("index %s did not become active in %s", indexName, schemaWaitTimeout)
+}
+
+func (s *DynamoDBSchema) SchemaVersion(ctx context.Context) (int, int, error) {
+	item, err := s.findSchemaItem(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return item.Version, latestDynamoDBSchemaVersion(), nil
+}
+
+func (s *DynamoDBSchema) findSchemaItem(ctx context.Context) (schemaItem, error) {
+	resp, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		Key:            tableKey(schemaPK, schemaPK),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return schemaItem{}, err
+	}
+	var item schemaItem
+	err = attributevalue.UnmarshalMap(resp.Item, &item)
+	if err != nil {
+		return schemaItem{}, err
+	}
+	return item, nil
+}
+
+// 同時に複数のインスタンスが実行しないよう、スキーマの項目にロックを取ってから適用する
+func (s *DynamoDBSchema) Migrate(ctx context.Context) error {
+	item, err := s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	// 中断された場合でも次の実行を待たせないようにロックは外す
+	defer s.unlock(context.WithoutCancel(ctx))
+
+	for _, migration := range dynamodbMigrations {
+		if migration.version <= item.Version {
+			continue
+		}
+		checkpoint := ""
+		if item.Migrating == migration.version {
+			checkpoint = item.Checkpoint
+			slog.Info("resuming schema migration", "version", migration.version, "description", migration.description)
+		} else {
+			slog.Info("running schema migration", "version", migration.version, "description", migration.description)
+		}
+
+		save := func(checkpoint string) error {
+			return s.updateSchemaItem(ctx, item.Version, migration.version, checkpoint)
+		}
+		err := migration.run(ctx, s, checkpoint, save)
+		if err != nil {
+			return fmt.Errorf("schema migration %d failed: %w", migration.version, err)
+		}
+		err = s.updateSchemaItem(ctx, migration.version, 0, "")
+		if err != nil {
+			return err
+		}
+		item.Version = migration.version
+	}
+	return nil
+}
+
+// ロックの期限を延ばしながら、スキーマバージョンと途中経過を記録する。
+// ロックを他のインスタンスに奪われていた場合は errSchemaLocked を返す
+func (s *DynamoDBSchema) updateSchemaItem(ctx context.Context, version int, migrating int, checkpoint string) error {
+	update := expression.Set(expression.Name("Version"), expression.Value(version)).
+		Set(expression.Name("LockedUntil"), expression.Value(time.Now().Add(schemaLockLease).Unix())).
+		Set(expression.Name("UpdatedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339Nano)))
+	if migrating == 0 {
+		update = update.Remove(expression.Name("Migrating")).Remove(expression.Name("Checkpoint"))
+	} else {
+		update = update.Set(expression.Name("Migrating"), expression.Value(migrating)).
+			Set(expression.Name("Checkpoint"), expression.Value(checkpoint))
+	}
+	cond := expression.Name("LockOwner").Equal(expression.Value(s.owner))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.tableName),
+		Key:                       tableKey(schemaPK, schemaPK),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return errSchemaLocked
+	}
+	return err
+}
+
+func (s *DynamoDBSchema) lock(ctx context.Context) (schemaItem, error) {
+	now := time.Now()
+	update := expression.Set(expression.Name("Type"), expression.Value(itemTypeSchema)).
+		Set(expression.Name("Version"), expression.IfNotExists(expression.Name("Version"), expression.Value(0))).
+		Set(expression.Name("LockOwner"), expression.Value(s.owner)).
+		Set(expression.Name("LockedUntil"), expression.Value(now.Add(schemaLockLease).Unix()))
+	cond := expression.AttributeNotExists(expression.Name("LockOwner")).
+		Or(expression.Name("LockedUntil").LessThan(expression.Value(now.Unix())))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return schemaItem{}, err
+	}
+	resp, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.tableName),
+		Key:                       tableKey(schemaPK, schemaPK),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return schemaItem{}, errSchemaLocked
+	}
+	if err != nil {
+		return schemaItem{}, err
+	}
+	var item schemaItem
+	err = attributevalue.UnmarshalMap(resp.Attributes, &item)
+	if err != nil {
+		return schemaItem{}, err
+	}
+	return item, nil
+}
+
+func (s *DynamoDBSchema) unlock(ctx context.Context) {
+	update := expression.Remove(expression.Name("LockOwner")).Remove(expression.Name("LockedUntil"))
+	cond := expression.Name("LockOwner").Equal(expression.Value(s.owner))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err == nil {
+		_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(s.tableName),
+			Key:                       tableKey(schemaPK, schemaPK),
+			UpdateExpression:          expr.Update(),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+	}
+	if err != nil {
+		// 期限が切れれば他のインスタンスが奪えるので、失敗しても続ける
+		slog.Warn("failed to release schema lock", "error", err.Error())
+	}
+}
@@ -0,0 +1,196 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// メタデータはすべて 1 つのテーブルに、種類ごとに PK と SK の形を変えて保存する。
+//
+//	種類              PK               SK                 GSI1PK                    GSI1SK   GSI2PK                         GSI2SK
+//	リポジトリ        REPO#<name>      #REPO              CATALOG                   <name>
+//	マニフェスト      REPO#<name>      MANIFEST#<digest>                                     REFERRERS#<name>#<subject>     <digest>
+//	タグ              REPO#<name>      TAG#<tag>          TAGGED#<name>#<digest>    <tag>
+//	blob のリンク     REPO#<name>      BLOB#<digest>      BLOB#<digest>             <name>
+//	blob 自体         BLOB#<digest>    #BLOB
+//	アップロード      UPLOAD#<uuid>    #UPLOAD
+//	権限の付与        GRANTS           GRANT#<id>
+//	アカウント        ACCOUNTS         ACCOUNT#<kind>#<name>
+//	チーム            TEAMS            TEAM#<name>
+//	pull link         PULLLINKS        PULLLINK#<id>
+//	pull link の利用  PULLLINK#<id>    USE#<日時>#<uuid>
+//
+// GSI1 はリポジトリの一覧、digest を指すタグの一覧、blob をリンクしているリポジトリの一覧に使い、
+// GSI2 は subject を持つマニフェスト (referrers) の一覧に使う
+const (
+	gsi1IndexName = "GSI1"
+	gsi2IndexName = "GSI2"
+)
+
+// Type 属性に入る値
+const (
+	itemTypeRepository  = "Repository"
+	itemTypeManifest    = "Manifest"
+	itemTypeTag         = "Tag"
+	itemTypeBlobLink    = "BlobLink"
+	itemTypeBlob        = "Blob"
+	itemTypeUpload      = "Upload"
+	itemTypeGrant       = "Grant"
+	itemTypeAccount     = "Account"
+	itemTypeTeam        = "Team"
+	itemTypePullLink    = "PullLink"
+	itemTypePullLinkUse = "PullLinkUse"
+)
+
+const (
+	repositorySK = "#REPO"
+	blobSK       = "#BLOB"
+	uploadSK     = "#UPLOAD"
+	catalogPK    = "CATALOG"
+	grantsPK     = "GRANTS"
+	accountsPK   = "ACCOUNTS"
+	teamsPK      = "TEAMS"
+	pullLinksPK  = "PULLLINKS"
+)
+
+// TransactionConflict のときに TransactWriteItems をやり直す回数
+const maxTransactRetries = 3
+
+// すべての項目が持つキー。GSI に載せない項目は GSI のキーを空のままにする
+type itemKeys struct {
+	PK     string `dynamodbav:"PK"`
+	SK     string `dynamodbav:"SK"`
+	Type   string `dynamodbav:"Type"`
+	GSI1PK string `dynamodbav:"GSI1PK,omitempty"`
+	GSI1SK string `dynamodbav:"GSI1SK,omitempty"`
+	GSI2PK string `dynamodbav:"GSI2PK,omitempty"`
+	GSI2SK string `dynamodbav:"GSI2SK,omitempty"`
+}
+
+func repositoryPK(name string) string {
+	return "REPO#" + name
+}
+
+func manifestSK(digest string) string {
+	return "MANIFEST#" + digest
+}
+
+func tagSK(tag string) string {
+	return "TAG#" + tag
+}
+
+func blobLinkSK(digest string) string {
+	return "BLOB#" + digest
+}
+
+func blobPK(digest string) string {
+	return "BLOB#" + digest
+}
+
+func uploadPK(uuid string) string {
+	return "UPLOAD#" + uuid
+}
+
+func grantSK(id string) string {
+	return "GRANT#" + id
+}
+
+// name を空にすると kind のアカウントの接頭辞になる
+func accountSK(kind string, name string) string {
+	return "ACCOUNT#" + kind + "#" + name
+}
+
+func teamSK(name string) string {
+	return "TEAM#" + name
+}
+
+func pullLinkSK(id string) string {
+	return "PULLLINK#" + id
+}
+
+func pullLinkPK(id string) string {
+	return "PULLLINK#" + id
+}
+
+// 日時の順に並ぶように、SK の先頭に利用した日時を入れる
+func pullLinkUseSK(usedAt time.Time, id string) string {
+	return "USE#" + usedAt.UTC().Format(time.RFC3339Nano) + "#" + id
+}
+
+func taggedGSI1PK(name string, digest string) string {
+	return "TAGGED#" + name + "#" + digest
+}
+
+func referrersGSI2PK(name string, subject string) string {
+	return "REFERRERS#" + name + "#" + subject
+}
+
+func tableKey(pk string, sk string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{
+			Value: pk,
+		},
+		"SK": &types.AttributeValueMemberS{
+			Value: sk,
+		},
+	}
+}
+
+// 同じ項目に対するトランザクションが競合した場合はやり直す
+func transactWriteItems(ctx context.Context, client *dynamodb.Client, items []types.TransactWriteItem) error {
+	var err error
+	for i := 0; i < maxTransactRetries; i++ {
+		_, err = client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: items,
+		})
+		if !isTransactionConflict(err) {
+			return err
+		}
+		slog.Warn("transaction conflict. retrying", "attempt", i+1)
+		err = sleepContext(ctx, time.Duration(i+1)*50*time.Millisecond)
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// リトライの間に待つ。待っている間に ctx がキャンセルされたらそのエラーを返す
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func isTransactionConflict(err error) bool {
+	var canceledErr *types.TransactionCanceledException
+	if !errors.As(err, &canceledErr) {
+		return false
+	}
+	for _, reason := range canceledErr.CancellationReasons {
+		if aws.ToString(reason.Code) == "TransactionConflict" {
+			return true
+		}
+	}
+	return false
+}
+
+// i 番目の項目の条件を満たさずにトランザクションが取り消されたかどうか
+func isConditionFailedAt(err error, i int) bool {
+	var canceledErr *types.TransactionCanceledException
+	if !errors.As(err, &canceledErr) || len(canceledErr.CancellationReasons) <= i {
+		return false
+	}
+	return aws.ToString(canceledErr.CancellationReasons[i].Code) == "ConditionalCheckFailed"
+}
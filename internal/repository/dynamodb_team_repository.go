@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// チームは権限の判定で全件を使うので、権限の付与と同じく 1 つのパーティションにまとめる
+type Team struct {
+	itemKeys
+	Name      string   `dynamodbav:"Name"`
+	Members   []string `dynamodbav:"Members"`
+	CreatedAt string   `dynamodbav:"CreatedAt"`
+	CreatedBy string   `dynamodbav:"CreatedBy"`
+}
+
+type TeamRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewTeamRepository(client *dynamodb.Client, TableName string) *TeamRepository {
+	return &TeamRepository{
+		client:    client,
+		tableName: TableName,
+	}
+}
+
+func (r TeamRepository) ListTeams(ctx context.Context) ([]model.Team, error) {
+	keyEx := expression.Key("PK").Equal(expression.Value(teamsPK))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var teams []model.Team
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var items []Team
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			createdAt, _ := time.Parse(time.RFC3339Nano, item.CreatedAt)
+			teams = append(teams, model.Team{
+				Name:      item.Name,
+				Members:   item.Members,
+				CreatedAt: createdAt,
+				CreatedBy: item.CreatedBy,
+			})
+		}
+	}
+	return teams, nil
+}
+
+func (r TeamRepository) CreateTeam(ctx context.Context, team model.Team) error {
+	item, err := attributevalue.MarshalMap(Team{
+		itemKeys: itemKeys{
+			PK:   teamsPK,
+			SK:   teamSK(team.Name),
+			Type: itemTypeTeam,
+		},
+		Name:      team.Name,
+		Members:   team.Members,
+		CreatedAt: team.CreatedAt.UTC().Format(time.RFC3339Nano),
+		CreatedBy: team.CreatedBy,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrTeamAlreadyExists
+	}
+	return err
+}
+
+func (r TeamRepository) UpdateTeam(ctx context.Context, team model.Team) error {
+	update := expression.Set(expression.Name("Members"), expression.Value(team.Members))
+	cond := expression.AttributeExists(expression.Name("PK"))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       tableKey(teamsPK, teamSK(team.Name)),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrTeamNotFound
+	}
+	return err
+}
+
+func (r TeamRepository) DeleteTeam(ctx context.Context, input dto.DeleteTeamInput) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(r.tableName),
+		Key:                 tableKey(teamsPK, teamSK(input.Name)),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return apperrors.ErrTeamNotFound
+	}
+	return err
+}
@@ -7,18 +7,16 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/a-takamin/tcr/internal/apperrors"
 	"github.com/a-takamin/tcr/internal/dto"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3Type "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type BlobRepository struct {
-	client                      *s3.Client
-	dClient                     *dynamodb.Client
-	bucketName                  string
-	blobUploadProgressTableName string
+	client     *s3.Client
+	bucketName string
 }
 
 type Blob struct {
@@ -27,25 +25,34 @@ type Blob struct {
 	Blob   string
 }
 
-func NewBlobRepository(client *s3.Client, bucketName string, dynamodbClient *dynamodb.Client, blobUploadProgressTName string) *BlobRepository {
+func NewBlobRepository(client *s3.Client, bucketName string) *BlobRepository {
 	return &BlobRepository{
-		client:                      client,
-		bucketName:                  bucketName,
-		dClient:                     dynamodbClient,
-		blobUploadProgressTableName: blobUploadProgressTName,
+		client:     client,
+		bucketName: bucketName,
 	}
 }
 
+// blob はリポジトリに関係なく digest だけをキーにして 1 つだけ保存する。
+// どのリポジトリから見えるかは BlobMetadataPersister のリンクで管理する
+func blobKey(digest string) string {
+	return "blobs/" + digest
+}
+
+// リポジトリごとに blob を保存していた頃のキー
+func legacyBlobKey(name string, digest string) string {
+	return name + "/" + digest
+}
+
 // Refactor
-func (r BlobRepository) ExistsBlob(input dto.ExistsBlobInput) (bool, error) {
-	_, err := r.client.GetObject(context.TODO(), &s3.GetObjectInput{
+func (r BlobRepository) ExistsBlob(ctx context.Context, input dto.ExistsBlobInput) (bool, error) {
+	_, err := r.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(r.bucketName),
-		Key:    aws.String(input.Name + "/" + input.Digest),
+		Key:    aws.String(blobKey(input.Digest)),
 	})
-	// GetObject はオブジェクトがないときにエラーを返す
+	// HeadObject はオブジェクトがないときにエラーを返す
 	if err != nil {
-		var noSuchKeyErr *s3Type.NoSuchKey
-		if errors.As(err, &noSuchKeyErr) {
+		var notFoundErr *s3Type.NotFound
+		if errors.As(err, &notFoundErr) {
 			return false, nil
 		}
 		return false, err
@@ -53,11 +60,19 @@ func (r BlobRepository) ExistsBlob(input dto.ExistsBlobInput) (bool, error) {
 	return true, nil
 }
 
-func (r BlobRepository) FindBlob(input dto.FindBlobInput) (dto.FindBlobOutput, error) {
-	resp, err := r.client.GetObject(context.TODO(), &s3.GetObjectInput{
+func (r BlobRepository) FindBlob(ctx context.Context, input dto.FindBlobInput) (dto.FindBlobOutput, error) {
+	resp, err := r.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(r.bucketName),
-		Key:    aws.String(input.Name + "/" + input.Digest),
+		Key:    aws.String(blobKey(input.Digest)),
 	})
+	var noSuchKeyErr *s3Type.NoSuchKey
+	if errors.As(err, &noSuchKeyErr) && input.Name != "" {
+		// 移行前に保存された blob はリポジトリごとのキーにある
+		resp, err = r.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(r.bucketName),
+			Key:    aws.String(legacyBlobKey(input.Name, input.Digest)),
+		})
+	}
 	if err != nil {
 		return dto.FindBlobOutput{}, err
 	}
@@ -71,10 +86,10 @@ func (r BlobRepository) FindBlob(input dto.FindBlobInput) (dto.FindBlobOutput, e
 	}, nil
 }
 
-func (r BlobRepository) FindChunkedBlob(input dto.FindChunkedBlobInput) (dto.FindBlobOutput, error) {
-	resp, err := r.client.GetObject(context.TODO(), &s3.GetObjectInput{
+func (r BlobRepository) FindChunkedBlob(ctx context.Context, input dto.FindChunkedBlobInput) (dto.FindBlobOutput, error) {
+	resp, err := r.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(r.bucketName),
-		Key:    aws.String(fmt.Sprintf("/%s/chunk/%s/%d", input.Name, input.Uuid, input.ChunkSeqNo)),
+		Key:    aws.String(chunkKey(input.Name, input.Uuid, input.ChunkSeqNo)),
 	})
 	if err != nil {
 		return dto.FindBlobOutput{}, err
@@ -89,40 +104,90 @@ func (r BlobRepository) FindChunkedBlob(input dto.FindChunkedBlobInput) (dto.Fin
 	}, nil
 }
 
-func (r BlobRepository) SaveBlob(input dto.SaveBlobInput) error {
+func (r BlobRepository) SaveBlob(ctx context.Context, input dto.SaveBlobInput) error {
 	// TODO: なぜか分からないが「"failed to seek body to start, request stream is not seekable”」が発生するので、
 	// 一度Blobを読み込んで再度Reader型にしている
 	b, err := io.ReadAll(input.Blob)
 	if err != nil {
 		return err
 	}
-	_, err = r.client.PutObject(context.TODO(), &s3.PutObjectInput{
+	_, err = r.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(r.bucketName),
-		Key:    aws.String(input.Name + "/" + input.Digest),
+		Key:    aws.String(blobKey(input.Digest)),
 		Body:   bytes.NewReader(b),
 	})
 	return err
 }
 
-func (r BlobRepository) SaveChunkedBlob(input dto.SaveChunkedBlobInput) error {
+func (r BlobRepository) SaveChunkedBlob(ctx context.Context, input dto.SaveChunkedBlobInput) error {
 	// TODO: なぜか分からないが「"failed to seek body to start, request stream is not seekable”」が発生するので、
 	// 一度Blobを読み込んで再度Reader型にしている
 	b, err := io.ReadAll(input.Blob)
 	if err != nil {
 		return err
 	}
-	_, err = r.client.PutObject(context.TODO(), &s3.PutObjectInput{
+	_, err = r.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(r.bucketName),
-		Key:    aws.String(fmt.Sprintf("/%s/chunk/%s/%d", input.Name, input.Uuid, input.ChunkSeqNo)),
+		Key:    aws.String(chunkKey(input.Name, input.Uuid, input.ChunkSeqNo)),
 		Body:   bytes.NewReader(b),
 	})
 	return err
 }
 
-func (r BlobRepository) DeleteBlob(input dto.DeleteBlobInput) error {
-	_, err := r.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+func (r BlobRepository) DeleteChunkedBlobs(ctx context.Context, input dto.DeleteChunkedBlobsInput) error {
+	// DeleteObjects は一度に 1000 件まで
+	for start := 0; start < input.ChunkNums; start += 1000 {
+		var objects []s3Type.ObjectIdentifier
+		for i := start; i < input.ChunkNums && i < start+1000; i++ {
+			objects = append(objects, s3Type.ObjectIdentifier{
+				Key: aws.String(chunkKey(input.Name, input.Uuid, i)),
+			})
+		}
+		resp, err := r.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(r.bucketName),
+			Delete: &s3Type.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Errors) > 0 {
+			return fmt.Errorf("failed to delete %d chunks: %s", len(resp.Errors), aws.ToString(resp.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+func chunkKey(name string, uuid string, seqNo int) string {
+	return fmt.Sprintf("/%s/chunk/%s/%d", name, uuid, seqNo)
+}
+
+// 移行前のキーにしかない blob は ErrPresignUnavailable を返すので、呼び出し側で中継すること
+func (r BlobRepository) PresignBlobURL(ctx context.Context, input dto.PresignBlobURLInput) (string, error) {
+	exists, err := r.ExistsBlob(ctx, dto.ExistsBlobInput{
+		Digest: input.Digest,
+	})
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", apperrors.ErrPresignUnavailable
+	}
+
+	req, err := s3.NewPresignClient(r.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucketName),
+		Key:    aws.String(blobKey(input.Digest)),
+	}, s3.WithPresignExpires(input.Expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// blob の実体を削除する。他のリポジトリからリンクされていないことは呼び出し側で確認すること
+func (r BlobRepository) DeleteBlob(ctx context.Context, input dto.DeleteBlobInput) error {
+	_, err := r.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(r.bucketName),
-		Key:    aws.String(input.Name + "/" + input.Digest),
+		Key:    aws.String(blobKey(input.Digest)),
 	})
 	return err
 }
@@ -57,6 +57,23 @@ func ValidateDigest(digestLike string) error {
 	return nil
 }
 
+// referrers API で返す artifactType。マニフェストに artifactType がなければ config の mediaType を使う
+func ArtifactType(manifest model.Manifest) string {
+	if manifest.ArtifactType != "" {
+		return manifest.ArtifactType
+	}
+	return manifest.Config.MediaType
+}
+
+// タグの仕様: [a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}
+func ValidateTag(tag string) error {
+	matched, _ := regexp.MatchString(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`, tag)
+	if !matched {
+		return apperrors.ErrInvalidReference
+	}
+	return nil
+}
+
 func CalcManifestDigest(manifest []byte) (string, error) {
 	p := sha256.Sum256(manifest)
 	return fmt.Sprintf("sha256:%s", fmt.Sprintf("%x", p)), nil
@@ -74,7 +91,8 @@ func IsDigest(digestLike string) bool {
 }
 
 func CalcBlobDigest(blob model.Blob) (string, error) {
-	return "", nil
+	p := sha256.Sum256(blob.Blob)
+	return fmt.Sprintf("sha256:%x", p), nil
 }
 
 func CalcManifestDigestRefactor(manifest []byte) (string, error) {
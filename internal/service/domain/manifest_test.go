@@ -1,6 +1,10 @@
 package domain
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/a-takamin/tcr/internal/model"
+)
 
 func TestValidateNameSpace(t *testing.T) {
 	tests := []struct {
@@ -26,3 +30,34 @@ func TestValidateNameSpace(t *testing.T) {
 	}
 
 }
+
+func TestCalcBlobDigest(t *testing.T) {
+	tests := []struct {
+		testName string
+		blob     []byte
+		want     string
+	}{
+		{
+			testName: "空の blob",
+			blob:     []byte{},
+			want:     "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			testName: "中身のある blob",
+			blob:     []byte("hello"),
+			want:     "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got, err := CalcBlobDigest(model.Blob{Blob: tt.blob})
+			if err != nil {
+				t.Fatalf("err is %s, but want nil", err.Error())
+			}
+			if got != tt.want {
+				t.Fatalf("got is %s, but want %s", got, tt.want)
+			}
+		})
+	}
+}
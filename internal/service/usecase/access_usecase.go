@@ -0,0 +1,364 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/a-takamin/tcr/internal/service/domain"
+	"github.com/google/uuid"
+)
+
+// リクエストの送り主がリポジトリ name に action を行えるか。行えなければ TCRERR_DENIED を返す
+type AccessChecker interface {
+	CheckAccess(ctx context.Context, name, action string) error
+}
+
+// checker が nil なら認証が無効なのですべて許可する
+func checkAccess(ctx context.Context, checker AccessChecker, name, action string) error {
+	if checker == nil {
+		return nil
+	}
+	return checker.CheckAccess(ctx, name, action)
+}
+
+// 役割と公開範囲による権限の管理と判定。
+// 権限の付与、チームとリポジトリの公開範囲はリクエストのたびに使うので、grantTTL の間はメモリに持っておく
+type AccessUseCase struct {
+	grantRepo persister.GrantPersister
+	teamRepo  persister.TeamPersister
+	repoRepo  persister.RepositoryPersister
+	// 設定ファイルで指定した管理者。権限の付与がなくてもすべての操作を行える
+	admins   []string
+	grantTTL time.Duration
+
+	mu           sync.Mutex
+	policy       *accessPolicy
+	loadedAt     time.Time
+	visibilities map[string]visibilityEntry
+}
+
+type visibilityEntry struct {
+	visibility string
+	loadedAt   time.Time
+}
+
+type accessPolicy struct {
+	grants []model.Grant
+	teams  []model.Team
+}
+
+func NewAccessUseCase(grantRepo persister.GrantPersister, teamRepo persister.TeamPersister, repoRepo persister.RepositoryPersister, admins []string, grantTTL time.Duration) *AccessUseCase {
+	return &AccessUseCase{
+		grantRepo:    grantRepo,
+		teamRepo:     teamRepo,
+		repoRepo:     repoRepo,
+		admins:       admins,
+		grantTTL:     grantTTL,
+		visibilities: map[string]visibilityEntry{},
+	}
+}
+
+// ctx に送り主がなければ認証が無効なので許可する。
+// トークンで認証した場合は、発行時に権限から決めたスコープで判定する
+func (u *AccessUseCase) CheckAccess(ctx context.Context, name, action string) error {
+	p, ok := auth.PrincipalFrom(ctx)
+	if !ok {
+		return nil
+	}
+	if p.FromToken {
+		if auth.Allows(p.Access, auth.RepositoryAccess(name, action)) {
+			return nil
+		}
+		return apperrors.TCRERR_DENIED.WithDetail(action + " on " + name)
+	}
+	actions, err := u.GrantedActions(ctx, p, name)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(actions, action) {
+		return apperrors.TCRERR_DENIED.WithDetail(action + " on " + name)
+	}
+	return nil
+}
+
+// p がリポジトリ name に行える操作。役割で pull できなくても、公開範囲によっては pull できる
+func (u *AccessUseCase) GrantedActions(ctx context.Context, p auth.Principal, name string) ([]string, error) {
+	actions, err := u.roleActions(ctx, p, name)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(actions, auth.ActionPull) {
+		return actions, nil
+	}
+	visibility, err := u.visibility(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if auth.VisibilityAllowsPull(visibility, p) {
+		actions = append([]string{auth.ActionPull}, actions...)
+	}
+	return actions, nil
+}
+
+// 公開範囲を考えずに、役割によって p がリポジトリ name に行える操作
+func (u *AccessUseCase) roleActions(ctx context.Context, p auth.Principal, name string) ([]string, error) {
+	if p.Subject == "" {
+		return nil, nil
+	}
+	if p.Kind == auth.KindFederated || p.Kind == auth.KindPullLink {
+		return auth.PermittedActions(p.Permissions, name), nil
+	}
+	if u.isConfiguredAdmin(p) {
+		return []string{auth.ActionPull, auth.ActionPush, auth.ActionDelete}, nil
+	}
+	policy, err := u.loadPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return auth.GrantedActions(policy.grants, policy.withTeams(p), name), nil
+}
+
+// repos のうち、リクエストの送り主が pull できるものの名前。
+// トークンの場合はスコープではなく、トークンが持つ送り主の情報で判定する
+func (u *AccessUseCase) VisibleRepositories(ctx context.Context, repos []model.Repository) ([]string, error) {
+	p, ok := auth.PrincipalFrom(ctx)
+	names := []string{}
+	for _, repo := range repos {
+		if !ok || auth.VisibilityAllowsPull(repo.Visibility, p) {
+			names = append(names, repo.Name)
+			continue
+		}
+		actions, err := u.roleActions(ctx, p, repo.Name)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(actions, auth.ActionPull) {
+			names = append(names, repo.Name)
+		}
+	}
+	return names, nil
+}
+
+func (u *AccessUseCase) GetVisibility(ctx context.Context, name string) (model.Repository, error) {
+	err := u.requireAdmin(ctx)
+	if err != nil {
+		return model.Repository{}, err
+	}
+	repo, err := u.repoRepo.FindRepository(ctx, dto.FindRepositoryInput{Name: name})
+	if err != nil {
+		return model.Repository{}, apperrors.Classify(err)
+	}
+	if repo.Visibility == "" {
+		repo.Visibility = auth.VisibilityPrivate
+	}
+	return repo, nil
+}
+
+// リポジトリが削除されると公開範囲も消え、次に push されたときは private になる
+func (u *AccessUseCase) SetVisibility(ctx context.Context, name string, req dto.SetRepositoryVisibilityRequest) (model.Repository, error) {
+	err := u.requireAdmin(ctx)
+	if err != nil {
+		return model.Repository{}, err
+	}
+	if !auth.ValidVisibility(req.Visibility) {
+		return model.Repository{}, apperrors.TCRERR_REQUEST_INVALID.WithDetail("visibility must be public, internal or private")
+	}
+	err = u.repoRepo.SetRepositoryVisibility(ctx, dto.SetRepositoryVisibilityInput{Name: name, Visibility: req.Visibility})
+	if err != nil {
+		return model.Repository{}, apperrors.Classify(err)
+	}
+	u.mu.Lock()
+	delete(u.visibilities, name)
+	u.mu.Unlock()
+	return model.Repository{Name: name, Visibility: req.Visibility}, nil
+}
+
+func (u *AccessUseCase) IsAdmin(ctx context.Context, p auth.Principal) (bool, error) {
+	if p.FromToken {
+		return auth.Allows(p.Access, auth.AdminAccess), nil
+	}
+	if p.Subject == "" || p.Kind == auth.KindFederated || p.Kind == auth.KindPullLink {
+		return false, nil
+	}
+	if u.isConfiguredAdmin(p) {
+		return true, nil
+	}
+	policy, err := u.loadPolicy(ctx)
+	if err != nil {
+		return false, err
+	}
+	return auth.IsAdmin(policy.grants, policy.withTeams(p)), nil
+}
+
+func (u *AccessUseCase) isConfiguredAdmin(p auth.Principal) bool {
+	return p.Kind != auth.KindRobot && slices.Contains(u.admins, p.Subject)
+}
+
+func (u *AccessUseCase) ListGrants(ctx context.Context) ([]model.Grant, error) {
+	err := u.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	grants, err := u.grantRepo.ListGrants(ctx)
+	if err != nil {
+		return nil, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return grants, nil
+}
+
+func (u *AccessUseCase) CreateGrant(ctx context.Context, req dto.CreateGrantRequest) (model.Grant, error) {
+	err := u.requireAdmin(ctx)
+	if err != nil {
+		return model.Grant{}, err
+	}
+	switch {
+	case !auth.ValidSubjectType(req.SubjectType):
+		return model.Grant{}, apperrors.TCRERR_GRANT_INVALID.WithDetail("subjectType must be user, group or robot")
+	case req.Subject == "":
+		return model.Grant{}, apperrors.TCRERR_GRANT_INVALID.WithDetail("subject is required")
+	case !auth.ValidRole(req.Role):
+		return model.Grant{}, apperrors.TCRERR_GRANT_INVALID.WithDetail("role must be reader, writer, maintainer or admin")
+	case !validPattern(req.Pattern):
+		return model.Grant{}, apperrors.TCRERR_GRANT_INVALID.WithDetail("pattern is invalid: " + req.Pattern)
+	}
+
+	p, _ := auth.PrincipalFrom(ctx)
+	grant := model.Grant{
+		ID:          uuid.NewString(),
+		SubjectType: req.SubjectType,
+		Subject:     req.Subject,
+		Pattern:     req.Pattern,
+		Role:        req.Role,
+		CreatedAt:   time.Now().UTC(),
+		CreatedBy:   p.Subject,
+	}
+	err = u.grantRepo.SaveGrant(ctx, grant)
+	if err != nil {
+		return model.Grant{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	u.invalidate()
+	return grant, nil
+}
+
+func (u *AccessUseCase) DeleteGrant(ctx context.Context, id string) error {
+	err := u.requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	err = u.grantRepo.DeleteGrant(ctx, dto.DeleteGrantInput{ID: id})
+	if err != nil {
+		return apperrors.Classify(err)
+	}
+	u.invalidate()
+	return nil
+}
+
+func (u *AccessUseCase) requireAdmin(ctx context.Context) error {
+	p, ok := auth.PrincipalFrom(ctx)
+	if !ok {
+		return apperrors.TCRERR_UNAUTHORIZED
+	}
+	admin, err := u.IsAdmin(ctx, p)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return apperrors.TCRERR_DENIED.WithDetail("admin role is required")
+	}
+	return nil
+}
+
+// * を除けばリポジトリ名として正しいか
+func validPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	return pattern != "" && domain.ValidateName(strings.ReplaceAll(pattern, "*", "a")) == nil
+}
+
+// 他のインスタンスでの変更は grantTTL だけ遅れて反映される
+func (u *AccessUseCase) loadPolicy(ctx context.Context) (*accessPolicy, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.policy != nil && time.Since(u.loadedAt) < u.grantTTL {
+		return u.policy, nil
+	}
+	grants, err := u.grantRepo.ListGrants(ctx)
+	if err != nil {
+		return nil, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	teams, err := u.teamRepo.ListTeams(ctx)
+	if err != nil {
+		return nil, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	u.policy, u.loadedAt = &accessPolicy{grants: grants, teams: teams}, time.Now()
+	return u.policy, nil
+}
+
+// 認証なしでも pull できるリポジトリかどうか
+func (u *AccessUseCase) IsPublic(ctx context.Context, name string) (bool, error) {
+	visibility, err := u.visibility(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return visibility == auth.VisibilityPublic, nil
+}
+
+// まだないリポジトリは private として扱う
+func (u *AccessUseCase) visibility(ctx context.Context, name string) (string, error) {
+	u.mu.Lock()
+	e, ok := u.visibilities[name]
+	u.mu.Unlock()
+	if ok && time.Since(e.loadedAt) < u.grantTTL {
+		return e.visibility, nil
+	}
+	repo, err := u.repoRepo.FindRepository(ctx, dto.FindRepositoryInput{Name: name})
+	if err != nil && !errors.Is(err, apperrors.ErrRepositoryNotFound) {
+		return "", apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	visibility := repo.Visibility
+	if visibility == "" {
+		visibility = auth.VisibilityPrivate
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	for n, e := range u.visibilities {
+		if now.Sub(e.loadedAt) >= u.grantTTL {
+			delete(u.visibilities, n)
+		}
+	}
+	u.visibilities[name] = visibilityEntry{visibility: visibility, loadedAt: now}
+	return visibility, nil
+}
+
+func (u *AccessUseCase) invalidate() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.policy = nil
+}
+
+// p が属するチームをグループに加える。ロボットアカウントはチームに属さない
+func (policy *accessPolicy) withTeams(p auth.Principal) auth.Principal {
+	if p.Kind == auth.KindRobot {
+		return p
+	}
+	groups := slices.Clone(p.Groups)
+	for _, t := range policy.teams {
+		if slices.Contains(t.Members, p.Subject) && !slices.Contains(groups, t.Name) {
+			groups = append(groups, t.Name)
+		}
+	}
+	p.Groups = groups
+	return p
+}
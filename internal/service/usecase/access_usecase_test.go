@@ -0,0 +1,328 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+type fakeGrantRepo struct {
+	grants []model.Grant
+}
+
+func (f *fakeGrantRepo) ListGrants(ctx context.Context) ([]model.Grant, error) {
+	return f.grants, nil
+}
+
+func (f *fakeGrantRepo) SaveGrant(ctx context.Context, grant model.Grant) error {
+	f.grants = append(f.grants, grant)
+	return nil
+}
+
+func (f *fakeGrantRepo) DeleteGrant(ctx context.Context, input dto.DeleteGrantInput) error {
+	for i, g := range f.grants {
+		if g.ID == input.ID {
+			f.grants = append(f.grants[:i], f.grants[i+1:]...)
+			return nil
+		}
+	}
+	return apperrors.ErrGrantNotFound
+}
+
+type fakeTeamRepo struct {
+	teams []model.Team
+}
+
+func (f *fakeTeamRepo) ListTeams(ctx context.Context) ([]model.Team, error) {
+	return f.teams, nil
+}
+
+func (f *fakeTeamRepo) CreateTeam(ctx context.Context, team model.Team) error {
+	for _, t := range f.teams {
+		if t.Name == team.Name {
+			return apperrors.ErrTeamAlreadyExists
+		}
+	}
+	f.teams = append(f.teams, team)
+	return nil
+}
+
+func (f *fakeTeamRepo) UpdateTeam(ctx context.Context, team model.Team) error {
+	for i, t := range f.teams {
+		if t.Name == team.Name {
+			f.teams[i].Members = team.Members
+			return nil
+		}
+	}
+	return apperrors.ErrTeamNotFound
+}
+
+func (f *fakeTeamRepo) DeleteTeam(ctx context.Context, input dto.DeleteTeamInput) error {
+	for i, t := range f.teams {
+		if t.Name == input.Name {
+			f.teams = append(f.teams[:i], f.teams[i+1:]...)
+			return nil
+		}
+	}
+	return apperrors.ErrTeamNotFound
+}
+
+// 名前順に並んだリポジトリ
+type fakeRepositoryRepo struct {
+	repos []model.Repository
+}
+
+func (f *fakeRepositoryRepo) ExistsRepository(ctx context.Context, input dto.ExistsRepositoryInput) (bool, error) {
+	_, err := f.FindRepository(ctx, dto.FindRepositoryInput{Name: input.Name})
+	return err == nil, nil
+}
+
+func (f *fakeRepositoryRepo) FindRepository(ctx context.Context, input dto.FindRepositoryInput) (model.Repository, error) {
+	for _, r := range f.repos {
+		if r.Name == input.Name {
+			return r, nil
+		}
+	}
+	return model.Repository{}, apperrors.ErrRepositoryNotFound
+}
+
+func (f *fakeRepositoryRepo) ListRepositories(ctx context.Context, input dto.ListRepositoriesInput) (dto.ListRepositoriesOutput, error) {
+	var out dto.ListRepositoriesOutput
+	for i, r := range f.repos {
+		if r.Name <= input.Last {
+			continue
+		}
+		if len(out.Names) == input.N {
+			out.Next = out.Names[len(out.Names)-1]
+			break
+		}
+		out.Names = append(out.Names, r.Name)
+		out.Repositories = append(out.Repositories, f.repos[i])
+	}
+	return out, nil
+}
+
+func (f *fakeRepositoryRepo) SaveRepository(ctx context.Context, input dto.SaveRepositoryInput) error {
+	f.repos = append(f.repos, model.Repository{Name: input.Name})
+	return nil
+}
+
+func (f *fakeRepositoryRepo) SetRepositoryVisibility(ctx context.Context, input dto.SetRepositoryVisibilityInput) error {
+	for i, r := range f.repos {
+		if r.Name == input.Name {
+			f.repos[i].Visibility = input.Visibility
+			return nil
+		}
+	}
+	return apperrors.ErrRepositoryNotFound
+}
+
+func (f *fakeRepositoryRepo) DeleteRepository(ctx context.Context, input dto.DeleteRepositoryInput) error {
+	return nil
+}
+
+func TestCheckAccess(t *testing.T) {
+	repo := &fakeGrantRepo{grants: []model.Grant{
+		{SubjectType: auth.SubjectUser, Subject: "alice", Pattern: "org/*", Role: auth.RoleWriter},
+		{SubjectType: auth.SubjectGroup, Subject: "ops", Pattern: "*", Role: auth.RoleMaintainer},
+	}}
+	teams := &fakeTeamRepo{teams: []model.Team{{Name: "ops", Members: []string{"carol"}}}}
+	repos := &fakeRepositoryRepo{repos: []model.Repository{
+		{Name: "base/public", Visibility: auth.VisibilityPublic},
+		{Name: "base/internal", Visibility: auth.VisibilityInternal},
+	}}
+	u := NewAccessUseCase(repo, teams, repos, []string{"root"}, time.Minute)
+	tests := []struct {
+		testName  string
+		principal *auth.Principal
+		name      string
+		action    string
+		wantErr   error
+	}{
+		{testName: "認証が無効", name: "org/app", action: auth.ActionDelete},
+		{testName: "役割の範囲の操作", principal: &auth.Principal{Subject: "alice"}, name: "org/app", action: auth.ActionPush},
+		{testName: "役割の範囲外の操作", principal: &auth.Principal{Subject: "alice"}, name: "org/app", action: auth.ActionDelete, wantErr: apperrors.TCRERR_DENIED},
+		{testName: "付与がないリポジトリ", principal: &auth.Principal{Subject: "alice"}, name: "other/app", action: auth.ActionPull, wantErr: apperrors.TCRERR_DENIED},
+		{testName: "チームへの付与", principal: &auth.Principal{Subject: "carol"}, name: "other/app", action: auth.ActionDelete},
+		{
+			testName:  "同じ名前のロボットはチームに属さない",
+			principal: &auth.Principal{Subject: "carol", Kind: auth.KindRobot},
+			name:      "other/app",
+			action:    auth.ActionPull,
+			wantErr:   apperrors.TCRERR_DENIED,
+		},
+		{
+			testName:  "OIDC の規則で与えられた役割",
+			principal: &auth.Principal{Subject: "github:repo:org/app", Kind: auth.KindFederated, Permissions: []auth.Permission{{Pattern: "ci/*", Role: auth.RoleWriter}}},
+			name:      "ci/app",
+			action:    auth.ActionPush,
+		},
+		{
+			testName:  "OIDC の送り主には権限の付与を使わない",
+			principal: &auth.Principal{Subject: "github:repo:org/app", Kind: auth.KindFederated, Groups: []string{"ops"}},
+			name:      "other/app",
+			action:    auth.ActionPull,
+			wantErr:   apperrors.TCRERR_DENIED,
+		},
+		{testName: "設定ファイルの管理者", principal: &auth.Principal{Subject: "root"}, name: "other/app", action: auth.ActionDelete},
+		{testName: "public のリポジトリは付与がなくても pull できる", principal: &auth.Principal{Subject: "bob"}, name: "base/public", action: auth.ActionPull},
+		{testName: "public のリポジトリでも push には付与が必要", principal: &auth.Principal{Subject: "bob"}, name: "base/public", action: auth.ActionPush, wantErr: apperrors.TCRERR_DENIED},
+		{testName: "internal のリポジトリは認証されていれば pull できる", principal: &auth.Principal{Subject: "bob"}, name: "base/internal", action: auth.ActionPull},
+		{
+			testName:  "OIDC の送り主も internal のリポジトリを pull できる",
+			principal: &auth.Principal{Subject: "github:repo:org/app", Kind: auth.KindFederated},
+			name:      "base/internal",
+			action:    auth.ActionPull,
+		},
+		{
+			testName:  "トークンはスコープで判定する",
+			principal: &auth.Principal{Subject: "bob", FromToken: true, Access: []auth.Access{auth.RepositoryAccess("other/app", auth.ActionPull)}},
+			name:      "other/app",
+			action:    auth.ActionPull,
+		},
+		{
+			testName:  "トークンのスコープにない操作",
+			principal: &auth.Principal{Subject: "alice", FromToken: true, Access: []auth.Access{auth.RepositoryAccess("org/app", auth.ActionPull)}},
+			name:      "org/app",
+			action:    auth.ActionPush,
+			wantErr:   apperrors.TCRERR_DENIED,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.principal != nil {
+				ctx = auth.WithPrincipal(ctx, *tt.principal)
+			}
+			err := u.CheckAccess(ctx, tt.name, tt.action)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateGrant(t *testing.T) {
+	valid := dto.CreateGrantRequest{SubjectType: auth.SubjectGroup, Subject: "ops", Pattern: "org/*", Role: auth.RoleMaintainer}
+	tests := []struct {
+		testName  string
+		principal auth.Principal
+		req       dto.CreateGrantRequest
+		wantErr   error
+	}{
+		{testName: "管理者", principal: auth.Principal{Subject: "root"}, req: valid},
+		{testName: "管理者ではない", principal: auth.Principal{Subject: "alice"}, req: valid, wantErr: apperrors.TCRERR_DENIED},
+		{
+			testName:  "知らない役割",
+			principal: auth.Principal{Subject: "root"},
+			req:       dto.CreateGrantRequest{SubjectType: auth.SubjectUser, Subject: "alice", Pattern: "org/*", Role: "owner"},
+			wantErr:   apperrors.TCRERR_GRANT_INVALID,
+		},
+		{
+			testName:  "不正なパターン",
+			principal: auth.Principal{Subject: "root"},
+			req:       dto.CreateGrantRequest{SubjectType: auth.SubjectUser, Subject: "alice", Pattern: "Org/*", Role: auth.RoleReader},
+			wantErr:   apperrors.TCRERR_GRANT_INVALID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			repo := &fakeGrantRepo{}
+			u := NewAccessUseCase(repo, &fakeTeamRepo{}, &fakeRepositoryRepo{}, []string{"root"}, time.Minute)
+			ctx := auth.WithPrincipal(context.Background(), tt.principal)
+
+			got, err := u.CreateGrant(ctx, tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.ID == "" || got.CreatedBy != "root" || len(repo.grants) != 1 {
+				t.Fatalf("grant is not saved: %+v", got)
+			}
+		})
+	}
+}
+
+func TestGrantedActionsByVisibility(t *testing.T) {
+	repos := &fakeRepositoryRepo{repos: []model.Repository{
+		{Name: "base/public", Visibility: auth.VisibilityPublic},
+		{Name: "base/internal", Visibility: auth.VisibilityInternal},
+		{Name: "base/private", Visibility: auth.VisibilityPrivate},
+	}}
+	grants := &fakeGrantRepo{grants: []model.Grant{
+		{SubjectType: auth.SubjectUser, Subject: "alice", Pattern: "base/*", Role: auth.RoleWriter},
+	}}
+	u := NewAccessUseCase(grants, &fakeTeamRepo{}, repos, nil, time.Minute)
+	tests := []struct {
+		testName  string
+		principal auth.Principal
+		name      string
+		want      []string
+	}{
+		{testName: "匿名で public", name: "base/public", want: []string{auth.ActionPull}},
+		{testName: "匿名で internal", name: "base/internal", want: nil},
+		{testName: "匿名で private", name: "base/private", want: nil},
+		{testName: "まだないリポジトリは private", name: "base/new", want: nil},
+		{testName: "認証されていれば internal", principal: auth.Principal{Subject: "bob"}, name: "base/internal", want: []string{auth.ActionPull}},
+		{testName: "役割と合わせる", principal: auth.Principal{Subject: "alice"}, name: "base/public", want: []string{auth.ActionPull, auth.ActionPush}},
+		{testName: "pull link では internal を pull できない", principal: auth.Principal{Subject: "pull-link:1", Kind: auth.KindPullLink}, name: "base/internal", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got, err := u.GrantedActions(context.Background(), tt.principal, tt.name)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetVisibility(t *testing.T) {
+	repos := &fakeRepositoryRepo{repos: []model.Repository{{Name: "base/app"}}}
+	u := NewAccessUseCase(&fakeGrantRepo{}, &fakeTeamRepo{}, repos, []string{"root"}, time.Minute)
+	ctx := context.Background()
+
+	// 変更する前の公開範囲をキャッシュに入れておく
+	got, err := u.GrantedActions(ctx, auth.Principal{}, "base/app")
+	if err != nil || got != nil {
+		t.Fatalf("got is %v and err is %v", got, err)
+	}
+
+	_, err = u.SetVisibility(auth.WithPrincipal(ctx, auth.Principal{Subject: "alice"}), "base/app", dto.SetRepositoryVisibilityRequest{Visibility: auth.VisibilityPublic})
+	if !errors.Is(err, apperrors.TCRERR_DENIED) {
+		t.Fatalf("err is %v, but want %v", err, apperrors.TCRERR_DENIED)
+	}
+	admin := auth.WithPrincipal(ctx, auth.Principal{Subject: "root"})
+	_, err = u.SetVisibility(admin, "base/app", dto.SetRepositoryVisibilityRequest{Visibility: "open"})
+	if !errors.Is(err, apperrors.TCRERR_REQUEST_INVALID) {
+		t.Fatalf("err is %v, but want %v", err, apperrors.TCRERR_REQUEST_INVALID)
+	}
+	_, err = u.SetVisibility(admin, "base/none", dto.SetRepositoryVisibilityRequest{Visibility: auth.VisibilityPublic})
+	if !errors.Is(err, apperrors.TCRERR_NAME_NOT_FOUND) {
+		t.Fatalf("err is %v, but want %v", err, apperrors.TCRERR_NAME_NOT_FOUND)
+	}
+	_, err = u.SetVisibility(admin, "base/app", dto.SetRepositoryVisibilityRequest{Visibility: auth.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = u.GrantedActions(ctx, auth.Principal{}, "base/app")
+	if err != nil || !reflect.DeepEqual(got, []string{auth.ActionPull}) {
+		t.Fatalf("the change must be reflected immediately: got is %v and err is %v", got, err)
+	}
+}
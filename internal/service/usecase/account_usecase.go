@@ -0,0 +1,367 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+// 最後に使われた日時を記録する間隔。Basic 認証ではリクエストのたびに認証するので、毎回は書き込まない
+const lastUsedResolution = time.Minute
+
+const minPasswordLength = 8
+
+// ユーザー名、ロボットアカウント名、チーム名。Basic 認証で使えない : や、ロボットの接頭辞の $ は含めない
+var accountNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._@-]{0,63}$`)
+
+// ユーザー、チーム、ロボットアカウントの管理と、メタデータに保存したアカウントでの認証
+type AccountUseCase struct {
+	accountRepo persister.AccountPersister
+	teamRepo    persister.TeamPersister
+	access      *AccessUseCase
+	// ロボットアカウントのシークレットの既定の有効期間
+	robotSecretTTL time.Duration
+}
+
+func NewAccountUseCase(accountRepo persister.AccountPersister, teamRepo persister.TeamPersister, access *AccessUseCase, robotSecretTTL time.Duration) *AccountUseCase {
+	return &AccountUseCase{
+		accountRepo:    accountRepo,
+		teamRepo:       teamRepo,
+		access:         access,
+		robotSecretTTL: robotSecretTTL,
+	}
+}
+
+// auth.Authenticator を満たす。ロボットアカウントは robot$<name> のユーザー名で認証する
+func (u *AccountUseCase) Authenticate(ctx context.Context, username, password string) (auth.Principal, error) {
+	kind, name := auth.KindUser, username
+	if robot, ok := strings.CutPrefix(username, auth.RobotPrefix); ok {
+		kind, name = auth.KindRobot, robot
+	}
+	account, err := u.accountRepo.FindAccount(ctx, dto.FindAccountInput{Kind: kind, Name: name})
+	if err != nil && !errors.Is(err, apperrors.ErrAccountNotFound) {
+		return auth.Principal{}, err
+	}
+	if !auth.VerifyPassword([]byte(account.SecretHash), password) {
+		return auth.Principal{}, auth.ErrInvalidCredentials
+	}
+	now := time.Now()
+	if account.Disabled || (account.ExpiresAt != nil && now.After(*account.ExpiresAt)) {
+		return auth.Principal{}, auth.ErrInvalidCredentials
+	}
+	u.touchAccount(ctx, account, now)
+	return auth.Principal{Subject: name, Kind: kind}, nil
+}
+
+// 最後に使われた日時を lastUsedResolution ごとに記録する
+func (u *AccountUseCase) touchAccount(ctx context.Context, account model.Account, now time.Time) {
+	if account.LastUsedAt != nil && now.Sub(*account.LastUsedAt) < lastUsedResolution {
+		return
+	}
+	err := u.accountRepo.TouchAccount(ctx, dto.TouchAccountInput{Kind: account.Kind, Name: account.Name, UsedAt: now})
+	if err != nil {
+		// 記録できなくても認証は成功させる
+		slog.Warn("failed to record the last used time", "kind", account.Kind, "name", account.Name, "error", err.Error())
+	}
+}
+
+// auth.AccountChecker を満たす。メタデータにないユーザーは他の方法で管理されているものとして通し、
+// ロボットアカウントはメタデータにあるものだけを通す。通したアカウントは最後に使われた日時を記録する
+func (u *AccountUseCase) CheckAccount(ctx context.Context, p auth.Principal) error {
+	account, err := u.accountRepo.FindAccount(ctx, dto.FindAccountInput{Kind: p.Kind, Name: p.Subject})
+	if errors.Is(err, apperrors.ErrAccountNotFound) {
+		if p.Kind == auth.KindRobot {
+			return auth.ErrInvalidCredentials
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if account.Disabled || (account.ExpiresAt != nil && now.After(*account.ExpiresAt)) {
+		return auth.ErrInvalidCredentials
+	}
+	u.touchAccount(ctx, account, now)
+	return nil
+}
+
+func (u *AccountUseCase) ListAccounts(ctx context.Context, kind string) ([]model.Account, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := u.accountRepo.ListAccounts(ctx, kind)
+	if err != nil {
+		return nil, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return accounts, nil
+}
+
+// パスワードを省略するとシークレットと同じように作って返す
+func (u *AccountUseCase) CreateUser(ctx context.Context, req dto.CreateUserRequest) (dto.AccountSecretOutput, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return dto.AccountSecretOutput{}, err
+	}
+	if !accountNamePattern.MatchString(req.Name) {
+		return dto.AccountSecretOutput{}, apperrors.TCRERR_ACCOUNT_INVALID.WithDetail("name is invalid: " + req.Name)
+	}
+	if req.Password != "" && len(req.Password) < minPasswordLength {
+		return dto.AccountSecretOutput{}, apperrors.TCRERR_ACCOUNT_INVALID.WithDetail("password is too short")
+	}
+
+	secret := req.Password
+	if secret == "" {
+		secret, err = auth.GenerateSecret()
+		if err != nil {
+			return dto.AccountSecretOutput{}, apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+		}
+	}
+	account := model.Account{Kind: auth.KindUser, Name: req.Name}
+	out, err := u.createAccount(ctx, account, secret)
+	if err != nil {
+		return dto.AccountSecretOutput{}, err
+	}
+	if req.Password != "" {
+		// 送られてきたパスワードは返さない
+		out.Secret = ""
+	}
+	return out, nil
+}
+
+// ロボットアカウントと、それに与える役割を作る
+func (u *AccountUseCase) CreateRobot(ctx context.Context, req dto.CreateRobotRequest) (dto.AccountSecretOutput, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return dto.AccountSecretOutput{}, err
+	}
+	if !accountNamePattern.MatchString(req.Name) {
+		return dto.AccountSecretOutput{}, apperrors.TCRERR_ACCOUNT_INVALID.WithDetail("name is invalid: " + req.Name)
+	}
+	if len(req.Grants) == 0 {
+		return dto.AccountSecretOutput{}, apperrors.TCRERR_ACCOUNT_INVALID.WithDetail("grants are required")
+	}
+	for _, g := range req.Grants {
+		// ロボットアカウントに管理 API は使わせない
+		if !auth.ValidRole(g.Role) || g.Role == auth.RoleAdmin {
+			return dto.AccountSecretOutput{}, apperrors.TCRERR_ACCOUNT_INVALID.WithDetail("role must be reader, writer or maintainer: " + g.Role)
+		}
+		if !validPattern(g.Pattern) {
+			return dto.AccountSecretOutput{}, apperrors.TCRERR_ACCOUNT_INVALID.WithDetail("pattern is invalid: " + g.Pattern)
+		}
+	}
+	expiresAt, err := u.robotExpiration(req.ExpiresIn, time.Now())
+	if err != nil {
+		return dto.AccountSecretOutput{}, err
+	}
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		return dto.AccountSecretOutput{}, apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+	}
+
+	// 既存のロボットアカウントに役割を足してしまわないように、アカウントを先に作る
+	out, err := u.createAccount(ctx, model.Account{Kind: auth.KindRobot, Name: req.Name, ExpiresAt: expiresAt}, secret)
+	if err != nil {
+		return dto.AccountSecretOutput{}, err
+	}
+	for _, g := range req.Grants {
+		_, err := u.access.CreateGrant(ctx, dto.CreateGrantRequest{
+			SubjectType: auth.SubjectRobot,
+			Subject:     req.Name,
+			Pattern:     g.Pattern,
+			Role:        g.Role,
+		})
+		if err != nil {
+			return dto.AccountSecretOutput{}, err
+		}
+	}
+	return out, nil
+}
+
+func (u *AccountUseCase) createAccount(ctx context.Context, account model.Account, secret string) (dto.AccountSecretOutput, error) {
+	hash, err := auth.HashPassword(secret)
+	if err != nil {
+		return dto.AccountSecretOutput{}, apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+	}
+	p, _ := auth.PrincipalFrom(ctx)
+	account.SecretHash = hash
+	account.CreatedAt = time.Now().UTC()
+	account.CreatedBy = p.Subject
+	err = u.accountRepo.CreateAccount(ctx, account)
+	if err != nil {
+		return dto.AccountSecretOutput{}, apperrors.Classify(err)
+	}
+	return dto.AccountSecretOutput{Account: account, Secret: secret}, nil
+}
+
+// 新しいシークレットを作って返す。古いシークレットはすぐに使えなくなる。
+// ロボットアカウントの有効期限はローテーションした時点から数え直す
+func (u *AccountUseCase) RotateSecret(ctx context.Context, kind, name string, req dto.RotateSecretRequest) (dto.AccountSecretOutput, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return dto.AccountSecretOutput{}, err
+	}
+	account, err := u.findAccount(ctx, kind, name)
+	if err != nil {
+		return dto.AccountSecretOutput{}, err
+	}
+	if kind == auth.KindRobot {
+		account.ExpiresAt, err = u.robotExpiration(req.ExpiresIn, time.Now())
+		if err != nil {
+			return dto.AccountSecretOutput{}, err
+		}
+	}
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		return dto.AccountSecretOutput{}, apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+	}
+	account.SecretHash, err = auth.HashPassword(secret)
+	if err != nil {
+		return dto.AccountSecretOutput{}, apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+	}
+	err = u.accountRepo.UpdateAccount(ctx, account)
+	if err != nil {
+		return dto.AccountSecretOutput{}, apperrors.Classify(err)
+	}
+	return dto.AccountSecretOutput{Account: account, Secret: secret}, nil
+}
+
+// 無効にしたアカウントでは認証できない。発行済みのトークンは期限まで使える
+func (u *AccountUseCase) SetDisabled(ctx context.Context, kind, name string, disabled bool) (model.Account, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return model.Account{}, err
+	}
+	account, err := u.findAccount(ctx, kind, name)
+	if err != nil {
+		return model.Account{}, err
+	}
+	account.Disabled = disabled
+	err = u.accountRepo.UpdateAccount(ctx, account)
+	if err != nil {
+		return model.Account{}, apperrors.Classify(err)
+	}
+	return account, nil
+}
+
+func (u *AccountUseCase) findAccount(ctx context.Context, kind, name string) (model.Account, error) {
+	account, err := u.accountRepo.FindAccount(ctx, dto.FindAccountInput{Kind: kind, Name: name})
+	if errors.Is(err, apperrors.ErrAccountNotFound) {
+		return model.Account{}, apperrors.TCRERR_ACCOUNT_NOT_FOUND.WithDetail(name)
+	}
+	if err != nil {
+		return model.Account{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return account, nil
+}
+
+// expiresIn を省略すると robotSecretTTL
+func (u *AccountUseCase) robotExpiration(expiresIn string, now time.Time) (*time.Time, error) {
+	ttl := u.robotSecretTTL
+	if expiresIn != "" {
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil || d <= 0 {
+			return nil, apperrors.TCRERR_ACCOUNT_INVALID.WithDetail("expiresIn must be a positive duration: " + expiresIn)
+		}
+		ttl = d
+	}
+	expiresAt := now.Add(ttl).UTC()
+	return &expiresAt, nil
+}
+
+func (u *AccountUseCase) ListTeams(ctx context.Context) ([]model.Team, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	teams, err := u.teamRepo.ListTeams(ctx)
+	if err != nil {
+		return nil, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return teams, nil
+}
+
+func (u *AccountUseCase) CreateTeam(ctx context.Context, req dto.CreateTeamRequest) (model.Team, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return model.Team{}, err
+	}
+	if !accountNamePattern.MatchString(req.Name) {
+		return model.Team{}, apperrors.TCRERR_TEAM_INVALID.WithDetail("name is invalid: " + req.Name)
+	}
+	members, err := teamMembers(req.Members)
+	if err != nil {
+		return model.Team{}, err
+	}
+	p, _ := auth.PrincipalFrom(ctx)
+	team := model.Team{
+		Name:      req.Name,
+		Members:   members,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: p.Subject,
+	}
+	err = u.teamRepo.CreateTeam(ctx, team)
+	if err != nil {
+		return model.Team{}, apperrors.Classify(err)
+	}
+	u.access.invalidate()
+	return team, nil
+}
+
+// メンバーを members で置き換える
+func (u *AccountUseCase) UpdateTeamMembers(ctx context.Context, name string, members []string) (model.Team, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return model.Team{}, err
+	}
+	members, err = teamMembers(members)
+	if err != nil {
+		return model.Team{}, err
+	}
+	team := model.Team{Name: name, Members: members}
+	err = u.teamRepo.UpdateTeam(ctx, team)
+	if err != nil {
+		return model.Team{}, apperrors.Classify(err)
+	}
+	u.access.invalidate()
+	return team, nil
+}
+
+// チームに与えた権限の付与は残す
+func (u *AccountUseCase) DeleteTeam(ctx context.Context, name string) error {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	err = u.teamRepo.DeleteTeam(ctx, dto.DeleteTeamInput{Name: name})
+	if err != nil {
+		return apperrors.Classify(err)
+	}
+	u.access.invalidate()
+	return nil
+}
+
+// 重複を除いたメンバー。存在しないユーザーも書ける
+func teamMembers(members []string) ([]string, error) {
+	unique := []string{}
+	for _, m := range members {
+		if !accountNamePattern.MatchString(m) {
+			return nil, apperrors.TCRERR_TEAM_INVALID.WithDetail("member is invalid: " + m)
+		}
+		if !slices.Contains(unique, m) {
+			unique = append(unique, m)
+		}
+	}
+	return unique, nil
+}
@@ -0,0 +1,218 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+type fakeAccountRepo struct {
+	accounts map[string]model.Account
+	touched  []string
+}
+
+func (f *fakeAccountRepo) FindAccount(ctx context.Context, input dto.FindAccountInput) (model.Account, error) {
+	a, ok := f.accounts[input.Kind+"/"+input.Name]
+	if !ok {
+		return model.Account{}, apperrors.ErrAccountNotFound
+	}
+	return a, nil
+}
+
+func (f *fakeAccountRepo) ListAccounts(ctx context.Context, kind string) ([]model.Account, error) {
+	var accounts []model.Account
+	for _, a := range f.accounts {
+		if a.Kind == kind {
+			accounts = append(accounts, a)
+		}
+	}
+	return accounts, nil
+}
+
+func (f *fakeAccountRepo) CreateAccount(ctx context.Context, account model.Account) error {
+	key := account.Kind + "/" + account.Name
+	if _, ok := f.accounts[key]; ok {
+		return apperrors.ErrAccountAlreadyExists
+	}
+	f.accounts[key] = account
+	return nil
+}
+
+func (f *fakeAccountRepo) UpdateAccount(ctx context.Context, account model.Account) error {
+	key := account.Kind + "/" + account.Name
+	if _, ok := f.accounts[key]; !ok {
+		return apperrors.ErrAccountNotFound
+	}
+	f.accounts[key] = account
+	return nil
+}
+
+func (f *fakeAccountRepo) TouchAccount(ctx context.Context, input dto.TouchAccountInput) error {
+	f.touched = append(f.touched, input.Kind+"/"+input.Name)
+	return nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	recently := time.Now().Add(-time.Second)
+	repo := &fakeAccountRepo{accounts: map[string]model.Account{
+		"user/alice": {Kind: auth.KindUser, Name: "alice", SecretHash: hash},
+		"user/bob":   {Kind: auth.KindUser, Name: "bob", SecretHash: hash, Disabled: true},
+		"user/carol": {Kind: auth.KindUser, Name: "carol", SecretHash: hash, LastUsedAt: &recently},
+		"robot/ci":   {Kind: auth.KindRobot, Name: "ci", SecretHash: hash, ExpiresAt: &future},
+		"robot/old":  {Kind: auth.KindRobot, Name: "old", SecretHash: hash, ExpiresAt: &past},
+	}}
+	tests := []struct {
+		testName    string
+		username    string
+		password    string
+		want        auth.Principal
+		wantErr     error
+		wantTouched bool
+	}{
+		{testName: "ユーザー", username: "alice", password: "secret", want: auth.Principal{Subject: "alice", Kind: auth.KindUser}, wantTouched: true},
+		{testName: "ロボットアカウント", username: "robot$ci", password: "secret", want: auth.Principal{Subject: "ci", Kind: auth.KindRobot}, wantTouched: true},
+		{testName: "接頭辞のないロボットアカウント", username: "ci", password: "secret", wantErr: auth.ErrInvalidCredentials},
+		{testName: "パスワードが違う", username: "alice", password: "wrong", wantErr: auth.ErrInvalidCredentials},
+		{testName: "存在しない", username: "dave", password: "secret", wantErr: auth.ErrInvalidCredentials},
+		{testName: "無効にされた", username: "bob", password: "secret", wantErr: auth.ErrInvalidCredentials},
+		{testName: "期限切れのシークレット", username: "robot$old", password: "secret", wantErr: auth.ErrInvalidCredentials},
+		{testName: "最近使われていれば記録しない", username: "carol", password: "secret", want: auth.Principal{Subject: "carol", Kind: auth.KindUser}},
+	}
+
+	u := NewAccountUseCase(repo, &fakeTeamRepo{}, nil, time.Hour)
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			repo.touched = nil
+			got, err := u.Authenticate(context.Background(), tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if got.Subject != tt.want.Subject || got.Kind != tt.want.Kind {
+				t.Fatalf("got is %+v, but want %+v", got, tt.want)
+			}
+			if touched := len(repo.touched) > 0; touched != tt.wantTouched {
+				t.Fatalf("touched is %v, but want %v", touched, tt.wantTouched)
+			}
+		})
+	}
+}
+
+func TestCheckAccount(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	recently := time.Now().Add(-time.Second)
+	repo := &fakeAccountRepo{accounts: map[string]model.Account{
+		"user/alice": {Kind: auth.KindUser, Name: "alice"},
+		"user/carol": {Kind: auth.KindUser, Name: "carol", LastUsedAt: &recently},
+		"user/bob":   {Kind: auth.KindUser, Name: "bob", Disabled: true},
+		"robot/ci":   {Kind: auth.KindRobot, Name: "ci", ExpiresAt: &future},
+		"robot/old":  {Kind: auth.KindRobot, Name: "old", ExpiresAt: &past},
+		"robot/off":  {Kind: auth.KindRobot, Name: "off", ExpiresAt: &future, Disabled: true},
+	}}
+	tests := []struct {
+		testName    string
+		principal   auth.Principal
+		wantErr     error
+		wantTouched bool
+	}{
+		{testName: "ユーザー", principal: auth.Principal{Subject: "alice", Kind: auth.KindUser}, wantTouched: true},
+		{testName: "最近使われていれば記録しない", principal: auth.Principal{Subject: "carol", Kind: auth.KindUser}},
+		{testName: "メタデータにないユーザー", principal: auth.Principal{Subject: "dave", Kind: auth.KindUser}},
+		{testName: "無効にされたユーザー", principal: auth.Principal{Subject: "bob", Kind: auth.KindUser}, wantErr: auth.ErrInvalidCredentials},
+		{testName: "ロボットアカウント", principal: auth.Principal{Subject: "ci", Kind: auth.KindRobot}, wantTouched: true},
+		{testName: "期限切れのロボットアカウント", principal: auth.Principal{Subject: "old", Kind: auth.KindRobot}, wantErr: auth.ErrInvalidCredentials},
+		{testName: "無効にされたロボットアカウント", principal: auth.Principal{Subject: "off", Kind: auth.KindRobot}, wantErr: auth.ErrInvalidCredentials},
+		{testName: "存在しないロボットアカウント", principal: auth.Principal{Subject: "ghost", Kind: auth.KindRobot}, wantErr: auth.ErrInvalidCredentials},
+	}
+
+	u := NewAccountUseCase(repo, &fakeTeamRepo{}, nil, time.Hour)
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			repo.touched = nil
+			err := u.CheckAccount(context.Background(), tt.principal)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if touched := len(repo.touched) > 0; touched != tt.wantTouched {
+				t.Fatalf("touched is %v, but want %v", touched, tt.wantTouched)
+			}
+		})
+	}
+}
+
+func TestCreateRobot(t *testing.T) {
+	tests := []struct {
+		testName string
+		req      dto.CreateRobotRequest
+		wantErr  error
+	}{
+		{
+			testName: "役割と有効期間",
+			req:      dto.CreateRobotRequest{Name: "ci", Grants: []dto.RobotGrant{{Pattern: "org/*", Role: auth.RoleWriter}}, ExpiresIn: "24h"},
+		},
+		{
+			testName: "役割がない",
+			req:      dto.CreateRobotRequest{Name: "ci"},
+			wantErr:  apperrors.TCRERR_ACCOUNT_INVALID,
+		},
+		{
+			testName: "admin は与えられない",
+			req:      dto.CreateRobotRequest{Name: "ci", Grants: []dto.RobotGrant{{Pattern: "*", Role: auth.RoleAdmin}}},
+			wantErr:  apperrors.TCRERR_ACCOUNT_INVALID,
+		},
+		{
+			testName: "不正な有効期間",
+			req:      dto.CreateRobotRequest{Name: "ci", Grants: []dto.RobotGrant{{Pattern: "org/*", Role: auth.RoleReader}}, ExpiresIn: "-1h"},
+			wantErr:  apperrors.TCRERR_ACCOUNT_INVALID,
+		},
+		{
+			testName: "すでにある",
+			req:      dto.CreateRobotRequest{Name: "existing", Grants: []dto.RobotGrant{{Pattern: "org/*", Role: auth.RoleReader}}},
+			wantErr:  apperrors.TCRERR_ACCOUNT_ALREADY_EXISTS,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			grants := &fakeGrantRepo{}
+			accounts := &fakeAccountRepo{accounts: map[string]model.Account{
+				"robot/existing": {Kind: auth.KindRobot, Name: "existing"},
+			}}
+			access := NewAccessUseCase(grants, &fakeTeamRepo{}, &fakeRepositoryRepo{}, []string{"root"}, time.Minute)
+			u := NewAccountUseCase(accounts, &fakeTeamRepo{}, access, time.Hour)
+			ctx := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "root"})
+
+			got, err := u.CreateRobot(ctx, tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if len(grants.grants) != 0 {
+					t.Fatalf("grants must not be created: %+v", grants.grants)
+				}
+				return
+			}
+			if got.Secret == "" || got.Account.ExpiresAt == nil || time.Until(*got.Account.ExpiresAt) > 24*time.Hour {
+				t.Fatalf("unexpected output: %+v", got)
+			}
+			if !auth.VerifyPassword([]byte(accounts.accounts["robot/ci"].SecretHash), got.Secret) {
+				t.Fatalf("secret does not match the saved hash")
+			}
+			if len(grants.grants) != 1 || grants.grants[0].SubjectType != auth.SubjectRobot || grants.grants[0].Subject != "ci" {
+				t.Fatalf("unexpected grants: %+v", grants.grants)
+			}
+		})
+	}
+}
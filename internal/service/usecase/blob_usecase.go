@@ -2,11 +2,15 @@ package usecase
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"time"
 
 	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
 	"github.com/a-takamin/tcr/internal/dto"
 	"github.com/a-takamin/tcr/internal/interface/persister"
 	"github.com/a-takamin/tcr/internal/model"
@@ -18,21 +22,78 @@ type BlobUseCase struct {
 	blobRepo     persister.BlobPersister
 	progressRepo persister.BlobUploadProgressPersister
 	repoRepo     persister.RepositoryPersister
+	metaRepo     persister.BlobMetadataPersister
+	// nil なら認証が無効なのですべて許可する
+	access AccessChecker
 }
 
-func NewBlobUseCase(blobRepo persister.BlobPersister, progressRepo persister.BlobUploadProgressPersister, repoRepo persister.RepositoryPersister) *BlobUseCase {
+func NewBlobUseCase(blobRepo persister.BlobPersister, progressRepo persister.BlobUploadProgressPersister, repoRepo persister.RepositoryPersister, metaRepo persister.BlobMetadataPersister, access AccessChecker) *BlobUseCase {
 	return &BlobUseCase{
 		blobRepo:     blobRepo,
 		progressRepo: progressRepo,
 		repoRepo:     repoRepo,
+		metaRepo:     metaRepo,
+		access:       access,
 	}
 }
 
-func (u BlobUseCase) ExistsBlob(input dto.FindBlobInput) (model.Blob, error) {
-	return u.GetBlob(input)
+// バッチ API で一度に問い合わせられる blob や参照の数
+const MaxBatchItems = 1000
+
+// 複数リポジトリの blob の存在をまとめて確認する。結果はリクエストと同じ順番で返す。
+// リポジトリからのリンクがない blob は、リポジトリ自体がなくても存在しないものとして返す
+func (u BlobUseCase) BatchExistsBlobs(ctx context.Context, requests []dto.BatchBlobsRequest) ([]dto.BatchBlobResult, error) {
+	var keys []dto.FindBlobMetadataInput
+	for _, req := range requests {
+		err := domain.ValidateName(req.Name)
+		if err != nil {
+			return nil, apperrors.TCRERR_NAME_INVALID
+		}
+		for _, digest := range req.Digests {
+			err = domain.ValidateDigest(digest)
+			if err != nil {
+				return nil, apperrors.TCRERR_DIGEST_INVALID
+			}
+			keys = append(keys, dto.FindBlobMetadataInput{Name: req.Name, Digest: digest})
+		}
+	}
+	if len(keys) > MaxBatchItems {
+		return nil, apperrors.TCRERR_BATCH_TOO_LARGE
+	}
+
+	// pull を許可されていないリポジトリの blob は、存在を明かさないように存在しないものとして返す
+	var allowed []dto.FindBlobMetadataInput
+	for _, key := range keys {
+		if checkAccess(ctx, u.access, key.Name, auth.ActionPull) == nil {
+			allowed = append(allowed, key)
+		}
+	}
+	found := map[dto.FindBlobMetadataInput]dto.FindBlobMetadataOutput{}
+	if len(allowed) > 0 {
+		resp, err := u.metaRepo.BatchFindBlobMetadata(ctx, dto.BatchFindBlobMetadataInput{Keys: allowed})
+		if err != nil {
+			return nil, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		}
+		for _, item := range resp.Items {
+			found[dto.FindBlobMetadataInput{Name: item.Name, Digest: item.Digest}] = item
+		}
+	}
+
+	results := make([]dto.BatchBlobResult, 0, len(keys))
+	for _, key := range keys {
+		item, ok := found[key]
+		results = append(results, dto.BatchBlobResult{
+			Name:   key.Name,
+			Digest: key.Digest,
+			Exists: ok,
+			Size:   item.Size,
+		})
+	}
+	return results, nil
 }
 
-func (u BlobUseCase) GetBlob(input dto.FindBlobInput) (model.Blob, error) {
+// blob の実体は取得せず、メタデータだけで存在を確認する
+func (u BlobUseCase) ExistsBlob(ctx context.Context, input dto.FindBlobInput) (model.Blob, error) {
 	err := domain.ValidateName(input.Name)
 	if err != nil {
 		return model.Blob{}, apperrors.TCRERR_NAME_INVALID
@@ -41,111 +102,305 @@ func (u BlobUseCase) GetBlob(input dto.FindBlobInput) (model.Blob, error) {
 	if err != nil {
 		return model.Blob{}, apperrors.TCRERR_DIGEST_INVALID
 	}
-	existsName, err := u.repoRepo.ExistsRepository(dto.ExistsRepositoryInput{
-		Name: input.Name,
-	})
+	err = checkAccess(ctx, u.access, input.Name, auth.ActionPull)
 	if err != nil {
-		return model.Blob{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
-	}
-	if !existsName {
-		return model.Blob{}, apperrors.TCRERR_NAME_NOT_FOUND
+		return model.Blob{}, err
 	}
-	existsBlob, err := u.blobRepo.ExistsBlob(dto.ExistsBlobInput{
+	metadata, err := u.metaRepo.FindBlobMetadata(ctx, dto.FindBlobMetadataInput{
 		Name:   input.Name,
 		Digest: input.Digest,
 	})
 	if err != nil {
 		return model.Blob{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
-	if !existsBlob {
+	// リンクがあればリポジトリも存在するので、見つからなかったときだけリポジトリを確認する
+	if metadata.Digest == "" {
+		existsName, err := u.repoRepo.ExistsRepository(ctx, dto.ExistsRepositoryInput{
+			Name: input.Name,
+		})
+		if err != nil {
+			return model.Blob{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		}
+		if !existsName {
+			return model.Blob{}, apperrors.TCRERR_NAME_NOT_FOUND
+		}
 		return model.Blob{}, apperrors.TCRERR_BLOB_NOT_FOUND
 	}
+	return model.Blob{
+		Name:      input.Name,
+		Digest:    input.Digest,
+		Size:      metadata.Size,
+		MediaType: metadata.MediaType,
+	}, nil
+}
 
-	resp, err := u.blobRepo.FindBlob(dto.FindBlobInput{
+func (u BlobUseCase) GetBlob(ctx context.Context, input dto.FindBlobInput) (model.Blob, error) {
+	blob, err := u.ExistsBlob(ctx, input)
+	if err != nil {
+		return model.Blob{}, err
+	}
+
+	resp, err := u.blobRepo.FindBlob(ctx, dto.FindBlobInput{
 		Name:   input.Name,
 		Digest: input.Digest,
 	})
 	if err != nil {
 		return model.Blob{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
-	return model.Blob{
-		Name:   input.Name,
-		Digest: input.Digest,
-		Blob:   resp.Blob,
-	}, nil
+	blob.Blob = resp.Blob
+	return blob, nil
 }
 
-func (u BlobUseCase) StartBlobUpload(name string) (string, error) {
-	uid, err := uuid.NewRandom()
+// blob を直接ダウンロードできる期限付きの URL を返す。
+// ストレージが URL を発行できない場合は apperrors.ErrPresignUnavailable を返すので、GetBlob で中継すること
+func (u BlobUseCase) GetBlobURL(ctx context.Context, input dto.FindBlobInput, expires time.Duration) (string, error) {
+	_, err := u.ExistsBlob(ctx, input)
+	if err != nil {
+		return "", err
+	}
+
+	presigner, ok := u.blobRepo.(persister.BlobURLPresigner)
+	if !ok {
+		return "", apperrors.ErrPresignUnavailable
+	}
+	url, err := presigner.PresignBlobURL(ctx, dto.PresignBlobURLInput{
+		Digest:  input.Digest,
+		Expires: expires,
+	})
+	if errors.Is(err, apperrors.ErrPresignUnavailable) {
+		return "", err
+	}
+	if err != nil {
+		return "", apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return url, nil
+}
+
+func (u BlobUseCase) StartBlobUpload(ctx context.Context, name string) (string, error) {
+	err := domain.ValidateName(name)
+	if err != nil {
+		return "", apperrors.TCRERR_NAME_INVALID
+	}
+	err = checkAccess(ctx, u.access, name, auth.ActionPush)
 	if err != nil {
 		return "", err
 	}
-	err = u.progressRepo.SaveBlobUploadProgress(dto.SaveBlobUploadProgressInput{
+	uid, err := uuid.NewRandom()
+	if err != nil {
+		return "", apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+	}
+	err = u.progressRepo.SaveBlobUploadProgress(ctx, dto.SaveBlobUploadProgressInput{
 		Uuid:         uid.String(),
+		Name:         name,
 		NextChunkNo:  0,
 		ByteUploaded: 0,
 		Digest:       "",
+		Version:      0,
 	})
 	if err != nil {
-		return "", err
+		return "", apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
-	err = u.repoRepo.SaveRepository(dto.SaveRepositoryInput{
+	err = u.repoRepo.SaveRepository(ctx, dto.SaveRepositoryInput{
 		Name: name,
 	})
 	if err != nil {
-		return "", err
+		return "", apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
 	return fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, uid), nil
 }
 
-func (u BlobUseCase) UploadMonolithicBlob(input dto.UploadMonolithicBlobInput) error {
+func (u BlobUseCase) UploadMonolithicBlob(ctx context.Context, input dto.UploadMonolithicBlobInput) error {
 	err := domain.ValidateName(input.Name)
 	if err != nil {
-		return err
+		return apperrors.TCRERR_NAME_INVALID
 	}
 	err = domain.ValidateDigest(input.Digest)
+	if err != nil {
+		return apperrors.TCRERR_DIGEST_INVALID
+	}
+	err = checkAccess(ctx, u.access, input.Name, auth.ActionPush)
 	if err != nil {
 		return err
 	}
 
-	err = u.blobRepo.SaveBlob(dto.SaveBlobInput{
-		Name:   input.Name,
-		Digest: input.Digest,
-		Blob:   input.Blob,
+	b, err := io.ReadAll(input.Blob)
+	if err != nil {
+		return apperrors.TCRERR_BLOB_UPLOAD_INVALID.WithDetail("could not read request body").Wrap(err)
+	}
+	// Content-Length が分からない (-1) ときは確かめない
+	if input.ContentLength >= 0 && int64(len(b)) != input.ContentLength {
+		return apperrors.TCRERR_SIZE_INVALID
+	}
+	return u.commitBlob(ctx, input.Name, input.Digest, b, input.ContentType, input.Uploader)
+}
+
+// アップロードされた内容が digest と一致することを確かめてから保存し、リポジトリからリンクする。
+//
+// 同じ digest の blob がすでにどこかのリポジトリに push されていれば実体は保存せず、リンクだけを作る
+func (u BlobUseCase) commitBlob(ctx context.Context, name string, digest string, b []byte, mediaType string, uploader string) error {
+	calcdDigest, err := domain.CalcBlobDigest(model.Blob{Blob: b})
+	if err != nil {
+		return apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+	}
+	if calcdDigest != digest {
+		return apperrors.TCRERR_DIGEST_INVALID
+	}
+
+	known, err := u.metaRepo.FindBlobContentMetadata(ctx, dto.FindBlobContentMetadataInput{
+		Digest: digest,
 	})
 	if err != nil {
-		return err
+		return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	stored := false
+	if known.Digest != "" {
+		// 記録があっても、実体が移行前のリポジトリごとのキーにしかないことがある
+		stored, err = u.blobRepo.ExistsBlob(ctx, dto.ExistsBlobInput{Digest: digest})
+		if err != nil {
+			return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		}
+	}
+	if stored {
+		slog.Info("blob already exists. only linking it to the repository", "name", name, "digest", digest)
+	} else {
+		err = u.blobRepo.SaveBlob(ctx, dto.SaveBlobInput{
+			Digest: digest,
+			Blob:   bytes.NewReader(b),
+		})
+		if err != nil {
+			return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		}
+	}
+
+	err = u.metaRepo.SaveBlobMetadata(ctx, dto.SaveBlobMetadataInput{
+		Name:      name,
+		Digest:    digest,
+		Size:      int64(len(b)),
+		MediaType: mediaType,
+		Uploader:  uploader,
+	})
+	if err != nil {
+		return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
 	return nil
 }
 
+// 他のリポジトリ (From) にある blob を Name のリポジトリからも見えるようにする。
+// blob の実体はコピーせず、リンクを作るだけ (移行前の blob は digest のキーにコピーする)
+//
+// bool: マウントできたかどうか。From に blob がない場合は false を返すので、通常のアップロードに切り替える
+func (u BlobUseCase) MountBlob(ctx context.Context, input dto.MountBlobInput) (bool, error) {
+	err := domain.ValidateName(input.Name)
+	if err != nil {
+		return false, apperrors.TCRERR_NAME_INVALID
+	}
+	err = domain.ValidateName(input.From)
+	if err != nil {
+		return false, apperrors.TCRERR_NAME_INVALID
+	}
+	err = domain.ValidateDigest(input.Digest)
+	if err != nil {
+		return false, apperrors.TCRERR_DIGEST_INVALID
+	}
+	err = checkAccess(ctx, u.access, input.Name, auth.ActionPush)
+	if err != nil {
+		return false, err
+	}
+	// From を読めない送り主には、From に blob があるかどうかも明かさずに通常のアップロードに切り替える
+	if checkAccess(ctx, u.access, input.From, auth.ActionPull) != nil {
+		return false, nil
+	}
+
+	source, err := u.metaRepo.FindBlobMetadata(ctx, dto.FindBlobMetadataInput{
+		Name:   input.From,
+		Digest: input.Digest,
+	})
+	if err != nil {
+		return false, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	if source.Digest == "" {
+		return false, nil
+	}
+	stored, err := u.ensureBlobStored(ctx, input.From, input.Digest)
+	if err != nil {
+		return false, err
+	}
+	if !stored {
+		return false, nil
+	}
+
+	err = u.repoRepo.SaveRepository(ctx, dto.SaveRepositoryInput{
+		Name: input.Name,
+	})
+	if err != nil {
+		return false, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	err = u.metaRepo.SaveBlobMetadata(ctx, dto.SaveBlobMetadataInput{
+		Name:      input.Name,
+		Digest:    input.Digest,
+		Size:      source.Size,
+		MediaType: source.MediaType,
+		Uploader:  input.Uploader,
+	})
+	if err != nil {
+		return false, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return true, nil
+}
+
+// 移行前に name のリポジトリへ push された blob の実体を、digest のキーにコピーする。
+// リンクだけを作ると、他のリポジトリからは実体を見つけられないため
+//
+// bool: digest のキーに実体があるかどうか
+func (u BlobUseCase) ensureBlobStored(ctx context.Context, name string, digest string) (bool, error) {
+	exists, err := u.blobRepo.ExistsBlob(ctx, dto.ExistsBlobInput{Digest: digest})
+	if err != nil {
+		return false, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	if exists {
+		return true, nil
+	}
+	resp, err := u.blobRepo.FindBlob(ctx, dto.FindBlobInput{Name: name, Digest: digest})
+	if err != nil {
+		slog.Warn("blob is linked but not stored", "name", name, "digest", digest, "error", err.Error())
+		return false, nil
+	}
+	err = u.blobRepo.SaveBlob(ctx, dto.SaveBlobInput{
+		Digest: digest,
+		Blob:   bytes.NewReader(resp.Blob),
+	})
+	if err != nil {
+		return false, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return true, nil
+}
+
 // int64: アップロードに成功したバイト数
 //
 // error: エラー
-func (u BlobUseCase) UploadChunkedBlob(input dto.UploadChunkedBlobInput) (int64, error) {
+func (u BlobUseCase) UploadChunkedBlob(ctx context.Context, input dto.UploadChunkedBlobInput) (int64, error) {
 	err := domain.ValidateName(input.Name)
+	if err != nil {
+		return 0, apperrors.TCRERR_NAME_INVALID
+	}
+	err = checkAccess(ctx, u.access, input.Name, auth.ActionPush)
 	if err != nil {
 		return 0, err
 	}
 	err = domain.ValidateContentRange(input.ContentRange)
 	if err != nil {
-		slog.Error(err.Error() + input.ContentRange)
-		return 0, err
+		return 0, apperrors.TCRERR_RANGE_INVALID.WithDetail(input.ContentRange).Wrap(err)
 	}
 	startByte, err := domain.GetContentRangeStart(input.ContentRange)
 	if err != nil {
-		slog.Error(err.Error() + input.ContentRange)
-		return 0, err
+		return 0, apperrors.TCRERR_RANGE_INVALID.WithDetail(input.ContentRange).Wrap(err)
 	}
 	endByte, err := domain.GetContentRangeEnd(input.ContentRange)
 	if err != nil {
-		slog.Error(err.Error() + input.ContentRange)
-		return 0, err
+		return 0, apperrors.TCRERR_RANGE_INVALID.WithDetail(input.ContentRange).Wrap(err)
 	}
 
-	info, err := u.progressRepo.FindBlobUploadProgress(dto.FindBlobUploadProgressInput{
-		Uuid: input.Uuid,
-	})
+	info, err := u.findUploadProgress(ctx, input.Name, input.Uuid)
 	if err != nil {
 		return 0, err
 	}
@@ -153,7 +408,7 @@ func (u BlobUseCase) UploadChunkedBlob(input dto.UploadChunkedBlobInput) (int64,
 	// TODO: 綺麗にする
 	// if info.ByteUploaded == 0 {
 	if startByte != info.ByteUploaded {
-		return info.ByteUploaded, apperrors.ErrChunkIsNotInSequence
+		return info.ByteUploaded, apperrors.TCRERR_RANGE_INVALID.Wrap(apperrors.ErrChunkIsNotInSequence)
 	}
 	// } else {
 	// 	if startByte != info.ByteUploaded+1 {
@@ -161,71 +416,95 @@ func (u BlobUseCase) UploadChunkedBlob(input dto.UploadChunkedBlobInput) (int64,
 	// 	}
 	// }
 
-	err = u.blobRepo.SaveChunkedBlob(dto.SaveChunkedBlobInput{
-		Name:       input.Name,
-		Uuid:       input.Uuid,
-		ChunkSeqNo: info.NextChunkNo,
-		Blob:       input.Blob,
-	})
-	if err != nil {
-		return info.ByteUploaded, err
-	}
-
-	err = u.progressRepo.SaveBlobUploadProgress(dto.SaveBlobUploadProgressInput{
+	// チャンクを書き込む前に進捗を条件付きで更新してチャンク番号を確保する。
+	// 同じ UUID への PATCH が同時に来てもどちらか一方しか確保できないので、
+	// 負けた方は ErrBlobUploadConflict となりチャンクを上書きしない
+	err = u.progressRepo.SaveBlobUploadProgress(ctx, dto.SaveBlobUploadProgressInput{
 		Uuid:         input.Uuid,
+		Name:         info.Name,
 		ByteUploaded: info.ByteUploaded + input.ContentLength,
 		NextChunkNo:  info.NextChunkNo + 1,
 		Digest:       input.Digest,
+		Version:      info.Version,
+	})
+	if err != nil {
+		return info.ByteUploaded, uploadProgressError(err)
+	}
+
+	err = u.blobRepo.SaveChunkedBlob(ctx, dto.SaveChunkedBlobInput{
+		Name:       input.Name,
+		Uuid:       input.Uuid,
+		ChunkSeqNo: info.NextChunkNo,
+		Blob:       input.Blob,
 	})
 	if err != nil {
-		return info.ByteUploaded, err
+		// 確保した分を戻す。戻せなかった場合はクライアントにアップロードをやり直してもらうしかない。
+		// クライアントが切断して失敗した場合でも戻せるように、ctx のキャンセルは引き継がない
+		rollbackErr := u.progressRepo.SaveBlobUploadProgress(context.WithoutCancel(ctx), dto.SaveBlobUploadProgressInput{
+			Uuid:         info.Uuid,
+			Name:         info.Name,
+			ByteUploaded: info.ByteUploaded,
+			NextChunkNo:  info.NextChunkNo,
+			Digest:       info.Digest,
+			Version:      info.Version + 1,
+		})
+		if rollbackErr != nil {
+			slog.Error("failed to rollback blob upload progress", "uuid", input.Uuid, "error", rollbackErr.Error())
+		}
+		return info.ByteUploaded, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
 	return endByte, nil
 }
 
-func (u BlobUseCase) UploadLastChunkedBlob(input dto.UploadChunkedBlobInput) (int64, error) {
+func (u BlobUseCase) UploadLastChunkedBlob(ctx context.Context, input dto.UploadChunkedBlobInput) (int64, error) {
 	var offset int64
-	var err error
+	err := checkAccess(ctx, u.access, input.Name, auth.ActionPush)
+	if err != nil {
+		return 0, err
+	}
 
 	if input.ContentLength != 0 {
 		// Last Upload with Blob
-		offset, err = u.UploadChunkedBlob(input)
+		offset, err = u.UploadChunkedBlob(ctx, input)
 		if err != nil && !errors.Is(err, apperrors.ErrAllChunksAreAlreadyUploaded) {
 			return offset, err
 		}
 	}
 
-	info, err := u.progressRepo.FindBlobUploadProgress(dto.FindBlobUploadProgressInput{
-		Uuid: input.Uuid,
-	})
+	info, err := u.findUploadProgress(ctx, input.Name, input.Uuid)
 	if err != nil {
 		return offset, err
 	}
 
-	err = u.progressRepo.SaveBlobUploadProgress(dto.SaveBlobUploadProgressInput{
+	err = u.progressRepo.SaveBlobUploadProgress(ctx, dto.SaveBlobUploadProgressInput{
 		Uuid:         info.Uuid,
+		Name:         info.Name,
 		ByteUploaded: info.ByteUploaded,
 		NextChunkNo:  info.NextChunkNo,
 		Digest:       input.Digest, // Digest を登録
+		Version:      info.Version,
 	})
 	if err != nil {
-		return offset, err
+		return offset, uploadProgressError(err)
 	}
 
-	err = u.StartBlobConcat(input.Name, input.Uuid, input.Digest)
+	err = u.StartBlobConcat(ctx, input)
 	if err != nil {
 		return offset, err
 	}
 
 	return offset, nil
 }
-func (u BlobUseCase) StartBlobConcat(name string, uuid string, digest string) error {
+func (u BlobUseCase) StartBlobConcat(ctx context.Context, input dto.UploadChunkedBlobInput) error {
 	// TODO: 非同期でやりたい
 	// TODO: ストリームでやりたい。今のままでは巨大なイメージに押しつぶされる
+	name, uuid, digest := input.Name, input.Uuid, input.Digest
+	err := checkAccess(ctx, u.access, name, auth.ActionPush)
+	if err != nil {
+		return err
+	}
 
-	info, err := u.progressRepo.FindBlobUploadProgress(dto.FindBlobUploadProgressInput{
-		Uuid: uuid,
-	})
+	info, err := u.findUploadProgress(ctx, name, uuid)
 	if err != nil {
 		return err
 	}
@@ -236,55 +515,54 @@ func (u BlobUseCase) StartBlobConcat(name string, uuid string, digest string) er
 
 	chunkNums := info.NextChunkNo
 	if chunkNums <= 0 {
-		return errors.New("NextChunkNo should be greater than or equal to 0")
+		return apperrors.TCRERR_BLOB_UPLOAD_INVALID.WithDetail("no chunks have been uploaded")
 	}
 	var concatBlob []byte
 	for i := 0; i != chunkNums; i++ {
-		resp, err := u.blobRepo.FindChunkedBlob(dto.FindChunkedBlobInput{
+		resp, err := u.blobRepo.FindChunkedBlob(ctx, dto.FindChunkedBlobInput{
 			Name:       name,
 			Uuid:       uuid,
 			ChunkSeqNo: i,
 		})
 		if err != nil {
-			// TODO: ちゃんとエラーハンドリング
-			slog.Warn("chunk not found")
-			return apperrors.ErrBlobNotFound
+			return apperrors.TCRERR_PERSISTER_ERROR.Wrap(fmt.Errorf("chunk %d of upload %s: %w", i, uuid, err))
 		}
 		concatBlob = append(concatBlob, resp.Blob...)
 	}
 
-	u.blobRepo.SaveBlob(dto.SaveBlobInput{
-		Name:   name,
-		Digest: digest,
-		Blob:   bytes.NewReader(concatBlob),
-	})
+	return u.commitBlob(ctx, name, digest, concatBlob, input.ContentType, input.Uploader)
+}
+
+func (u BlobUseCase) DeleteBlob(ctx context.Context, input dto.DeleteBlobInput) error {
+	err := checkAccess(ctx, u.access, input.Name, auth.ActionDelete)
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (u BlobUseCase) DeleteBlob(input dto.DeleteBlobInput) error {
-	_, err := u.ExistsBlob(dto.FindBlobInput{
+	_, err = u.ExistsBlob(ctx, dto.FindBlobInput{
 		Name:   input.Name,
 		Digest: input.Digest,
 	})
 	if err != nil {
 		return err
 	}
-	err = domain.ValidateName(input.Name)
+	// 実体は他のリポジトリからも参照されうるので、このリポジトリからのリンクだけを削除する
+	err = u.metaRepo.DeleteBlobLink(ctx, dto.DeleteBlobLinkInput{
+		Name:   input.Name,
+		Digest: input.Digest,
+	})
 	if err != nil {
-		return err
+		return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
-	return u.blobRepo.DeleteBlob(input)
+	return nil
 }
 
 // TODO: モノリスかラストチャンクかの見分けをもう少しちゃんと考える
-func (u BlobUseCase) IsChunkedUpload(name string, uuid string) (bool, error) {
-	info, err := u.progressRepo.FindBlobUploadProgress(dto.FindBlobUploadProgressInput{
-		Uuid: uuid,
-	})
-
+func (u BlobUseCase) IsChunkedUpload(ctx context.Context, name string, uuid string) (bool, error) {
+	err := checkAccess(ctx, u.access, name, auth.ActionPush)
+	if err != nil {
+		return false, err
+	}
+	info, err := u.findUploadProgress(ctx, name, uuid)
 	if err != nil {
 		return false, err
 	}
@@ -300,12 +578,69 @@ func (u BlobUseCase) IsChunkedUpload(name string, uuid string) (bool, error) {
 	return false, nil
 }
 
-func (u BlobUseCase) GetBlobUploadOffset(name string, uuid string) (int64, error) {
-	info, err := u.progressRepo.FindBlobUploadProgress(dto.FindBlobUploadProgressInput{
-		Uuid: uuid,
-	})
+func (u BlobUseCase) GetBlobUploadOffset(ctx context.Context, name string, uuid string) (int64, error) {
+	err := checkAccess(ctx, u.access, name, auth.ActionPush)
+	if err != nil {
+		return 0, err
+	}
+	info, err := u.findUploadProgress(ctx, name, uuid)
 	if err != nil {
 		return 0, err
 	}
 	return info.ByteUploaded - 1, nil
 }
+
+// アップロードを中止して、アップロード済みのチャンクを削除する
+func (u BlobUseCase) CancelBlobUpload(ctx context.Context, name string, uuid string) error {
+	err := domain.ValidateName(name)
+	if err != nil {
+		return apperrors.TCRERR_NAME_INVALID
+	}
+	err = checkAccess(ctx, u.access, name, auth.ActionPush)
+	if err != nil {
+		return err
+	}
+	info, err := u.findUploadProgress(ctx, name, uuid)
+	if err != nil {
+		return err
+	}
+	// 先に進捗を消して、これ以上チャンクが追加されないようにする
+	err = u.progressRepo.DeleteBlobUploadProgress(ctx, dto.DeleteBlobUploadProgressInput{
+		Uuid: uuid,
+	})
+	if err != nil {
+		return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	err = u.blobRepo.DeleteChunkedBlobs(context.WithoutCancel(ctx), dto.DeleteChunkedBlobsInput{
+		Name:      name,
+		Uuid:      uuid,
+		ChunkNums: info.NextChunkNo,
+	})
+	if err != nil {
+		// アップロードは中止できているので、残ったチャンクはクライアントには関係ない
+		slog.Warn("failed to delete chunks of canceled upload", "uuid", uuid, "error", err.Error())
+	}
+	return nil
+}
+
+// 権限は URL のリポジトリに対して確認しているので、他のリポジトリで開始されたアップロードは見つからないものとして扱う
+func (u BlobUseCase) findUploadProgress(ctx context.Context, name string, uuid string) (dto.FindBlobUploadProgressOutput, error) {
+	info, err := u.progressRepo.FindBlobUploadProgress(ctx, dto.FindBlobUploadProgressInput{
+		Uuid: uuid,
+	})
+	if err != nil {
+		return dto.FindBlobUploadProgressOutput{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	if info.Uuid == "" || info.Name != name {
+		return dto.FindBlobUploadProgressOutput{}, apperrors.TCRERR_BLOB_UPLOAD_NOT_FOUND
+	}
+	return info, nil
+}
+
+// 進捗の保存で先を越された場合はクライアントに 409 を返す
+func uploadProgressError(err error) error {
+	if errors.Is(err, apperrors.ErrBlobUploadConflict) {
+		return apperrors.TCRERR_BLOB_UPLOAD_CONFLICT.Wrap(err)
+	}
+	return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+}
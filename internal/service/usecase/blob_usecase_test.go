@@ -0,0 +1,495 @@
+package usecase
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+type fakeBlobRepo struct {
+	chunks map[int]string
+	// digest をキーにして保存された blob
+	blobs map[string][]byte
+	// 移行前の <name>/<digest> のキーにある blob
+	legacy map[string][]byte
+	saves  int
+}
+
+func (r *fakeBlobRepo) ExistsBlob(ctx context.Context, input dto.ExistsBlobInput) (bool, error) {
+	_, ok := r.blobs[input.Digest]
+	return ok, nil
+}
+func (r *fakeBlobRepo) FindBlob(ctx context.Context, input dto.FindBlobInput) (dto.FindBlobOutput, error) {
+	if b, ok := r.blobs[input.Digest]; ok {
+		return dto.FindBlobOutput{Blob: b}, nil
+	}
+	if b, ok := r.legacy[input.Name+"/"+input.Digest]; ok {
+		return dto.FindBlobOutput{Blob: b}, nil
+	}
+	return dto.FindBlobOutput{}, errors.New("no such key")
+}
+func (r *fakeBlobRepo) FindChunkedBlob(ctx context.Context, input dto.FindChunkedBlobInput) (dto.FindBlobOutput, error) {
+	return dto.FindBlobOutput{Blob: []byte(r.chunks[input.ChunkSeqNo])}, nil
+}
+func (r *fakeBlobRepo) SaveBlob(ctx context.Context, input dto.SaveBlobInput) error {
+	b, err := io.ReadAll(input.Blob)
+	if err != nil {
+		return err
+	}
+	if r.blobs == nil {
+		r.blobs = map[string][]byte{}
+	}
+	r.blobs[input.Digest] = b
+	r.saves++
+	return nil
+}
+func (r *fakeBlobRepo) SaveChunkedBlob(ctx context.Context, input dto.SaveChunkedBlobInput) error {
+	b, err := io.ReadAll(input.Blob)
+	if err != nil {
+		return err
+	}
+	r.chunks[input.ChunkSeqNo] = string(b)
+	return nil
+}
+func (r *fakeBlobRepo) DeleteBlob(ctx context.Context, input dto.DeleteBlobInput) error { return nil }
+func (r *fakeBlobRepo) DeleteChunkedBlobs(ctx context.Context, input dto.DeleteChunkedBlobsInput) error {
+	return nil
+}
+
+type fakeBlobMetadataRepo struct {
+	links map[dto.FindBlobMetadataInput]dto.FindBlobMetadataOutput
+	// blob 自体のメタデータ
+	blobs map[string]dto.FindBlobMetadataOutput
+	saved []dto.SaveBlobMetadataInput
+}
+
+func (r *fakeBlobMetadataRepo) FindBlobMetadata(ctx context.Context, input dto.FindBlobMetadataInput) (dto.FindBlobMetadataOutput, error) {
+	return r.links[input], nil
+}
+
+func (r *fakeBlobMetadataRepo) BatchFindBlobMetadata(ctx context.Context, input dto.BatchFindBlobMetadataInput) (dto.BatchFindBlobMetadataOutput, error) {
+	var out dto.BatchFindBlobMetadataOutput
+	for _, key := range input.Keys {
+		if item, ok := r.links[key]; ok {
+			out.Items = append(out.Items, item)
+		}
+	}
+	return out, nil
+}
+
+func (r *fakeBlobMetadataRepo) FindBlobContentMetadata(ctx context.Context, input dto.FindBlobContentMetadataInput) (dto.FindBlobMetadataOutput, error) {
+	return r.blobs[input.Digest], nil
+}
+
+func (r *fakeBlobMetadataRepo) SaveBlobMetadata(ctx context.Context, input dto.SaveBlobMetadataInput) error {
+	if r.links == nil {
+		r.links = map[dto.FindBlobMetadataInput]dto.FindBlobMetadataOutput{}
+	}
+	if r.blobs == nil {
+		r.blobs = map[string]dto.FindBlobMetadataOutput{}
+	}
+	item := dto.FindBlobMetadataOutput{Name: input.Name, Digest: input.Digest, Size: input.Size, MediaType: input.MediaType, Uploader: input.Uploader}
+	r.links[dto.FindBlobMetadataInput{Name: input.Name, Digest: input.Digest}] = item
+	if _, ok := r.blobs[input.Digest]; !ok {
+		item.Name = ""
+		r.blobs[input.Digest] = item
+	}
+	r.saved = append(r.saved, input)
+	return nil
+}
+
+func (r *fakeBlobMetadataRepo) ListBlobLinks(ctx context.Context, input dto.ListBlobLinksInput) (dto.ListBlobLinksOutput, error) {
+	var out dto.ListBlobLinksOutput
+	for key := range r.links {
+		if key.Digest == input.Digest {
+			out.Names = append(out.Names, key.Name)
+		}
+	}
+	return out, nil
+}
+
+func (r *fakeBlobMetadataRepo) DeleteBlobLink(ctx context.Context, input dto.DeleteBlobLinkInput) error {
+	delete(r.links, dto.FindBlobMetadataInput{Name: input.Name, Digest: input.Digest})
+	return nil
+}
+
+// beforeSave を使うと Find と Save の間に別のリクエストが割り込んだ状況を作れる
+type fakeProgressRepo struct {
+	progress   map[string]dto.FindBlobUploadProgressOutput
+	beforeSave func()
+}
+
+func (r *fakeProgressRepo) FindBlobUploadProgress(ctx context.Context, input dto.FindBlobUploadProgressInput) (dto.FindBlobUploadProgressOutput, error) {
+	return r.progress[input.Uuid], nil
+}
+
+func (r *fakeProgressRepo) SaveBlobUploadProgress(ctx context.Context, input dto.SaveBlobUploadProgressInput) error {
+	if f := r.beforeSave; f != nil {
+		r.beforeSave = nil
+		f()
+	}
+	if r.progress[input.Uuid].Version != input.Version {
+		return apperrors.ErrBlobUploadConflict
+	}
+	r.progress[input.Uuid] = dto.FindBlobUploadProgressOutput{
+		Uuid:         input.Uuid,
+		Name:         input.Name,
+		ByteUploaded: input.ByteUploaded,
+		NextChunkNo:  input.NextChunkNo,
+		Digest:       input.Digest,
+		Version:      input.Version + 1,
+	}
+	return nil
+}
+
+func (r *fakeProgressRepo) DeleteBlobUploadProgress(ctx context.Context, input dto.DeleteBlobUploadProgressInput) error {
+	delete(r.progress, input.Uuid)
+	return nil
+}
+
+func TestUploadChunkedBlobConflict(t *testing.T) {
+	blobRepo := &fakeBlobRepo{chunks: map[int]string{}}
+	progressRepo := &fakeProgressRepo{
+		progress: map[string]dto.FindBlobUploadProgressOutput{
+			"uuid": {Uuid: "uuid", Name: "org/repo", Version: 1},
+		},
+	}
+	u := NewBlobUseCase(blobRepo, progressRepo, nil, nil, nil)
+
+	chunk := func(body string) dto.UploadChunkedBlobInput {
+		return dto.UploadChunkedBlobInput{
+			Name:          "org/repo",
+			Uuid:          "uuid",
+			ContentLength: int64(len(body)),
+			ContentRange:  fmt.Sprintf("0-%d", len(body)-1),
+			Blob:          io.NopCloser(strings.NewReader(body)),
+		}
+	}
+
+	// 1 つ目の PATCH が進捗を読んだ後に、同じ範囲の 2 つ目の PATCH が先に完了する
+	progressRepo.beforeSave = func() {
+		if _, err := u.UploadChunkedBlob(context.Background(), chunk("bbbb")); err != nil {
+			t.Fatalf("err is %s, but want nil", err.Error())
+		}
+	}
+	_, err := u.UploadChunkedBlob(context.Background(), chunk("aaaa"))
+	if !errors.Is(err, apperrors.ErrBlobUploadConflict) {
+		t.Fatalf("err is %v, but want %v", err, apperrors.ErrBlobUploadConflict)
+	}
+
+	got := progressRepo.progress["uuid"]
+	if got.ByteUploaded != 4 || got.NextChunkNo != 1 || got.Name != "org/repo" {
+		t.Fatalf("progress is %+v, but want ByteUploaded 4, NextChunkNo 1 and Name org/repo", got)
+	}
+	if blobRepo.chunks[0] != "bbbb" {
+		t.Fatalf("chunk 0 is %s, but want bbbb", blobRepo.chunks[0])
+	}
+}
+
+func TestExistsBlob(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		testName string
+		links    map[dto.FindBlobMetadataInput]dto.FindBlobMetadataOutput
+		repos    []model.Repository
+		wantSize int64
+		wantErr  error
+	}{
+		{
+			testName: "リンクがある",
+			links:    map[dto.FindBlobMetadataInput]dto.FindBlobMetadataOutput{{Name: "org/repo", Digest: digest}: {Name: "org/repo", Digest: digest, Size: 4}},
+			repos:    []model.Repository{{Name: "org/repo"}},
+			wantSize: 4,
+		},
+		{
+			testName: "他のリポジトリにしかリンクがない",
+			links:    map[dto.FindBlobMetadataInput]dto.FindBlobMetadataOutput{{Name: "org/other", Digest: digest}: {Name: "org/other", Digest: digest, Size: 4}},
+			repos:    []model.Repository{{Name: "org/repo"}, {Name: "org/other"}},
+			wantErr:  apperrors.TCRERR_BLOB_NOT_FOUND,
+		},
+		{
+			testName: "リポジトリがない",
+			wantErr:  apperrors.TCRERR_NAME_NOT_FOUND,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			metaRepo := &fakeBlobMetadataRepo{links: tt.links}
+			u := NewBlobUseCase(&fakeBlobRepo{}, nil, &fakeRepositoryRepo{repos: tt.repos}, metaRepo, nil)
+			blob, err := u.ExistsBlob(context.Background(), dto.FindBlobInput{Name: "org/repo", Digest: digest})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if blob.Size != tt.wantSize {
+				t.Fatalf("got is %d, but want %d", blob.Size, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestUploadMonolithicBlobRecordsMetadata(t *testing.T) {
+	body := "layer"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(body)))
+	blobRepo := &fakeBlobRepo{}
+	metaRepo := &fakeBlobMetadataRepo{}
+	u := NewBlobUseCase(blobRepo, nil, &fakeRepositoryRepo{}, metaRepo, nil)
+
+	err := u.UploadMonolithicBlob(context.Background(), dto.UploadMonolithicBlobInput{
+		Name:          "org/repo",
+		Digest:        digest,
+		ContentLength: int64(len(body)),
+		ContentType:   "application/octet-stream",
+		Uploader:      "alice",
+		Blob:          io.NopCloser(strings.NewReader(body)),
+	})
+	if err != nil {
+		t.Fatalf("err is %s, but want nil", err.Error())
+	}
+	if string(blobRepo.blobs[digest]) != body {
+		t.Fatalf("got is %s, but want %s", blobRepo.blobs[digest], body)
+	}
+	want := dto.SaveBlobMetadataInput{Name: "org/repo", Digest: digest, Size: 5, MediaType: "application/octet-stream", Uploader: "alice"}
+	if len(metaRepo.saved) != 1 || metaRepo.saved[0] != want {
+		t.Fatalf("got is %+v, but want %+v", metaRepo.saved, want)
+	}
+}
+
+func TestUploadMonolithicBlobDedup(t *testing.T) {
+	body := "layer"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(body)))
+	tests := []struct {
+		testName string
+		// 他のリポジトリに push 済みで、blob 自体のメタデータがある
+		known bool
+		// digest のキーに実体がある
+		stored    bool
+		wantSaves int
+	}{
+		{testName: "初めての blob は保存する", wantSaves: 1},
+		{testName: "記録と実体があれば保存しない", known: true, stored: true, wantSaves: 0},
+		{testName: "記録があっても実体が移行前のキーにしかなければ保存する", known: true, wantSaves: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			blobRepo := &fakeBlobRepo{blobs: map[string][]byte{}}
+			metaRepo := &fakeBlobMetadataRepo{}
+			if tt.known {
+				metaRepo.blobs = map[string]dto.FindBlobMetadataOutput{digest: {Digest: digest, Size: 5}}
+			}
+			if tt.stored {
+				blobRepo.blobs[digest] = []byte(body)
+			}
+			u := NewBlobUseCase(blobRepo, nil, &fakeRepositoryRepo{}, metaRepo, nil)
+
+			err := u.UploadMonolithicBlob(context.Background(), dto.UploadMonolithicBlobInput{
+				Name:          "org/repo",
+				Digest:        digest,
+				ContentLength: int64(len(body)),
+				Blob:          io.NopCloser(strings.NewReader(body)),
+			})
+			if err != nil {
+				t.Fatalf("err is %s, but want nil", err.Error())
+			}
+			if blobRepo.saves != tt.wantSaves {
+				t.Fatalf("got is %d, but want %d", blobRepo.saves, tt.wantSaves)
+			}
+			if string(blobRepo.blobs[digest]) != body {
+				t.Fatalf("got is %s, but want %s", blobRepo.blobs[digest], body)
+			}
+			if _, ok := metaRepo.links[dto.FindBlobMetadataInput{Name: "org/repo", Digest: digest}]; !ok {
+				t.Fatalf("link is not created: %+v", metaRepo.links)
+			}
+		})
+	}
+}
+
+func TestMountBlob(t *testing.T) {
+	body := []byte("layer")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	source := dto.FindBlobMetadataInput{Name: "org/base", Digest: digest}
+	tests := []struct {
+		testName string
+		// From からのリンクがある
+		linked    bool
+		blobs     map[string][]byte
+		legacy    map[string][]byte
+		want      bool
+		wantSaves int
+	}{
+		{
+			testName: "From のリンクと実体がある",
+			linked:   true,
+			blobs:    map[string][]byte{digest: body},
+			want:     true,
+		},
+		{
+			testName:  "実体が移行前のキーにしかなければコピーする",
+			linked:    true,
+			legacy:    map[string][]byte{"org/base/" + digest: body},
+			want:      true,
+			wantSaves: 1,
+		},
+		{
+			testName: "リンクがあっても実体がなければ通常のアップロードにする",
+			linked:   true,
+			want:     false,
+		},
+		{
+			testName: "From にリンクがなければ通常のアップロードにする",
+			blobs:    map[string][]byte{digest: body},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			blobRepo := &fakeBlobRepo{blobs: tt.blobs, legacy: tt.legacy}
+			metaRepo := &fakeBlobMetadataRepo{links: map[dto.FindBlobMetadataInput]dto.FindBlobMetadataOutput{}}
+			if tt.linked {
+				metaRepo.links[source] = dto.FindBlobMetadataOutput{Name: source.Name, Digest: digest, Size: 5}
+			}
+			u := NewBlobUseCase(blobRepo, nil, &fakeRepositoryRepo{}, metaRepo, nil)
+
+			got, err := u.MountBlob(context.Background(), dto.MountBlobInput{Name: "org/app", From: "org/base", Digest: digest})
+			if err != nil {
+				t.Fatalf("err is %s, but want nil", err.Error())
+			}
+			if got != tt.want {
+				t.Fatalf("got is %v, but want %v", got, tt.want)
+			}
+			if blobRepo.saves != tt.wantSaves {
+				t.Fatalf("saves are %d, but want %d", blobRepo.saves, tt.wantSaves)
+			}
+			_, linked := metaRepo.links[dto.FindBlobMetadataInput{Name: "org/app", Digest: digest}]
+			if linked != tt.want {
+				t.Fatalf("link is %v, but want %v", linked, tt.want)
+			}
+			if tt.want && string(blobRepo.blobs[digest]) != string(body) {
+				t.Fatalf("got is %s, but want %s", blobRepo.blobs[digest], body)
+			}
+		})
+	}
+}
+
+func TestBatchExistsBlobs(t *testing.T) {
+	a := "sha256:" + strings.Repeat("a", 64)
+	b := "sha256:" + strings.Repeat("b", 64)
+	tests := []struct {
+		testName string
+		requests []dto.BatchBlobsRequest
+		denied   map[string]bool
+		want     []dto.BatchBlobResult
+		wantErr  error
+	}{
+		{
+			testName: "リクエストと同じ順番で返す",
+			requests: []dto.BatchBlobsRequest{
+				{Name: "org/app", Digests: []string{b, a}},
+				{Name: "org/other", Digests: []string{a}},
+			},
+			want: []dto.BatchBlobResult{
+				{Name: "org/app", Digest: b},
+				{Name: "org/app", Digest: a, Exists: true, Size: 4},
+				{Name: "org/other", Digest: a},
+			},
+		},
+		{
+			testName: "pull できないリポジトリの blob は存在しないものとして返す",
+			requests: []dto.BatchBlobsRequest{
+				{Name: "org/secret", Digests: []string{a}},
+				{Name: "org/app", Digests: []string{a}},
+			},
+			denied: map[string]bool{"org/secret": true},
+			want: []dto.BatchBlobResult{
+				{Name: "org/secret", Digest: a},
+				{Name: "org/app", Digest: a, Exists: true, Size: 4},
+			},
+		},
+		{
+			testName: "上限を超える",
+			requests: []dto.BatchBlobsRequest{{Name: "org/app", Digests: func() []string {
+				digests := make([]string, MaxBatchItems+1)
+				for i := range digests {
+					digests[i] = a
+				}
+				return digests
+			}()}},
+			wantErr: apperrors.TCRERR_BATCH_TOO_LARGE,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			metaRepo := &fakeBlobMetadataRepo{links: map[dto.FindBlobMetadataInput]dto.FindBlobMetadataOutput{
+				{Name: "org/app", Digest: a}:    {Name: "org/app", Digest: a, Size: 4},
+				{Name: "org/secret", Digest: a}: {Name: "org/secret", Digest: a, Size: 4},
+			}}
+			u := NewBlobUseCase(&fakeBlobRepo{}, nil, &fakeRepositoryRepo{}, metaRepo, fakeAccessChecker{denied: tt.denied})
+			got, err := u.BatchExistsBlobs(context.Background(), tt.requests)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got is %+v, but want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadSessionBoundToRepository(t *testing.T) {
+	tests := []struct {
+		testName string
+		name     string
+		wantErr  error
+	}{
+		{testName: "開始したリポジトリ", name: "org/a"},
+		{testName: "他のリポジトリ", name: "org/b", wantErr: apperrors.TCRERR_BLOB_UPLOAD_NOT_FOUND},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			progressRepo := &fakeProgressRepo{progress: map[string]dto.FindBlobUploadProgressOutput{}}
+			u := NewBlobUseCase(&fakeBlobRepo{chunks: map[int]string{}}, progressRepo, &fakeRepositoryRepo{}, nil, nil)
+			location, err := u.StartBlobUpload(context.Background(), "org/a")
+			if err != nil {
+				t.Fatalf("err is %s, but want nil", err.Error())
+			}
+			uuid := location[strings.LastIndex(location, "/")+1:]
+
+			_, err = u.UploadChunkedBlob(context.Background(), dto.UploadChunkedBlobInput{
+				Name:          tt.name,
+				Uuid:          uuid,
+				ContentLength: 4,
+				ContentRange:  "0-3",
+				Blob:          io.NopCloser(strings.NewReader("aaaa")),
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			_, err = u.GetBlobUploadOffset(context.Background(), tt.name, uuid)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			err = u.CancelBlobUpload(context.Background(), tt.name, uuid)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			// 他のリポジトリからは中止できない
+			_, remains := progressRepo.progress[uuid]
+			if remains != (tt.wantErr != nil) {
+				t.Fatalf("remains is %v, but want %v", remains, tt.wantErr != nil)
+			}
+		})
+	}
+}
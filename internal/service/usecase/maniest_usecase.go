@@ -1,10 +1,13 @@
 package usecase
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"strings"
 
 	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
 	"github.com/a-takamin/tcr/internal/dto"
 	"github.com/a-takamin/tcr/internal/interface/persister"
 	"github.com/a-takamin/tcr/internal/model"
@@ -14,69 +17,231 @@ import (
 type ManifestUseCase struct {
 	maniRepo persister.ManifestPersister
 	repoRepo persister.RepositoryPersister
+	// nil の場合は先読みしない
+	prefetcher persister.BlobPrefetcher
+	// nil なら認証が無効なのですべて許可する
+	access AccessChecker
 }
 
-func NewManifestUseCase(maniRepo persister.ManifestPersister, repoRepo persister.RepositoryPersister) *ManifestUseCase {
+func NewManifestUseCase(maniRepo persister.ManifestPersister, repoRepo persister.RepositoryPersister, prefetcher persister.BlobPrefetcher, access AccessChecker) *ManifestUseCase {
 	return &ManifestUseCase{
-		maniRepo: maniRepo,
-		repoRepo: repoRepo,
+		maniRepo:   maniRepo,
+		repoRepo:   repoRepo,
+		prefetcher: prefetcher,
+		access:     access,
 	}
 }
 
-func (u ManifestUseCase) ExistsManifest(metadata model.ManifestMetadata) (dto.GetManifestResponse, error) {
-	return u.GetManifest(metadata)
+func (u ManifestUseCase) ExistsManifest(ctx context.Context, metadata model.ManifestMetadata) (dto.GetManifestResponse, error) {
+	return u.findManifest(ctx, metadata)
 }
 
-func (u ManifestUseCase) GetManifest(metadata model.ManifestMetadata) (dto.GetManifestResponse, error) {
-	err := domain.ValidateName(metadata.Name)
+// マニフェストを pull したクライアントは続けてレイヤーを pull するので、先読みしておく
+func (u ManifestUseCase) GetManifest(ctx context.Context, metadata model.ManifestMetadata) (dto.GetManifestResponse, error) {
+	resp, err := u.findManifest(ctx, metadata)
 	if err != nil {
-		return dto.GetManifestResponse{}, apperrors.TCRERR_NAME_INVALID
+		return dto.GetManifestResponse{}, err
 	}
 
-	exists, err := u.maniRepo.ExistsManifest(dto.ExistsManifestInput{
-		Name:      metadata.Name,
-		Reference: metadata.Reference,
-	})
+	if u.prefetcher != nil {
+		digests := []string{}
+		if resp.Manifest.Config.Digest != "" {
+			digests = append(digests, resp.Manifest.Config.Digest)
+		}
+		for _, layer := range resp.Manifest.Layers {
+			digests = append(digests, layer.Digest)
+		}
+		u.prefetcher.PrefetchBlobs(ctx, dto.PrefetchBlobsInput{
+			Name:    metadata.Name,
+			Digests: digests,
+		})
+	}
+	return resp, nil
+}
+
+func (u ManifestUseCase) findManifest(ctx context.Context, metadata model.ManifestMetadata) (dto.GetManifestResponse, error) {
+	err := domain.ValidateName(metadata.Name)
 	if err != nil {
-		return dto.GetManifestResponse{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		return dto.GetManifestResponse{}, apperrors.TCRERR_NAME_INVALID
 	}
-	if !exists {
-		return dto.GetManifestResponse{}, apperrors.TCRERR_NAME_NOT_FOUND
+	err = checkAccess(ctx, u.access, metadata.Name, auth.ActionPull)
+	if err != nil {
+		return dto.GetManifestResponse{}, err
 	}
 
-	resp, err := u.maniRepo.FindManifest(dto.FindManifestInput{
+	resp, err := u.maniRepo.FindManifest(ctx, dto.FindManifestInput{
 		Name:      metadata.Name,
 		Reference: metadata.Reference,
 	})
 	if err != nil {
 		return dto.GetManifestResponse{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
+	if resp.Name == "" {
+		return dto.GetManifestResponse{}, u.manifestNotFound(ctx, metadata.Name)
+	}
 
 	var m model.Manifest
 	err = json.Unmarshal(resp.Manifest, &m)
+	if err != nil {
+		// 保存時に検証しているので、読めないのは TCR の不具合
+		return dto.GetManifestResponse{}, apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+	}
+	err = u.checkBoundDigest(ctx, metadata.Name, resp.Digest)
 	if err != nil {
 		return dto.GetManifestResponse{}, err
 	}
 
 	return dto.GetManifestResponse{
 		Manifest: m,
+		Raw:      resp.Manifest,
 		Digest:   resp.Digest,
 	}, nil
 }
 
-func (u ManifestUseCase) GetTags(name string) (dto.GetTagsResponse, error) {
+// リポジトリはあるがマニフェストがない場合とリポジトリがない場合で、返すエラーを分ける
+func (u ManifestUseCase) manifestNotFound(ctx context.Context, name string) error {
+	existsName, err := u.repoRepo.ExistsRepository(ctx, dto.ExistsRepositoryInput{
+		Name: name,
+	})
+	if err != nil {
+		return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	if !existsName {
+		return apperrors.TCRERR_NAME_NOT_FOUND
+	}
+	return apperrors.TCRERR_MANIFEST_NOT_FOUND
+}
+
+// digest を指定した pull link で認証した場合の、pull できるマニフェストの digest。それ以外は空。
+// ブロブは digest で指定しないと取得できないので、制限しない
+func boundDigest(ctx context.Context) string {
+	p, ok := auth.PrincipalFrom(ctx)
+	if !ok || p.Kind != auth.KindPullLink {
+		return ""
+	}
+	return p.Digest
+}
+
+// マルチプラットフォームのイメージを pull できるように、指定された digest がインデックスなら、
+// それに含まれるマニフェストも pull できる
+func (u ManifestUseCase) checkBoundDigest(ctx context.Context, name, digest string) error {
+	bound := boundDigest(ctx)
+	if bound == "" || digest == bound {
+		return nil
+	}
+	resp, err := u.maniRepo.FindManifest(ctx, dto.FindManifestInput{Name: name, Reference: bound})
+	if err != nil {
+		return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	if resp.Name != "" {
+		var index model.Manifest
+		err = json.Unmarshal(resp.Manifest, &index)
+		if err != nil {
+			return apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+		}
+		for _, d := range index.Manifests {
+			if d.Digest == digest {
+				return nil
+			}
+		}
+	}
+	return apperrors.TCRERR_DENIED.WithDetail("pull link is bound to " + bound)
+}
+
+// name:tag や name@digest 形式の参照をまとめて digest に解決する。結果はリクエストと同じ順番で返す。
+// タグを省略した場合は latest とみなす
+func (u ManifestUseCase) ResolveReferences(ctx context.Context, references []string) ([]dto.BatchReferenceResult, error) {
+	if len(references) > MaxBatchItems {
+		return nil, apperrors.TCRERR_BATCH_TOO_LARGE
+	}
+
+	inputs := make([]dto.FindManifestInput, 0, len(references))
+	for _, ref := range references {
+		input, err := parseImageReference(ref)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, input)
+	}
+
+	// pull を許可されていないリポジトリの参照は、存在を明かさないように存在しないものとして返す
+	var allowed []dto.FindManifestInput
+	for _, input := range inputs {
+		if checkAccess(ctx, u.access, input.Name, auth.ActionPull) == nil {
+			allowed = append(allowed, input)
+		}
+	}
+	found := map[dto.FindManifestInput]dto.ResolvedReference{}
+	if len(allowed) > 0 {
+		resp, err := u.maniRepo.ResolveReferences(ctx, dto.ResolveReferencesInput{References: allowed})
+		if err != nil {
+			return nil, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		}
+		bound := boundDigest(ctx)
+		for _, item := range resp.Items {
+			if bound != "" && item.Digest != bound {
+				continue
+			}
+			found[dto.FindManifestInput{Name: item.Name, Reference: item.Reference}] = item
+		}
+	}
+
+	results := make([]dto.BatchReferenceResult, 0, len(references))
+	for i, ref := range references {
+		item, ok := found[inputs[i]]
+		results = append(results, dto.BatchReferenceResult{
+			Reference: ref,
+			Exists:    ok,
+			Digest:    item.Digest,
+			Size:      item.Size,
+		})
+	}
+	return results, nil
+}
+
+// name の中に : は使えないので、最後の / より後ろにある : をタグの区切りとみなす
+func parseImageReference(ref string) (dto.FindManifestInput, error) {
+	var name, reference string
+	if i := strings.Index(ref, "@"); i >= 0 {
+		name, reference = ref[:i], ref[i+1:]
+		if domain.ValidateDigest(reference) != nil {
+			return dto.FindManifestInput{}, apperrors.TCRERR_DIGEST_INVALID
+		}
+	} else {
+		name, reference = ref, "latest"
+		if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+			name, reference = ref[:i], ref[i+1:]
+		}
+		if domain.ValidateTag(reference) != nil {
+			return dto.FindManifestInput{}, apperrors.TCRERR_TAG_INVALID
+		}
+	}
+	if domain.ValidateName(name) != nil {
+		return dto.FindManifestInput{}, apperrors.TCRERR_NAME_INVALID
+	}
+	return dto.FindManifestInput{Name: name, Reference: reference}, nil
+}
+
+func (u ManifestUseCase) GetTags(ctx context.Context, name string) (dto.GetTagsResponse, error) {
 	err := domain.ValidateName(name)
+	if err != nil {
+		return dto.GetTagsResponse{}, apperrors.TCRERR_NAME_INVALID
+	}
+	err = checkAccess(ctx, u.access, name, auth.ActionPull)
 	if err != nil {
 		return dto.GetTagsResponse{}, err
 	}
+	if bound := boundDigest(ctx); bound != "" {
+		return dto.GetTagsResponse{}, apperrors.TCRERR_DENIED.WithDetail("pull link is bound to " + bound)
+	}
 
-	existsName, err := u.repoRepo.ExistsRepository(dto.ExistsRepositoryInput{
+	existsName, err := u.repoRepo.ExistsRepository(ctx, dto.ExistsRepositoryInput{
 		Name: name,
 	})
 	if err != nil {
 		return dto.GetTagsResponse{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
-	resp, err := u.maniRepo.GetTags(name)
+	resp, err := u.maniRepo.GetTags(ctx, name)
 	if err != nil {
 		return dto.GetTagsResponse{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
@@ -86,62 +251,120 @@ func (u ManifestUseCase) GetTags(name string) (dto.GetTagsResponse, error) {
 	return resp, nil
 }
 
-func (u ManifestUseCase) PutManifest(metadata model.ManifestMetadata, manifest []byte) (string, error) {
+func (u ManifestUseCase) PutManifest(ctx context.Context, metadata model.ManifestMetadata, manifest []byte) (dto.PutManifestResponse, error) {
 	err := domain.ValidateName(metadata.Name)
 	if err != nil {
-		return "", apperrors.TCRERR_NAME_INVALID
+		return dto.PutManifestResponse{}, apperrors.TCRERR_NAME_INVALID
 	}
-
-	err = domain.ValidateManifest(metadata, manifest)
+	err = checkAccess(ctx, u.access, metadata.Name, auth.ActionPush)
 	if err != nil {
-		return "", apperrors.TCRERR_MANIFEST_INVALID.Wrap(err)
+		return dto.PutManifestResponse{}, err
 	}
 
-	existsName, err := u.repoRepo.ExistsRepository(dto.ExistsRepositoryInput{
-		Name: metadata.Name,
-	})
+	err = domain.ValidateManifest(metadata, manifest)
 	if err != nil {
-		return "", apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		return dto.PutManifestResponse{}, apperrors.TCRERR_MANIFEST_INVALID.Wrap(err)
 	}
-	if !existsName {
-		return "", apperrors.TCRERR_NAME_NOT_FOUND
+	var m model.Manifest
+	err = json.Unmarshal(manifest, &m)
+	if err != nil {
+		return dto.PutManifestResponse{}, apperrors.TCRERR_MANIFEST_INVALID.Wrap(err)
 	}
 
 	calcdDigest, err := domain.CalcManifestDigestRefactor(manifest)
 	if err != nil {
-		return "", err
+		return dto.PutManifestResponse{}, apperrors.TCRERR_MANIFEST_INVALID.Wrap(err)
 	}
 	isDigest := domain.IsDigest(metadata.Reference)
 	var tag string
 	if isDigest {
 		if calcdDigest != metadata.Reference {
-			return "", errors.New("digest does not match")
+			return dto.PutManifestResponse{}, apperrors.TCRERR_DIGEST_INVALID.WithDetail("digest does not match the manifest content")
 		}
-		tag = calcdDigest // tag がない場合は digest を tag にする
+		tag = "" // digest 指定の push ではタグを付けない
 	} else {
 		tag = metadata.Reference
 	}
 
-	err = u.maniRepo.SaveManifest(dto.SaveManifestInput{
-		Name:     metadata.Name,
-		Tag:      tag,
-		Digest:   calcdDigest,
-		Manifest: manifest,
+	// リポジトリの存在確認も SaveManifest のトランザクションの中で行われる
+	err = u.maniRepo.SaveManifest(ctx, dto.SaveManifestInput{
+		Name:         metadata.Name,
+		Tag:          tag,
+		Digest:       calcdDigest,
+		Manifest:     manifest,
+		MediaType:    m.MediaType,
+		ArtifactType: domain.ArtifactType(m),
+		Subject:      m.Subject.Digest,
+		Annotations:  m.Annotations,
 	})
+	if errors.Is(err, apperrors.ErrRepositoryNotFound) {
+		return dto.PutManifestResponse{}, apperrors.TCRERR_NAME_NOT_FOUND
+	}
+	if err != nil {
+		return dto.PutManifestResponse{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return dto.PutManifestResponse{
+		Digest:  calcdDigest,
+		Subject: m.Subject.Digest,
+	}, nil
+}
 
+// digest のマニフェストを subject に持つマニフェストの一覧を返す。
+// subject のマニフェストが存在しなくても、空の一覧を返す
+func (u ManifestUseCase) GetReferrers(ctx context.Context, name string, digest string, artifactType string) (dto.GetReferrersResponse, error) {
+	err := domain.ValidateName(name)
 	if err != nil {
-		return "", errors.New("適切なエラーを設定してください")
+		return dto.GetReferrersResponse{}, apperrors.TCRERR_NAME_INVALID
 	}
-	return calcdDigest, nil
+	err = checkAccess(ctx, u.access, name, auth.ActionPull)
+	if err != nil {
+		return dto.GetReferrersResponse{}, err
+	}
+	err = domain.ValidateDigest(digest)
+	if err != nil {
+		return dto.GetReferrersResponse{}, apperrors.TCRERR_DIGEST_INVALID
+	}
+	if bound := boundDigest(ctx); bound != "" && digest != bound {
+		return dto.GetReferrersResponse{}, apperrors.TCRERR_DENIED.WithDetail("pull link is bound to " + bound)
+	}
+
+	resp, err := u.maniRepo.ListReferrers(ctx, dto.ListReferrersInput{
+		Name:         name,
+		Digest:       digest,
+		ArtifactType: artifactType,
+	})
+	if err != nil {
+		return dto.GetReferrersResponse{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+
+	index := dto.GetReferrersResponse{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+		Manifests:     []dto.ReferrerDescriptor{},
+	}
+	for _, d := range resp.Descriptors {
+		index.Manifests = append(index.Manifests, dto.ReferrerDescriptor{
+			MediaType:    d.MediaType,
+			Digest:       d.Digest,
+			Size:         d.Size,
+			ArtifactType: d.ArtifactType,
+			Annotations:  d.Annotations,
+		})
+	}
+	return index, nil
 }
 
-func (u ManifestUseCase) DeleteManifest(metadata model.ManifestMetadata) error {
+func (u ManifestUseCase) DeleteManifest(ctx context.Context, metadata model.ManifestMetadata) error {
 	err := domain.ValidateName(metadata.Name)
 	if err != nil {
 		return apperrors.TCRERR_NAME_INVALID
 	}
+	err = checkAccess(ctx, u.access, metadata.Name, auth.ActionDelete)
+	if err != nil {
+		return err
+	}
 
-	existsName, err := u.repoRepo.ExistsRepository(dto.ExistsRepositoryInput{
+	existsName, err := u.repoRepo.ExistsRepository(ctx, dto.ExistsRepositoryInput{
 		Name: metadata.Name,
 	})
 	if err != nil {
@@ -151,13 +374,15 @@ func (u ManifestUseCase) DeleteManifest(metadata model.ManifestMetadata) error {
 		return apperrors.TCRERR_NAME_NOT_FOUND
 	}
 
-	err = u.maniRepo.DeleteManifest(dto.DeleteManifestInput{
+	err = u.maniRepo.DeleteManifest(ctx, dto.DeleteManifestInput{
 		Name:      metadata.Name,
 		Reference: metadata.Reference,
 	})
-
+	if errors.Is(err, apperrors.ErrManifestNotFound) {
+		return apperrors.TCRERR_MANIFEST_NOT_FOUND
+	}
 	if err != nil {
-		return err
+		return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
 	}
 	return nil
 }
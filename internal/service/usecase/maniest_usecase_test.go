@@ -0,0 +1,254 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/a-takamin/tcr/internal/service/domain"
+)
+
+// テストで使うメソッドだけを実装する
+type fakeManifestRepo struct {
+	persister.ManifestPersister
+	manifests map[string]dto.FindManifestOutput
+	// SaveManifest に渡された入力
+	saved []dto.SaveManifestInput
+	// SaveManifest が返すエラー
+	saveErr error
+	// ResolveReferences に渡された参照
+	resolved []dto.FindManifestInput
+}
+
+// denied のリポジトリへのアクセスを拒否する
+type fakeAccessChecker struct {
+	denied map[string]bool
+}
+
+func (f fakeAccessChecker) CheckAccess(ctx context.Context, name, action string) error {
+	if f.denied[name] {
+		return apperrors.TCRERR_DENIED
+	}
+	return nil
+}
+
+func (f *fakeManifestRepo) FindManifest(ctx context.Context, input dto.FindManifestInput) (dto.FindManifestOutput, error) {
+	return f.manifests[input.Name+"@"+input.Reference], nil
+}
+
+func (f *fakeManifestRepo) ResolveReferences(ctx context.Context, input dto.ResolveReferencesInput) (dto.ResolveReferencesOutput, error) {
+	f.resolved = append(f.resolved, input.References...)
+	var out dto.ResolveReferencesOutput
+	for _, ref := range input.References {
+		m, ok := f.manifests[ref.Name+"@"+ref.Reference]
+		if !ok {
+			continue
+		}
+		out.Items = append(out.Items, dto.ResolvedReference{Name: ref.Name, Reference: ref.Reference, Digest: m.Digest, Size: int64(len(m.Manifest))})
+	}
+	return out, nil
+}
+
+func (f *fakeManifestRepo) DeleteManifest(ctx context.Context, input dto.DeleteManifestInput) error {
+	key := input.Name + "@" + input.Reference
+	if _, ok := f.manifests[key]; !ok {
+		return apperrors.ErrManifestNotFound
+	}
+	delete(f.manifests, key)
+	return nil
+}
+
+func (f *fakeManifestRepo) SaveManifest(ctx context.Context, input dto.SaveManifestInput) error {
+	f.saved = append(f.saved, input)
+	return f.saveErr
+}
+
+func TestParseImageReference(t *testing.T) {
+	digest := "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	tests := []struct {
+		testName string
+		ref      string
+		want     dto.FindManifestInput
+		wantErr  error
+	}{
+		{
+			testName: "タグ指定",
+			ref:      "org/repo:v1",
+			want:     dto.FindManifestInput{Name: "org/repo", Reference: "v1"},
+		},
+		{
+			testName: "タグを省略すると latest",
+			ref:      "org/repo",
+			want:     dto.FindManifestInput{Name: "org/repo", Reference: "latest"},
+		},
+		{
+			testName: "digest 指定",
+			ref:      "org/repo@" + digest,
+			want:     dto.FindManifestInput{Name: "org/repo", Reference: digest},
+		},
+		{
+			testName: "不正な digest",
+			ref:      "org/repo@sha256:xyz",
+			wantErr:  apperrors.TCRERR_DIGEST_INVALID,
+		},
+		{
+			testName: "不正なタグ",
+			ref:      "org/repo:.v1",
+			wantErr:  apperrors.TCRERR_TAG_INVALID,
+		},
+		{
+			testName: "不正な name",
+			ref:      "Org/Repo:v1",
+			wantErr:  apperrors.TCRERR_NAME_INVALID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got, err := parseImageReference(tt.ref)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got is %+v, but want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPutManifestTag(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json"}}`)
+	digest, err := domain.CalcManifestDigestRefactor(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		testName  string
+		reference string
+		saveErr   error
+		wantTag   string
+		wantErr   error
+	}{
+		{testName: "タグでの push はタグを付ける", reference: "latest", wantTag: "latest"},
+		{testName: "digest での push はタグを付けない", reference: digest, wantTag: ""},
+		{testName: "リポジトリがない", reference: "latest", saveErr: apperrors.ErrRepositoryNotFound, wantTag: "latest", wantErr: apperrors.TCRERR_NAME_NOT_FOUND},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			repo := &fakeManifestRepo{saveErr: tt.saveErr}
+			u := NewManifestUseCase(repo, &fakeRepositoryRepo{}, nil, nil)
+			_, err := u.PutManifest(context.Background(), model.ManifestMetadata{
+				Name:        "org/repo",
+				Reference:   tt.reference,
+				ContentType: "application/vnd.oci.image.manifest.v1+json",
+			}, manifest)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if len(repo.saved) != 1 {
+				t.Fatalf("SaveManifest is called %d times, but want once", len(repo.saved))
+			}
+			if got := repo.saved[0]; got.Tag != tt.wantTag || got.Digest != digest {
+				t.Fatalf("got is %+v, but want tag %q and digest %s", got, tt.wantTag, digest)
+			}
+		})
+	}
+}
+
+func TestResolveReferences(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	manifest := []byte(`{"schemaVersion":2}`)
+	tests := []struct {
+		testName   string
+		references []string
+		denied     map[string]bool
+		want       []dto.BatchReferenceResult
+		wantErr    error
+	}{
+		{
+			testName:   "リクエストと同じ順番で返す",
+			references: []string{"org/app:missing", "org/app", "org/app@" + digest},
+			want: []dto.BatchReferenceResult{
+				{Reference: "org/app:missing"},
+				{Reference: "org/app", Exists: true, Digest: digest, Size: int64(len(manifest))},
+				{Reference: "org/app@" + digest, Exists: true, Digest: digest, Size: int64(len(manifest))},
+			},
+		},
+		{
+			testName:   "pull できないリポジトリは存在しないものとして返す",
+			references: []string{"org/secret:latest", "org/app:latest"},
+			denied:     map[string]bool{"org/secret": true},
+			want: []dto.BatchReferenceResult{
+				{Reference: "org/secret:latest"},
+				{Reference: "org/app:latest", Exists: true, Digest: digest, Size: int64(len(manifest))},
+			},
+		},
+		{
+			testName:   "上限を超える",
+			references: make([]string, MaxBatchItems+1),
+			wantErr:    apperrors.TCRERR_BATCH_TOO_LARGE,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			repo := &fakeManifestRepo{manifests: map[string]dto.FindManifestOutput{
+				"org/app@latest":    {Name: "org/app", Digest: digest, Manifest: manifest},
+				"org/app@" + digest: {Name: "org/app", Digest: digest, Manifest: manifest},
+				"org/secret@latest": {Name: "org/secret", Digest: digest, Manifest: manifest},
+			}}
+			u := NewManifestUseCase(repo, &fakeRepositoryRepo{}, nil, fakeAccessChecker{denied: tt.denied})
+			got, err := u.ResolveReferences(context.Background(), tt.references)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got is %+v, but want %+v", got, tt.want)
+			}
+			for _, ref := range repo.resolved {
+				if tt.denied[ref.Name] {
+					t.Fatalf("denied repository must not be looked up: %+v", ref)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestNotFound(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		testName string
+		name     string
+		delete   bool
+		wantErr  error
+	}{
+		{testName: "リポジトリにないマニフェストを取得する", name: "org/app", wantErr: apperrors.TCRERR_MANIFEST_NOT_FOUND},
+		{testName: "ないリポジトリのマニフェストを取得する", name: "org/none", wantErr: apperrors.TCRERR_NAME_NOT_FOUND},
+		{testName: "リポジトリにないマニフェストを削除する", name: "org/app", delete: true, wantErr: apperrors.TCRERR_MANIFEST_NOT_FOUND},
+		{testName: "ないリポジトリのマニフェストを削除する", name: "org/none", delete: true, wantErr: apperrors.TCRERR_NAME_NOT_FOUND},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			repo := &fakeManifestRepo{manifests: map[string]dto.FindManifestOutput{}}
+			u := NewManifestUseCase(repo, &fakeRepositoryRepo{repos: []model.Repository{{Name: "org/app"}}}, nil, nil)
+			metadata := model.ManifestMetadata{Name: tt.name, Reference: digest}
+			var err error
+			if tt.delete {
+				err = u.DeleteManifest(context.Background(), metadata)
+			} else {
+				_, err = u.GetManifest(context.Background(), metadata)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
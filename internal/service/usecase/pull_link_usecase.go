@@ -0,0 +1,233 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/a-takamin/tcr/internal/model"
+	"github.com/a-takamin/tcr/internal/service/domain"
+	"github.com/google/uuid"
+)
+
+// 同じクライアントから pull link が使われたことを記録する間隔。blob ごとにリクエストされるので、毎回は書き込まない
+const pullLinkUseResolution = time.Minute
+
+// アカウントを作らずに pull だけを許可する、期限付きのリンクの発行と検証。
+// トークンは署名されているが、取り消しを反映するために使われるたびにメタデータを確かめる
+type PullLinkUseCase struct {
+	linkRepo persister.PullLinkPersister
+	issuer   *auth.TokenIssuer
+	access   *AccessUseCase
+	// expiresIn を省略したときの有効期間と、指定できる最長の有効期間
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+
+	mu sync.Mutex
+	// リンクとクライアントの組ごとに、最後に使われたことを記録した日時
+	recordedUses map[pullLinkClient]time.Time
+}
+
+type pullLinkClient struct {
+	linkID    string
+	ip        string
+	userAgent string
+}
+
+func NewPullLinkUseCase(linkRepo persister.PullLinkPersister, issuer *auth.TokenIssuer, access *AccessUseCase, defaultTTL, maxTTL time.Duration) *PullLinkUseCase {
+	return &PullLinkUseCase{
+		linkRepo:     linkRepo,
+		issuer:       issuer,
+		access:       access,
+		defaultTTL:   defaultTTL,
+		maxTTL:       maxTTL,
+		recordedUses: map[pullLinkClient]time.Time{},
+	}
+}
+
+func (u *PullLinkUseCase) ListPullLinks(ctx context.Context) ([]model.PullLink, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	links, err := u.linkRepo.ListPullLinks(ctx)
+	if err != nil {
+		return nil, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return links, nil
+}
+
+// トークンは作成したときにだけ返し、メタデータには保存しない
+func (u *PullLinkUseCase) CreatePullLink(ctx context.Context, req dto.CreatePullLinkRequest) (dto.PullLinkTokenOutput, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return dto.PullLinkTokenOutput{}, err
+	}
+	if domain.ValidateName(req.Repository) != nil {
+		return dto.PullLinkTokenOutput{}, apperrors.TCRERR_PULL_LINK_INVALID.WithDetail("repository is invalid: " + req.Repository)
+	}
+	if req.Digest != "" && domain.ValidateDigest(req.Digest) != nil {
+		return dto.PullLinkTokenOutput{}, apperrors.TCRERR_PULL_LINK_INVALID.WithDetail("digest is invalid: " + req.Digest)
+	}
+	ttl := u.defaultTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			return dto.PullLinkTokenOutput{}, apperrors.TCRERR_PULL_LINK_INVALID.WithDetail("expiresIn must be a positive duration: " + req.ExpiresIn)
+		}
+		ttl = d
+	}
+	if ttl > u.maxTTL {
+		return dto.PullLinkTokenOutput{}, apperrors.TCRERR_PULL_LINK_INVALID.WithDetail("expiresIn must not exceed " + u.maxTTL.String())
+	}
+
+	p, _ := auth.PrincipalFrom(ctx)
+	now := time.Now().UTC()
+	link := model.PullLink{
+		ID:          uuid.NewString(),
+		Repository:  req.Repository,
+		Digest:      req.Digest,
+		Description: req.Description,
+		ExpiresAt:   now.Add(ttl),
+		CreatedAt:   now,
+		CreatedBy:   p.Subject,
+	}
+	token, err := u.issuer.IssuePullLink(auth.PullLinkClaims{ID: link.ID, Repository: link.Repository, Digest: link.Digest}, now, link.ExpiresAt)
+	if err != nil {
+		return dto.PullLinkTokenOutput{}, apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+	}
+	err = u.linkRepo.CreatePullLink(ctx, link)
+	if err != nil {
+		return dto.PullLinkTokenOutput{}, apperrors.Classify(err)
+	}
+	return dto.PullLinkTokenOutput{Link: link, Token: token}, nil
+}
+
+// 取り消したリンクのトークンはすぐに使えなくなる。
+// /token で交換済みのレジストリのトークンは、その期限まで使える
+func (u *PullLinkUseCase) RevokePullLink(ctx context.Context, id string) (model.PullLink, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return model.PullLink{}, err
+	}
+	p, _ := auth.PrincipalFrom(ctx)
+	err = u.linkRepo.RevokePullLink(ctx, dto.RevokePullLinkInput{ID: id, RevokedBy: p.Subject})
+	if err != nil {
+		return model.PullLink{}, u.classify(err, id)
+	}
+	link, err := u.linkRepo.FindPullLink(ctx, dto.FindPullLinkInput{ID: id})
+	if err != nil {
+		return model.PullLink{}, u.classify(err, id)
+	}
+	return link, nil
+}
+
+func (u *PullLinkUseCase) ListPullLinkUses(ctx context.Context, id string) ([]model.PullLinkUse, error) {
+	err := u.access.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = u.linkRepo.FindPullLink(ctx, dto.FindPullLinkInput{ID: id})
+	if err != nil {
+		return nil, u.classify(err, id)
+	}
+	uses, err := u.linkRepo.ListPullLinkUses(ctx, dto.ListPullLinkUsesInput{ID: id})
+	if err != nil {
+		return nil, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+	}
+	return uses, nil
+}
+
+func (u *PullLinkUseCase) classify(err error, id string) error {
+	if errors.Is(err, apperrors.ErrPullLinkNotFound) {
+		return apperrors.TCRERR_PULL_LINK_NOT_FOUND.WithDetail(id)
+	}
+	return apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+}
+
+// トークンを検証して、使われたことを記録する。使えないトークンなら auth.ErrInvalidToken を返す。
+// 記録できなければ、監査できない pull を許さないように失敗させる
+func (u *PullLinkUseCase) VerifyPullLink(ctx context.Context, token string) (auth.Principal, error) {
+	claims, err := u.issuer.VerifyPullLink(token)
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	link, err := u.linkRepo.FindPullLink(ctx, dto.FindPullLinkInput{ID: claims.ID})
+	if errors.Is(err, apperrors.ErrPullLinkNotFound) {
+		return auth.Principal{}, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	now := time.Now()
+	if link.RevokedAt != nil || now.After(link.ExpiresAt) || link.Repository != claims.Repository || link.Digest != claims.Digest {
+		return auth.Principal{}, auth.ErrInvalidToken
+	}
+
+	client := auth.ClientFrom(ctx)
+	key := pullLinkClient{linkID: link.ID, ip: client.IP, userAgent: client.UserAgent}
+	if u.shouldRecordUse(key, now) {
+		err = u.linkRepo.RecordPullLinkUse(ctx, model.PullLinkUse{LinkID: link.ID, UsedAt: now.UTC(), ClientIP: client.IP, UserAgent: client.UserAgent})
+		if err != nil {
+			// 次のリクエストで記録し直す
+			u.mu.Lock()
+			delete(u.recordedUses, key)
+			u.mu.Unlock()
+		}
+		if errors.Is(err, apperrors.ErrPullLinkNotFound) {
+			return auth.Principal{}, auth.ErrInvalidToken
+		}
+		if err != nil {
+			return auth.Principal{}, err
+		}
+	}
+	return auth.Principal{
+		Subject:     auth.PullLinkUsername + ":" + link.ID,
+		Kind:        auth.KindPullLink,
+		FromToken:   true,
+		Access:      []auth.Access{auth.RepositoryAccess(link.Repository, auth.ActionPull)},
+		Permissions: []auth.Permission{{Pattern: link.Repository, Role: auth.RoleReader}},
+		Digest:      link.Digest,
+	}, nil
+}
+
+// 同じリンクを同じクライアントが pullLinkUseResolution の間に使った記録がなければ true を返し、記録したことにする。
+// 別のクライアントからの利用はいつでも記録する
+func (u *PullLinkUseCase) shouldRecordUse(key pullLinkClient, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if recordedAt, ok := u.recordedUses[key]; ok && now.Sub(recordedAt) < pullLinkUseResolution {
+		return false
+	}
+	for k, recordedAt := range u.recordedUses {
+		if now.Sub(recordedAt) >= pullLinkUseResolution {
+			delete(u.recordedUses, k)
+		}
+	}
+	u.recordedUses[key] = now
+	return true
+}
+
+// auth.Authenticator を満たす。/token でユーザー名を pull-link、パスワードをリンクのトークンにすると、
+// リンクの範囲だけを pull できるレジストリのトークンと交換できる
+func (u *PullLinkUseCase) Authenticate(ctx context.Context, username, password string) (auth.Principal, error) {
+	if username != auth.PullLinkUsername {
+		return auth.Principal{}, auth.ErrInvalidCredentials
+	}
+	p, err := u.VerifyPullLink(ctx, password)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		return auth.Principal{}, auth.ErrInvalidCredentials
+	}
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	// 交換したトークンのスコープは、Permissions から決め直す
+	p.FromToken = false
+	p.Access = nil
+	return p, nil
+}
@@ -0,0 +1,311 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+type fakePullLinkRepo struct {
+	links map[string]model.PullLink
+	uses  []model.PullLinkUse
+}
+
+func (f *fakePullLinkRepo) ListPullLinks(ctx context.Context) ([]model.PullLink, error) {
+	var links []model.PullLink
+	for _, l := range f.links {
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+func (f *fakePullLinkRepo) FindPullLink(ctx context.Context, input dto.FindPullLinkInput) (model.PullLink, error) {
+	l, ok := f.links[input.ID]
+	if !ok {
+		return model.PullLink{}, apperrors.ErrPullLinkNotFound
+	}
+	return l, nil
+}
+
+func (f *fakePullLinkRepo) CreatePullLink(ctx context.Context, link model.PullLink) error {
+	f.links[link.ID] = link
+	return nil
+}
+
+func (f *fakePullLinkRepo) RevokePullLink(ctx context.Context, input dto.RevokePullLinkInput) error {
+	l, ok := f.links[input.ID]
+	if !ok {
+		return apperrors.ErrPullLinkNotFound
+	}
+	now := time.Now()
+	l.RevokedAt, l.RevokedBy = &now, input.RevokedBy
+	f.links[input.ID] = l
+	return nil
+}
+
+func (f *fakePullLinkRepo) RecordPullLinkUse(ctx context.Context, use model.PullLinkUse) error {
+	l, ok := f.links[use.LinkID]
+	if !ok {
+		return apperrors.ErrPullLinkNotFound
+	}
+	l.Uses++
+	l.LastUsedAt = &use.UsedAt
+	f.links[use.LinkID] = l
+	f.uses = append(f.uses, use)
+	return nil
+}
+
+func (f *fakePullLinkRepo) ListPullLinkUses(ctx context.Context, input dto.ListPullLinkUsesInput) ([]model.PullLinkUse, error) {
+	return f.uses, nil
+}
+
+func newTestPullLinkUseCase(t *testing.T, repo *fakePullLinkRepo) *PullLinkUseCase {
+	t.Helper()
+	key, err := auth.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := auth.NewTokenIssuer(key, "tcr", "tcr", 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := NewAccessUseCase(&fakeGrantRepo{}, &fakeTeamRepo{}, &fakeRepositoryRepo{}, []string{"root"}, time.Minute)
+	return NewPullLinkUseCase(repo, issuer, access, time.Hour, 24*time.Hour)
+}
+
+func TestCreatePullLink(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		testName  string
+		principal auth.Principal
+		req       dto.CreatePullLinkRequest
+		wantErr   error
+	}{
+		{
+			testName:  "digest と有効期間",
+			principal: auth.Principal{Subject: "root"},
+			req:       dto.CreatePullLinkRequest{Repository: "org/app", Digest: digest, ExpiresIn: "2h"},
+		},
+		{
+			testName:  "管理者でなければ作れない",
+			principal: auth.Principal{Subject: "alice"},
+			req:       dto.CreatePullLinkRequest{Repository: "org/app"},
+			wantErr:   apperrors.TCRERR_DENIED,
+		},
+		{
+			testName:  "最長の有効期間を超える",
+			principal: auth.Principal{Subject: "root"},
+			req:       dto.CreatePullLinkRequest{Repository: "org/app", ExpiresIn: "48h"},
+			wantErr:   apperrors.TCRERR_PULL_LINK_INVALID,
+		},
+		{
+			testName:  "digest の形式が違う",
+			principal: auth.Principal{Subject: "root"},
+			req:       dto.CreatePullLinkRequest{Repository: "org/app", Digest: "latest"},
+			wantErr:   apperrors.TCRERR_PULL_LINK_INVALID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			repo := &fakePullLinkRepo{links: map[string]model.PullLink{}}
+			u := newTestPullLinkUseCase(t, repo)
+			ctx := auth.WithPrincipal(context.Background(), tt.principal)
+			out, err := u.CreatePullLink(ctx, tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if out.Token == "" || out.Link.CreatedBy != "root" || len(repo.links) != 1 {
+				t.Fatalf("unexpected output: %+v", out)
+			}
+		})
+	}
+}
+
+func TestVerifyPullLink(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		testName string
+		// 作成したリンクのメタデータを書き換える
+		modify  func(l *model.PullLink)
+		wantErr error
+	}{
+		{testName: "使えるリンク"},
+		{
+			testName: "取り消された",
+			modify:   func(l *model.PullLink) { now := time.Now(); l.RevokedAt = &now },
+			wantErr:  auth.ErrInvalidToken,
+		},
+		{
+			testName: "メタデータで期限切れ",
+			modify:   func(l *model.PullLink) { l.ExpiresAt = time.Now().Add(-time.Minute) },
+			wantErr:  auth.ErrInvalidToken,
+		},
+		{
+			testName: "メタデータと digest が違う",
+			modify:   func(l *model.PullLink) { l.Digest = "" },
+			wantErr:  auth.ErrInvalidToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			repo := &fakePullLinkRepo{links: map[string]model.PullLink{}}
+			u := newTestPullLinkUseCase(t, repo)
+			admin := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "root"})
+			out, err := u.CreatePullLink(admin, dto.CreatePullLinkRequest{Repository: "org/app", Digest: digest})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.modify != nil {
+				l := repo.links[out.Link.ID]
+				tt.modify(&l)
+				repo.links[out.Link.ID] = l
+			}
+
+			ctx := auth.WithClient(context.Background(), auth.Client{IP: "192.0.2.1", UserAgent: "docker/27.0"})
+			p, err := u.VerifyPullLink(ctx, out.Token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if len(repo.uses) != 0 {
+					t.Fatalf("rejected use must not be recorded: %+v", repo.uses)
+				}
+				return
+			}
+			if p.Kind != auth.KindPullLink || p.Digest != digest || !auth.Allows(p.Access, auth.RepositoryAccess("org/app", auth.ActionPull)) {
+				t.Fatalf("unexpected principal: %+v", p)
+			}
+			if len(repo.uses) != 1 || repo.uses[0].ClientIP != "192.0.2.1" || repo.uses[0].UserAgent != "docker/27.0" {
+				t.Fatalf("use is not recorded: %+v", repo.uses)
+			}
+		})
+	}
+}
+
+func TestVerifyPullLinkRecordsUse(t *testing.T) {
+	repo := &fakePullLinkRepo{links: map[string]model.PullLink{}}
+	u := newTestPullLinkUseCase(t, repo)
+	admin := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "root"})
+	out, err := u.CreatePullLink(admin, dto.CreatePullLinkRequest{Repository: "org/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partner := auth.Client{IP: "192.0.2.1", UserAgent: "docker/27.0"}
+	tests := []struct {
+		testName string
+		client   auth.Client
+		// 検証する前に、記録した日時をずらす
+		shift    time.Duration
+		wantUses int
+	}{
+		{testName: "初めて使われた", client: partner, wantUses: 1},
+		{testName: "同じクライアントが直前に使っていれば記録しない", client: partner, wantUses: 1},
+		{testName: "別の IP アドレスからは記録する", client: auth.Client{IP: "198.51.100.7", UserAgent: "docker/27.0"}, wantUses: 2},
+		{testName: "別の User-Agent からは記録する", client: auth.Client{IP: "192.0.2.1", UserAgent: "curl/8.0"}, wantUses: 3},
+		{testName: "間隔を空ければ同じクライアントでも記録する", client: partner, shift: -pullLinkUseResolution, wantUses: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			for k, recordedAt := range u.recordedUses {
+				u.recordedUses[k] = recordedAt.Add(tt.shift)
+			}
+			_, err := u.VerifyPullLink(auth.WithClient(context.Background(), tt.client), out.Token)
+			if err != nil {
+				t.Fatalf("err is %v, but want nil", err)
+			}
+			if len(repo.uses) != tt.wantUses {
+				t.Fatalf("got is %v, but want %v", len(repo.uses), tt.wantUses)
+			}
+		})
+	}
+}
+
+func TestPullLinkAuthenticate(t *testing.T) {
+	repo := &fakePullLinkRepo{links: map[string]model.PullLink{}}
+	u := newTestPullLinkUseCase(t, repo)
+	admin := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "root"})
+	out, err := u.CreatePullLink(admin, dto.CreatePullLinkRequest{Repository: "org/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 他の認証に回すように、ErrInvalidCredentials を返す
+	_, err = u.Authenticate(context.Background(), "alice", out.Token)
+	if !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("err is %v, but want %v", err, auth.ErrInvalidCredentials)
+	}
+	_, err = u.Authenticate(context.Background(), auth.PullLinkUsername, "wrong")
+	if !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("err is %v, but want %v", err, auth.ErrInvalidCredentials)
+	}
+
+	p, err := u.Authenticate(context.Background(), auth.PullLinkUsername, out.Token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	actions, err := u.access.GrantedActions(context.Background(), p, "org/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0] != auth.ActionPull {
+		t.Fatalf("actions are %v, but want only pull", actions)
+	}
+	other, err := u.access.GrantedActions(context.Background(), p, "org/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other) != 0 {
+		t.Fatalf("actions on other repository are %v", other)
+	}
+}
+
+func TestPullLinkBoundDigest(t *testing.T) {
+	index := "sha256:" + strings.Repeat("a", 64)
+	child := "sha256:" + strings.Repeat("b", 64)
+	other := "sha256:" + strings.Repeat("c", 64)
+	repo := &fakeManifestRepo{manifests: map[string]dto.FindManifestOutput{
+		"org/app@" + index: {Name: "org/app", Digest: index, Manifest: []byte(`{"schemaVersion":2,"manifests":[{"digest":"` + child + `"}]}`)},
+		"org/app@latest":   {Name: "org/app", Digest: index, Manifest: []byte(`{"schemaVersion":2,"manifests":[{"digest":"` + child + `"}]}`)},
+		"org/app@" + child: {Name: "org/app", Digest: child, Manifest: []byte(`{"schemaVersion":2}`)},
+		"org/app@" + other: {Name: "org/app", Digest: other, Manifest: []byte(`{"schemaVersion":2}`)},
+	}}
+	u := NewManifestUseCase(repo, &fakeRepositoryRepo{}, nil, nil)
+	ctx := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "pull-link:1", Kind: auth.KindPullLink, Digest: index})
+
+	tests := []struct {
+		testName  string
+		reference string
+		wantErr   error
+	}{
+		{testName: "指定された digest", reference: index},
+		{testName: "指定された digest を指すタグ", reference: "latest"},
+		{testName: "インデックスに含まれるマニフェスト", reference: child},
+		{testName: "他のマニフェスト", reference: other, wantErr: apperrors.TCRERR_DENIED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			_, err := u.GetManifest(ctx, model.ManifestMetadata{Name: "org/app", Reference: tt.reference})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err is %v, but want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	_, err := u.GetTags(ctx, "org/app")
+	if !errors.Is(err, apperrors.TCRERR_DENIED) {
+		t.Fatalf("tags must be denied for a digest-bound pull link: %v", err)
+	}
+}
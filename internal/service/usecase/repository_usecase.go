@@ -0,0 +1,94 @@
+package usecase
+
+import (
+	"context"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/dto"
+	"github.com/a-takamin/tcr/internal/interface/persister"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+// _catalog で一度に返すリポジトリの数
+const (
+	defaultCatalogPageSize = 100
+	maxCatalogPageSize     = 1000
+)
+
+// 見えないリポジトリを除くために、1 回の _catalog で読むページの数の上限
+const maxCatalogScanPages = 10
+
+// リクエストの送り主が _catalog で見られるリポジトリの名前を返す
+type CatalogFilter interface {
+	VisibleRepositories(ctx context.Context, repos []model.Repository) ([]string, error)
+}
+
+type RepositoryUseCase struct {
+	repoRepo persister.RepositoryPersister
+	// nil ならすべてのリポジトリを返す
+	filter CatalogFilter
+}
+
+func NewRepositoryUseCase(repoRepo persister.RepositoryPersister, filter CatalogFilter) *RepositoryUseCase {
+	return &RepositoryUseCase{
+		repoRepo: repoRepo,
+		filter:   filter,
+	}
+}
+
+// n が 0 以下の場合は defaultCatalogPageSize 件、maxCatalogPageSize を超える場合は maxCatalogPageSize 件にする
+func (u RepositoryUseCase) ListRepositories(ctx context.Context, n int, last string) (dto.ListRepositoriesOutput, error) {
+	if n <= 0 {
+		n = defaultCatalogPageSize
+	}
+	if n > maxCatalogPageSize {
+		n = maxCatalogPageSize
+	}
+	if u.filter == nil {
+		resp, err := u.repoRepo.ListRepositories(ctx, dto.ListRepositoriesInput{
+			N:    n,
+			Last: last,
+		})
+		if err != nil {
+			return dto.ListRepositoriesOutput{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		}
+		if resp.Names == nil {
+			resp.Names = []string{}
+		}
+		return resp, nil
+	}
+
+	// 見えないリポジトリを除いて n 件になるまで読み進める。
+	// 読むページの数には上限があり、超えた場合は n 件に満たなくても続きの位置を返す
+	output := dto.ListRepositoriesOutput{Names: []string{}}
+	for page := 0; page < maxCatalogScanPages; page++ {
+		resp, err := u.repoRepo.ListRepositories(ctx, dto.ListRepositoriesInput{
+			N:    n,
+			Last: last,
+		})
+		if err != nil {
+			return dto.ListRepositoriesOutput{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		}
+		visible, err := u.filter.VisibleRepositories(ctx, resp.Repositories)
+		if err != nil {
+			return dto.ListRepositoriesOutput{}, err
+		}
+		for _, name := range visible {
+			if len(output.Names) == n {
+				output.Next = output.Names[n-1]
+				return output, nil
+			}
+			output.Names = append(output.Names, name)
+		}
+		if resp.Next == "" {
+			return output, nil
+		}
+		if len(output.Names) == n {
+			output.Next = output.Names[n-1]
+			return output, nil
+		}
+		last = resp.Next
+	}
+	output.Next = last
+	return output, nil
+}
@@ -0,0 +1,72 @@
+package usecase
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/model"
+)
+
+func TestListRepositories(t *testing.T) {
+	repos := &fakeRepositoryRepo{repos: []model.Repository{
+		{Name: "a/private"},
+		{Name: "b/public", Visibility: auth.VisibilityPublic},
+		{Name: "c/internal", Visibility: auth.VisibilityInternal},
+		{Name: "d/private"},
+		{Name: "e/public", Visibility: auth.VisibilityPublic},
+		{Name: "f/public", Visibility: auth.VisibilityPublic},
+	}}
+	grants := &fakeGrantRepo{grants: []model.Grant{
+		{SubjectType: auth.SubjectUser, Subject: "alice", Pattern: "d/*", Role: auth.RoleReader},
+	}}
+	access := NewAccessUseCase(grants, &fakeTeamRepo{}, repos, nil, time.Minute)
+	tests := []struct {
+		testName  string
+		filter    CatalogFilter
+		principal *auth.Principal
+		n         int
+		last      string
+		want      []string
+		wantNext  string
+	}{
+		{testName: "認証が無効", n: 10, want: []string{"a/private", "b/public", "c/internal", "d/private", "e/public", "f/public"}},
+		{testName: "匿名には public だけを見せる", filter: access, principal: &auth.Principal{FromToken: true}, n: 10, want: []string{"b/public", "e/public", "f/public"}},
+		{
+			testName:  "付与されたリポジトリと internal を見せる",
+			filter:    access,
+			principal: &auth.Principal{Subject: "alice", FromToken: true},
+			n:         10,
+			want:      []string{"b/public", "c/internal", "d/private", "e/public", "f/public"},
+		},
+		{
+			testName:  "見えないリポジトリを除いて n 件になるまで読み進める",
+			filter:    access,
+			principal: &auth.Principal{FromToken: true},
+			n:         2,
+			want:      []string{"b/public", "e/public"},
+			wantNext:  "e/public",
+		},
+		{testName: "続きから", filter: access, principal: &auth.Principal{FromToken: true}, n: 2, last: "e/public", want: []string{"f/public"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			u := NewRepositoryUseCase(repos, tt.filter)
+			ctx := context.Background()
+			if tt.principal != nil {
+				ctx = auth.WithPrincipal(ctx, *tt.principal)
+			}
+
+			got, err := u.ListRepositories(ctx, tt.n, tt.last)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got.Names, tt.want) || got.Next != tt.wantNext {
+				t.Fatalf("got is %v (next %q), but want %v (next %q)", got.Names, got.Next, tt.want, tt.wantNext)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/a-takamin/tcr/internal/apperrors"
+	"github.com/a-takamin/tcr/internal/auth"
+	"github.com/a-takamin/tcr/internal/dto"
+)
+
+// Docker のトークン認証のトークンを発行する
+type TokenUseCase struct {
+	authenticator auth.Authenticator
+	// nil ならクライアント証明書では認証しない
+	certs   *auth.CertificateAuthenticator
+	issuer  *auth.TokenIssuer
+	service string
+	access  *AccessUseCase
+}
+
+func NewTokenUseCase(authenticator auth.Authenticator, certs *auth.CertificateAuthenticator, issuer *auth.TokenIssuer, service string, access *AccessUseCase) *TokenUseCase {
+	return &TokenUseCase{
+		authenticator: authenticator,
+		certs:         certs,
+		issuer:        issuer,
+		service:       service,
+		access:        access,
+	}
+}
+
+func (u TokenUseCase) IssueToken(ctx context.Context, input dto.IssueTokenInput) (dto.IssueTokenOutput, error) {
+	if input.Service != "" && input.Service != u.service {
+		return dto.IssueTokenOutput{}, apperrors.TCRERR_REQUEST_INVALID.WithDetail("unknown service: " + input.Service)
+	}
+	var requested []auth.Access
+	for _, scope := range input.Scopes {
+		accesses, err := auth.ParseScope(scope)
+		if err != nil {
+			return dto.IssueTokenOutput{}, apperrors.TCRERR_REQUEST_INVALID.WithDetail(err.Error())
+		}
+		requested = append(requested, accesses...)
+	}
+
+	principal := auth.Principal{}
+	switch {
+	case input.HasCredentials:
+		p, err := u.authenticator.Authenticate(ctx, input.Username, input.Password)
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			return dto.IssueTokenOutput{}, apperrors.TCRERR_UNAUTHORIZED.Wrap(err)
+		}
+		if err != nil {
+			return dto.IssueTokenOutput{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		}
+		principal = p
+	case input.Certificate != nil && u.certs != nil:
+		p, err := u.certs.AuthenticateCertificate(ctx, input.Certificate)
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			return dto.IssueTokenOutput{}, apperrors.TCRERR_UNAUTHORIZED.Wrap(err)
+		}
+		if err != nil {
+			return dto.IssueTokenOutput{}, apperrors.TCRERR_PERSISTER_ERROR.Wrap(err)
+		}
+		principal = p
+	}
+
+	granted, err := u.grantAccess(ctx, principal, requested)
+	if err != nil {
+		return dto.IssueTokenOutput{}, err
+	}
+	now := time.Now()
+	token, expiresAt, err := u.issuer.Issue(principal, granted, now)
+	if err != nil {
+		return dto.IssueTokenOutput{}, apperrors.TCRERR_LOGIC_ERROR.Wrap(err)
+	}
+	return dto.IssueTokenOutput{Token: token, IssuedAt: now, ExpiresAt: expiresAt}, nil
+}
+
+// 要求された操作のうち、トークンで許可するもの。リポジトリに与えられた役割と公開範囲の範囲で許可する。
+// 匿名の送り主は public のリポジトリの pull と、public のリポジトリだけの _catalog を行える。
+// 権限の変更はトークンを発行し直すまで反映されない
+func (u TokenUseCase) grantAccess(ctx context.Context, principal auth.Principal, requested []auth.Access) ([]auth.Access, error) {
+	var granted []auth.Access
+	for _, r := range requested {
+		var actions []string
+		switch r.Type {
+		case auth.TypeRepository:
+			allowed, err := u.access.GrantedActions(ctx, principal, r.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, action := range r.Actions {
+				if action == auth.ActionAll {
+					actions = allowed
+					break
+				}
+				if slices.Contains(allowed, action) {
+					actions = append(actions, action)
+				}
+			}
+		case auth.TypeRegistry:
+			switch r.Name {
+			case auth.CatalogAccess.Name:
+				actions = auth.CatalogAccess.Actions
+			case auth.AdminAccess.Name:
+				admin, err := u.access.IsAdmin(ctx, principal)
+				if err != nil {
+					return nil, err
+				}
+				if admin {
+					actions = auth.AdminAccess.Actions
+				}
+			}
+		}
+		if len(actions) > 0 {
+			granted = append(granted, auth.Access{Type: r.Type, Name: r.Name, Actions: actions})
+		}
+	}
+	return granted, nil
+}
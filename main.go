@@ -1,16 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/a-takamin/tcr/internal/auth"
 	"github.com/a-takamin/tcr/internal/client"
+	"github.com/a-takamin/tcr/internal/config"
 	"github.com/a-takamin/tcr/internal/handler"
+	"github.com/a-takamin/tcr/internal/interface/persister"
 	"github.com/a-takamin/tcr/internal/repository"
 	"github.com/a-takamin/tcr/internal/service/usecase"
 	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
 )
 
 func init() {
@@ -18,70 +31,384 @@ func init() {
 }
 
 func main() {
+	// SIGTERM を受け取ったら新しいリクエストの受け付けをやめ、処理中のリクエストを待ってから終了する
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// 設定の確認だけを行うサブコマンド
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		err := runConfig(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	r := gin.New()
 	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{
 		SkipPaths: []string{"/health"},
 	}))
 	r.Use(handler.LogMiddleWare())
 	r.Use(gin.Recovery())
-	isLocal := true
 
-	env := os.Getenv("IS_LOCAL")
-	if env != "" {
-		isLocal = false
-	}
-	blobStorageName := os.Getenv("BLOB_STORAGE_NAME")
-	if blobStorageName == "" {
-		blobStorageName = "tcr-blob-local"
-	}
-	manifestTableName := os.Getenv("MANIFEST_TABLE_NAME")
-	if manifestTableName == "" {
-		manifestTableName = "tcr-manifest-local"
-	}
-	repositoryTableName := os.Getenv("REPOSITORY_TABLE_NAME")
-	if repositoryTableName == "" {
-		repositoryTableName = "tcr-repository-local"
-	}
-	blobUploadProgressTableName := os.Getenv("BLOB_UPLOAD_PROGRESS_TABLE_NAME")
-	if blobUploadProgressTableName == "" {
-		blobUploadProgressTableName = "tcr-blob-upload-progress-local"
+	dynamodbClient, err := client.NewDynamoDbClient(ctx, cfg.Storage.Metadata.Region, cfg.Storage.Metadata.Endpoint)
+	if err != nil {
+		log.Fatal(err)
+		return
 	}
 
-	dynamodbClient, err := client.NewDynamoDbClient(isLocal)
+	s3Client, err := client.NewS3Client(ctx, cfg.Storage.Blob.Region, cfg.Storage.Blob.Endpoint, cfg.Storage.Blob.UsePathStyle)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
-	s3Client, err := client.NewS3Client(isLocal)
+	var bRepo persister.BlobPersister = repository.NewBlobRepository(s3Client, cfg.Storage.Blob.Bucket)
+
+	var schema persister.SchemaMigrator = repository.NewDynamoDBSchema(dynamodbClient, cfg.Storage.Metadata.Table, bRepo, legacyTableNames(cfg))
+
+	// デプロイの前にスキーマを最新にしておくためのサブコマンド
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrate(ctx, schema, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// ローカルではテーブルの作成とマイグレーションを起動時に行う
+	if cfg.SchemaAutoCreate() {
+		err := schema.EnsureSchema(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.SchemaAutoMigrate() {
+		err := schema.Migrate(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	current, latest, err := schema.SchemaVersion(ctx)
 	if err != nil {
 		log.Fatal(err)
-		return
+	}
+	if current < latest {
+		log.Fatalf("metadata schema is at version %d but version %d is required. run `migrate` before starting the server", current, latest)
+	}
+	if current > latest {
+		// 新しいバージョンから切り戻した場合。新しく追加された属性を読まないだけなので動かす
+		slog.Warn("metadata schema is newer than this server", "current", current, "latest", latest)
 	}
 
-	mRepo := repository.NewManifestRepository(dynamodbClient, manifestTableName)
-	bRepo := repository.NewBlobRepository(s3Client, blobStorageName, dynamodbClient, blobUploadProgressTableName)
-	rRepo := repository.NewRepositoryRepository(dynamodbClient, repositoryTableName)
-	pRepo := repository.NewBlobUploadProgressRepository(dynamodbClient, blobUploadProgressTableName)
+	var prefetcher persister.BlobPrefetcher
+	if cfg.Cache.Blob.Dir != "" {
+		cache, err := repository.NewCachedBlobRepository(bRepo, cfg.Cache.Blob.Dir, cfg.Cache.Blob.MaxBytes)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		bRepo = cache
+		if cfg.Cache.Blob.Prefetch {
+			prefetcher = cache
+		}
+	}
+	var mRepo persister.ManifestPersister = repository.NewManifestRepository(dynamodbClient, cfg.Storage.Metadata.Table, bRepo, cfg.Limits.ManifestInlineLimit)
+	if cfg.Cache.Manifest.Enabled {
+		mRepo = repository.NewCachedManifestRepository(mRepo, cfg.Cache.Manifest.TagTTL, 10000)
+	}
+	rRepo := repository.NewRepositoryRepository(dynamodbClient, cfg.Storage.Metadata.Table)
+	pRepo := repository.NewBlobUploadProgressRepository(dynamodbClient, cfg.Storage.Metadata.Table)
+	bmRepo := repository.NewBlobMetadataRepository(dynamodbClient, cfg.Storage.Metadata.Table)
 
-	mu := usecase.NewManifestUseCase(mRepo, rRepo)
-	bu := usecase.NewBlobUseCase(bRepo, pRepo, rRepo)
+	gRepo := repository.NewGrantRepository(dynamodbClient, cfg.Storage.Metadata.Table)
+	tRepo := repository.NewTeamRepository(dynamodbClient, cfg.Storage.Metadata.Table)
+	aRepo := repository.NewAccountRepository(dynamodbClient, cfg.Storage.Metadata.Table)
+
+	au := usecase.NewAccessUseCase(gRepo, tRepo, rRepo, cfg.Auth.Admins, cfg.Auth.GrantCacheTTL)
+	acu := usecase.NewAccountUseCase(aRepo, tRepo, au, cfg.Auth.RobotSecretTTL)
+	// nil のインターフェースを渡すと権限を判定しない
+	var checker usecase.AccessChecker
+	var catalogFilter usecase.CatalogFilter
+	var publicChecker handler.PublicChecker
+	if cfg.Auth.Mode != config.AuthModeNone {
+		checker = au
+		catalogFilter = au
+		publicChecker = au
+	}
+	mu := usecase.NewManifestUseCase(mRepo, rRepo, prefetcher, checker)
+	bu := usecase.NewBlobUseCase(bRepo, pRepo, rRepo, bmRepo, checker)
+	ru := usecase.NewRepositoryUseCase(rRepo, catalogFilter)
 
-	mh := handler.NewManifestHandler(mu)
-	bh := handler.NewBlobHandler(bu)
+	mh := handler.NewManifestHandler(mu, publicChecker)
+	bh := handler.NewBlobHandler(bu, handler.BlobRedirectOption{
+		Enabled:             cfg.BlobRedirect.Enabled,
+		Expires:             cfg.BlobRedirect.Expires,
+		ExcludeRepositories: cfg.BlobRedirect.ExcludeRepositories,
+		ExcludeUserAgents:   cfg.BlobRedirect.ExcludeUserAgents,
+	}, publicChecker)
 
-	facade := handler.NewFacadeHandler(mh, bh)
+	bth := handler.NewBatchHandler(bu, mu)
+	rh := handler.NewRepositoryHandler(ru)
+
+	// クライアント証明書を検証するときだけ証明書で認証する
+	var certs *auth.CertificateAuthenticator
+	if cfg.Server.TLS.ClientCAFile != "" {
+		certs, err = auth.NewCertificateAuthenticator(cfg.Server.TLS.ClientIdentity, acu)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// nil のインターフェースを渡すと認証しない
+	var authorizer handler.RequestAuthorizer
+	// pull link のトークンは TokenIssuer で署名するので、token でだけ使える。
+	// ユーザー名 pull-link は pull link のために使うので、他の認証より先に試す
+	var plu *usecase.PullLinkUseCase
+	switch cfg.Auth.Mode {
+	case config.AuthModeToken:
+		authenticator, err := newAuthenticator(ctx, cfg, acu)
+		if err != nil {
+			log.Fatal(err)
+		}
+		issuer, err := newTokenIssuer(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		plRepo := repository.NewPullLinkRepository(dynamodbClient, cfg.Storage.Metadata.Table)
+		plu = usecase.NewPullLinkUseCase(plRepo, issuer, au, cfg.Auth.PullLink.DefaultTTL, cfg.Auth.PullLink.MaxTTL)
+		tu := usecase.NewTokenUseCase(auth.Authenticators{plu, authenticator}, certs, issuer, cfg.Auth.Token.Service, au)
+		r.GET("/token", handler.NewTokenHandler(tu).GetTokenHandler)
+		authorizer = handler.NewTokenAuthorizer(issuer, plu, cfg.Auth.Token.Realm, cfg.Auth.Token.Service)
+	case config.AuthModeBasic:
+		authenticator, err := newAuthenticator(ctx, cfg, acu)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authorizer = handler.NewBasicAuthorizer(authenticator, certs, "tcr")
+	}
+
+	if authorizer != nil {
+		ah := handler.NewAdminHandler(au, acu, plu)
+		ah.RegisterRoutes(r.Group("/admin", handler.AdminMiddleware(authorizer)))
+	}
+
+	router := handler.NewRouter(mh, bh, bth, rh, handler.RequestTimeoutOption{
+		Default:  cfg.Limits.RequestTimeout,
+		Transfer: cfg.Limits.TransferTimeout,
+	}, authorizer)
 
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, "ok")
 	})
-	r.HEAD("/v2/*remain", facade.HandleHEAD)     // end-2, end-3
-	r.GET("/v2/*remain", facade.HandleGET)       // end-2, end-3, end-8a
-	r.POST("/v2/*remain", facade.HandlePOST)     // end-4a, 4b
-	r.PUT("/v2/*remain", facade.HandlePUT)       // end-6,
-	r.PATCH("/v2/*remain", facade.HandlePATCH)   // end-5
-	r.DELETE("/v2/*remain", facade.HandleDELETE) // end-9, end-10
+	if cfg.Server.DebugVars {
+		// コマンドラインやメモリの状況も見えるので、認証が有効なら管理者に限る
+		debug := r.Group("/debug")
+		if authorizer != nil {
+			debug.Use(handler.AdminMiddleware(authorizer))
+		}
+		debug.GET("/vars", gin.WrapH(expvar.Handler()))
+	}
+	// メソッドの振り分けも Router が行い、受け付けないメソッドには 405 を返す
+	r.Any("/v2/*remain", router.Handle)
+
+	srv := &http.Server{Addr: cfg.Server.Listen, Handler: r}
+	if t := cfg.Server.TLS; t.CertFile != "" {
+		reloader, err := auth.NewTLSReloader(t.CertFile, t.KeyFile, t.ClientCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go reloader.Watch(ctx, t.ReloadInterval)
+		clientAuth := tls.VerifyClientCertIfGiven
+		if t.ClientAuth == config.ClientAuthRequire {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+		srv.TLSConfig = reloader.Config(clientAuth)
+	}
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			// 証明書は TLSConfig から読む
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down", "gracePeriod", cfg.Server.ShutdownGracePeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownGracePeriod)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("requests did not finish within the grace period", "error", err)
+	}
+}
+
+// 単一テーブルに移行する前のテーブル名。指定されていないテーブルは移行しない
+func legacyTableNames(cfg config.Config) repository.LegacyTableNames {
+	t := cfg.Storage.Metadata.LegacyTables
+	return repository.LegacyTableNames{
+		Manifest:           t.Manifest,
+		Tag:                t.Tag,
+		Repository:         t.Repository,
+		BlobMetadata:       t.BlobMetadata,
+		BlobUploadProgress: t.BlobUploadProgress,
+	}
+}
+
+// 鍵のファイルが指定されていなければ起動ごとに鍵を作る。config の検証でローカルに限っている
+func newTokenIssuer(cfg config.Config) (*auth.TokenIssuer, error) {
+	var key crypto.Signer
+	var err error
+	if cfg.Auth.Token.SigningKeyFile != "" {
+		key, err = auth.LoadSigningKey(cfg.Auth.Token.SigningKeyFile)
+	} else {
+		slog.Warn("auth.token.signingKeyFile is not set. tokens are signed with a temporary key")
+		key, err = auth.GenerateSigningKey()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load token signing key: %w", err)
+	}
+	return auth.NewTokenIssuer(key, cfg.Auth.Token.Issuer, cfg.Auth.Token.Service, cfg.Auth.Token.Expiration)
+}
+
+// 設定ファイルのアカウント、htpasswd ファイルのアカウント、メタデータに保存したアカウント、LDAP、OIDC のトークンの順に試す
+func newAuthenticator(ctx context.Context, cfg config.Config, accounts auth.Authenticator) (auth.Authenticator, error) {
+	var authenticators auth.Authenticators
+	if len(cfg.Auth.Accounts) > 0 {
+		hashes := map[string]string{}
+		for _, a := range cfg.Auth.Accounts {
+			hashes[a.Name] = a.PasswordHash
+		}
+		authenticators = append(authenticators, auth.NewStaticAuthenticator(hashes))
+	}
+	if cfg.Auth.Htpasswd.File != "" {
+		htpasswd, err := auth.NewHtpasswdAuthenticator(cfg.Auth.Htpasswd.File)
+		if err != nil {
+			return nil, fmt.Errorf("load htpasswd file: %w", err)
+		}
+		go htpasswd.Watch(ctx, cfg.Auth.Htpasswd.ReloadInterval)
+		authenticators = append(authenticators, htpasswd)
+	}
+	authenticators = append(authenticators, accounts)
+	if l := cfg.Auth.LDAP; l.URL != "" {
+		var mappings []auth.LDAPGroupMapping
+		for _, m := range l.GroupMappings {
+			mappings = append(mappings, auth.LDAPGroupMapping{Group: m.Group, Team: m.Team, Pattern: m.Pattern, Role: m.Role})
+		}
+		ldap, err := auth.NewLDAPAuthenticator(auth.LDAPOptions{
+			URL:            l.URL,
+			StartTLS:       l.StartTLS,
+			BindDN:         l.BindDN,
+			BindPassword:   l.BindPassword,
+			UserBaseDN:     l.UserBaseDN,
+			UserFilter:     l.UserFilter,
+			GroupBaseDN:    l.GroupBaseDN,
+			GroupFilter:    l.GroupFilter,
+			GroupAttribute: l.GroupAttribute,
+			GroupMappings:  mappings,
+			CacheTTL:       l.CacheTTL,
+			Timeout:        l.Timeout,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("configure ldap: %w", err)
+		}
+		authenticators = append(authenticators, ldap)
+	}
+	if len(cfg.Auth.OIDC.Providers) > 0 {
+		authenticators = append(authenticators, auth.NewOIDCAuthenticator(oidcProviders(cfg)))
+	}
+	return authenticators, nil
+}
 
-	r.Run(":8080")
+func oidcProviders(cfg config.Config) []auth.OIDCProvider {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var providers []auth.OIDCProvider
+	for _, p := range cfg.Auth.OIDC.Providers {
+		var keys *auth.KeySet
+		switch {
+		case p.JWKSFile != "":
+			keys = auth.NewFileKeySet(p.JWKSFile)
+		case p.JWKSURL != "":
+			keys = auth.NewRemoteKeySet(client, p.JWKSURL)
+		default:
+			keys = auth.NewDiscoveryKeySet(client, p.Issuer)
+		}
+		var rules []auth.ClaimRule
+		for _, r := range p.Rules {
+			rules = append(rules, auth.ClaimRule{Claims: r.Claims, Pattern: r.Pattern, Role: r.Role})
+		}
+		providers = append(providers, auth.OIDCProvider{
+			Name:     p.Name,
+			Issuer:   p.Issuer,
+			Audience: p.Audience,
+			Keys:     keys,
+			Rules:    rules,
+		})
+	}
+	return providers
+}
+
+// migrate: テーブルやインデックスを作成してから、未適用のマイグレーションを適用する
+//
+// migrate status: 適用済みのバージョンと最新のバージョンを表示する
+func runMigrate(ctx context.Context, schema persister.SchemaMigrator, args []string) error {
+	if len(args) > 0 && args[0] == "status" {
+		current, latest, err := schema.SchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("current: %d\nlatest: %d\n", current, latest)
+		return nil
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
 
+	err := schema.EnsureSchema(ctx)
+	if err != nil {
+		return err
+	}
+	err = schema.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+	current, _, err := schema.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("metadata schema is up to date", "version", current)
+	return nil
+}
+
+// config check [path]: 設定ファイルと環境変数を検証し、適用される設定を表示する。
+// path を省略すると CONFIG_FILE を使う
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("usage: config check [path]")
+	}
+	path := os.Getenv("CONFIG_FILE")
+	if len(args) > 1 {
+		path = args[1]
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	return nil
 }